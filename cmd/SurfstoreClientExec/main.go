@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"cse224/proj5/pkg/surfstore"
 	"flag"
 	"fmt"
@@ -8,13 +9,15 @@ import (
 	"log"
 	"os"
 	"strconv"
+	"strings"
+	"time"
 )
 
 // Arguments
 const ARG_COUNT int = 2
 
 // Usage strings
-const USAGE_STRING = "./run-client.sh -d -f config_file.txt baseDir blockSize"
+const USAGE_STRING = "./run-client.sh -d -f config_file.txt [-namespace name] [-token token] [-tls-ca ca.pem [-tls-cert cert.pem -tls-key key.pem]] [-cache addr] [-history filename | -restore filename@version | -watch | -at revision|time] baseDir blockSize"
 
 const DEBUG_NAME = "d"
 const DEBUG_USAGE = "Output log statements"
@@ -22,6 +25,36 @@ const DEBUG_USAGE = "Output log statements"
 const CONFIG_NAME = "f config_file.txt"
 const CONFIG_USAGE = "Path to config file that specifies addresses for all Raft nodes"
 
+const NAMESPACE_NAME = "namespace name"
+const NAMESPACE_USAGE = "Namespace to sync with instead of the default one"
+
+const TOKEN_NAME = "token token"
+const TOKEN_USAGE = "Token identifying this client to servers that require auth (default $SURFSTORE_TOKEN)"
+
+const TLS_CA_NAME = "tls-ca ca.pem"
+const TLS_CA_USAGE = "Connect over TLS, trusting servers signed by this CA"
+
+const TLS_CERT_NAME = "tls-cert cert.pem"
+const TLS_CERT_USAGE = "Certificate to present to servers over TLS"
+
+const TLS_KEY_NAME = "tls-key key.pem"
+const TLS_KEY_USAGE = "Private key of the TLS certificate"
+
+const CACHE_NAME = "cache addr"
+const CACHE_USAGE = "Caching BlockStore to read and write blocks through instead of the BlockStores the servers list"
+
+const HISTORY_NAME = "history filename"
+const HISTORY_USAGE = "Print every version of a file stored on the server instead of syncing"
+
+const RESTORE_NAME = "restore filename@version"
+const RESTORE_USAGE = "Store an older version of a file as its newest version, then sync"
+
+const WATCH_NAME = "watch"
+const WATCH_USAGE = "Print metadata changes as the server commits them instead of syncing"
+
+const AT_NAME = "at revision|time"
+const AT_USAGE = "Check out the files as of a revision or RFC3339 time into an empty baseDir instead of syncing"
+
 const BASEDIR_NAME = "baseDir"
 const BASEDIR_USAGE = "Base directory of the client"
 
@@ -38,6 +71,16 @@ func main() {
 		fmt.Fprintf(w, "Usage of %s:\n", USAGE_STRING)
 		fmt.Fprintf(w, "  -%s: %v\n", DEBUG_NAME, DEBUG_USAGE)
 		fmt.Fprintf(w, "  -%s: %v\n", CONFIG_NAME, CONFIG_USAGE)
+		fmt.Fprintf(w, "  -%s: %v\n", NAMESPACE_NAME, NAMESPACE_USAGE)
+		fmt.Fprintf(w, "  -%s: %v\n", TOKEN_NAME, TOKEN_USAGE)
+		fmt.Fprintf(w, "  -%s: %v\n", TLS_CA_NAME, TLS_CA_USAGE)
+		fmt.Fprintf(w, "  -%s: %v\n", TLS_CERT_NAME, TLS_CERT_USAGE)
+		fmt.Fprintf(w, "  -%s: %v\n", TLS_KEY_NAME, TLS_KEY_USAGE)
+		fmt.Fprintf(w, "  -%s: %v\n", CACHE_NAME, CACHE_USAGE)
+		fmt.Fprintf(w, "  -%s: %v\n", HISTORY_NAME, HISTORY_USAGE)
+		fmt.Fprintf(w, "  -%s: %v\n", RESTORE_NAME, RESTORE_USAGE)
+		fmt.Fprintf(w, "  -%s: %v\n", WATCH_NAME, WATCH_USAGE)
+		fmt.Fprintf(w, "  -%s: %v\n", AT_NAME, AT_USAGE)
 		fmt.Fprintf(w, "  %s: %v\n", BASEDIR_NAME, BASEDIR_USAGE)
 		fmt.Fprintf(w, "  %s: %v\n", BLOCK_NAME, BLOCK_USAGE)
 	}
@@ -45,12 +88,22 @@ func main() {
 	// Parse command-line arguments and flags
 	debug := flag.Bool("d", false, DEBUG_USAGE)
 	configFile := flag.String("f", "", "(required) Config file")
+	namespace := flag.String("namespace", "", NAMESPACE_USAGE)
+	token := flag.String("token", os.Getenv("SURFSTORE_TOKEN"), TOKEN_USAGE)
+	tlsCA := flag.String("tls-ca", "", TLS_CA_USAGE)
+	tlsCert := flag.String("tls-cert", "", TLS_CERT_USAGE)
+	tlsKey := flag.String("tls-key", "", TLS_KEY_USAGE)
+	cacheAddr := flag.String("cache", "", CACHE_USAGE)
+	historyFile := flag.String("history", "", HISTORY_USAGE)
+	restoreFile := flag.String("restore", "", RESTORE_USAGE)
+	watch := flag.Bool("watch", false, WATCH_USAGE)
+	at := flag.String("at", "", AT_USAGE)
 	flag.Parse()
 
 	// Use tail arguments to hold non-flag arguments
 	args := flag.Args()
 
-	if len(args) != ARG_COUNT {
+	if len(args) != ARG_COUNT || surfstore.ValidateNamespace(*namespace) != nil {
 		flag.Usage()
 		os.Exit(EX_USAGE)
 	}
@@ -72,5 +125,96 @@ func main() {
 	}
 
 	rpcClient := surfstore.NewSurfstoreRPCClient(addrs, baseDir, blockSize)
+	rpcClient.Namespace = *namespace
+	rpcClient.Token = *token
+	rpcClient.BlockCacheAddr = *cacheAddr
+	if *tlsCA != "" || *tlsCert != "" || *tlsKey != "" {
+		if rpcClient.TLS, err = surfstore.LoadTLSConfig(*tlsCert, *tlsKey, *tlsCA, false); err != nil {
+			fmt.Fprintln(os.Stderr, "Could not load TLS config:", err)
+			os.Exit(1)
+		}
+	}
+
+	if *historyFile != "" {
+		printHistory(rpcClient, *historyFile)
+		return
+	}
+
+	if *watch {
+		watchChanges(rpcClient)
+		return
+	}
+
+	if *at != "" {
+		checkout(rpcClient, *at)
+		return
+	}
+
+	if *restoreFile != "" {
+		restoreVersion(rpcClient, *restoreFile)
+	}
+
 	surfstore.ClientSync(rpcClient)
 }
+
+func printHistory(rpcClient surfstore.RPCClient, filename string) {
+	var versions []*surfstore.FileMetaData
+	if err := rpcClient.GetFileHistory(filename, &versions); err != nil {
+		fmt.Fprintln(os.Stderr, "Could not get history:", err)
+		os.Exit(1)
+	}
+	for _, fileMeta := range versions {
+		state := fmt.Sprintf("%d blocks", len(fileMeta.BlockHashList))
+		if len(fileMeta.BlockHashList) == 1 && fileMeta.BlockHashList[0] == "0" {
+			state = "deleted"
+		}
+		fmt.Printf("%s\t%d\t%s\n", fileMeta.Filename, fileMeta.Version, state)
+	}
+}
+
+func watchChanges(rpcClient surfstore.RPCClient) {
+	err := rpcClient.WatchFileInfo(context.Background(), 0, func(change *surfstore.FileChange) error {
+		fileMeta := change.FileMetaData
+		fmt.Printf("%d\t%s\t%d\n", change.Revision, fileMeta.Filename, fileMeta.Version)
+		return nil
+	})
+	fmt.Fprintln(os.Stderr, "Watch ended:", err)
+	os.Exit(1)
+}
+
+func restoreVersion(rpcClient surfstore.RPCClient, restoreArg string) {
+	sep := strings.LastIndex(restoreArg, "@")
+	if sep < 0 {
+		flag.Usage()
+		os.Exit(EX_USAGE)
+	}
+	version, err := strconv.Atoi(restoreArg[sep+1:])
+	if err != nil {
+		flag.Usage()
+		os.Exit(EX_USAGE)
+	}
+
+	var latestVersion int32
+	if err := rpcClient.RestoreFileVersion(restoreArg[:sep], int32(version), &latestVersion); err != nil {
+		fmt.Fprintln(os.Stderr, "Could not restore file:", err)
+		os.Exit(1)
+	}
+	log.Println("Restored", restoreArg[:sep], "as version", latestVersion)
+}
+
+func checkout(rpcClient surfstore.RPCClient, atArg string) {
+	var revision, timestamp int64
+	if rev, err := strconv.ParseInt(atArg, 10, 64); err == nil && rev > 0 {
+		revision = rev
+	} else if t, err := time.Parse(time.RFC3339, atArg); err == nil {
+		timestamp = t.UnixNano()
+	} else {
+		flag.Usage()
+		os.Exit(EX_USAGE)
+	}
+
+	if err := surfstore.ClientCheckout(rpcClient, revision, timestamp); err != nil {
+		fmt.Fprintln(os.Stderr, "Could not check out:", err)
+		os.Exit(1)
+	}
+}
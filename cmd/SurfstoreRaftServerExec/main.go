@@ -5,16 +5,35 @@ import (
 	"flag"
 	"io/ioutil"
 	"log"
+	"strings"
+	"time"
 )
 
 func main() {
 	serverId := flag.Int64("i", -1, "(required) Server ID")
 	configFile := flag.String("f", "", "(required) Config file, absolute path")
-	blockStoreAddr := flag.String("b", "", "(required) BlockStore address")
+	blockStoreAddrs := flag.String("b", "", "BlockStore addresses, comma separated (default only those that register themselves)")
 	debug := flag.Bool("d", false, "Output log statements")
+	keepVersions := flag.Int("keep-versions", 0, "Number of versions to keep per file (0 = no limit)")
+	keepDays := flag.Int("keep-days", 0, "Days to keep superseded versions (0 = no limit)")
+	replication := flag.Int("replication", 1, "Number of BlockStore servers each block is stored on")
+	repairInterval := flag.Duration("repair-interval", surfstore.REPAIR_INTERVAL, "How often the leader re-copies blocks missing from some of their replicas (0 = never)")
+	storagePolicyFile := flag.String("storage-policy", "", "Storage policy file choosing which files are erasure coded instead of replicated")
+	rebalanceRate := flag.Int64("rebalance-rate", 0, "Bytes per second the leader may move when the BlockStores change (0 = unlimited)")
+	rebalanceInterval := flag.Duration("rebalance-interval", surfstore.REBALANCE_INTERVAL, "How often the leader moves blocks while the BlockStores are changing")
+	blockStoreTimeout := flag.Duration("blockstore-timeout", surfstore.BLOCKSTORE_TIMEOUT, "How long a registered BlockStore may go without a heartbeat before it is no longer handed out")
+	gcInterval := flag.Duration("gc-interval", 0, "How often the leader deletes blocks no retained version references (0 = never)")
+	authFile := flag.String("auth", "", "Auth config file; if set, every RPC needs a known token")
+	tlsCert := flag.String("tls-cert", "", "Certificate to serve TLS with (and present to peers)")
+	tlsKey := flag.String("tls-key", "", "Private key of the TLS certificate")
+	tlsCA := flag.String("tls-ca", "", "CA to verify peers and client certificates with (default system roots)")
+	mutualTLS := flag.Bool("mtls", false, "Only accept AppendEntries from peers with a certificate signed by the CA")
 	flag.Parse()
 
 	addrs := surfstore.LoadRaftConfigFile(*configFile)
+	if *replication < 1 {
+		log.Fatal("-replication must be at least 1")
+	}
 
 	// Disable log outputs if debug flag is missing
 	if !(*debug) {
@@ -22,14 +41,70 @@ func main() {
 		log.SetOutput(ioutil.Discard)
 	}
 
-	log.Fatal(startServer(*serverId, addrs, *blockStoreAddr))
+	opts := surfstore.RaftServerOptions{
+		ReplicationFactor: *replication,
+		RebalanceRate:     *rebalanceRate,
+		BlockStoreTimeout: *blockStoreTimeout,
+		Retention: surfstore.RetentionPolicy{
+			KeepVersions: *keepVersions,
+			KeepFor:      time.Duration(*keepDays) * 24 * time.Hour,
+		},
+	}
+	if *blockStoreAddrs != "" {
+		opts.BlockStoreAddrs = strings.Split(*blockStoreAddrs, ",")
+	}
+
+	if *authFile != "" {
+		var err error
+		if opts.Auth, err = surfstore.LoadAuthConfigFile(*authFile); err != nil {
+			log.Fatal("Error loading auth config: ", err)
+		}
+	}
+
+	if *storagePolicyFile != "" {
+		var err error
+		if opts.StoragePolicies, err = surfstore.LoadStoragePolicyFile(*storagePolicyFile); err != nil {
+			log.Fatal("Error loading storage policy: ", err)
+		}
+	}
+
+	if *tlsCert != "" || *tlsKey != "" {
+		var err error
+		if opts.TLS, err = surfstore.LoadTLSConfig(*tlsCert, *tlsKey, *tlsCA, *mutualTLS); err != nil {
+			log.Fatal("Error loading TLS config: ", err)
+		}
+	} else if *tlsCA != "" || *mutualTLS {
+		log.Fatal("-tls-ca and -mtls need -tls-cert and -tls-key")
+	}
+
+	loops := leaderLoops{
+		gcInterval:        *gcInterval,
+		repairInterval:    *repairInterval,
+		rebalanceInterval: *rebalanceInterval,
+	}
+
+	log.Fatal(startServer(*serverId, addrs, opts, loops))
 }
 
-func startServer(id int64, addrs []string, blockStoreAddr string) error {
-	raftServer, err := surfstore.NewRaftServer(id, addrs, blockStoreAddr)
+// How often the leader looks after the blocks
+type leaderLoops struct {
+	gcInterval        time.Duration
+	repairInterval    time.Duration
+	rebalanceInterval time.Duration
+}
+
+func startServer(id int64, addrs []string, opts surfstore.RaftServerOptions, loops leaderLoops) error {
+	raftServer, err := surfstore.NewRaftServer(id, addrs, opts)
 	if err != nil {
 		log.Fatal("Error creating servers")
 	}
+	if loops.gcInterval > 0 {
+		go raftServer.GCLoop(loops.gcInterval)
+	}
+	if loops.repairInterval > 0 {
+		go raftServer.RepairLoop(loops.repairInterval)
+	}
+	go raftServer.RebalanceLoop(loops.rebalanceInterval)
 
 	return surfstore.ServeRaftServer(raftServer)
 }
@@ -8,17 +8,22 @@ import (
 	"log"
 	"net"
 	"os"
+	"path/filepath"
 	"strconv"
 	"strings"
+	"time"
 
 	"google.golang.org/grpc"
 )
 
 // Usage String
-const USAGE_STRING = "./run-server.sh -s <service_type> -p <port> -l -d (blockStoreAddr*)"
+const USAGE_STRING = "./run-server.sh -s <service_type> -p <port> -l -d [-datadir dir] [-storage memory|fs|tiered|pack [-cache-bytes n]] [-cache-max-bytes n] [-verify-reads] [-scrub-interval d] [-anti-entropy-interval d] [-gc-interval d] [-gc-grace d] [-replication n] [-repair-interval d] [-rebalance-rate n] [-rebalance-interval d] [-blockstore-timeout d] [-storage-policy policy.txt] [-auth auth_config.txt] [-tls-cert cert.pem -tls-key key.pem [-tls-ca ca.pem [-mtls]]] [-f replica_config.txt -i replica_id] [-meta-config config.txt [-advertise addr] [-heartbeat-interval d]] (blockStoreAddr*)"
 
 // Set of valid services
-var SERVICE_TYPES = map[string]bool{"meta": true, "block": true, "both": true}
+var SERVICE_TYPES = map[string]bool{"meta": true, "block": true, "both": true, "cache": true}
+
+// Set of valid BlockStore storage backends
+var STORAGE_TYPES = map[string]bool{"memory": true, "fs": true, "tiered": true, "pack": true}
 
 // Exit codes
 const EX_USAGE int = 64
@@ -31,22 +36,45 @@ func main() {
 		flag.VisitAll(func(f *flag.Flag) {
 			fmt.Fprintf(w, "  -%s: %v\n", f.Name, f.Usage)
 		})
-		fmt.Fprintf(w, "  (blockStoreAddr*): BlockStore Address (include self if service type is both)\n")
+		fmt.Fprintf(w, "  (blockStoreAddr*): BlockStore Addresses, blocks are spread across them by hash (include self if service type is both; just the upstream BlockStore if it is cache)\n")
 	}
 
 	// Parse command-line argument flags
-	service := flag.String("s", "", "(required) Service Type of the Server: meta, block, both")
+	service := flag.String("s", "", "(required) Service Type of the Server: meta, block, both, cache")
 	port := flag.Int("p", 8080, "(default = 8080) Port to accept connections")
 	localOnly := flag.Bool("l", false, "Only listen on localhost")
 	debug := flag.Bool("d", false, "Output log statements")
+	keepVersions := flag.Int("keep-versions", 0, "Number of versions to keep per file (0 = no limit)")
+	keepDays := flag.Int("keep-days", 0, "Days to keep superseded versions (0 = no limit)")
+	replicaConfig := flag.String("f", "", "BlockStore replica config file, replicates blocks across the listed servers")
+	replicaId := flag.Int64("i", -1, "Index of this server in the BlockStore replica config file")
+	dataDir := flag.String("datadir", "", "Directory to keep the MetaStore (and fs blocks) in across restarts (default in memory only)")
+	storage := flag.String("storage", "memory", "BlockStore storage backend: memory, fs to keep blocks under -datadir, tiered to also cache them in memory, or pack to append them to pack files")
+	cacheBytes := flag.Int64("cache-bytes", 64<<20, "Bytes of blocks the tiered backend keeps in memory")
+	cacheMaxBytes := flag.Int64("cache-max-bytes", 0, "Bytes of blocks a cache keeps before evicting the least recently used (0 = no limit)")
+	verifyReads := flag.Bool("verify-reads", false, "Re-hash every block before serving it")
+	scrubInterval := flag.Duration("scrub-interval", surfstore.SCRUB_INTERVAL, "How often to re-hash every stored block (0 = never)")
+	antiEntropyInterval := flag.Duration("anti-entropy-interval", surfstore.ANTI_ENTROPY_INTERVAL, "How often a BlockStore replica compares its blocks with its peers and copies the missing ones (0 = never)")
+	gcInterval := flag.Duration("gc-interval", 0, "How often the MetaStore deletes blocks no retained version references (0 = never)")
+	gcGrace := flag.Duration("gc-grace", surfstore.GC_GRACE_PERIOD, "How long the BlockStore keeps unreferenced blocks after they were last stored or asked about")
+	replication := flag.Int("replication", 1, "Number of BlockStore servers each block is stored on")
+	repairInterval := flag.Duration("repair-interval", surfstore.REPAIR_INTERVAL, "How often the MetaStore re-copies blocks missing from some of their replicas (0 = never)")
+	rebalanceRate := flag.Int64("rebalance-rate", 0, "Bytes per second the MetaStore may move when the BlockStores change (0 = unlimited)")
+	rebalanceInterval := flag.Duration("rebalance-interval", surfstore.REBALANCE_INTERVAL, "How often the MetaStore moves blocks while the BlockStores are changing")
+	blockStoreTimeout := flag.Duration("blockstore-timeout", surfstore.BLOCKSTORE_TIMEOUT, "How long a registered BlockStore may go without a heartbeat before the MetaStore stops handing it out")
+	metaConfig := flag.String("meta-config", "", "Raft config file listing the metadata servers this BlockStore registers with")
+	advertise := flag.String("advertise", "", "Address this BlockStore registers under (default localhost:<port> with -l, otherwise <hostname>:<port>)")
+	heartbeatInterval := flag.Duration("heartbeat-interval", surfstore.BLOCKSTORE_HEARTBEAT_INTERVAL, "How often a registered BlockStore sends heartbeats")
+	storagePolicyFile := flag.String("storage-policy", "", "Storage policy file choosing which files are erasure coded instead of replicated")
+	authFile := flag.String("auth", "", "Auth config file; if set, every RPC needs a known token")
+	tlsCert := flag.String("tls-cert", "", "Certificate to serve TLS with (and present to replicas)")
+	tlsKey := flag.String("tls-key", "", "Private key of the TLS certificate")
+	tlsCA := flag.String("tls-ca", "", "CA to verify replicas and client certificates with (default system roots)")
+	mutualTLS := flag.Bool("mtls", false, "Only accept replication RPCs from peers with a certificate signed by the CA")
 	flag.Parse()
 
-	// Use tail arguments to hold BlockStore address
-	args := flag.Args()
-	blockStoreAddr := ""
-	if len(args) == 1 {
-		blockStoreAddr = args[0]
-	}
+	// Use tail arguments to hold BlockStore addresses
+	blockStoreAddrs := flag.Args()
 
 	// Valid service type argument
 	if _, ok := SERVICE_TYPES[strings.ToLower(*service)]; !ok {
@@ -54,6 +82,33 @@ func main() {
 		os.Exit(EX_USAGE)
 	}
 
+	if *replication < 1 {
+		flag.Usage()
+		os.Exit(EX_USAGE)
+	}
+
+	// A cache stands in for exactly one upstream BlockStore
+	if strings.ToLower(*service) == "cache" && len(blockStoreAddrs) != 1 {
+		flag.Usage()
+		os.Exit(EX_USAGE)
+	}
+
+	// Valid storage argument; the filesystem backend needs somewhere to keep blocks
+	if _, ok := STORAGE_TYPES[strings.ToLower(*storage)]; !ok || (strings.ToLower(*storage) != "memory" && *dataDir == "") {
+		flag.Usage()
+		os.Exit(EX_USAGE)
+	}
+
+	// Load the replica group if this BlockStore is replicated
+	var replicaAddrs []string
+	if *replicaConfig != "" {
+		replicaAddrs = surfstore.LoadRaftConfigFile(*replicaConfig)
+		if *replicaId < 0 || *replicaId >= int64(len(replicaAddrs)) {
+			flag.Usage()
+			os.Exit(EX_USAGE)
+		}
+	}
+
 	// Add localhost if necessary
 	addr := ""
 	if *localOnly {
@@ -61,31 +116,199 @@ func main() {
 	}
 	addr += ":" + strconv.Itoa(*port)
 
+	// Registering needs an address others can dial
+	advertiseAddr := *advertise
+	if advertiseAddr == "" {
+		host := "localhost"
+		if !*localOnly {
+			var err error
+			if host, err = os.Hostname(); err != nil {
+				log.Fatal("Error getting hostname: ", err)
+			}
+		}
+		advertiseAddr = host + ":" + strconv.Itoa(*port)
+	}
+
 	// Disable log outputs if debug flag is missing
 	if !(*debug) {
 		log.SetFlags(0)
 		log.SetOutput(ioutil.Discard)
 	}
 
-	log.Fatal(startServer(addr, strings.ToLower(*service), blockStoreAddr))
+	metaOpts := metaStoreOptions{
+		retention: surfstore.RetentionPolicy{
+			KeepVersions: *keepVersions,
+			KeepFor:      time.Duration(*keepDays) * 24 * time.Hour,
+		},
+		replication:       *replication,
+		repairInterval:    *repairInterval,
+		rebalanceRate:     *rebalanceRate,
+		rebalanceInterval: *rebalanceInterval,
+		blockStoreTimeout: *blockStoreTimeout,
+		gcInterval:        *gcInterval,
+	}
+
+	if *storagePolicyFile != "" {
+		var err error
+		if metaOpts.storagePolicies, err = surfstore.LoadStoragePolicyFile(*storagePolicyFile); err != nil {
+			log.Fatal("Error loading storage policy: ", err)
+		}
+	}
+
+	var auth *surfstore.AuthConfig
+	if *authFile != "" {
+		var err error
+		if auth, err = surfstore.LoadAuthConfigFile(*authFile); err != nil {
+			log.Fatal("Error loading auth config: ", err)
+		}
+	}
+
+	var tlsConfig *surfstore.TLSConfig
+	if *tlsCert != "" || *tlsKey != "" {
+		var err error
+		if tlsConfig, err = surfstore.LoadTLSConfig(*tlsCert, *tlsKey, *tlsCA, *mutualTLS); err != nil {
+			log.Fatal("Error loading TLS config: ", err)
+		}
+	} else if *tlsCA != "" || *mutualTLS {
+		flag.Usage()
+		os.Exit(EX_USAGE)
+	}
+
+	blockOpts := blockStoreOptions{
+		storageType:         strings.ToLower(*storage),
+		cacheBytes:          *cacheBytes,
+		cacheMaxBytes:       *cacheMaxBytes,
+		verifyReads:         *verifyReads,
+		scrubInterval:       *scrubInterval,
+		antiEntropyInterval: *antiEntropyInterval,
+		gcGrace:             *gcGrace,
+		advertiseAddr:       advertiseAddr,
+		heartbeatInterval:   *heartbeatInterval,
+	}
+	if *metaConfig != "" {
+		blockOpts.metaStoreAddrs = surfstore.LoadRaftConfigFile(*metaConfig)
+	}
+
+	log.Fatal(startServer(addr, strings.ToLower(*service), blockStoreAddrs, *dataDir, metaOpts, blockOpts, auth, tlsConfig, *replicaId, replicaAddrs))
+}
+
+// How the MetaStore keeps versions and looks after the blocks they reference
+type metaStoreOptions struct {
+	retention       surfstore.RetentionPolicy
+	replication     int
+	storagePolicies *surfstore.StoragePolicyConfig
+	repairInterval  time.Duration
+	// Limit and pace of moving blocks when the BlockStores change
+	rebalanceRate     int64
+	rebalanceInterval time.Duration
+	blockStoreTimeout time.Duration
+	gcInterval        time.Duration
+}
+
+// How the BlockStore keeps and checks its blocks
+type blockStoreOptions struct {
+	storageType   string
+	cacheBytes    int64
+	verifyReads   bool
+	scrubInterval time.Duration
+	gcGrace       time.Duration
+	// Only for caches
+	cacheMaxBytes int64
+	// Only for replicas
+	antiEntropyInterval time.Duration
+	// Metadata servers to register with, if any
+	metaStoreAddrs    []string
+	advertiseAddr     string
+	heartbeatInterval time.Duration
 }
 
-func startServer(hostAddr string, serviceType string, blockStoreAddr string) error {
+func startServer(hostAddr string, serviceType string, blockStoreAddrs []string, dataDir string, metaOpts metaStoreOptions, blockOpts blockStoreOptions, auth *surfstore.AuthConfig, tlsConfig *surfstore.TLSConfig, replicaId int64, replicaAddrs []string) error {
 	// Create a new RPC server
-	grpcServer := grpc.NewServer()
+	opts := append(tlsConfig.ServerOptions(), auth.ServerOptions()...)
+	grpcServer := grpc.NewServer(opts...)
 
 	// Register RPC service
 	// Determined by the serviceType
 	// Register the MetaStore Services to the GRPC Server
 	if serviceType == "meta" || serviceType == "both" {
-		metaStore := surfstore.NewMetaStore(blockStoreAddr)
+		// With a data directory, the MetaStore picks up the state it left there
+		var metaStore *surfstore.MetaStore
+		if dataDir != "" {
+			var err error
+			if metaStore, err = surfstore.OpenMetaStore(dataDir, blockStoreAddrs...); err != nil {
+				return fmt.Errorf("failed to open MetaStore: %v", err)
+			}
+		} else {
+			metaStore = surfstore.NewMetaStore(blockStoreAddrs...)
+		}
+		metaStore.Retention = metaOpts.retention
+		metaStore.ReplicationFactor = metaOpts.replication
+		metaStore.StoragePolicies = metaOpts.storagePolicies
+		metaStore.RebalanceRate = metaOpts.rebalanceRate
+		metaStore.BlockStoreTimeout = metaOpts.blockStoreTimeout
+		metaStore.Auth = auth
+		metaStore.TLS = tlsConfig
+		go metaStore.PruneLoop(surfstore.PRUNE_INTERVAL)
+		if metaOpts.gcInterval > 0 {
+			go metaStore.GCLoop(metaOpts.gcInterval)
+		}
+		if metaOpts.repairInterval > 0 {
+			go metaStore.RepairLoop(metaOpts.repairInterval)
+		}
+		go metaStore.RebalanceLoop(metaOpts.rebalanceInterval)
 		surfstore.RegisterMetaStoreServer(grpcServer, metaStore)
 	}
 
 	//Register the BlockStore Services to the GRPC Server
 	if serviceType == "block" || serviceType == "both" {
-		blockStore := surfstore.NewBlockStore()
-		surfstore.RegisterBlockStoreServer(grpcServer, blockStore)
+		storage, err := openBlockStorage(dataDir, blockOpts)
+		if err != nil {
+			return fmt.Errorf("failed to open block storage: %v", err)
+		}
+		var blockStore *surfstore.BlockStore
+		if len(replicaAddrs) > 0 {
+			replicatedStore := surfstore.NewReplicatedBlockStore(replicaId, replicaAddrs)
+			replicatedStore.TLS = tlsConfig
+			surfstore.RegisterBlockStoreServer(grpcServer, replicatedStore)
+			blockStore = replicatedStore.BlockStore
+			if blockOpts.antiEntropyInterval > 0 {
+				go replicatedStore.AntiEntropyLoop(blockOpts.antiEntropyInterval)
+			}
+		} else {
+			blockStore = surfstore.NewBlockStore()
+			surfstore.RegisterBlockStoreServer(grpcServer, blockStore)
+		}
+		blockStore.Storage = storage
+		blockStore.Auth = auth
+		blockStore.VerifyOnRead = blockOpts.verifyReads
+		blockStore.GCGracePeriod = blockOpts.gcGrace
+		if dataDir != "" {
+			blockStore.QuarantineDir = filepath.Join(dataDir, surfstore.QUARANTINE_DIRNAME)
+		}
+		if blockOpts.scrubInterval > 0 {
+			go blockStore.ScrubLoop(blockOpts.scrubInterval)
+		}
+		if len(blockOpts.metaStoreAddrs) > 0 {
+			go blockStore.HeartbeatLoop(blockOpts.advertiseAddr, blockOpts.metaStoreAddrs, tlsConfig, blockOpts.heartbeatInterval)
+		}
+	}
+
+	// Register a cache standing in for the upstream BlockStore
+	if serviceType == "cache" {
+		storage, err := openBlockStorage(dataDir, blockOpts)
+		if err != nil {
+			return fmt.Errorf("failed to open block storage: %v", err)
+		}
+		cachingStore := surfstore.NewCachingBlockStore(blockStoreAddrs[0])
+		cachingStore.Storage = storage
+		cachingStore.Auth = auth
+		cachingStore.TLS = tlsConfig
+		cachingStore.VerifyOnRead = blockOpts.verifyReads
+		cachingStore.MaxBytes = blockOpts.cacheMaxBytes
+		if err := cachingStore.IndexCache(); err != nil {
+			return fmt.Errorf("failed to index cached blocks: %v", err)
+		}
+		surfstore.RegisterBlockStoreServer(grpcServer, cachingStore)
 	}
 
 	// Start listening and serving
@@ -100,3 +323,24 @@ func startServer(hostAddr string, serviceType string, blockStoreAddr string) err
 
 	return nil
 }
+
+func openBlockStorage(dataDir string, blockOpts blockStoreOptions) (surfstore.BlockStorage, error) {
+	switch blockOpts.storageType {
+	case "fs", "tiered":
+		fileStorage, err := surfstore.NewFileBlockStorage(filepath.Join(dataDir, surfstore.BLOCKS_DIRNAME))
+		if err != nil || blockOpts.storageType == "fs" {
+			return fileStorage, err
+		}
+		tieredStorage := surfstore.NewTieredBlockStorage(fileStorage, blockOpts.cacheBytes)
+		go tieredStorage.StatsLoop(surfstore.TIERED_STATS_INTERVAL)
+		return tieredStorage, nil
+	case "pack":
+		packStorage, err := surfstore.NewPackBlockStorage(filepath.Join(dataDir, surfstore.PACKS_DIRNAME))
+		if err != nil {
+			return nil, err
+		}
+		go packStorage.RepackLoop(surfstore.REPACK_INTERVAL)
+		return packStorage, nil
+	}
+	return surfstore.NewMemoryBlockStorage(), nil
+}
@@ -0,0 +1,345 @@
+package surfstore
+
+import (
+	context "context"
+	"crypto/sha256"
+	"encoding/hex"
+	"log"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	grpc "google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// merkleTree summarizes every block a BlockStore holds, in any namespace.
+// Blocks fall into MERKLE_BUCKETS buckets by the leading bits of their
+// hash; a leaf hashes the keys in its bucket and every other node hashes
+// its children, so two stores with the same root hold the same blocks.
+type merkleTree struct {
+	// Indexed by node number; node 0 is unused
+	nodes []string
+	// Sorted block keys (see blockKey) in each bucket
+	buckets [][]string
+	builtAt time.Time
+}
+
+func (bs *BlockStore) merkleTree() (*merkleTree, error) {
+	tree := &merkleTree{
+		nodes:   make([]string, 2*MERKLE_BUCKETS),
+		buckets: make([][]string, MERKLE_BUCKETS),
+		builtAt: time.Now(),
+	}
+	err := bs.Storage.Walk(func(namespace string, hash string) error {
+		bucket := merkleBucket(hash)
+		tree.buckets[bucket] = append(tree.buckets[bucket], blockKey(namespace, hash))
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	for bucket, keys := range tree.buckets {
+		if len(keys) > 0 {
+			sort.Strings(keys)
+			tree.nodes[MERKLE_BUCKETS+bucket] = merkleHash(strings.Join(keys, "\n"))
+		}
+	}
+	for node := MERKLE_BUCKETS - 1; node >= 1; node-- {
+		left, right := tree.nodes[2*node], tree.nodes[2*node+1]
+		if left != "" || right != "" {
+			tree.nodes[node] = merkleHash(left + right)
+		}
+	}
+	return tree, nil
+}
+
+// Returns the tree served to peers. A peer asks for a few levels of it
+// and then for the differing buckets, so rather than walking the storage
+// for each request the tree is kept until a block is stored or deleted
+// through the BlockStore, or for MERKLE_TREE_CACHE_TTL at most, in case
+// the storage was changed underneath it.
+func (bs *BlockStore) cachedMerkleTree() (*merkleTree, error) {
+	bs.merkleMutex.Lock()
+	if bs.merkle != nil && time.Since(bs.merkle.builtAt) < MERKLE_TREE_CACHE_TTL {
+		tree := bs.merkle
+		bs.merkleMutex.Unlock()
+		return tree, nil
+	}
+	changes := bs.blockChanges
+	bs.merkleMutex.Unlock()
+
+	tree, err := bs.merkleTree()
+	if err != nil {
+		return nil, err
+	}
+	// Only keep the tree if no block changed while it was built
+	bs.merkleMutex.Lock()
+	if bs.blockChanges == changes {
+		bs.merkle = tree
+	}
+	bs.merkleMutex.Unlock()
+	return tree, nil
+}
+
+func (bs *BlockStore) blocksChanged() {
+	bs.merkleMutex.Lock()
+	bs.blockChanges++
+	bs.merkle = nil
+	bs.merkleMutex.Unlock()
+}
+
+// Returns the bucket a block hash falls in. Block hashes are hex, so the
+// first two digits spread them evenly over 256 hash ranges.
+func merkleBucket(hash string) int {
+	if len(hash) < 2 {
+		return 0
+	}
+	prefix, err := strconv.ParseUint(hash[:2], 16, 8)
+	if err != nil {
+		return 0
+	}
+	return int(prefix) * MERKLE_BUCKETS / 256
+}
+
+func merkleHash(s string) string {
+	sum := sha256.Sum256([]byte(s))
+	return hex.EncodeToString(sum[:])
+}
+
+func validMerkleNode(node int32, leavesOnly bool) bool {
+	if leavesOnly {
+		return node >= MERKLE_BUCKETS && node < 2*MERKLE_BUCKETS
+	}
+	return node >= 1 && node < 2*MERKLE_BUCKETS
+}
+
+// Returns the hashes of the given nodes of the Merkle tree over every
+// block stored here.
+func (bs *BlockStore) GetMerkleHashes(ctx context.Context, merkleNodes *MerkleNodes) (*MerkleHashes, error) {
+	tree, err := bs.cachedMerkleTree()
+	if err != nil {
+		return nil, err
+	}
+	hashes := make([]string, 0, len(merkleNodes.GetNodes()))
+	for _, node := range merkleNodes.GetNodes() {
+		if !validMerkleNode(node, false) {
+			return nil, status.Errorf(codes.InvalidArgument, "no Merkle tree node %d", node)
+		}
+		hashes = append(hashes, tree.nodes[node])
+	}
+	return &MerkleHashes{Hashes: hashes}, nil
+}
+
+// Returns the keys (namespace/hash) of the blocks in the given leaves,
+// and of the ones recently deleted from them.
+func (bs *BlockStore) GetMerkleBuckets(ctx context.Context, merkleNodes *MerkleNodes) (*MerkleBuckets, error) {
+	tree, err := bs.cachedMerkleTree()
+	if err != nil {
+		return nil, err
+	}
+	keys := make([]string, 0)
+	for _, node := range merkleNodes.GetNodes() {
+		if !validMerkleNode(node, true) {
+			return nil, status.Errorf(codes.InvalidArgument, "Merkle tree node %d is not a leaf", node)
+		}
+		keys = append(keys, tree.buckets[node-MERKLE_BUCKETS]...)
+	}
+	deletedKeys := make([]string, 0)
+	for key := range bs.recentlyDeleted(merkleNodes.GetNodes()) {
+		deletedKeys = append(deletedKeys, key)
+	}
+	return &MerkleBuckets{Keys: keys, DeletedKeys: deletedKeys}, nil
+}
+
+func (rs *ReplicatedBlockStore) GetMerkleHashes(ctx context.Context, merkleNodes *MerkleNodes) (*MerkleHashes, error) {
+	if rs.crashed() {
+		return nil, ERR_SERVER_CRASHED
+	}
+	return rs.BlockStore.GetMerkleHashes(ctx, merkleNodes)
+}
+
+func (rs *ReplicatedBlockStore) GetMerkleBuckets(ctx context.Context, merkleNodes *MerkleNodes) (*MerkleBuckets, error) {
+	if rs.crashed() {
+		return nil, ERR_SERVER_CRASHED
+	}
+	return rs.BlockStore.GetMerkleBuckets(ctx, merkleNodes)
+}
+
+// AntiEntropyStats describes one exchange with a peer
+type AntiEntropyStats struct {
+	// Tree nodes whose hashes were compared, and the leaves that differed
+	ComparedNodes    int
+	DifferingBuckets int
+	// Blocks copied from the peer, and to it
+	Pulled int
+	Pushed int
+	// Blocks one side had recently deleted, so the other side's copies
+	// were deleted instead of copied
+	Deleted int
+	// Blocks that could not be copied either way
+	Failed int
+}
+
+// Compares this replica's blocks with a peer's and copies the missing
+// ones in both directions. Starting from the roots, only the children of
+// nodes whose hashes differ are compared, so replicas that mostly agree
+// exchange a few hashes per differing bucket rather than every block hash.
+// A block one side deleted within BLOCK_TOMBSTONE_LIFETIME is not copied
+// back to it; the other side's copy is deleted, subject to its own grace
+// period, as the missed delete would have.
+func (rs *ReplicatedBlockStore) AntiEntropy(addr string) (AntiEntropyStats, error) {
+	stats := AntiEntropyStats{}
+	tree, err := rs.merkleTree()
+	if err != nil {
+		return stats, err
+	}
+	conn, err := grpc.Dial(addr, rs.TLS.DialOption())
+	if err != nil {
+		return stats, err
+	}
+	defer conn.Close()
+	c := NewBlockStoreClient(conn)
+
+	// Walk down one level of the tree per round trip
+	differing := make([]int32, 0)
+	level := []int32{1}
+	for len(level) > 0 {
+		ctx, cancel := rs.peerContext()
+		theirs, err := c.GetMerkleHashes(ctx, &MerkleNodes{Nodes: level})
+		cancel()
+		if err != nil {
+			return stats, err
+		}
+		if len(theirs.GetHashes()) != len(level) {
+			return stats, status.Errorf(codes.Internal, "%s returned %d hashes for %d nodes", addr, len(theirs.GetHashes()), len(level))
+		}
+		stats.ComparedNodes += len(level)
+		next := make([]int32, 0)
+		for i, node := range level {
+			if tree.nodes[node] == theirs.GetHashes()[i] {
+				continue
+			}
+			if node >= MERKLE_BUCKETS {
+				differing = append(differing, node)
+			} else {
+				next = append(next, 2*node, 2*node+1)
+			}
+		}
+		level = next
+	}
+	stats.DifferingBuckets = len(differing)
+	if len(differing) == 0 {
+		return stats, nil
+	}
+
+	ctx, cancel := rs.peerContext()
+	theirs, err := c.GetMerkleBuckets(ctx, &MerkleNodes{Nodes: differing})
+	cancel()
+	if err != nil {
+		return stats, err
+	}
+	ours := make(map[string]bool)
+	for _, node := range differing {
+		for _, key := range tree.buckets[node-MERKLE_BUCKETS] {
+			ours[key] = true
+		}
+	}
+	ourDeletes := rs.recentlyDeleted(differing)
+	theirDeletes := make(map[string]bool)
+	for _, key := range theirs.GetDeletedKeys() {
+		theirDeletes[key] = true
+	}
+	// Keys by namespace, since a namespace is passed per request
+	deleteThere := make(map[string][]string)
+	deleteHere := make(map[string][]string)
+
+	for _, key := range theirs.GetKeys() {
+		if ours[key] {
+			delete(ours, key)
+			continue
+		}
+		namespace, hash := splitBlockKey(key)
+		if ourDeletes[key] {
+			deleteThere[namespace] = append(deleteThere[namespace], hash)
+			continue
+		}
+		block, err := rs.getBlockFromReplica(addr, namespace, hash)
+		if err == nil && GetBlockHashString(block.GetBlockData()) != hash {
+			err = ERR_CORRUPT_BLOCK
+		}
+		if err == nil {
+			err = rs.storeBlock(namespace, block)
+		}
+		if err != nil {
+			log.Println(SURF_SERVER, "anti-entropy could not copy", key, "from", addr+":", err)
+			stats.Failed++
+			continue
+		}
+		stats.Pulled++
+	}
+	// What is left is only here
+	for key := range ours {
+		namespace, hash := splitBlockKey(key)
+		if theirDeletes[key] {
+			deleteHere[namespace] = append(deleteHere[namespace], hash)
+			continue
+		}
+		block, err := rs.Storage.Get(namespace, hash)
+		if err == nil && block != nil {
+			err = rs.replicateBlockToReplica(addr, namespace, block)
+		}
+		if err != nil || block == nil {
+			log.Println(SURF_SERVER, "anti-entropy could not copy", key, "to", addr+":", err)
+			stats.Failed++
+			continue
+		}
+		stats.Pushed++
+	}
+
+	for namespace, hashes := range deleteThere {
+		ctx, cancel := rs.peerContext()
+		deleted, err := c.DeleteReplicatedBlocks(WithNamespace(ctx, namespace), &BlockHashes{Hashes: hashes})
+		cancel()
+		if err != nil {
+			log.Println(SURF_SERVER, "anti-entropy could not delete blocks from", addr+":", err)
+			continue
+		}
+		stats.Deleted += len(deleted.GetHashes())
+	}
+	for namespace, hashes := range deleteHere {
+		deleted, err := rs.deleteBlocks(namespace, hashes)
+		if err != nil {
+			log.Println(SURF_SERVER, "anti-entropy could not delete blocks:", err)
+		}
+		stats.Deleted += len(deleted)
+	}
+	return stats, nil
+}
+
+// Periodically runs anti-entropy with each peer in turn.
+func (rs *ReplicatedBlockStore) AntiEntropyLoop(interval time.Duration) {
+	for range time.Tick(interval) {
+		if rs.crashed() {
+			continue
+		}
+		for idx, addr := range rs.addrs {
+			if int64(idx) == rs.id {
+				continue
+			}
+			stats, err := rs.AntiEntropy(addr)
+			if err != nil {
+				log.Println(SURF_SERVER, "anti-entropy with", addr, "failed:", err)
+				continue
+			}
+			log.Println(SURF_SERVER, "anti-entropy with", addr, "found", stats.DifferingBuckets, "differing buckets, pulled", stats.Pulled, "pushed", stats.Pushed, "and deleted", stats.Deleted, "blocks")
+		}
+	}
+}
+
+func (rs *ReplicatedBlockStore) peerContext() (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithTimeout(context.Background(), REPLICA_RPC_TIMEOUT)
+	return WithToken(ctx, rs.Auth.ServerToken()), cancel
+}
@@ -0,0 +1,323 @@
+package surfstore
+
+import (
+	"bufio"
+	context "context"
+	"fmt"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+
+	grpc "google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+// Roles a token can have. Users are limited by their grants, admins can
+// also call the testing RPCs, and servers can also call the RPCs replicas
+// use to talk to each other.
+const (
+	AUTH_ROLE_USER   = "user"
+	AUTH_ROLE_ADMIN  = "admin"
+	AUTH_ROLE_SERVER = "server"
+)
+
+// Grants can use this in place of a namespace or a prefix to match all of them
+const AUTH_WILDCARD = "*"
+
+// RPCs only admins may call
+var adminMethods = map[string]bool{
+	"Crash":            true,
+	"Restore":          true,
+	"IsCrashed":        true,
+	"SetLeader":        true,
+	"SendHeartbeat":    true,
+	"GetInternalState": true,
+	"GetRepairReport":  true,
+	// Changing the ring moves every block around
+	"SetBlockStoreAddrs":     true,
+	"GetRebalanceStatus":     true,
+	"DrainBlockStore":        true,
+	"DecommissionBlockStore": true,
+	"GetBlockStoreStatuses":  true,
+}
+
+// RPCs only servers (and admins) may call
+var serverMethods = map[string]bool{
+	"AppendEntries":          true,
+	"ReplicateBlock":         true,
+	"DeleteReplicatedBlocks": true,
+	"ListBlocks":             true,
+	"DeleteBlocks":           true,
+	// Bucket contents list blocks of every namespace
+	"GetMerkleHashes":  true,
+	"GetMerkleBuckets": true,
+	// BlockStores join the ring by themselves
+	"RegisterBlockStore":  true,
+	"BlockStoreHeartbeat": true,
+}
+
+// AuthConfig maps tokens to identities and lists the path prefixes each
+// identity may read and write. A nil *AuthConfig lets everyone do anything.
+//
+// The config file has one entry per line:
+//
+//	user <name> <token> [user|admin|server]
+//	grant <name> <r|rw> <namespace|*> <prefix|*>
+type AuthConfig struct {
+	identities map[string]*Identity
+	grants     map[string][]accessGrant
+	// Of the first server user in the file
+	serverToken string
+}
+
+// Identity is who an authenticated RPC was made by
+type Identity struct {
+	Name string
+	Role string
+}
+
+type accessGrant struct {
+	namespace string
+	prefix    string
+	write     bool
+}
+
+type identityContextKey struct{}
+
+func LoadAuthConfigFile(filename string) (*AuthConfig, error) {
+	configFD, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer configFD.Close()
+
+	auth := &AuthConfig{
+		identities: make(map[string]*Identity),
+		grants:     make(map[string][]accessGrant),
+	}
+	scanner := bufio.NewScanner(configFD)
+	for lineNum := 1; scanner.Scan(); lineNum++ {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+		switch {
+		case fields[0] == "user" && (len(fields) == 3 || len(fields) == 4):
+			role := AUTH_ROLE_USER
+			if len(fields) == 4 {
+				role = fields[3]
+			}
+			if role != AUTH_ROLE_USER && role != AUTH_ROLE_ADMIN && role != AUTH_ROLE_SERVER {
+				return nil, fmt.Errorf("%s:%d: unknown role %q", filename, lineNum, role)
+			}
+			auth.identities[fields[2]] = &Identity{Name: fields[1], Role: role}
+			if role == AUTH_ROLE_SERVER && auth.serverToken == "" {
+				auth.serverToken = fields[2]
+			}
+		case fields[0] == "grant" && len(fields) == 5 && (fields[2] == "r" || fields[2] == "rw"):
+			grant := accessGrant{namespace: fields[3], prefix: fields[4], write: fields[2] == "rw"}
+			if grant.namespace != AUTH_WILDCARD {
+				if err := ValidateNamespace(grant.namespace); err != nil {
+					return nil, fmt.Errorf("%s:%d: %v", filename, lineNum, err)
+				}
+			}
+			auth.grants[fields[1]] = append(auth.grants[fields[1]], grant)
+		default:
+			return nil, fmt.Errorf("%s:%d: malformed line", filename, lineNum)
+		}
+	}
+	return auth, scanner.Err()
+}
+
+// Returns the token servers present to each other, that of the first
+// server user in the file, or "" if there is none
+func (a *AuthConfig) ServerToken() string {
+	if a == nil {
+		return ""
+	}
+	return a.serverToken
+}
+
+// Returns the gRPC server options that authenticate every RPC
+func (a *AuthConfig) ServerOptions() []grpc.ServerOption {
+	if a == nil {
+		return nil
+	}
+	return []grpc.ServerOption{
+		grpc.ChainUnaryInterceptor(a.unaryInterceptor),
+		grpc.ChainStreamInterceptor(a.streamInterceptor),
+	}
+}
+
+func (a *AuthConfig) unaryInterceptor(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	ctx, err := a.authenticate(ctx, info.FullMethod)
+	if err != nil {
+		return nil, err
+	}
+	return handler(ctx, req)
+}
+
+func (a *AuthConfig) streamInterceptor(srv interface{}, stream grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+	ctx, err := a.authenticate(stream.Context(), info.FullMethod)
+	if err != nil {
+		return err
+	}
+	return handler(srv, &authenticatedStream{ServerStream: stream, ctx: ctx})
+}
+
+// Passes the authenticated identity on to stream handlers
+type authenticatedStream struct {
+	grpc.ServerStream
+	ctx context.Context
+}
+
+func (s *authenticatedStream) Context() context.Context {
+	return s.ctx
+}
+
+// Looks up the caller's token and checks that its role may call the method
+func (a *AuthConfig) authenticate(ctx context.Context, fullMethod string) (context.Context, error) {
+	var token string
+	if md, ok := metadata.FromIncomingContext(ctx); ok {
+		if values := md.Get(AUTH_METADATA_KEY); len(values) == 1 {
+			token = strings.TrimPrefix(values[0], AUTH_TOKEN_PREFIX)
+		}
+	}
+	identity, ok := a.identities[token]
+	if token == "" || !ok {
+		return nil, status.Error(codes.Unauthenticated, "missing or unknown token")
+	}
+
+	method := path.Base(fullMethod)
+	if (adminMethods[method] && identity.Role != AUTH_ROLE_ADMIN) ||
+		(serverMethods[method] && identity.Role == AUTH_ROLE_USER) {
+		return nil, status.Errorf(codes.PermissionDenied, "%s may not call %s", identity.Name, method)
+	}
+	return context.WithValue(ctx, identityContextKey{}, identity), nil
+}
+
+// Returns who made an authenticated RPC
+func IdentityFromContext(ctx context.Context) (*Identity, bool) {
+	identity, ok := ctx.Value(identityContextKey{}).(*Identity)
+	return identity, ok
+}
+
+// Reports whether the caller may read the file in the namespace it selected
+func (a *AuthConfig) canRead(ctx context.Context, filename string) bool {
+	return a.allowed(ctx, filename, false)
+}
+
+// Reports whether the caller may write the file in the namespace it selected
+func (a *AuthConfig) canWrite(ctx context.Context, filename string) bool {
+	return a.allowed(ctx, filename, true)
+}
+
+// Reports whether the caller has any grant in the namespace it selected,
+// which is what reading and storing that namespace's blocks takes
+func (a *AuthConfig) canUseNamespace(ctx context.Context) bool {
+	if a == nil {
+		return true
+	}
+	identity, ok := IdentityFromContext(ctx)
+	if !ok {
+		return false
+	}
+	if identity.Role != AUTH_ROLE_USER {
+		return true
+	}
+	namespace, _ := NamespaceFromContext(ctx)
+	for _, grant := range a.grants[identity.Name] {
+		if grant.namespace == AUTH_WILDCARD || grant.namespace == namespace {
+			return true
+		}
+	}
+	return false
+}
+
+func (a *AuthConfig) allowed(ctx context.Context, filename string, write bool) bool {
+	if a == nil {
+		return true
+	}
+	identity, ok := IdentityFromContext(ctx)
+	if !ok {
+		return false
+	}
+	if identity.Role != AUTH_ROLE_USER {
+		return true
+	}
+	namespace, _ := NamespaceFromContext(ctx)
+	for _, grant := range a.grants[identity.Name] {
+		if write && !grant.write {
+			continue
+		}
+		if grant.namespace != AUTH_WILDCARD && grant.namespace != namespace {
+			continue
+		}
+		if grant.prefix == AUTH_WILDCARD || strings.HasPrefix(filename, grant.prefix) {
+			return true
+		}
+		// The directories leading down to a granted prefix come with it
+		if isDirectory(filename) && strings.HasPrefix(grant.prefix, filename) {
+			return true
+		}
+	}
+	return false
+}
+
+// Ties a sync acknowledgement to the caller, who needs a grant in the
+// namespace. Client IDs are only unique to the user running the client,
+// so they are qualified with the caller's name, and one user cannot
+// acknowledge changes for another's clients.
+func (a *AuthConfig) ownSyncAck(ctx context.Context, syncAck *SyncAck) (*SyncAck, error) {
+	if a == nil {
+		return syncAck, nil
+	}
+	if !a.canUseNamespace(ctx) {
+		namespace, _ := NamespaceFromContext(ctx)
+		return nil, permissionDenied(ctx, "namespace "+strconv.Quote(namespace))
+	}
+	identity, _ := IdentityFromContext(ctx)
+	return &SyncAck{ClientId: identity.Name + "/" + syncAck.GetClientId(), Revision: syncAck.GetRevision()}, nil
+}
+
+// Drops the files the caller may not read
+func (a *AuthConfig) filterReadable(ctx context.Context, fileInfoMap map[string]*FileMetaData) map[string]*FileMetaData {
+	if a == nil {
+		return fileInfoMap
+	}
+	readable := make(map[string]*FileMetaData, len(fileInfoMap))
+	for filename, fileMetaData := range fileInfoMap {
+		if a.canRead(ctx, filename) {
+			readable[filename] = fileMetaData
+		}
+	}
+	return readable
+}
+
+// Records who is writing a version. The owner always comes from the
+// caller's identity, never from the request.
+func setOwner(ctx context.Context, fileMetaData *FileMetaData) {
+	fileMetaData.Owner = ""
+	if identity, ok := IdentityFromContext(ctx); ok {
+		fileMetaData.Owner = identity.Name
+	}
+}
+
+func permissionDenied(ctx context.Context, filename string) error {
+	name := "anonymous"
+	if identity, ok := IdentityFromContext(ctx); ok {
+		name = identity.Name
+	}
+	return status.Errorf(codes.PermissionDenied, "%s may not access %s", name, filename)
+}
+
+// Sends a token with an outgoing RPC
+func WithToken(ctx context.Context, token string) context.Context {
+	if token == "" {
+		return ctx
+	}
+	return metadata.AppendToOutgoingContext(ctx, AUTH_METADATA_KEY, AUTH_TOKEN_PREFIX+token)
+}
@@ -0,0 +1,281 @@
+package surfstore
+
+import (
+	context "context"
+	"fmt"
+	"log"
+	"sort"
+	"time"
+
+	grpc "google.golang.org/grpc"
+	emptypb "google.golang.org/protobuf/types/known/emptypb"
+)
+
+// Returns the report of the last repair; its timestamp is zero if no
+// repair has run yet.
+func (m *MetaStore) GetRepairReport(ctx context.Context, _ *emptypb.Empty) (*RepairReport, error) {
+	m.Mutex.RLock()
+	defer m.Mutex.RUnlock()
+	return m.repairReport, nil
+}
+
+// Checks that every block a retained version references is stored on all
+// of its replicas, and copies the under-replicated ones from a replica
+// that has them to the ones that do not. A replica that cannot be reached
+// counts as missing the blocks it should hold. Erasure-coded blocks get
+// their missing shards rebuilt from the others instead.
+func (m *MetaStore) RepairBlocks() *RepairReport {
+	report := &RepairReport{Timestamp: time.Now().UnixNano(), LostBlocks: make([]string, 0)}
+	repairer := &blockRepairer{metaStore: m, ring: m.blockStoreRing(), conns: make(map[string]*grpc.ClientConn)}
+	defer repairer.close()
+
+	namespaces := m.allNamespaces()
+	names := make([]string, 0, len(namespaces))
+	for namespace := range namespaces {
+		names = append(names, namespace)
+	}
+	sort.Strings(names)
+	for _, namespace := range names {
+		repairer.repairNamespace(namespace, namespaces[namespace], report)
+	}
+
+	m.Mutex.Lock()
+	m.repairReport = report
+	m.Mutex.Unlock()
+	return report
+}
+
+// Periodically repairs the blocks of the standalone MetaStore. Blocks a
+// rebalance has not moved yet would look lost, so it waits for that.
+func (m *MetaStore) RepairLoop(interval time.Duration) {
+	for range time.Tick(interval) {
+		if m.rebalancing() {
+			continue
+		}
+		report := m.RepairBlocks()
+		log.Println(SURF_SERVER, "repair found", report.UnderReplicatedBlocks, "under-replicated and", len(report.LostBlocks), "lost blocks")
+	}
+}
+
+// blockRepairer holds the connections to the BlockStores for one repair
+type blockRepairer struct {
+	metaStore *MetaStore
+	ring      *ConsistentHashRing
+	conns     map[string]*grpc.ClientConn
+}
+
+func (r *blockRepairer) repairNamespace(namespace string, ns *MetaStore, report *RepairReport) {
+	ns.Mutex.RLock()
+	hashes := make([]string, 0, len(ns.blockRefs))
+	for hash := range ns.blockRefs {
+		hashes = append(hashes, hash)
+	}
+	ns.Mutex.RUnlock()
+	sort.Strings(hashes)
+
+	held := make(map[string]map[string]bool)
+	for addr, serverHashes := range r.ring.GroupByServer(hashes) {
+		stored, err := r.hasBlocks(namespace, addr, serverHashes)
+		if err != nil {
+			log.Println(SURF_SERVER, "repair could not reach", addr+":", err)
+			continue
+		}
+		for _, hash := range stored {
+			if held[hash] == nil {
+				held[hash] = make(map[string]bool)
+			}
+			held[hash][addr] = true
+		}
+	}
+
+	for _, hash := range hashes {
+		report.CheckedBlocks++
+		replicas := r.ring.GetReplicaServers(hash)
+		if len(held[hash]) == len(replicas) {
+			continue
+		}
+		report.UnderReplicatedBlocks++
+		var block *Block
+		for _, addr := range replicas {
+			if held[hash][addr] {
+				if block = r.getBlock(namespace, addr, hash); block != nil {
+					break
+				}
+			}
+		}
+		if block == nil {
+			report.LostBlocks = append(report.LostBlocks, blockKey(namespace, hash))
+			continue
+		}
+		for _, addr := range replicas {
+			if held[hash][addr] {
+				continue
+			}
+			if err := r.putBlock(namespace, addr, block); err != nil {
+				log.Println(SURF_SERVER, "repair could not copy", blockKey(namespace, hash), "to", addr+":", err)
+				report.FailedCopies++
+			} else {
+				report.RepairedCopies++
+			}
+		}
+	}
+	r.repairStripes(namespace, ns, report)
+}
+
+func (r *blockRepairer) repairStripes(namespace string, ns *MetaStore, report *RepairReport) {
+	stripes, blockHashes := ns.retainedStripes()
+
+	// Ask each server about all of its shards at once
+	byServer := make(map[string][]string)
+	for _, hash := range blockHashes {
+		stripe := stripes[hash]
+		for i, addr := range r.ring.GetShardServers(hash, len(stripe.GetShardHashes())) {
+			byServer[addr] = append(byServer[addr], stripe.GetShardHashes()[i])
+		}
+	}
+	held := make(map[string]map[string]bool)
+	for addr, shardHashes := range byServer {
+		stored, err := r.hasBlocks(namespace, addr, shardHashes)
+		if err != nil {
+			log.Println(SURF_SERVER, "repair could not reach", addr+":", err)
+			continue
+		}
+		for _, hash := range stored {
+			if held[hash] == nil {
+				held[hash] = make(map[string]bool)
+			}
+			held[hash][addr] = true
+		}
+	}
+
+	for _, hash := range blockHashes {
+		report.CheckedBlocks++
+		stripe := stripes[hash]
+		servers := r.ring.GetShardServers(hash, len(stripe.GetShardHashes()))
+		shards := make([][]byte, len(servers))
+		missing := make([]int, 0)
+		for i, addr := range servers {
+			if !held[stripe.GetShardHashes()[i]][addr] {
+				missing = append(missing, i)
+			}
+		}
+		if len(missing) == 0 {
+			continue
+		}
+		report.UnderReplicatedBlocks++
+		for i, addr := range servers {
+			if held[stripe.GetShardHashes()[i]][addr] {
+				if shard := r.getBlock(namespace, addr, stripe.GetShardHashes()[i]); shard != nil {
+					shards[i] = shard.GetBlockData()
+				}
+			}
+		}
+		rs, err := NewReedSolomon(int(stripe.GetDataShards()), len(servers)-int(stripe.GetDataShards()))
+		if err == nil {
+			err = rs.Reconstruct(shards)
+		}
+		if err != nil {
+			report.LostBlocks = append(report.LostBlocks, blockKey(namespace, hash))
+			continue
+		}
+		for _, i := range missing {
+			shardHash := stripe.GetShardHashes()[i]
+			if GetBlockHashString(shards[i]) != shardHash {
+				// The stripe does not describe the shards that are left
+				report.FailedCopies++
+				continue
+			}
+			shard := &Block{BlockData: shards[i], BlockSize: int32(len(shards[i]))}
+			if err := r.putBlock(namespace, servers[i], shard); err != nil {
+				log.Println(SURF_SERVER, "repair could not rebuild", blockKey(namespace, shardHash), "on", servers[i]+":", err)
+				report.FailedCopies++
+			} else {
+				report.RepairedCopies++
+			}
+		}
+	}
+}
+
+// Returns the stripe of every erasure-coded block a retained version
+// references, and their block hashes in order
+func (m *MetaStore) retainedStripes() (map[string]*ErasureStripe, []string) {
+	m.Mutex.RLock()
+	stripes := make(map[string]*ErasureStripe)
+	for _, history := range m.FileHistory {
+		for _, version := range history {
+			for _, stripe := range version.GetErasureStripes() {
+				stripes[stripe.GetBlockHash()] = stripe
+			}
+		}
+	}
+	m.Mutex.RUnlock()
+	blockHashes := make([]string, 0, len(stripes))
+	for hash := range stripes {
+		blockHashes = append(blockHashes, hash)
+	}
+	sort.Strings(blockHashes)
+	return stripes, blockHashes
+}
+
+func (r *blockRepairer) client(addr string) (BlockStoreClient, error) {
+	conn, ok := r.conns[addr]
+	if !ok {
+		var err error
+		if conn, err = grpc.Dial(addr, r.metaStore.TLS.DialOption()); err != nil {
+			return nil, err
+		}
+		r.conns[addr] = conn
+	}
+	return NewBlockStoreClient(conn), nil
+}
+
+func (r *blockRepairer) context(namespace string) (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithTimeout(context.Background(), GC_RPC_TIMEOUT)
+	return WithToken(WithNamespace(ctx, namespace), r.metaStore.Auth.ServerToken()), cancel
+}
+
+func (r *blockRepairer) hasBlocks(namespace string, addr string, hashes []string) ([]string, error) {
+	c, err := r.client(addr)
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := r.context(namespace)
+	defer cancel()
+	stored, err := c.HasBlocks(ctx, &BlockHashes{Hashes: hashes})
+	return stored.GetHashes(), err
+}
+
+// Returns nil if the block cannot be read or does not match its hash
+func (r *blockRepairer) getBlock(namespace string, addr string, hash string) *Block {
+	c, err := r.client(addr)
+	if err != nil {
+		return nil
+	}
+	ctx, cancel := r.context(namespace)
+	defer cancel()
+	block, err := c.GetBlock(ctx, &BlockHash{Hash: hash})
+	if err != nil || GetBlockHashString(block.GetBlockData()) != hash {
+		return nil
+	}
+	return block
+}
+
+func (r *blockRepairer) putBlock(namespace string, addr string, block *Block) error {
+	c, err := r.client(addr)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := r.context(namespace)
+	defer cancel()
+	succ, err := c.PutBlock(ctx, block)
+	if err == nil && !succ.GetFlag() {
+		err = fmt.Errorf("%s did not store the block", addr)
+	}
+	return err
+}
+
+func (r *blockRepairer) close() {
+	for _, conn := range r.conns {
+		conn.Close()
+	}
+}
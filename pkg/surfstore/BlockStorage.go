@@ -0,0 +1,193 @@
+package surfstore
+
+import (
+	"encoding/hex"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+var ERR_INVALID_BLOCK_HASH = fmt.Errorf("Block hash is not a hex string.")
+var ERR_CORRUPT_BLOCK = fmt.Errorf("Block does not match its hash.")
+
+// BlockStorage is where a BlockStore keeps its blocks. Blocks are
+// addressed by their namespace and hash.
+type BlockStorage interface {
+	// Returns the block, or nil if it is not stored
+	Get(namespace string, hash string) (*Block, error)
+	Put(namespace string, hash string, block *Block) error
+	Has(namespace string, hash string) (bool, error)
+	// Deleting a block that is not stored does nothing
+	Delete(namespace string, hash string) error
+	// Calls visit with every stored block until it returns an error
+	Walk(visit func(namespace string, hash string) error) error
+}
+
+// MemoryBlockStorage keeps blocks in a map, so they are lost on restart
+type MemoryBlockStorage struct {
+	BlockMap map[string]*Block
+	Mutex    *sync.RWMutex
+}
+
+func NewMemoryBlockStorage() *MemoryBlockStorage {
+	return &MemoryBlockStorage{
+		BlockMap: map[string]*Block{},
+		Mutex:    &sync.RWMutex{},
+	}
+}
+
+func (s *MemoryBlockStorage) Get(namespace string, hash string) (*Block, error) {
+	s.Mutex.RLock()
+	defer s.Mutex.RUnlock()
+	return s.BlockMap[blockKey(namespace, hash)], nil
+}
+
+func (s *MemoryBlockStorage) Put(namespace string, hash string, block *Block) error {
+	s.Mutex.Lock()
+	defer s.Mutex.Unlock()
+	s.BlockMap[blockKey(namespace, hash)] = block
+	return nil
+}
+
+func (s *MemoryBlockStorage) Has(namespace string, hash string) (bool, error) {
+	s.Mutex.RLock()
+	defer s.Mutex.RUnlock()
+	_, ok := s.BlockMap[blockKey(namespace, hash)]
+	return ok, nil
+}
+
+func (s *MemoryBlockStorage) Delete(namespace string, hash string) error {
+	s.Mutex.Lock()
+	defer s.Mutex.Unlock()
+	delete(s.BlockMap, blockKey(namespace, hash))
+	return nil
+}
+
+// The lock is not held while visiting, so visit may use the storage
+func (s *MemoryBlockStorage) Walk(visit func(namespace string, hash string) error) error {
+	s.Mutex.RLock()
+	keys := make([]string, 0, len(s.BlockMap))
+	for key := range s.BlockMap {
+		keys = append(keys, key)
+	}
+	s.Mutex.RUnlock()
+	for _, key := range keys {
+		if err := visit(splitBlockKey(key)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// FileBlockStorage keeps each block in its own file named after its hash,
+// sharded by the first two bytes of the hash (root/ab/cd/abcd...). Other
+// namespaces than the default one get their own tree under root/ns/.
+type FileBlockStorage struct {
+	Root string
+}
+
+func NewFileBlockStorage(root string) (*FileBlockStorage, error) {
+	if err := os.MkdirAll(root, 0700); err != nil {
+		return nil, err
+	}
+	return &FileBlockStorage{Root: root}, nil
+}
+
+func (s *FileBlockStorage) Get(namespace string, hash string) (*Block, error) {
+	blockPath, ok := s.blockPath(namespace, hash)
+	if !ok {
+		return nil, nil
+	}
+	data, err := os.ReadFile(blockPath)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &Block{BlockData: data, BlockSize: int32(len(data))}, nil
+}
+
+// Blocks are written to a temporary file and renamed into place, so a
+// crash never leaves a partial block under its hash
+func (s *FileBlockStorage) Put(namespace string, hash string, block *Block) error {
+	blockPath, ok := s.blockPath(namespace, hash)
+	if !ok {
+		return ERR_INVALID_BLOCK_HASH
+	}
+	// The same hash always has the same contents
+	if _, err := os.Stat(blockPath); err == nil {
+		return nil
+	}
+	if err := os.MkdirAll(filepath.Dir(blockPath), 0700); err != nil {
+		return err
+	}
+	return writeFileAtomic(blockPath, block.GetBlockData())
+}
+
+func (s *FileBlockStorage) Has(namespace string, hash string) (bool, error) {
+	blockPath, ok := s.blockPath(namespace, hash)
+	if !ok {
+		return false, nil
+	}
+	_, err := os.Stat(blockPath)
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+func (s *FileBlockStorage) Delete(namespace string, hash string) error {
+	blockPath, ok := s.blockPath(namespace, hash)
+	if !ok {
+		return nil
+	}
+	if err := os.Remove(blockPath); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+func (s *FileBlockStorage) Walk(visit func(namespace string, hash string) error) error {
+	return filepath.WalkDir(s.Root, func(blockPath string, entry fs.DirEntry, err error) error {
+		if err != nil || entry.IsDir() {
+			return err
+		}
+		rel, err := filepath.Rel(s.Root, blockPath)
+		if err != nil {
+			return err
+		}
+		namespace := DEFAULT_NAMESPACE
+		parts := strings.Split(filepath.ToSlash(rel), "/")
+		if len(parts) == 5 && parts[0] == "ns" {
+			namespace = parts[1]
+		} else if len(parts) != 3 {
+			return nil
+		}
+		// Skips temporary files left behind by a crash
+		hash := entry.Name()
+		if expected, ok := s.blockPath(namespace, hash); !ok || expected != blockPath {
+			return nil
+		}
+		return visit(namespace, hash)
+	})
+}
+
+// Only hex hashes map to a path, so a hash from a request cannot point
+// outside the tree
+func (s *FileBlockStorage) blockPath(namespace string, hash string) (string, bool) {
+	if len(hash) < 4 {
+		return "", false
+	}
+	if _, err := hex.DecodeString(hash); err != nil {
+		return "", false
+	}
+	dir := s.Root
+	if namespace != DEFAULT_NAMESPACE {
+		dir = filepath.Join(dir, "ns", namespace)
+	}
+	return filepath.Join(dir, hash[0:2], hash[2:4], hash), true
+}
@@ -2,19 +2,60 @@ package surfstore
 
 import (
 	context "context"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
 	"sync"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	emptypb "google.golang.org/protobuf/types/known/emptypb"
 )
 
 type BlockStore struct {
-	BlockMap map[string]*Block
-	Mutex    *sync.RWMutex
+	Storage BlockStorage
+	// Re-hash blocks before serving them, quarantining the ones that no longer match
+	VerifyOnRead bool
+	// Quarantined blocks are saved here for inspection; empty just drops them
+	QuarantineDir string
+	// Decides who may use which namespace's blocks; nil allows everyone
+	Auth *AuthConfig
+	// DeleteBlocks keeps blocks stored or asked about more recently than this
+	GCGracePeriod time.Duration
+	// When blocks were last stored or asked about, for the ones within
+	// the grace period. Blocks not listed count as touched at startedAt.
+	touched map[string]time.Time
+	// When blocks were deleted, for the ones deleted within
+	// BLOCK_TOMBSTONE_LIFETIME and not stored again since
+	deleted      map[string]time.Time
+	touchedMutex *sync.Mutex
+	startedAt    time.Time
+	// The Merkle tree last served to a peer, until a block changes, and
+	// how many times blocks have changed
+	merkle       *merkleTree
+	blockChanges int64
+	merkleMutex  *sync.Mutex
 	UnimplementedBlockStoreServer
 }
 
 // Implement BlockStore Interface's methods
 // Retrieves a block indexed by hash value h
 func (bs *BlockStore) GetBlock(ctx context.Context, blockHash *BlockHash) (*Block, error) {
-	if blockVal, ok := bs.BlockMap[blockHash.GetHash()]; ok {
+	namespace, err := bs.namespaceFromContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+	blockVal, err := bs.Storage.Get(namespace, blockHash.GetHash())
+	if err != nil {
+		return nil, err
+	}
+	if blockVal != nil {
+		if bs.VerifyOnRead && GetBlockHashString(blockVal.GetBlockData()) != blockHash.GetHash() {
+			bs.quarantine(namespace, blockHash.GetHash(), blockVal)
+			return nil, status.Error(codes.DataLoss, ERR_CORRUPT_BLOCK.Error())
+		}
 		return blockVal, nil
 	}
 	return nil, ctx.Err()
@@ -27,12 +68,27 @@ func (bs *BlockStore) PutBlock(ctx context.Context, block *Block) (*Success, err
 	if block == nil {
 		return &Success{Flag: false}, ctx.Err()
 	}
-	hashString := GetBlockHashString(block.GetBlockData())
-	// Put the new entry into map
-	bs.BlockMap[hashString] = block
+	namespace, err := bs.namespaceFromContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if err := bs.storeBlock(namespace, block); err != nil {
+		return nil, err
+	}
 	return &Success{Flag: true}, nil
 }
 
+func (bs *BlockStore) storeBlock(namespace string, block *Block) error {
+	hashString := GetBlockHashString(block.GetBlockData())
+	bs.touch(namespace, []string{hashString})
+	bs.touchedMutex.Lock()
+	delete(bs.deleted, blockKey(namespace, hashString))
+	bs.touchedMutex.Unlock()
+	// Put the new entry into storage
+	defer bs.blocksChanged()
+	return bs.Storage.Put(namespace, hashString, block)
+}
+
 // Given a list of hashes “in”, returns a list containing the
 // subset of in that are stored in the key-value store
 func (bs *BlockStore) HasBlocks(ctx context.Context, blockHashesIn *BlockHashes) (*BlockHashes, error) {
@@ -40,22 +96,201 @@ func (bs *BlockStore) HasBlocks(ctx context.Context, blockHashesIn *BlockHashes)
 	if blockHashesIn == nil {
 		return nil, ctx.Err()
 	}
+	namespace, err := bs.namespaceFromContext(ctx)
+	if err != nil {
+		return nil, err
+	}
 	hashList := blockHashesIn.GetHashes()
+	// A client that finds a block here will not upload it, so it must
+	// not be collected before the client commits the file using it.
+	// Touching it first means a concurrent DeleteBlocks either sees the
+	// touch or has already deleted the block, which is then not reported.
+	bs.touch(namespace, hashList)
 	// init output list
-	blockExist := make([]string, len(hashList))
+	blockExist := make([]string, 0, len(hashList))
 	for _, hash := range hashList {
-		if _, ok := bs.BlockMap[hash]; ok {
+		ok, err := bs.Storage.Has(namespace, hash)
+		if err != nil {
+			return nil, err
+		}
+		if ok {
 			blockExist = append(blockExist, hash)
 		}
 	}
 	return &BlockHashes{Hashes: blockExist}, nil
 }
 
+// Returns the hash of every block stored in the namespace.
+func (bs *BlockStore) ListBlocks(ctx context.Context, _ *emptypb.Empty) (*BlockHashes, error) {
+	namespace, err := bs.namespaceFromContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+	hashes := make([]string, 0)
+	err = bs.Storage.Walk(func(blockNamespace string, hash string) error {
+		if blockNamespace == namespace {
+			hashes = append(hashes, hash)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &BlockHashes{Hashes: hashes}, nil
+}
+
+// Deletes the given blocks from the namespace, except for those stored or
+// asked about within the grace period, and returns the ones deleted.
+func (bs *BlockStore) DeleteBlocks(ctx context.Context, blockHashesIn *BlockHashes) (*BlockHashes, error) {
+	namespace, err := bs.namespaceFromContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+	deleted, err := bs.deleteBlocks(namespace, blockHashesIn.GetHashes())
+	return &BlockHashes{Hashes: deleted}, err
+}
+
+// Deletes the blocks not used within the grace period and remembers
+// deleting them
+func (bs *BlockStore) deleteBlocks(namespace string, hashes []string) ([]string, error) {
+	bs.touchedMutex.Lock()
+	defer bs.touchedMutex.Unlock()
+	now := time.Now()
+	cutoff := now.Add(-bs.GCGracePeriod)
+	for key, touchedAt := range bs.touched {
+		if touchedAt.Before(cutoff) {
+			delete(bs.touched, key)
+		}
+	}
+	for key, deletedAt := range bs.deleted {
+		if deletedAt.Before(now.Add(-BLOCK_TOMBSTONE_LIFETIME)) {
+			delete(bs.deleted, key)
+		}
+	}
+
+	deleted := make([]string, 0, len(hashes))
+	if bs.startedAt.After(cutoff) {
+		return deleted, nil
+	}
+	defer bs.blocksChanged()
+	for _, hash := range hashes {
+		key := blockKey(namespace, hash)
+		if _, ok := bs.touched[key]; ok {
+			continue
+		}
+		if err := bs.Storage.Delete(namespace, hash); err != nil {
+			return deleted, err
+		}
+		bs.deleted[key] = now
+		deleted = append(deleted, hash)
+	}
+	return deleted, nil
+}
+
+// Returns the keys of the blocks deleted within BLOCK_TOMBSTONE_LIFETIME
+// that fall in the given Merkle tree leaves
+func (bs *BlockStore) recentlyDeleted(leaves []int32) map[string]bool {
+	inLeaves := make(map[int]bool)
+	for _, node := range leaves {
+		inLeaves[int(node)-MERKLE_BUCKETS] = true
+	}
+	bs.touchedMutex.Lock()
+	defer bs.touchedMutex.Unlock()
+	cutoff := time.Now().Add(-BLOCK_TOMBSTONE_LIFETIME)
+	keys := make(map[string]bool)
+	for key, deletedAt := range bs.deleted {
+		_, hash := splitBlockKey(key)
+		if deletedAt.After(cutoff) && inLeaves[merkleBucket(hash)] {
+			keys[key] = true
+		}
+	}
+	return keys
+}
+
+func (bs *BlockStore) touch(namespace string, hashes []string) {
+	now := time.Now()
+	bs.touchedMutex.Lock()
+	defer bs.touchedMutex.Unlock()
+	for _, hash := range hashes {
+		bs.touched[blockKey(namespace, hash)] = now
+	}
+}
+
+// Re-hashes every stored block and quarantines the ones that no longer
+// match. Returns how many blocks were checked and how many quarantined.
+func (bs *BlockStore) Scrub() (int, int, error) {
+	checked, quarantined := 0, 0
+	err := bs.Storage.Walk(func(namespace string, hash string) error {
+		block, err := bs.Storage.Get(namespace, hash)
+		if err != nil {
+			log.Println(SURF_SERVER, "scrub could not read block", blockKey(namespace, hash), err)
+			return nil
+		}
+		// Deleted since the walk started
+		if block == nil {
+			return nil
+		}
+		checked++
+		if GetBlockHashString(block.GetBlockData()) != hash {
+			bs.quarantine(namespace, hash, block)
+			quarantined++
+		}
+		return nil
+	})
+	return checked, quarantined, err
+}
+
+// Periodically scrubs the BlockStore.
+func (bs *BlockStore) ScrubLoop(interval time.Duration) {
+	for range time.Tick(interval) {
+		checked, quarantined, err := bs.Scrub()
+		log.Println(SURF_SERVER, "scrubbed", checked, "blocks, quarantined", quarantined, err)
+	}
+}
+
+// Takes a block that no longer matches its hash out of service, so that
+// HasBlocks stops reporting it and clients upload it again
+func (bs *BlockStore) quarantine(namespace string, hash string, block *Block) {
+	log.Println(SURF_SERVER, "quarantining corrupt block", blockKey(namespace, hash))
+	if bs.QuarantineDir != "" {
+		name := filepath.Join(bs.QuarantineDir, filepath.Base(namespace+"-"+hash))
+		err := os.MkdirAll(bs.QuarantineDir, 0700)
+		if err == nil {
+			err = os.WriteFile(name, block.GetBlockData(), 0600)
+		}
+		if err != nil {
+			log.Println(SURF_SERVER, "could not save quarantined block:", err)
+		}
+	}
+	if err := bs.Storage.Delete(namespace, hash); err != nil {
+		log.Println(SURF_SERVER, "could not remove quarantined block:", err)
+	}
+	bs.blocksChanged()
+}
+
+// Returns the namespace an RPC selected, if the caller may use it
+func (bs *BlockStore) namespaceFromContext(ctx context.Context) (string, error) {
+	namespace, err := NamespaceFromContext(ctx)
+	if err != nil {
+		return "", err
+	}
+	if !bs.Auth.canUseNamespace(ctx) {
+		return "", permissionDenied(ctx, "namespace "+strconv.Quote(namespace))
+	}
+	return namespace, nil
+}
+
 // This line guarantees all method for BlockStore are implemented
 var _ BlockStoreInterface = new(BlockStore)
 
 func NewBlockStore() *BlockStore {
 	return &BlockStore{
-		BlockMap: map[string]*Block{},
+		Storage:       NewMemoryBlockStorage(),
+		GCGracePeriod: GC_GRACE_PERIOD,
+		touched:       map[string]time.Time{},
+		deleted:       map[string]time.Time{},
+		touchedMutex:  &sync.Mutex{},
+		startedAt:     time.Now(),
+		merkleMutex:   &sync.Mutex{},
 	}
 }
@@ -0,0 +1,354 @@
+package surfstore
+
+import (
+	context "context"
+	"fmt"
+	"log"
+	"sort"
+	"time"
+
+	grpc "google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	emptypb "google.golang.org/protobuf/types/known/emptypb"
+)
+
+var ERR_UNKNOWN_BLOCKSTORE = fmt.Errorf("BlockStore is not registered.")
+var ERR_BLOCKSTORE_DECOMMISSIONED = fmt.Errorf("BlockStore has been decommissioned.")
+var ERR_BLOCKSTORE_NOT_DRAINED = fmt.Errorf("BlockStore must be drained before it is decommissioned.")
+
+// Adds a BlockStore to the ring, moving blocks onto it in the background.
+// Registering again is harmless, and counts as a heartbeat.
+func (m *MetaStore) RegisterBlockStore(ctx context.Context, addr *BlockStoreAddr) (*BlockStoreStatus, error) {
+	op, err := m.registration(addr.GetAddr(), BlockStoreState_ACTIVE)
+	if err != nil {
+		return nil, err
+	}
+	if op != nil {
+		if _, err := m.applyOperation(op); err != nil {
+			return nil, err
+		}
+	}
+	return m.BlockStoreHeartbeat(ctx, addr)
+}
+
+// Records that a registered BlockStore is alive. Liveness is not part of
+// the replicated state: each metadata server only trusts the heartbeats
+// it received itself.
+func (m *MetaStore) BlockStoreHeartbeat(ctx context.Context, addr *BlockStoreAddr) (*BlockStoreStatus, error) {
+	m.Mutex.Lock()
+	state, ok := m.blockStoreRegistry[addr.GetAddr()]
+	if ok && state != BlockStoreState_DECOMMISSIONED {
+		m.blockStoreHeartbeats[addr.GetAddr()] = time.Now()
+	}
+	m.Mutex.Unlock()
+	switch {
+	case !ok:
+		// The BlockStore registers again on seeing NotFound
+		return nil, status.Error(codes.NotFound, ERR_UNKNOWN_BLOCKSTORE.Error())
+	case state == BlockStoreState_DECOMMISSIONED:
+		return nil, ERR_BLOCKSTORE_DECOMMISSIONED
+	}
+	return m.blockStoreStatus(addr.GetAddr()), nil
+}
+
+// Takes a BlockStore off the ring. It keeps serving the blocks it holds
+// until the rebalance has moved them to the rest of the ring.
+func (m *MetaStore) DrainBlockStore(ctx context.Context, addr *BlockStoreAddr) (*BlockStoreStatus, error) {
+	op, err := m.registration(addr.GetAddr(), BlockStoreState_DRAINING)
+	if err != nil {
+		return nil, err
+	}
+	if op != nil {
+		if _, err := m.applyOperation(op); err != nil {
+			return nil, err
+		}
+	}
+	return m.blockStoreStatus(addr.GetAddr()), nil
+}
+
+// Forgets a drained BlockStore for good, so it cannot register again.
+func (m *MetaStore) DecommissionBlockStore(ctx context.Context, addr *BlockStoreAddr) (*BlockStoreStatus, error) {
+	op, err := m.registration(addr.GetAddr(), BlockStoreState_DECOMMISSIONED)
+	if err != nil {
+		return nil, err
+	}
+	if op != nil {
+		if _, err := m.applyOperation(op); err != nil {
+			return nil, err
+		}
+	}
+	return m.blockStoreStatus(addr.GetAddr()), nil
+}
+
+// Returns every BlockStore that registered or is on either ring.
+func (m *MetaStore) GetBlockStoreStatuses(ctx context.Context, _ *emptypb.Empty) (*BlockStoreStatuses, error) {
+	m.Mutex.RLock()
+	seen := make(map[string]bool)
+	addrs := make([]string, 0)
+	for _, list := range [][]string{m.BlockStoreAddrs, m.previousBlockStoreAddrs, m.registeredBlockStores()} {
+		for _, addr := range list {
+			if !seen[addr] {
+				seen[addr] = true
+				addrs = append(addrs, addr)
+			}
+		}
+	}
+	m.Mutex.RUnlock()
+	sort.Strings(addrs)
+
+	statuses := make([]*BlockStoreStatus, 0, len(addrs))
+	for _, addr := range addrs {
+		statuses = append(statuses, m.blockStoreStatus(addr))
+	}
+	return &BlockStoreStatuses{Statuses: statuses}, nil
+}
+
+func (m *MetaStore) blockStoreStatus(addr string) *BlockStoreStatus {
+	m.Mutex.RLock()
+	defer m.Mutex.RUnlock()
+	state, registered := m.blockStoreRegistry[addr]
+	onRing := containsAddr(m.BlockStoreAddrs, addr)
+	return &BlockStoreStatus{
+		Addr:          addr,
+		Registered:    registered,
+		State:         state,
+		Healthy:       m.healthy(addr, time.Now()),
+		LastHeartbeat: unixNanos(m.blockStoreHeartbeats[addr]),
+		OnRing:        onRing,
+		Drained:       state == BlockStoreState_DRAINING && !onRing && !containsAddr(m.previousBlockStoreAddrs, addr),
+	}
+}
+
+// Returns the operation moving a BlockStore to a state, or nil if it is
+// already there.
+func (m *MetaStore) registration(addr string, state BlockStoreState) (*UpdateOperation, error) {
+	registration := &BlockStoreRegistration{Addr: addr, State: state}
+	m.Mutex.RLock()
+	defer m.Mutex.RUnlock()
+	if err := m.checkRegistration(registration); err != nil {
+		return nil, err
+	}
+	if current, ok := m.blockStoreRegistry[addr]; ok && (current == state || state == BlockStoreState_ACTIVE) {
+		return nil, nil
+	}
+	return &UpdateOperation{
+		Registration: registration,
+		Timestamp:    time.Now().UnixNano(),
+	}, nil
+}
+
+// BlockStores register themselves, and only an operator drains them; a
+// drained BlockStore stays drained when it registers again after a
+// restart. The caller must hold the lock.
+func (m *MetaStore) checkRegistration(registration *BlockStoreRegistration) error {
+	addr := registration.GetAddr()
+	if addr == "" {
+		return ERR_UNKNOWN_BLOCKSTORE
+	}
+	current, registered := m.blockStoreRegistry[addr]
+	if current == BlockStoreState_DECOMMISSIONED && registered {
+		if registration.GetState() == BlockStoreState_DECOMMISSIONED {
+			return nil
+		}
+		return ERR_BLOCKSTORE_DECOMMISSIONED
+	}
+	switch registration.GetState() {
+	case BlockStoreState_DRAINING:
+		if !registered && !containsAddr(m.BlockStoreAddrs, addr) && !containsAddr(m.previousBlockStoreAddrs, addr) {
+			return ERR_UNKNOWN_BLOCKSTORE
+		}
+		if len(m.ringWithRegistry(m.BlockStoreAddrs, registration)) == 0 {
+			return ERR_NO_BLOCKSTORES
+		}
+	case BlockStoreState_DECOMMISSIONED:
+		if current != BlockStoreState_DRAINING || !registered ||
+			containsAddr(m.BlockStoreAddrs, addr) || containsAddr(m.previousBlockStoreAddrs, addr) {
+			return ERR_BLOCKSTORE_NOT_DRAINED
+		}
+	}
+	return nil
+}
+
+// The caller must hold the lock and have checked the registration.
+func (m *MetaStore) changeRegistry(registration *BlockStoreRegistration, timestamp int64) {
+	addr := registration.GetAddr()
+	if _, ok := m.blockStoreRegistry[addr]; ok && registration.GetState() == BlockStoreState_ACTIVE {
+		return
+	}
+	m.blockStoreRegistry[addr] = registration.GetState()
+	if registration.GetState() == BlockStoreState_DECOMMISSIONED {
+		delete(m.blockStoreHeartbeats, addr)
+	}
+	m.reconcileBlockStores(timestamp)
+}
+
+// Starts moving blocks onto the ring the registry asks for, unless a
+// rebalance is already in progress; the ring catches up when it finishes.
+// Every replica does this as it applies the same operation, so they all
+// agree on the ring. The caller must hold the lock.
+func (m *MetaStore) reconcileBlockStores(timestamp int64) {
+	if m.previousBlockStoreAddrs == nil {
+		m.changeBlockStores(&BlockStoreChange{Addrs: m.BlockStoreAddrs}, timestamp)
+	}
+}
+
+// Returns a ring without the BlockStores being drained or decommissioned
+// and with every active registered one, in a deterministic order.
+// A registration not yet applied can be included. The caller must hold
+// the lock.
+func (m *MetaStore) ringWithRegistry(addrs []string, pending *BlockStoreRegistration) []string {
+	stateOf := func(addr string) (BlockStoreState, bool) {
+		if pending != nil && pending.GetAddr() == addr {
+			return pending.GetState(), true
+		}
+		state, ok := m.blockStoreRegistry[addr]
+		return state, ok
+	}
+	ring := make([]string, 0, len(addrs))
+	for _, addr := range addrs {
+		if state, ok := stateOf(addr); !ok || state == BlockStoreState_ACTIVE {
+			ring = append(ring, addr)
+		}
+	}
+	registered := m.registeredBlockStores()
+	if pending != nil && !containsAddr(registered, pending.GetAddr()) {
+		registered = append(registered, pending.GetAddr())
+		sort.Strings(registered)
+	}
+	for _, addr := range registered {
+		if state, _ := stateOf(addr); state == BlockStoreState_ACTIVE && !containsAddr(ring, addr) {
+			ring = append(ring, addr)
+		}
+	}
+	return ring
+}
+
+// The caller must hold the lock.
+func (m *MetaStore) registeredBlockStores() []string {
+	addrs := make([]string, 0, len(m.blockStoreRegistry))
+	for addr := range m.blockStoreRegistry {
+		addrs = append(addrs, addr)
+	}
+	sort.Strings(addrs)
+	return addrs
+}
+
+// BlockStores that never registered are not expected to send heartbeats,
+// so they always count as healthy. A registered one gets a full timeout
+// after this server starts before it has to have sent one. The caller
+// must hold the lock.
+func (m *MetaStore) healthy(addr string, now time.Time) bool {
+	state, ok := m.blockStoreRegistry[addr]
+	if !ok {
+		return true
+	}
+	if state == BlockStoreState_DECOMMISSIONED {
+		return false
+	}
+	last := m.blockStoreHeartbeats[addr]
+	if last.Before(m.startedAt) {
+		last = m.startedAt
+	}
+	return now.Sub(last) < m.BlockStoreTimeout
+}
+
+// The caller must hold the lock.
+func (m *MetaStore) unhealthyBlockStores() []string {
+	now := time.Now()
+	unhealthy := make([]string, 0)
+	for _, addrs := range [][]string{m.BlockStoreAddrs, m.previousBlockStoreAddrs} {
+		for _, addr := range addrs {
+			if !m.healthy(addr, now) && !containsAddr(unhealthy, addr) {
+				unhealthy = append(unhealthy, addr)
+			}
+		}
+	}
+	return unhealthy
+}
+
+func unixNanos(t time.Time) int64 {
+	if t.IsZero() {
+		return 0
+	}
+	return t.UnixNano()
+}
+
+// blockStoreRegistryClient is the part of the MetaStore and RaftSurfstore
+// services a BlockStore uses to register itself
+type blockStoreRegistryClient interface {
+	RegisterBlockStore(ctx context.Context, in *BlockStoreAddr, opts ...grpc.CallOption) (*BlockStoreStatus, error)
+	BlockStoreHeartbeat(ctx context.Context, in *BlockStoreAddr, opts ...grpc.CallOption) (*BlockStoreStatus, error)
+}
+
+// Registers the BlockStore under addr with the metadata servers and then
+// keeps sending them heartbeats. Every metadata server is sent heartbeats,
+// since any of them may become the leader; registering goes through the
+// log, so it only has to reach one that accepts it. Returns once the
+// BlockStore has been decommissioned.
+func (bs *BlockStore) HeartbeatLoop(addr string, metaStoreAddrs []string, tlsConfig *TLSConfig, interval time.Duration) {
+	registered := false
+	for range time.Tick(interval) {
+		if !registered {
+			registered = bs.register(addr, metaStoreAddrs, tlsConfig, interval)
+		}
+		for _, metaStoreAddr := range metaStoreAddrs {
+			err := bs.callRegistry(metaStoreAddr, tlsConfig, interval, func(ctx context.Context, c blockStoreRegistryClient) error {
+				_, err := c.BlockStoreHeartbeat(ctx, &BlockStoreAddr{Addr: addr})
+				return err
+			})
+			switch {
+			case status.Code(err) == codes.NotFound:
+				// e.g. the metadata server lost its state, or has not
+				// applied the registration yet
+				registered = false
+			case isDecommissioned(err):
+				log.Println(SURF_SERVER, addr, "has been decommissioned, no longer sending heartbeats")
+				return
+			case err != nil:
+				log.Println(SURF_SERVER, "heartbeat to", metaStoreAddr, "failed:", err)
+			}
+		}
+	}
+}
+
+func (bs *BlockStore) register(addr string, metaStoreAddrs []string, tlsConfig *TLSConfig, timeout time.Duration) bool {
+	for _, metaStoreAddr := range metaStoreAddrs {
+		err := bs.callRegistry(metaStoreAddr, tlsConfig, timeout, func(ctx context.Context, c blockStoreRegistryClient) error {
+			_, err := c.RegisterBlockStore(ctx, &BlockStoreAddr{Addr: addr})
+			return err
+		})
+		if err == nil {
+			log.Println(SURF_SERVER, "registered", addr, "with", metaStoreAddr)
+			return true
+		}
+		if isDecommissioned(err) {
+			return false
+		}
+	}
+	return false
+}
+
+// Calls a metadata server through the RaftSurfstore service, or the
+// MetaStore service if it is not a Raft server
+func (bs *BlockStore) callRegistry(metaStoreAddr string, tlsConfig *TLSConfig, timeout time.Duration, call func(ctx context.Context, c blockStoreRegistryClient) error) error {
+	conn, err := grpc.Dial(metaStoreAddr, tlsConfig.DialOption())
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	ctx = WithToken(ctx, bs.Auth.ServerToken())
+	err = call(ctx, NewRaftSurfstoreClient(conn))
+	if status.Code(err) == codes.Unimplemented {
+		err = call(ctx, NewMetaStoreClient(conn))
+	}
+	return err
+}
+
+func isDecommissioned(err error) bool {
+	st, ok := status.FromError(err)
+	return ok && st.Message() == ERR_BLOCKSTORE_DECOMMISSIONED.Error()
+}
@@ -0,0 +1,330 @@
+package surfstore
+
+import (
+	"container/list"
+	context "context"
+	"log"
+	"sync"
+
+	grpc "google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	emptypb "google.golang.org/protobuf/types/known/emptypb"
+)
+
+// CachingBlockStore stands in for a distant BlockStore, e.g. at a branch
+// office. Blocks it serves are kept in its own storage, so each one crosses
+// the link to the upstream BlockStore once; blocks stored through it are
+// written to the upstream before it reports success. Everything else is
+// asked of the upstream, which stays the only authority on what exists.
+type CachingBlockStore struct {
+	*BlockStore
+
+	upstream string
+	// Secures the link to the upstream; nil dials it in plaintext
+	TLS *TLSConfig
+	// Bytes of blocks kept before the least recently used are evicted;
+	// zero keeps everything
+	MaxBytes int64
+
+	mutex sync.Mutex
+	// Kept open, since the upstream is usually far away
+	conn *grpc.ClientConn
+	// Misses being fetched from the upstream, keyed by block key
+	fetches map[string]*blockFetch
+	// Most recently used at the front; values are *cachedBlock
+	lru     *list.List
+	entries map[string]*list.Element
+	bytes   int64
+	stats   CacheStats
+}
+
+// CacheStats counts how a CachingBlockStore has been doing
+type CacheStats struct {
+	Hits int64
+	// Misses fetched from the upstream, and the ones that waited for a
+	// fetch of the same block already under way
+	Misses       int64
+	SharedMisses int64
+	Evictions    int64
+	// Blocks and bytes currently cached
+	Blocks int64
+	Bytes  int64
+}
+
+// One fetch from the upstream, shared by every GetBlock missing that block
+type blockFetch struct {
+	done  chan struct{}
+	block *Block
+	err   error
+}
+
+type cachedBlock struct {
+	key  string
+	size int64
+}
+
+// Serves the block from the cache, or fetches it from the upstream and
+// keeps a copy. Concurrent misses for one block share a single fetch.
+func (cs *CachingBlockStore) GetBlock(ctx context.Context, blockHash *BlockHash) (*Block, error) {
+	namespace, err := cs.namespaceFromContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+	hash := blockHash.GetHash()
+	block, err := cs.Storage.Get(namespace, hash)
+	if err != nil {
+		return nil, err
+	}
+	if block != nil {
+		if !cs.VerifyOnRead || GetBlockHashString(block.GetBlockData()) == hash {
+			cs.mutex.Lock()
+			cs.stats.Hits++
+			cs.mutex.Unlock()
+			cs.cached(blockKey(namespace, hash), int64(len(block.GetBlockData())))
+			return block, nil
+		}
+		// The upstream still has a good copy
+		cs.quarantine(namespace, hash, block)
+	}
+	return cs.fetch(ctx, namespace, hash)
+}
+
+// Stores the block upstream, then keeps a copy once the upstream has it
+func (cs *CachingBlockStore) PutBlock(ctx context.Context, block *Block) (*Success, error) {
+	if block == nil {
+		return &Success{Flag: false}, ctx.Err()
+	}
+	namespace, err := cs.namespaceFromContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+	c, err := cs.upstreamClient()
+	if err != nil {
+		return nil, err
+	}
+	upstreamCtx, cancel := cs.upstreamContext(ctx, namespace)
+	defer cancel()
+	succ, err := c.PutBlock(upstreamCtx, block)
+	if err != nil || !succ.Flag {
+		return succ, err
+	}
+	cs.cache(namespace, GetBlockHashString(block.GetBlockData()), block)
+	return succ, nil
+}
+
+// Reports the blocks the upstream has, since only those are safe for a
+// client to skip uploading
+func (cs *CachingBlockStore) HasBlocks(ctx context.Context, blockHashesIn *BlockHashes) (*BlockHashes, error) {
+	namespace, err := cs.namespaceFromContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+	c, err := cs.upstreamClient()
+	if err != nil {
+		return nil, err
+	}
+	upstreamCtx, cancel := cs.upstreamContext(ctx, namespace)
+	defer cancel()
+	return c.HasBlocks(upstreamCtx, blockHashesIn)
+}
+
+// Lists the upstream's blocks
+func (cs *CachingBlockStore) ListBlocks(ctx context.Context, empty *emptypb.Empty) (*BlockHashes, error) {
+	namespace, err := cs.namespaceFromContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+	c, err := cs.upstreamClient()
+	if err != nil {
+		return nil, err
+	}
+	upstreamCtx, cancel := cs.upstreamContext(ctx, namespace)
+	defer cancel()
+	return c.ListBlocks(upstreamCtx, empty)
+}
+
+// Deletes the blocks upstream, which applies its own grace period, and
+// drops the cached copies of the ones it deleted
+func (cs *CachingBlockStore) DeleteBlocks(ctx context.Context, blockHashesIn *BlockHashes) (*BlockHashes, error) {
+	namespace, err := cs.namespaceFromContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+	c, err := cs.upstreamClient()
+	if err != nil {
+		return nil, err
+	}
+	upstreamCtx, cancel := cs.upstreamContext(ctx, namespace)
+	defer cancel()
+	deleted, err := c.DeleteBlocks(upstreamCtx, blockHashesIn)
+	if err != nil {
+		return deleted, err
+	}
+	for _, hash := range deleted.GetHashes() {
+		cs.evict(blockKey(namespace, hash))
+	}
+	return deleted, nil
+}
+
+// Indexes the blocks already in storage, e.g. from before a restart, so
+// they count towards MaxBytes.
+func (cs *CachingBlockStore) IndexCache() error {
+	return cs.Storage.Walk(func(namespace string, hash string) error {
+		block, err := cs.Storage.Get(namespace, hash)
+		if err != nil || block == nil {
+			return err
+		}
+		cs.cached(blockKey(namespace, hash), int64(len(block.GetBlockData())))
+		return nil
+	})
+}
+
+func (cs *CachingBlockStore) Stats() CacheStats {
+	cs.mutex.Lock()
+	defer cs.mutex.Unlock()
+	stats := cs.stats
+	stats.Blocks = int64(len(cs.entries))
+	stats.Bytes = cs.bytes
+	return stats
+}
+
+// Waits for the block to be fetched from the upstream, starting the fetch
+// unless one is already under way. The fetch does not depend on the caller
+// that started it, so a caller giving up does not fail the others.
+func (cs *CachingBlockStore) fetch(ctx context.Context, namespace string, hash string) (*Block, error) {
+	key := blockKey(namespace, hash)
+	cs.mutex.Lock()
+	f, ok := cs.fetches[key]
+	if ok {
+		cs.stats.SharedMisses++
+	} else {
+		cs.stats.Misses++
+		f = &blockFetch{done: make(chan struct{})}
+		cs.fetches[key] = f
+		go cs.fetchFromUpstream(namespace, hash, f)
+	}
+	cs.mutex.Unlock()
+
+	select {
+	case <-f.done:
+		return f.block, f.err
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+func (cs *CachingBlockStore) fetchFromUpstream(namespace string, hash string, f *blockFetch) {
+	f.block, f.err = cs.getBlockFromUpstream(namespace, hash)
+	if f.err == nil {
+		cs.cache(namespace, hash, f.block)
+	}
+	cs.mutex.Lock()
+	delete(cs.fetches, blockKey(namespace, hash))
+	cs.mutex.Unlock()
+	close(f.done)
+}
+
+func (cs *CachingBlockStore) getBlockFromUpstream(namespace string, hash string) (*Block, error) {
+	c, err := cs.upstreamClient()
+	if err != nil {
+		return nil, err
+	}
+	upstreamCtx, cancel := cs.upstreamContext(context.Background(), namespace)
+	defer cancel()
+	block, err := c.GetBlock(upstreamCtx, &BlockHash{Hash: hash})
+	if err != nil {
+		return nil, err
+	}
+	if GetBlockHashString(block.GetBlockData()) != hash {
+		return nil, status.Error(codes.DataLoss, ERR_CORRUPT_BLOCK.Error())
+	}
+	return block, nil
+}
+
+// Keeps a copy of a block the upstream has. Failing to is not an error,
+// the block is just fetched again next time.
+func (cs *CachingBlockStore) cache(namespace string, hash string, block *Block) {
+	if err := cs.Storage.Put(namespace, hash, block); err != nil {
+		log.Println(SURF_SERVER, "could not cache block", blockKey(namespace, hash), err)
+		return
+	}
+	cs.cached(blockKey(namespace, hash), int64(len(block.GetBlockData())))
+}
+
+// Marks a cached block as the most recently used, then evicts the least
+// recently used blocks while the cache is over MaxBytes
+func (cs *CachingBlockStore) cached(key string, size int64) {
+	cs.mutex.Lock()
+	if elem, ok := cs.entries[key]; ok {
+		cs.lru.MoveToFront(elem)
+		cs.mutex.Unlock()
+		return
+	}
+	cs.entries[key] = cs.lru.PushFront(&cachedBlock{key: key, size: size})
+	cs.bytes += size
+	evicted := make([]string, 0)
+	for cs.MaxBytes > 0 && cs.bytes > cs.MaxBytes && cs.lru.Len() > 1 {
+		entry := cs.lru.Remove(cs.lru.Back()).(*cachedBlock)
+		delete(cs.entries, entry.key)
+		cs.bytes -= entry.size
+		cs.stats.Evictions++
+		evicted = append(evicted, entry.key)
+	}
+	cs.mutex.Unlock()
+
+	for _, key := range evicted {
+		cs.deleteCached(key)
+	}
+}
+
+func (cs *CachingBlockStore) evict(key string) {
+	cs.mutex.Lock()
+	if elem, ok := cs.entries[key]; ok {
+		cs.lru.Remove(elem)
+		delete(cs.entries, key)
+		cs.bytes -= elem.Value.(*cachedBlock).size
+	}
+	cs.mutex.Unlock()
+	cs.deleteCached(key)
+}
+
+func (cs *CachingBlockStore) deleteCached(key string) {
+	namespace, hash := splitBlockKey(key)
+	if err := cs.Storage.Delete(namespace, hash); err != nil {
+		log.Println(SURF_SERVER, "could not evict cached block", key, err)
+	}
+}
+
+func (cs *CachingBlockStore) upstreamClient() (BlockStoreClient, error) {
+	cs.mutex.Lock()
+	defer cs.mutex.Unlock()
+	if cs.conn == nil {
+		conn, err := grpc.Dial(cs.upstream, cs.TLS.DialOption())
+		if err != nil {
+			return nil, err
+		}
+		cs.conn = conn
+	}
+	return NewBlockStoreClient(cs.conn), nil
+}
+
+// The cache has already checked that the caller may use the namespace,
+// so it asks the upstream as a server
+func (cs *CachingBlockStore) upstreamContext(ctx context.Context, namespace string) (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithTimeout(ctx, CACHE_UPSTREAM_TIMEOUT)
+	return WithToken(WithNamespace(ctx, namespace), cs.Auth.ServerToken()), cancel
+}
+
+// This line guarantees all method for CachingBlockStore are implemented
+var _ BlockStoreInterface = new(CachingBlockStore)
+
+func NewCachingBlockStore(upstream string) *CachingBlockStore {
+	return &CachingBlockStore{
+		BlockStore: NewBlockStore(),
+		upstream:   upstream,
+		fetches:    map[string]*blockFetch{},
+		lru:        list.New(),
+		entries:    map[string]*list.Element{},
+	}
+}
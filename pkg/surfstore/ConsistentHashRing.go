@@ -0,0 +1,131 @@
+package surfstore
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"sort"
+	"strconv"
+)
+
+// ConsistentHashRing places blocks on BlockStore servers. Each server is
+// hashed onto the ring at RING_VIRTUAL_NODES points, and a block belongs to
+// the server owning the first point at or after the block's hash, wrapping
+// around. Adding or removing a server only moves the blocks next to its
+// points. With a replication factor above one, a block also belongs to
+// the next distinct servers found walking on around the ring.
+type ConsistentHashRing struct {
+	// Server owning each point on the ring, keyed by the point's hash
+	ServerMap map[string]string
+	// Number of servers each block is stored on, capped at the number of servers
+	ReplicationFactor int
+	// While rebalancing, the ring blocks are still moving away from; reads
+	// fall back to it
+	Previous *ConsistentHashRing
+	// Servers that stopped sending heartbeats; clients read from them last
+	// and only write to them if a block has nowhere else to go
+	Unhealthy map[string]bool
+	// Hashes of the points, in ring order
+	points []string
+}
+
+func NewConsistentHashRing(serverAddrs []string) *ConsistentHashRing {
+	ring := &ConsistentHashRing{
+		ServerMap:         make(map[string]string),
+		ReplicationFactor: 1,
+		points:            make([]string, 0, len(serverAddrs)*RING_VIRTUAL_NODES),
+	}
+	for _, addr := range serverAddrs {
+		for i := 0; i < RING_VIRTUAL_NODES; i++ {
+			point := ring.Hash("blockstore" + addr + "#" + strconv.Itoa(i))
+			ring.ServerMap[point] = addr
+			ring.points = append(ring.points, point)
+		}
+	}
+	sort.Strings(ring.points)
+	return ring
+}
+
+// Returns the address of the server a block belongs to, or "" if the ring
+// has no servers. Block hashes are hex SHA-256 like the points, so they
+// compare in the same order.
+func (ring *ConsistentHashRing) GetResponsibleServer(blockHash string) string {
+	if len(ring.points) == 0 {
+		return ""
+	}
+	i := sort.SearchStrings(ring.points, blockHash)
+	if i == len(ring.points) {
+		i = 0
+	}
+	return ring.ServerMap[ring.points[i]]
+}
+
+// Returns the servers a block is stored on, the responsible one first
+func (ring *ConsistentHashRing) GetReplicaServers(blockHash string) []string {
+	return ring.serversFrom(blockHash, ring.ReplicationFactor)
+}
+
+// Returns the server each shard of an erasure-coded block is stored on:
+// the distinct servers found walking the ring from the block's hash, in
+// turn, starting over if there are fewer servers than shards
+func (ring *ConsistentHashRing) GetShardServers(blockHash string, shards int) []string {
+	distinct := ring.serversFrom(blockHash, shards)
+	if len(distinct) == 0 {
+		return nil
+	}
+	servers := make([]string, shards)
+	for i := range servers {
+		servers[i] = distinct[i%len(distinct)]
+	}
+	return servers
+}
+
+// Returns up to n distinct servers, walking the ring from a hash
+func (ring *ConsistentHashRing) serversFrom(hash string, n int) []string {
+	if len(ring.points) == 0 {
+		return nil
+	}
+	servers := make([]string, 0, n)
+	seen := make(map[string]bool)
+	start := sort.SearchStrings(ring.points, hash)
+	for i := 0; i < len(ring.points) && len(servers) < n; i++ {
+		server := ring.ServerMap[ring.points[(start+i)%len(ring.points)]]
+		if !seen[server] {
+			seen[server] = true
+			servers = append(servers, server)
+		}
+	}
+	return servers
+}
+
+// Returns the servers, healthy ones first
+func (ring *ConsistentHashRing) HealthyFirst(servers []string) []string {
+	ordered := make([]string, 0, len(servers))
+	for _, server := range servers {
+		if !ring.Unhealthy[server] {
+			ordered = append(ordered, server)
+		}
+	}
+	for _, server := range servers {
+		if ring.Unhealthy[server] {
+			ordered = append(ordered, server)
+		}
+	}
+	return ordered
+}
+
+// Groups block hashes by each server they are stored on
+func (ring *ConsistentHashRing) GroupByServer(blockHashes []string) map[string][]string {
+	groups := make(map[string][]string)
+	for _, hash := range blockHashes {
+		for _, server := range ring.GetReplicaServers(hash) {
+			groups[server] = append(groups[server], hash)
+		}
+	}
+	return groups
+}
+
+func (ring *ConsistentHashRing) Hash(addr string) string {
+	h := sha256.New()
+	h.Write([]byte(addr))
+	return hex.EncodeToString(h.Sum(nil))
+}
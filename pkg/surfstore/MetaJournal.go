@@ -0,0 +1,375 @@
+package surfstore
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+
+	"google.golang.org/protobuf/proto"
+)
+
+// Every record starts with the payload length, a CRC-32C of the rest of
+// the record, and the record's sequence number
+const journalHeaderSize = 16
+
+var crcTable = crc32.MakeTable(crc32.Castagnoli)
+
+var errTornRecord = errors.New("torn or corrupt record")
+
+// metaJournal is the append-only log of operations a durable MetaStore
+// has applied since its last checkpoint. A nil *metaJournal records nothing.
+type metaJournal struct {
+	dir  string
+	file *os.File
+	// Bytes of complete records in the file
+	size int64
+	// Sequence number of the last record written
+	sequence uint64
+	// Records written since the last checkpoint
+	pending int
+	mutex   sync.Mutex
+	// Held for reading while an operation is applied and journaled, and
+	// for writing while a checkpoint captures every namespace
+	applying sync.RWMutex
+}
+
+// Returns a MetaStore that journals every change it applies to dataDir
+// and comes back with the same state when opened again after a restart.
+// If the BlockStores differ from the ones it had, their blocks are
+// rebalanced onto the new ones as if SetBlockStoreAddrs had been called.
+func OpenMetaStore(dataDir string, blockStoreAddrs ...string) (*MetaStore, error) {
+	if err := os.MkdirAll(dataDir, 0700); err != nil {
+		return nil, err
+	}
+	// The BlockStores come from the checkpoint and journal like the rest
+	m := NewMetaStore()
+
+	// Operations the checkpoint already covers are skipped on replay
+	checkpointed, err := m.loadCheckpoint(filepath.Join(dataDir, CHECKPOINT_FILENAME))
+	if err != nil {
+		return nil, err
+	}
+
+	file, err := os.OpenFile(filepath.Join(dataDir, JOURNAL_FILENAME), os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+	journal := &metaJournal{dir: dataDir, file: file, sequence: checkpointed}
+	if err := m.replayJournal(journal); err != nil {
+		file.Close()
+		return nil, err
+	}
+	m.journal = journal
+
+	// BlockStores that registered stay on the ring, and drained ones off it
+	if len(blockStoreAddrs) > 0 && !sameAddrs(m.ringWithRegistry(blockStoreAddrs, nil), m.BlockStoreAddrs) {
+		if _, err := m.applyOperation(blockStoreChange(blockStoreAddrs)); err != nil {
+			log.Println(SURF_SERVER, "keeping BlockStores", m.BlockStoreAddrs, "until the rebalance finishes:", err)
+		}
+	}
+	return m, nil
+}
+
+// Writes the state of every namespace to the data directory and empties
+// the journal. Does nothing for a MetaStore that is not durable.
+func (m *MetaStore) Checkpoint() error {
+	journal := m.journal
+	if journal == nil {
+		return nil
+	}
+	journal.applying.Lock()
+	defer journal.applying.Unlock()
+
+	m.Mutex.RLock()
+	checkpoint := &MetaStoreCheckpoint{
+		BlockStoreAddrs:         m.BlockStoreAddrs,
+		PreviousBlockStoreAddrs: m.previousBlockStoreAddrs,
+	}
+	for _, addr := range m.registeredBlockStores() {
+		checkpoint.BlockStoreRegistry = append(checkpoint.BlockStoreRegistry, &BlockStoreRegistration{
+			Addr:  addr,
+			State: m.blockStoreRegistry[addr],
+		})
+	}
+	m.Mutex.RUnlock()
+	for namespace, ns := range m.allNamespaces() {
+		ns.Mutex.RLock()
+		checkpoint.Namespaces = append(checkpoint.Namespaces, ns.checkpoint(namespace))
+		ns.Mutex.RUnlock()
+	}
+	sort.Slice(checkpoint.Namespaces, func(i, j int) bool {
+		return checkpoint.Namespaces[i].Namespace < checkpoint.Namespaces[j].Namespace
+	})
+
+	journal.mutex.Lock()
+	defer journal.mutex.Unlock()
+	record, err := encodeRecord(journal.sequence, checkpoint)
+	if err != nil {
+		return err
+	}
+	if err := writeFileAtomic(filepath.Join(journal.dir, CHECKPOINT_FILENAME), record); err != nil {
+		return err
+	}
+	// A crash before the truncation is harmless: the records left in the
+	// journal are at or below the checkpoint's sequence and get skipped
+	if err := journal.file.Truncate(0); err != nil {
+		return err
+	}
+	journal.size = 0
+	journal.pending = 0
+	return journal.file.Sync()
+}
+
+// Closes the journal. The MetaStore must not be used afterwards.
+func (m *MetaStore) Close() error {
+	if m.journal == nil {
+		return nil
+	}
+	return m.journal.file.Close()
+}
+
+// Captures the namespace's state. The caller must hold the lock.
+func (m *MetaStore) checkpoint(namespace string) *NamespaceCheckpoint {
+	clientRevisions := make(map[string]int64, len(m.ClientRevisions))
+	for clientId, revision := range m.ClientRevisions {
+		clientRevisions[clientId] = revision
+	}
+	forgotten := make([]string, 0)
+	for filename := range m.FileHistory {
+		if _, ok := m.FileMetaMap[filename]; !ok {
+			forgotten = append(forgotten, filename)
+		}
+	}
+	return &NamespaceCheckpoint{
+		Namespace:         namespace,
+		Revision:          m.Revision,
+		CompactedRevision: m.CompactedRevision,
+		SnapshotHorizon:   m.SnapshotHorizon,
+		Changes:           append([]*FileMetaData(nil), m.Changes...),
+		ClientRevisions:   clientRevisions,
+		ForgottenFiles:    forgotten,
+	}
+}
+
+// Puts back a namespace's state. Every retained version is in Changes, so
+// the history and the current versions are rebuilt from it.
+func (m *MetaStore) restoreCheckpoint(checkpoint *NamespaceCheckpoint) {
+	m.Mutex.Lock()
+	defer m.Mutex.Unlock()
+	m.Revision = checkpoint.GetRevision()
+	m.CompactedRevision = checkpoint.GetCompactedRevision()
+	m.SnapshotHorizon = checkpoint.GetSnapshotHorizon()
+	for clientId, revision := range checkpoint.GetClientRevisions() {
+		m.ClientRevisions[clientId] = revision
+	}
+	for _, change := range checkpoint.GetChanges() {
+		filename := change.GetFilename()
+		m.FileMetaMap[filename] = change
+		m.FileHistory[filename] = append(m.FileHistory[filename], change)
+		m.Changes = append(m.Changes, change)
+		m.countReferences(change, 1)
+	}
+	for _, filename := range checkpoint.GetForgottenFiles() {
+		delete(m.FileMetaMap, filename)
+	}
+}
+
+// Loads the checkpoint, if there is one, and returns the sequence number
+// of the last journal record it covers
+func (m *MetaStore) loadCheckpoint(filename string) (uint64, error) {
+	file, err := os.Open(filename)
+	if os.IsNotExist(err) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+
+	// The checkpoint is renamed into place, so unlike the journal it is
+	// never partially written; a bad one means the disk is damaged
+	info, err := file.Stat()
+	if err != nil {
+		return 0, err
+	}
+	checkpoint := &MetaStoreCheckpoint{}
+	sequence, _, err := readRecord(bufio.NewReader(file), info.Size(), checkpoint)
+	if err != nil {
+		return 0, fmt.Errorf("reading %s: %v", filename, err)
+	}
+	for _, nsCheckpoint := range checkpoint.GetNamespaces() {
+		m.namespaceStore(nsCheckpoint.GetNamespace()).restoreCheckpoint(nsCheckpoint)
+	}
+	if len(checkpoint.GetBlockStoreAddrs()) > 0 {
+		m.BlockStoreAddrs = checkpoint.GetBlockStoreAddrs()
+		m.previousBlockStoreAddrs = checkpoint.GetPreviousBlockStoreAddrs()
+	}
+	for _, registration := range checkpoint.GetBlockStoreRegistry() {
+		m.blockStoreRegistry[registration.GetAddr()] = registration.GetState()
+	}
+	return sequence, nil
+}
+
+// Applies the journaled operations newer than the checkpoint. A record
+// cut short or garbled by a crash can only be the last one written, so
+// it and anything after it are truncated away.
+func (m *MetaStore) replayJournal(journal *metaJournal) error {
+	info, err := journal.file.Stat()
+	if err != nil {
+		return err
+	}
+	reader := bufio.NewReader(journal.file)
+	for {
+		op := &UpdateOperation{}
+		sequence, n, err := readRecord(reader, info.Size()-journal.size, op)
+		if err == io.EOF {
+			break
+		}
+		if err == errTornRecord {
+			log.Println(SURF_SERVER, "truncating journal after", journal.size, "bytes")
+			if err := journal.file.Truncate(journal.size); err != nil {
+				return err
+			}
+			break
+		}
+		if err != nil {
+			return err
+		}
+		journal.size += n
+		if sequence <= journal.sequence {
+			continue
+		}
+		// Only operations that succeeded were journaled
+		m.operationNamespace(op).apply(op, nil)
+		journal.sequence = sequence
+		journal.pending++
+	}
+	return nil
+}
+
+// Appends an operation and waits for it to reach the disk
+func (j *metaJournal) append(op *UpdateOperation) error {
+	if j == nil {
+		return nil
+	}
+	j.mutex.Lock()
+	defer j.mutex.Unlock()
+	record, err := encodeRecord(j.sequence+1, op)
+	if err != nil {
+		return err
+	}
+	if _, err = j.file.WriteAt(record, j.size); err == nil {
+		err = j.file.Sync()
+	}
+	if err != nil {
+		// Drop whatever part of the record made it so later records
+		// do not end up behind a torn one
+		j.file.Truncate(j.size)
+		return err
+	}
+	j.size += int64(len(record))
+	j.sequence++
+	j.pending++
+	return nil
+}
+
+func (j *metaJournal) beginApply() {
+	if j != nil {
+		j.applying.RLock()
+	}
+}
+
+func (j *metaJournal) endApply() {
+	if j != nil {
+		j.applying.RUnlock()
+	}
+}
+
+func (j *metaJournal) checkpointDue() bool {
+	if j == nil {
+		return false
+	}
+	j.mutex.Lock()
+	defer j.mutex.Unlock()
+	return j.pending >= CHECKPOINT_INTERVAL
+}
+
+func encodeRecord(sequence uint64, msg proto.Message) ([]byte, error) {
+	payload, err := proto.Marshal(msg)
+	if err != nil {
+		return nil, err
+	}
+	record := make([]byte, journalHeaderSize+len(payload))
+	binary.BigEndian.PutUint32(record[0:4], uint32(len(payload)))
+	binary.BigEndian.PutUint64(record[8:16], sequence)
+	copy(record[journalHeaderSize:], payload)
+	binary.BigEndian.PutUint32(record[4:8], crc32.Checksum(record[8:], crcTable))
+	return record, nil
+}
+
+// Returns the record's sequence number and size. io.EOF means there are
+// no more records; errTornRecord means the next one is incomplete or corrupt.
+// remaining bounds the record size so a garbled length is not allocated.
+func readRecord(reader *bufio.Reader, remaining int64, msg proto.Message) (uint64, int64, error) {
+	header := make([]byte, journalHeaderSize)
+	if n, err := io.ReadFull(reader, header); err != nil {
+		if err == io.EOF && n == 0 {
+			return 0, 0, io.EOF
+		}
+		return 0, 0, errTornRecord
+	}
+	length := int64(binary.BigEndian.Uint32(header[0:4]))
+	if length > remaining-journalHeaderSize {
+		return 0, 0, errTornRecord
+	}
+	body := make([]byte, 8+length)
+	copy(body, header[8:16])
+	if _, err := io.ReadFull(reader, body[8:]); err != nil {
+		return 0, 0, errTornRecord
+	}
+	if crc32.Checksum(body, crcTable) != binary.BigEndian.Uint32(header[4:8]) {
+		return 0, 0, errTornRecord
+	}
+	if err := proto.Unmarshal(body[8:], msg); err != nil {
+		return 0, 0, errTornRecord
+	}
+	return binary.BigEndian.Uint64(header[8:16]), int64(journalHeaderSize + len(body) - 8), nil
+}
+
+// Replaces a file so that readers see either the old or the new contents
+func writeFileAtomic(filename string, data []byte) error {
+	tmpFile, err := os.CreateTemp(filepath.Dir(filename), filepath.Base(filename)+".tmp*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmpFile.Name())
+	if _, err := tmpFile.Write(data); err != nil {
+		tmpFile.Close()
+		return err
+	}
+	if err := tmpFile.Sync(); err != nil {
+		tmpFile.Close()
+		return err
+	}
+	if err := tmpFile.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmpFile.Name(), filename); err != nil {
+		return err
+	}
+	// Make the rename itself durable
+	dir, err := os.Open(filepath.Dir(filename))
+	if err != nil {
+		return err
+	}
+	defer dir.Close()
+	return dir.Sync()
+}
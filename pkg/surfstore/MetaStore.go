@@ -3,59 +3,907 @@ package surfstore
 import (
 	context "context"
 	"errors"
+	"fmt"
+	"log"
+	"sort"
 	"sync"
+	"time"
 
+	grpc "google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
 	emptypb "google.golang.org/protobuf/types/known/emptypb"
 )
 
+// RetentionPolicy decides which superseded file versions are kept.
+// A version survives if it passes either limit; zero disables a limit,
+// and with both limits at zero every version is kept.
+type RetentionPolicy struct {
+	// Number of newest versions of each file to keep, including the current one
+	KeepVersions int
+	// How long to keep a version after it has been superseded
+	KeepFor time.Duration
+}
+
 type MetaStore struct {
-	FileMetaMap    map[string]*FileMetaData
-	BlockStoreAddr string
-	Mutex          *sync.RWMutex
+	FileMetaMap map[string]*FileMetaData
+	// Every version ever stored for each file, oldest first
+	FileHistory map[string][]*FileMetaData
+	// BlockStore servers on the consistent-hash ring that places blocks.
+	// Once serving, it only changes through SetBlockStoreAddrs and the
+	// BlockStore registry, under the lock.
+	BlockStoreAddrs []string
+	// Number of BlockStore servers each block is stored on
+	ReplicationFactor int
+	// Bytes per second a rebalance may move; zero is unlimited
+	RebalanceRate int64
+	// Which files are erasure coded instead of replicated; nil replicates everything
+	StoragePolicies *StoragePolicyConfig
+	// Bumped by every committed file update
+	Revision int64
+	// Retained versions of all files in the order they were committed
+	Changes []*FileMetaData
+	// Deleted files up to this revision have been forgotten, so changes
+	// since an older revision can no longer be replayed
+	CompactedRevision int64
+	// Pruned versions were current up to this revision, so point-in-time
+	// reads are only exact at or after it
+	SnapshotHorizon int64
+	// Latest revision each client has reported syncing to
+	ClientRevisions map[string]int64
+	Retention       RetentionPolicy
+	// Decides who may read and write which files; nil allows everyone
+	Auth *AuthConfig
+	// Secures the link to the BlockStore when collecting garbage; nil dials it in plaintext
+	TLS   *TLSConfig
+	Mutex *sync.RWMutex
+	// Number of retained versions referencing each block
+	blockRefs map[string]int
+	// Number of retained versions referencing each shard of an erasure-coded block
+	shardRefs map[string]int
+	// Outcome of the last RepairBlocks
+	repairReport *RepairReport
+	// The ring blocks are still moving away from; nil unless rebalancing
+	previousBlockStoreAddrs []string
+	// Progress of the current or last rebalance
+	rebalanceStatus *RebalanceStatus
+	// How long a registered BlockStore may go without a heartbeat before
+	// it counts as unhealthy
+	BlockStoreTimeout time.Duration
+	// BlockStores that registered themselves, and those an operator
+	// drained or decommissioned; only changes through the log
+	blockStoreRegistry map[string]BlockStoreState
+	// When each registered BlockStore last sent this server a heartbeat
+	blockStoreHeartbeats map[string]time.Time
+	startedAt            time.Time
+	// Closed and replaced whenever a change is committed
+	changed chan struct{}
+	// The MetaStore holds the default namespace itself; every other
+	// namespace gets its own MetaStore, created on first use
+	namespaces      map[string]*MetaStore
+	namespacesMutex *sync.Mutex
+	// Records every applied operation on disk; nil keeps the MetaStore in memory only
+	journal *metaJournal
 	UnimplementedMetaStoreServer
 }
 
 // Implement MetaStore Interface's methods
 func (m *MetaStore) GetFileInfoMap(ctx context.Context, _ *emptypb.Empty) (*FileInfoMap, error) {
-	if m.FileMetaMap == nil {
+	ns, err := m.namespaceFromContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+	ns.Mutex.RLock()
+	defer ns.Mutex.RUnlock()
+	if ns.FileMetaMap == nil {
 		return nil, ctx.Err()
 	}
-	return &FileInfoMap{FileInfoMap: m.FileMetaMap}, nil
+	// Copy so the map can be serialized after the lock is released
+	fileInfoMap := make(map[string]*FileMetaData, len(ns.FileMetaMap))
+	for filename, fileMetaData := range ns.FileMetaMap {
+		fileInfoMap[filename] = fileMetaData
+	}
+	return &FileInfoMap{FileInfoMap: m.Auth.filterReadable(ctx, fileInfoMap), Revision: ns.Revision}, nil
 }
 
 // Updates the FileInfo values associated with a file stored in the cloud.
 // This method replaces the hash list for the file with the provided hash list only if the new version number is exactly one greater than the current version number.
 // Otherwise, an error is sent to the client telling them that the version they are trying to store is not right (likely too old) as well as the current value of the file’s version on the server.
 func (m *MetaStore) UpdateFile(ctx context.Context, fileMetaData *FileMetaData) (*Version, error) {
-	// Get current metadata
-	var currMetadata *FileMetaData
+	namespace, err := NamespaceFromContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if !m.Auth.canWrite(ctx, fileMetaData.GetFilename()) {
+		return nil, permissionDenied(ctx, fileMetaData.GetFilename())
+	}
+	setOwner(ctx, fileMetaData)
+	return m.applyOperation(&UpdateOperation{
+		FileMetaData: fileMetaData,
+		Timestamp:    time.Now().UnixNano(),
+		Namespace:    namespace,
+	})
+}
+
+// Returns the first healthy BlockStore address, for clients that only know
+// of one.
+func (m *MetaStore) GetBlockStoreAddr(ctx context.Context, _ *emptypb.Empty) (*BlockStoreAddr, error) {
+	m.Mutex.RLock()
+	defer m.Mutex.RUnlock()
+	now := time.Now()
+	for _, addr := range m.BlockStoreAddrs {
+		if m.healthy(addr, now) {
+			return &BlockStoreAddr{Addr: addr}, nil
+		}
+	}
+	return &BlockStoreAddr{}, nil
+}
+
+// Returns every BlockStore address on the ring. Clients build the same
+// ring from them to find the server each block belongs to, and while
+// rebalancing, the previous ring to fall back to for blocks not moved yet.
+func (m *MetaStore) GetBlockStoreAddrs(ctx context.Context, _ *emptypb.Empty) (*BlockStoreAddrs, error) {
+	m.Mutex.RLock()
+	defer m.Mutex.RUnlock()
+	return &BlockStoreAddrs{
+		Addrs:             append([]string(nil), m.BlockStoreAddrs...),
+		ReplicationFactor: int32(m.ReplicationFactor),
+		PreviousAddrs:     append([]string(nil), m.previousBlockStoreAddrs...),
+		UnhealthyAddrs:    m.unhealthyBlockStores(),
+	}, nil
+}
+
+// Returns the storage policies of the namespace the caller selected.
+func (m *MetaStore) GetStoragePolicies(ctx context.Context, _ *emptypb.Empty) (*StoragePolicies, error) {
+	namespace, err := NamespaceFromContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return &StoragePolicies{Policies: m.StoragePolicies.policiesFor(namespace)}, nil
+}
+
+func (m *MetaStore) blockStoreRing() *ConsistentHashRing {
+	ring := NewConsistentHashRing(m.currentBlockStoreAddrs())
+	ring.ReplicationFactor = m.ReplicationFactor
+	return ring
+}
+
+// Returns every stored version of a file, oldest first.
+func (m *MetaStore) GetFileHistory(ctx context.Context, fileName *FileName) (*FileHistory, error) {
+	ns, err := m.namespaceFromContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if !m.Auth.canRead(ctx, fileName.GetFilename()) {
+		return nil, permissionDenied(ctx, fileName.GetFilename())
+	}
+	ns.Mutex.RLock()
+	defer ns.Mutex.RUnlock()
+	versions, ok := ns.FileHistory[fileName.GetFilename()]
+	if !ok {
+		return nil, fmt.Errorf("no history for file %s", fileName.GetFilename())
+	}
+	return &FileHistory{Versions: append([]*FileMetaData(nil), versions...)}, nil
+}
+
+// Returns the retained versions of the readable files that reference a block.
+func (m *MetaStore) GetBlockReferences(ctx context.Context, blockHash *BlockHash) (*BlockReferences, error) {
+	ns, err := m.namespaceFromContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+	ns.Mutex.RLock()
+	defer ns.Mutex.RUnlock()
+	references := make([]*FileVersion, 0)
+	if !ns.isReferenced(blockHash.GetHash()) {
+		return &BlockReferences{References: references}, nil
+	}
+	for filename, history := range ns.FileHistory {
+		if !m.Auth.canRead(ctx, filename) {
+			continue
+		}
+		for _, version := range history {
+			if referencesBlock(version, blockHash.GetHash()) {
+				references = append(references, &FileVersion{Filename: filename, Version: version.GetVersion()})
+			}
+		}
+	}
+	sort.Slice(references, func(i, j int) bool {
+		if references[i].GetFilename() != references[j].GetFilename() {
+			return references[i].GetFilename() < references[j].GetFilename()
+		}
+		return references[i].GetVersion() < references[j].GetVersion()
+	})
+	return &BlockReferences{References: references}, nil
+}
+
+// Stores a new version of the file whose block list is the one of the requested older version.
+func (m *MetaStore) RestoreFileVersion(ctx context.Context, fileVersion *FileVersion) (*Version, error) {
+	op, err := m.restoreOperation(ctx, fileVersion)
+	if err != nil {
+		return nil, err
+	}
+	return m.applyOperation(op)
+}
+
+// The restored version is worked out when the operation is applied, so
+// that it builds on whatever version is current by then
+func (m *MetaStore) restoreOperation(ctx context.Context, fileVersion *FileVersion) (*UpdateOperation, error) {
+	namespace, err := NamespaceFromContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if !m.Auth.canWrite(ctx, fileVersion.GetFilename()) {
+		return nil, permissionDenied(ctx, fileVersion.GetFilename())
+	}
+	restoreOp := &RestoreOperation{FileVersion: fileVersion}
+	if identity, ok := IdentityFromContext(ctx); ok {
+		restoreOp.Owner = identity.Name
+	}
+	return &UpdateOperation{
+		Restore:   restoreOp,
+		Timestamp: time.Now().UnixNano(),
+		Namespace: namespace,
+	}, nil
+}
+
+// Returns the current metadata of the files changed after the given
+// revision. If deleted files have been forgotten since then, the whole
+// FileInfoMap is returned instead.
+func (m *MetaStore) GetChangesSince(ctx context.Context, revision *Revision) (*FileInfoDelta, error) {
+	ns, err := m.namespaceFromContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+	ns.Mutex.RLock()
+	defer ns.Mutex.RUnlock()
+
+	delta := &FileInfoDelta{
+		Changes:  make(map[string]*FileMetaData),
+		Revision: ns.Revision,
+	}
+	if revision.GetRevision() < ns.CompactedRevision {
+		delta.Full = true
+		for filename, fileMetaData := range ns.FileMetaMap {
+			delta.Changes[filename] = fileMetaData
+		}
+	} else {
+		// Later versions of a file overwrite earlier ones
+		for _, change := range ns.changesSince(revision.GetRevision()) {
+			delta.Changes[change.GetFilename()] = change
+		}
+	}
+	delta.Changes = m.Auth.filterReadable(ctx, delta.Changes)
+	return delta, nil
+}
+
+// Returns the FileInfoMap as it was at a past revision or time. Files
+// deleted by then are reported with their tombstone.
+func (m *MetaStore) GetFileInfoMapAt(ctx context.Context, snapshotRequest *SnapshotRequest) (*FileInfoMap, error) {
+	ns, err := m.namespaceFromContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+	ns.Mutex.RLock()
+	defer ns.Mutex.RUnlock()
+
+	revision := snapshotRequest.GetRevision()
+	if revision == 0 {
+		revision = ns.revisionAt(snapshotRequest.GetTimestamp())
+	}
+	if revision > ns.Revision {
+		return nil, status.Errorf(codes.OutOfRange, "revision %d has not been committed yet", revision)
+	}
+	if revision < ns.SnapshotHorizon {
+		return nil, status.Errorf(codes.OutOfRange, "revision %d is no longer retained", revision)
+	}
+
+	fileInfoMap := make(map[string]*FileMetaData)
+	for filename, history := range ns.FileHistory {
+		// Versions are in commit order, so find the last one at or before the revision
+		i := sort.Search(len(history), func(i int) bool {
+			return history[i].GetRevision() > revision
+		})
+		if i > 0 {
+			fileInfoMap[filename] = history[i-1]
+		}
+	}
+	return &FileInfoMap{FileInfoMap: m.Auth.filterReadable(ctx, fileInfoMap), Revision: revision}, nil
+}
+
+// Returns the latest retained revision committed at or before the given
+// time. The caller must hold the lock.
+func (m *MetaStore) revisionAt(timestamp int64) int64 {
+	i := sort.Search(len(m.Changes), func(i int) bool {
+		return m.Changes[i].GetTimestamp() > timestamp
+	})
+	if i == 0 {
+		return 0
+	}
+	return m.Changes[i-1].GetRevision()
+}
+
+// Records that a client has seen every change up to the given revision.
+// Tombstones are only pruned once all known clients are past them.
+func (m *MetaStore) AckSync(ctx context.Context, syncAck *SyncAck) (*Success, error) {
+	namespace, err := NamespaceFromContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if syncAck, err = m.Auth.ownSyncAck(ctx, syncAck); err != nil {
+		return nil, err
+	}
+	if _, err := m.applyOperation(&UpdateOperation{SyncAck: syncAck, Namespace: namespace}); err != nil {
+		return nil, err
+	}
+	return &Success{Flag: true}, nil
+}
+
+// Streams every change committed after the requested revision, then keeps
+// streaming new changes as they are committed.
+func (m *MetaStore) WatchFileInfo(watchRequest *WatchRequest, stream MetaStore_WatchFileInfoServer) error {
+	return m.watchFileInfo(stream.Context(), watchRequest.GetFromRevision(), stream.Send, func() error { return nil })
+}
+
+// alive is polled while there is nothing to send so that a watch on a
+// server that stopped serving does not hang forever.
+func (m *MetaStore) watchFileInfo(ctx context.Context, fromRevision int64, send func(*FileChange) error, alive func() error) error {
+	for {
+		if err := alive(); err != nil {
+			return err
+		}
+		// Looked up again each time, since the namespace may not exist
+		// until something is stored in it
+		ns, err := m.namespaceFromContext(ctx)
+		if err != nil {
+			return err
+		}
+
+		ns.Mutex.RLock()
+		if fromRevision < ns.CompactedRevision {
+			ns.Mutex.RUnlock()
+			return status.Errorf(codes.OutOfRange, "revision %d has been compacted", fromRevision)
+		}
+		changes := ns.changesSince(fromRevision)
+		changed := ns.changed
+		ns.Mutex.RUnlock()
+
+		for _, change := range changes {
+			fromRevision = change.GetRevision()
+			if !m.Auth.canRead(ctx, change.GetFilename()) {
+				continue
+			}
+			if err := send(&FileChange{FileMetaData: change, Revision: change.GetRevision()}); err != nil {
+				return err
+			}
+		}
+
+		select {
+		case <-changed:
+		case <-time.After(WATCH_POLL_INTERVAL):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// Applies one mutation to the MetaStore. Standalone calls and committed
+// Raft log entries both go through here so that replicas stay identical.
+func (m *MetaStore) applyOperation(op *UpdateOperation) (*Version, error) {
+	if op.GetBarrier() {
+		return &Version{}, nil
+	}
+	m.journal.beginApply()
+	version, err := m.operationNamespace(op).apply(op, m.journal)
+	m.journal.endApply()
+
+	if m.journal.checkpointDue() {
+		if err := m.Checkpoint(); err != nil {
+			log.Println(SURF_SERVER, "checkpoint failed:", err)
+		}
+	}
+	return version, err
+}
+
+// Returns the MetaStore holding the namespace an RPC selected
+func (m *MetaStore) namespaceFromContext(ctx context.Context) (*MetaStore, error) {
+	namespace, err := NamespaceFromContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return m.lookupNamespace(namespace), nil
+}
+
+// Returns the MetaStore of a namespace, or an empty one standing in for
+// it if nothing has been stored in the namespace yet, so that reading a
+// namespace does not create it.
+func (m *MetaStore) lookupNamespace(namespace string) *MetaStore {
+	if namespace == DEFAULT_NAMESPACE {
+		return m
+	}
+	m.namespacesMutex.Lock()
+	ns, ok := m.namespaces[namespace]
+	m.namespacesMutex.Unlock()
+	if !ok {
+		ns = NewMetaStore(m.currentBlockStoreAddrs()...)
+	}
+	return ns
+}
+
+// Only storing a file creates a namespace. Other operations on a namespace
+// nothing has been stored in apply to an empty stand-in, which keeps them
+// deterministic for every replica and the journal.
+func (m *MetaStore) operationNamespace(op *UpdateOperation) *MetaStore {
+	if op.GetFileMetaData() != nil {
+		return m.namespaceStore(op.GetNamespace())
+	}
+	return m.lookupNamespace(op.GetNamespace())
+}
+
+// Returns the MetaStore of a namespace, creating it if need be
+func (m *MetaStore) namespaceStore(namespace string) *MetaStore {
+	if namespace == DEFAULT_NAMESPACE {
+		return m
+	}
+	m.namespacesMutex.Lock()
+	defer m.namespacesMutex.Unlock()
+	ns, ok := m.namespaces[namespace]
+	if !ok {
+		ns = NewMetaStore(m.currentBlockStoreAddrs()...)
+		m.namespaces[namespace] = ns
+	}
+	return ns
+}
+
+// Returns the default namespace followed by every other one in use,
+// keyed by name
+func (m *MetaStore) allNamespaces() map[string]*MetaStore {
+	m.namespacesMutex.Lock()
+	defer m.namespacesMutex.Unlock()
+	all := map[string]*MetaStore{DEFAULT_NAMESPACE: m}
+	for namespace, ns := range m.namespaces {
+		all[namespace] = ns
+	}
+	return all
+}
+
+// Operations are journaled (if the MetaStore is durable) once they are
+// known to succeed, so replaying the journal applies exactly the same ones.
+// The journal is written, and synced, with the namespace locked: checking
+// the next operation needs this one applied, and applying it before it is
+// on disk would let readers see a change a crash could still undo. Files
+// in other namespaces stay readable meanwhile, and the journal's own mutex
+// keeps its records in the order they were applied.
+func (m *MetaStore) apply(op *UpdateOperation, journal *metaJournal) (*Version, error) {
+	m.Mutex.Lock()
+	defer m.Mutex.Unlock()
+	if err := m.checkOperation(op); err != nil {
+		return nil, err
+	}
+	if err := journal.append(op); err != nil {
+		return nil, err
+	}
+	switch {
+	case op.GetFileMetaData() != nil:
+		return m.updateFile(op.GetFileMetaData(), op.GetTimestamp()), nil
+	case op.GetRestore() != nil:
+		restored, _ := m.restoredFileMetaData(op.GetRestore().GetFileVersion())
+		restored.Owner = op.GetRestore().GetOwner()
+		return m.updateFile(restored, op.GetTimestamp()), nil
+	case op.GetSyncAck() != nil:
+		m.ackSync(op.GetSyncAck())
+	case op.GetPrune() != nil:
+		m.prune(op.GetPrune())
+	case op.GetBlockStoreChange() != nil:
+		m.changeBlockStores(op.GetBlockStoreChange(), op.GetTimestamp())
+	case op.GetRegistration() != nil:
+		m.changeRegistry(op.GetRegistration(), op.GetTimestamp())
+	}
+	return &Version{}, nil
+}
+
+// The caller must hold the lock.
+func (m *MetaStore) checkOperation(op *UpdateOperation) error {
+	switch {
+	case op.GetFileMetaData() != nil:
+		// Get current metadata and check version
+		fileMetaData := op.GetFileMetaData()
+		if currMetadata, ok := m.FileMetaMap[fileMetaData.GetFilename()]; ok &&
+			fileMetaData.GetVersion()-currMetadata.GetVersion() != 1 {
+			return errors.New("incorrect version")
+		}
+		return checkStripes(fileMetaData)
+	case op.GetRestore() != nil:
+		_, err := m.restoredFileMetaData(op.GetRestore().GetFileVersion())
+		return err
+	case op.GetSyncAck() != nil, op.GetPrune() != nil:
+		return nil
+	case op.GetBlockStoreChange() != nil:
+		return m.checkBlockStoreChange(op.GetBlockStoreChange())
+	case op.GetRegistration() != nil:
+		return m.checkRegistration(op.GetRegistration())
+	}
+	return errors.New("empty operation")
+}
+
+// The caller must hold the lock and have checked the version.
+func (m *MetaStore) updateFile(fileMetaData *FileMetaData, timestamp int64) *Version {
 	filename := fileMetaData.GetFilename()
-	if metadata, ok := m.FileMetaMap[filename]; ok {
-		currMetadata = metadata
-		// Check version
-		if fileMetaData.GetVersion()-currMetadata.GetVersion() == 1 {
-			m.FileMetaMap[filename] = fileMetaData
-			return &Version{Version: fileMetaData.GetVersion()}, nil
+	if m.forgotten(filename) && fileMetaData.GetVersion() <= lastVersion(m.FileHistory[filename]).GetVersion() {
+		// A new file under the name of a forgotten one starts a new history,
+		// unlike a restore, which carries on with the old one
+		m.prune(&PruneOperation{Versions: fileVersions(filename, m.FileHistory[filename])})
+	}
+	m.Revision++
+	committed := proto.Clone(fileMetaData).(*FileMetaData)
+	committed.Revision = m.Revision
+	committed.Timestamp = timestamp
+	inheritStripes(committed, m.FileMetaMap[filename])
+	m.FileMetaMap[filename] = committed
+	m.FileHistory[filename] = append(m.FileHistory[filename], committed)
+	m.Changes = append(m.Changes, committed)
+	m.countReferences(committed, 1)
+	close(m.changed)
+	m.changed = make(chan struct{})
+	return &Version{Version: committed.GetVersion()}
+}
+
+// The caller must hold the lock.
+func (m *MetaStore) ackSync(syncAck *SyncAck) {
+	if syncAck.GetRevision() > m.ClientRevisions[syncAck.GetClientId()] {
+		m.ClientRevisions[syncAck.GetClientId()] = syncAck.GetRevision()
+	}
+}
+
+// Drops the listed versions. Dropping a file's latest version, which is
+// always a tombstone, forgets the deleted file: it leaves the FileInfoMap,
+// while its older versions stay in the history for as long as they are
+// retained. A forgotten file whose tombstone is all that is left goes
+// altogether. The caller must hold the lock.
+func (m *MetaStore) prune(pruneOp *PruneOperation) {
+	pruned := make(map[*FileMetaData]bool)
+	for _, fileVersion := range pruneOp.GetVersions() {
+		filename := fileVersion.GetFilename()
+		history := m.FileHistory[filename]
+		if len(history) == 0 {
+			continue
+		}
+		if latest := lastVersion(history); latest.GetVersion() == fileVersion.GetVersion() {
+			if !isTombstone(latest) {
+				continue
+			}
+			if latest.GetRevision() > m.CompactedRevision {
+				m.CompactedRevision = latest.GetRevision()
+			}
+			delete(m.FileMetaMap, filename)
 		} else {
-			return nil, errors.New("incorrect version")
+			for i, old := range history {
+				if old.GetVersion() == fileVersion.GetVersion() {
+					pruned[old] = true
+					if supersededAt := history[i+1].GetRevision(); supersededAt > m.SnapshotHorizon {
+						m.SnapshotHorizon = supersededAt
+					}
+					m.FileHistory[filename] = append(history[:i:i], history[i+1:]...)
+					break
+				}
+			}
+		}
+
+		if history := m.FileHistory[filename]; len(history) == 1 && m.forgotten(filename) {
+			pruned[history[0]] = true
+			if history[0].GetRevision() > m.SnapshotHorizon {
+				m.SnapshotHorizon = history[0].GetRevision()
+			}
+			delete(m.FileHistory, filename)
 		}
-	} else {
-		m.FileMetaMap[filename] = fileMetaData
-		return &Version{Version: fileMetaData.GetVersion()}, nil
 	}
+
+	if len(pruned) == 0 {
+		return
+	}
+	for old := range pruned {
+		m.countReferences(old, -1)
+	}
+	changes := make([]*FileMetaData, 0, len(m.Changes)-len(pruned))
+	for _, change := range m.Changes {
+		if !pruned[change] {
+			changes = append(changes, change)
+		}
+	}
+	m.Changes = changes
 }
 
-// Returns the BlockStore address.
-func (m *MetaStore) GetBlockStoreAddr(ctx context.Context, _ *emptypb.Empty) (*BlockStoreAddr, error) {
-	return &BlockStoreAddr{Addr: m.BlockStoreAddr}, nil
+// Adds delta to the reference count of each block of a version, counting
+// the shards of erasure-coded blocks instead of the blocks themselves,
+// which are not stored anywhere. The caller must hold the lock.
+func (m *MetaStore) countReferences(fileMetaData *FileMetaData, delta int) {
+	if isTombstone(fileMetaData) {
+		return
+	}
+	striped := make(map[string]bool)
+	for _, stripe := range fileMetaData.GetErasureStripes() {
+		striped[stripe.GetBlockHash()] = true
+		for _, hash := range stripe.GetShardHashes() {
+			addReference(m.shardRefs, hash, delta)
+		}
+	}
+	for _, hash := range fileMetaData.GetBlockHashList() {
+		if !striped[hash] {
+			addReference(m.blockRefs, hash, delta)
+		}
+	}
+}
+
+func addReference(refs map[string]int, hash string, delta int) {
+	refs[hash] += delta
+	if refs[hash] <= 0 {
+		delete(refs, hash)
+	}
+}
+
+// Reports whether a stored block or shard is referenced. The caller must
+// hold the lock.
+func (m *MetaStore) isReferenced(hash string) bool {
+	return m.blockRefs[hash] > 0 || m.shardRefs[hash] > 0
+}
+
+// Reports whether a version uses a block, or a shard of one of its blocks
+func referencesBlock(fileMetaData *FileMetaData, hash string) bool {
+	for _, blockHash := range fileMetaData.GetBlockHashList() {
+		if blockHash == hash {
+			return true
+		}
+	}
+	for _, stripe := range fileMetaData.GetErasureStripes() {
+		for _, shardHash := range stripe.GetShardHashes() {
+			if shardHash == hash {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// A version that keeps blocks of the previous one without saying how they
+// are stored, like an attribute-only change, keeps their stripes too
+func inheritStripes(fileMetaData *FileMetaData, previous *FileMetaData) {
+	striped := make(map[string]bool)
+	for _, stripe := range fileMetaData.GetErasureStripes() {
+		striped[stripe.GetBlockHash()] = true
+	}
+	blocks := make(map[string]bool)
+	for _, hash := range fileMetaData.GetBlockHashList() {
+		blocks[hash] = true
+	}
+	for _, stripe := range previous.GetErasureStripes() {
+		if blocks[stripe.GetBlockHash()] && !striped[stripe.GetBlockHash()] {
+			fileMetaData.ErasureStripes = append(fileMetaData.ErasureStripes, stripe)
+			striped[stripe.GetBlockHash()] = true
+		}
+	}
+}
+
+// Deletes the blocks that no retained version of any file references
+// from every BlockStore, and returns how many it deleted. Blocks are
+// listed before they are checked against the reference counts, so a block
+// uploaded after that is never seen; and the BlockStore keeps the blocks
+// stored or asked about within its grace period, which covers uploads
+// whose file has not been committed yet.
+func (m *MetaStore) CollectGarbage() (int, error) {
+	deleted := 0
+	for _, addr := range m.currentBlockStoreAddrs() {
+		n, err := m.collectGarbageAt(addr)
+		deleted += n
+		if err != nil {
+			return deleted, err
+		}
+	}
+	return deleted, nil
+}
+
+func (m *MetaStore) collectGarbageAt(blockStoreAddr string) (int, error) {
+	conn, err := grpc.Dial(blockStoreAddr, m.TLS.DialOption())
+	if err != nil {
+		return 0, err
+	}
+	defer conn.Close()
+	c := NewBlockStoreClient(conn)
+
+	deleted := 0
+	for namespace, ns := range m.allNamespaces() {
+		ctx, cancel := context.WithTimeout(context.Background(), GC_RPC_TIMEOUT)
+		ctx = WithToken(WithNamespace(ctx, namespace), m.Auth.ServerToken())
+		stored, err := c.ListBlocks(ctx, &emptypb.Empty{})
+		if err != nil {
+			cancel()
+			return deleted, err
+		}
+		unreferenced := make([]string, 0)
+		ns.Mutex.RLock()
+		for _, hash := range stored.GetHashes() {
+			if !ns.isReferenced(hash) {
+				unreferenced = append(unreferenced, hash)
+			}
+		}
+		ns.Mutex.RUnlock()
+		if len(unreferenced) > 0 {
+			var result *BlockHashes
+			result, err = c.DeleteBlocks(ctx, &BlockHashes{Hashes: unreferenced})
+			deleted += len(result.GetHashes())
+		}
+		cancel()
+		if err != nil {
+			return deleted, err
+		}
+	}
+	return deleted, nil
+}
+
+// Periodically collects the blocks of the standalone MetaStore.
+func (m *MetaStore) GCLoop(interval time.Duration) {
+	for range time.Tick(interval) {
+		deleted, err := m.CollectGarbage()
+		log.Println(SURF_SERVER, "collected", deleted, "unreferenced blocks", err)
+	}
+}
+
+// Returns the retained versions committed after the given revision, in
+// commit order. The caller must hold the lock.
+func (m *MetaStore) changesSince(revision int64) []*FileMetaData {
+	first := sort.Search(len(m.Changes), func(i int) bool {
+		return m.Changes[i].GetRevision() > revision
+	})
+	return append([]*FileMetaData(nil), m.Changes[first:]...)
+}
+
+// Returns one prune operation for each namespace with something to prune
+func (m *MetaStore) pruneOperations(now time.Time) []*UpdateOperation {
+	var ops []*UpdateOperation
+	for namespace, ns := range m.allNamespaces() {
+		pruneOp := ns.prunableVersions(now, m.Retention)
+		if len(pruneOp.Versions) > 0 {
+			ops = append(ops, &UpdateOperation{Prune: pruneOp, Namespace: namespace})
+		}
+	}
+	return ops
+}
+
+// Lists the versions the retention policy no longer needs, plus the
+// tombstones every known client has synced past. Tombstones are forgotten
+// whatever the retention policy, which only decides how long the versions
+// before them stay in the history.
+func (m *MetaStore) prunableVersions(now time.Time, retention RetentionPolicy) *PruneOperation {
+	m.Mutex.RLock()
+	defer m.Mutex.RUnlock()
+
+	pruneOp := &PruneOperation{}
+	keepAll := retention.KeepVersions <= 0 && retention.KeepFor <= 0
+
+	for filename, history := range m.FileHistory {
+		for i, old := range history[:len(history)-1] {
+			// A version is superseded when the next one is committed
+			supersededAt := time.Unix(0, history[i+1].GetTimestamp())
+			newer := len(history) - 1 - i
+			if keepAll || (retention.KeepVersions > 0 && newer < retention.KeepVersions) ||
+				(retention.KeepFor > 0 && now.Sub(supersededAt) < retention.KeepFor) {
+				continue
+			}
+			pruneOp.Versions = append(pruneOp.Versions, &FileVersion{Filename: filename, Version: old.GetVersion()})
+		}
+
+		latest := lastVersion(history)
+		if isTombstone(latest) && !m.forgotten(filename) && m.allClientsSyncedPast(latest.GetRevision()) {
+			pruneOp.Versions = append(pruneOp.Versions, &FileVersion{Filename: filename, Version: latest.GetVersion()})
+		}
+	}
+	return pruneOp
+}
+
+// Reports whether a file has history but has dropped out of the
+// FileInfoMap. The caller must hold the lock.
+func (m *MetaStore) forgotten(filename string) bool {
+	_, ok := m.FileMetaMap[filename]
+	return !ok && len(m.FileHistory[filename]) > 0
+}
+
+func lastVersion(history []*FileMetaData) *FileMetaData {
+	if len(history) == 0 {
+		return nil
+	}
+	return history[len(history)-1]
+}
+
+func fileVersions(filename string, history []*FileMetaData) []*FileVersion {
+	versions := make([]*FileVersion, 0, len(history))
+	for _, version := range history {
+		versions = append(versions, &FileVersion{Filename: filename, Version: version.GetVersion()})
+	}
+	return versions
+}
+
+// The caller must hold the lock.
+func (m *MetaStore) allClientsSyncedPast(revision int64) bool {
+	for _, clientRevision := range m.ClientRevisions {
+		if clientRevision < revision {
+			return false
+		}
+	}
+	return true
+}
+
+// Prunes whatever the retention policy allows as of now.
+// Raft servers must not call this and prune through the log instead.
+func (m *MetaStore) ApplyRetention(now time.Time) {
+	for _, op := range m.pruneOperations(now) {
+		m.applyOperation(op)
+	}
+}
+
+// Periodically prunes the standalone MetaStore.
+func (m *MetaStore) PruneLoop(interval time.Duration) {
+	for range time.Tick(interval) {
+		m.ApplyRetention(time.Now())
+	}
+}
+
+// Builds the metadata for restoring an older version on top of the
+// latest one, which for a forgotten file is its tombstone. The caller
+// must hold the lock.
+func (m *MetaStore) restoredFileMetaData(fileVersion *FileVersion) (*FileMetaData, error) {
+	filename := fileVersion.GetFilename()
+	current := lastVersion(m.FileHistory[filename])
+	if current == nil {
+		return nil, fmt.Errorf("no history for file %s", filename)
+	}
+	for _, old := range m.FileHistory[filename] {
+		if old.GetVersion() == fileVersion.GetVersion() {
+			return &FileMetaData{
+				Filename:       filename,
+				Version:        current.GetVersion() + 1,
+				BlockHashList:  old.GetBlockHashList(),
+				Mode:           old.GetMode(),
+				Mtime:          old.GetMtime(),
+				Size:           old.GetSize(),
+				SymlinkTarget:  old.GetSymlinkTarget(),
+				ErasureStripes: old.GetErasureStripes(),
+			}, nil
+		}
+	}
+	return nil, fmt.Errorf("version %d of file %s not found", fileVersion.GetVersion(), filename)
+}
+
+func isTombstone(fileMetaData *FileMetaData) bool {
+	hashList := fileMetaData.GetBlockHashList()
+	return len(hashList) == 1 && hashList[0] == TOMBSTONE_HASH
 }
 
 // This line guarantees all method for MetaStore are implemented
 var _ MetaStoreInterface = new(MetaStore)
 
-func NewMetaStore(blockStoreAddr string) *MetaStore {
+// Returns a MetaStore kept in memory only. A durable one, which loads the
+// state left in its data directory, comes from OpenMetaStore instead:
+// loading can fail, and the namespaces inside a durable MetaStore are
+// themselves made with NewMetaStore and journaled by their parent.
+func NewMetaStore(blockStoreAddrs ...string) *MetaStore {
 	return &MetaStore{
-		FileMetaMap:    map[string]*FileMetaData{},
-		BlockStoreAddr: blockStoreAddr,
+		FileMetaMap:       map[string]*FileMetaData{},
+		FileHistory:       map[string][]*FileMetaData{},
+		BlockStoreAddrs:   blockStoreAddrs,
+		ReplicationFactor: 1,
+		repairReport:      &RepairReport{},
+		rebalanceStatus:   &RebalanceStatus{},
+		BlockStoreTimeout: BLOCKSTORE_TIMEOUT,
+		ClientRevisions:   map[string]int64{},
+		Mutex:             &sync.RWMutex{},
+		blockRefs:         map[string]int{},
+		shardRefs:         map[string]int{},
+		changed:           make(chan struct{}),
+		namespaces:        map[string]*MetaStore{},
+		namespacesMutex:   &sync.Mutex{},
+
+		blockStoreRegistry:   map[string]BlockStoreState{},
+		blockStoreHeartbeats: map[string]time.Time{},
+		startedAt:            time.Now(),
 	}
 }
@@ -0,0 +1,64 @@
+package surfstore
+
+import (
+	context "context"
+	"regexp"
+	"strings"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+var namespacePattern = regexp.MustCompile(`^[A-Za-z0-9_-]{1,64}$`)
+
+// Returns the namespace an incoming RPC selected through its metadata,
+// or the default namespace if it did not select one
+func NamespaceFromContext(ctx context.Context) (string, error) {
+	md, ok := metadata.FromIncomingContext(ctx)
+	if !ok {
+		return DEFAULT_NAMESPACE, nil
+	}
+	values := md.Get(NAMESPACE_METADATA_KEY)
+	switch len(values) {
+	case 0:
+		return DEFAULT_NAMESPACE, nil
+	case 1:
+		return values[0], ValidateNamespace(values[0])
+	}
+	return "", status.Errorf(codes.InvalidArgument, "more than one namespace selected")
+}
+
+// Namespace names are limited to letters, digits, '-' and '_' so that
+// they can be used as a prefix of block keys
+func ValidateNamespace(namespace string) error {
+	if namespace == DEFAULT_NAMESPACE || namespacePattern.MatchString(namespace) {
+		return nil
+	}
+	return status.Errorf(codes.InvalidArgument, "invalid namespace %q", namespace)
+}
+
+// Selects the namespace for an outgoing RPC
+func WithNamespace(ctx context.Context, namespace string) context.Context {
+	if namespace == DEFAULT_NAMESPACE {
+		return ctx
+	}
+	return metadata.AppendToOutgoingContext(ctx, NAMESPACE_METADATA_KEY, namespace)
+}
+
+// Blocks are stored under their namespace, so a hash only finds the
+// blocks stored through the same namespace
+func blockKey(namespace string, hash string) string {
+	if namespace == DEFAULT_NAMESPACE {
+		return hash
+	}
+	return namespace + "/" + hash
+}
+
+// Reverses blockKey
+func splitBlockKey(key string) (string, string) {
+	if i := strings.LastIndex(key, "/"); i >= 0 {
+		return key[:i], key[i+1:]
+	}
+	return DEFAULT_NAMESPACE, key
+}
@@ -0,0 +1,463 @@
+package surfstore
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Every pack record starts with the length of its data, a CRC-32C of the
+// rest of the record, the length of its key and its kind, followed by the
+// key and then the data
+const packHeaderSize = 12
+
+const (
+	packRecordBlock   byte = 1
+	packRecordDeleted byte = 2
+)
+
+// PackBlockStorage appends blocks to large pack files instead of writing
+// one file per block, and keeps an index from each block to where it is
+// stored. Deleting a block appends a record saying so; Repack reclaims the
+// space by rewriting the live blocks of mostly-dead packs.
+//
+// The packs describe themselves, so the index is rebuilt by scanning them
+// when the storage is opened. A later record for a block wins over an
+// earlier one.
+type PackBlockStorage struct {
+	// Size at which a new pack is started
+	SegmentBytes int64
+
+	root  string
+	mutex sync.RWMutex
+	packs map[int]*packFile
+	// Number of the pack new records are appended to
+	current int
+	index   map[string]packLocation
+}
+
+type packFile struct {
+	file *os.File
+	// Bytes of complete records
+	size int64
+	// Bytes of records that no longer hold a live block
+	deadBytes int64
+}
+
+type packLocation struct {
+	pack int
+	// Of the record's header
+	offset int64
+	keyLen int
+	length int
+}
+
+func (loc packLocation) recordSize() int64 {
+	return int64(packHeaderSize + loc.keyLen + loc.length)
+}
+
+func NewPackBlockStorage(root string) (*PackBlockStorage, error) {
+	if err := os.MkdirAll(root, 0700); err != nil {
+		return nil, err
+	}
+	s := &PackBlockStorage{
+		SegmentBytes: PACK_SEGMENT_BYTES,
+		root:         root,
+		packs:        map[int]*packFile{},
+		index:        map[string]packLocation{},
+	}
+
+	names, err := filepath.Glob(filepath.Join(root, "pack-*.pack"))
+	if err != nil {
+		return nil, err
+	}
+	numbers := make([]int, 0, len(names))
+	for _, name := range names {
+		var n int
+		if _, err := fmt.Sscanf(filepath.Base(name), "pack-%d.pack", &n); err == nil {
+			numbers = append(numbers, n)
+		}
+	}
+	sort.Ints(numbers)
+	for i, n := range numbers {
+		if err := s.loadPack(n, i == len(numbers)-1); err != nil {
+			s.Close()
+			return nil, err
+		}
+	}
+	if len(numbers) == 0 {
+		if err := s.startPack(1); err != nil {
+			return nil, err
+		}
+	}
+	return s, nil
+}
+
+func (s *PackBlockStorage) Get(namespace string, hash string) (*Block, error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	loc, ok := s.index[blockKey(namespace, hash)]
+	if !ok {
+		return nil, nil
+	}
+	data := make([]byte, loc.length)
+	if _, err := s.packs[loc.pack].file.ReadAt(data, loc.offset+int64(packHeaderSize+loc.keyLen)); err != nil {
+		return nil, err
+	}
+	return &Block{BlockData: data, BlockSize: int32(len(data))}, nil
+}
+
+func (s *PackBlockStorage) Put(namespace string, hash string, block *Block) error {
+	key := blockKey(namespace, hash)
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if _, ok := s.index[key]; ok {
+		return nil
+	}
+	loc, err := s.appendRecord(packRecordBlock, key, block.GetBlockData())
+	if err != nil {
+		return err
+	}
+	s.index[key] = loc
+	return nil
+}
+
+func (s *PackBlockStorage) Has(namespace string, hash string) (bool, error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	_, ok := s.index[blockKey(namespace, hash)]
+	return ok, nil
+}
+
+func (s *PackBlockStorage) Delete(namespace string, hash string) error {
+	key := blockKey(namespace, hash)
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	loc, ok := s.index[key]
+	if !ok {
+		return nil
+	}
+	tombstone, err := s.appendRecord(packRecordDeleted, key, nil)
+	if err != nil {
+		return err
+	}
+	delete(s.index, key)
+	s.packs[loc.pack].deadBytes += loc.recordSize()
+	s.packs[tombstone.pack].deadBytes += tombstone.recordSize()
+	return nil
+}
+
+// The lock is not held while visiting, so visit may use the storage
+func (s *PackBlockStorage) Walk(visit func(namespace string, hash string) error) error {
+	s.mutex.RLock()
+	keys := make([]string, 0, len(s.index))
+	for key := range s.index {
+		keys = append(keys, key)
+	}
+	s.mutex.RUnlock()
+	for _, key := range keys {
+		if err := visit(splitBlockKey(key)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Rewrites the live blocks of every pack that is at least half dead into
+// the current pack, then removes the old pack
+func (s *PackBlockStorage) Repack() error {
+	s.mutex.RLock()
+	numbers := s.packNumbers()
+	s.mutex.RUnlock()
+
+	for _, n := range numbers {
+		s.mutex.Lock()
+		err := s.repackPack(n)
+		s.mutex.Unlock()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Periodically repacks the storage.
+func (s *PackBlockStorage) RepackLoop(interval time.Duration) {
+	for range time.Tick(interval) {
+		if err := s.Repack(); err != nil {
+			log.Println(SURF_SERVER, "repack failed:", err)
+		}
+	}
+}
+
+func (s *PackBlockStorage) Close() error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	var err error
+	for _, pack := range s.packs {
+		if closeErr := pack.file.Close(); closeErr != nil {
+			err = closeErr
+		}
+	}
+	return err
+}
+
+// The caller must hold the lock.
+func (s *PackBlockStorage) repackPack(n int) error {
+	pack, ok := s.packs[n]
+	if !ok || n == s.current || pack.deadBytes*2 < pack.size {
+		return nil
+	}
+	// A deletion has to be carried over while an older pack may still
+	// hold the block it deleted
+	keepTombstones := false
+	for other := range s.packs {
+		if other < n {
+			keepTombstones = true
+		}
+	}
+
+	var appendErr error
+	_, err := scanPack(pack.file, pack.size, func(kind byte, key string, loc packLocation, data []byte) {
+		if appendErr != nil {
+			return
+		}
+		loc.pack = n
+		_, live := s.index[key]
+		switch {
+		case kind == packRecordBlock && s.index[key] == loc:
+			var moved packLocation
+			if moved, appendErr = s.appendRecord(packRecordBlock, key, data); appendErr == nil {
+				s.index[key] = moved
+			}
+		case kind == packRecordDeleted && keepTombstones && !live:
+			var tombstone packLocation
+			if tombstone, appendErr = s.appendRecord(packRecordDeleted, key, nil); appendErr == nil {
+				s.packs[tombstone.pack].deadBytes += tombstone.recordSize()
+			}
+		}
+	}, func(offset int64, length int64) {
+		// Already quarantined when the pack was loaded
+	})
+	if err == nil {
+		err = appendErr
+	}
+	if err != nil {
+		return err
+	}
+
+	// Every record copied above is synced, so the old pack can go
+	pack.file.Close()
+	delete(s.packs, n)
+	return os.Remove(s.packPath(n))
+}
+
+// Appends a record to the current pack, starting a new pack if it is
+// full, and waits for it to reach the disk. The caller must hold the lock.
+func (s *PackBlockStorage) appendRecord(kind byte, key string, data []byte) (packLocation, error) {
+	if s.packs[s.current].size >= s.SegmentBytes {
+		if err := s.startPack(s.current + 1); err != nil {
+			return packLocation{}, err
+		}
+	}
+	pack := s.packs[s.current]
+
+	record := make([]byte, packHeaderSize+len(key)+len(data))
+	binary.BigEndian.PutUint32(record[0:4], uint32(len(data)))
+	binary.BigEndian.PutUint16(record[8:10], uint16(len(key)))
+	record[10] = kind
+	copy(record[packHeaderSize:], key)
+	copy(record[packHeaderSize+len(key):], data)
+	binary.BigEndian.PutUint32(record[4:8], packChecksum(record))
+
+	_, err := pack.file.WriteAt(record, pack.size)
+	if err == nil {
+		err = pack.file.Sync()
+	}
+	if err != nil {
+		// Drop whatever part of the record made it so later records
+		// do not end up behind a torn one
+		pack.file.Truncate(pack.size)
+		return packLocation{}, err
+	}
+	loc := packLocation{pack: s.current, offset: pack.size, keyLen: len(key), length: len(data)}
+	pack.size += int64(len(record))
+	return loc, nil
+}
+
+// The caller must hold the lock.
+func (s *PackBlockStorage) startPack(n int) error {
+	file, err := os.OpenFile(s.packPath(n), os.O_RDWR|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+	s.packs[n] = &packFile{file: file}
+	s.current = n
+	return nil
+}
+
+// Adds a pack's records to the index. A record cut short by a crash can
+// only be at the end of the last pack, so there it is truncated away.
+// Anything else that is not an intact record is corruption: it is copied
+// to the quarantine directory under the packs and skipped, so the blocks
+// after it stay readable, and counts as dead space for Repack.
+func (s *PackBlockStorage) loadPack(n int, last bool) error {
+	file, err := os.OpenFile(s.packPath(n), os.O_RDWR, 0600)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	pack := &packFile{file: file}
+	s.packs[n] = pack
+	s.current = n
+
+	visit := func(kind byte, key string, loc packLocation, data []byte) {
+		loc.pack = n
+		if old, ok := s.index[key]; ok {
+			s.packs[old.pack].deadBytes += old.recordSize()
+			delete(s.index, key)
+		}
+		if kind == packRecordBlock {
+			s.index[key] = loc
+		} else {
+			pack.deadBytes += loc.recordSize()
+		}
+	}
+	corrupt := func(offset int64, length int64) {
+		s.quarantine(n, file, offset, length)
+		pack.deadBytes += length
+	}
+	size, err := scanPack(file, info.Size(), visit, corrupt)
+	if err != nil {
+		return err
+	}
+	if size < info.Size() {
+		if last {
+			log.Println(SURF_SERVER, "truncating", s.packPath(n), "after", size, "bytes")
+			if err := file.Truncate(size); err != nil {
+				return err
+			}
+		} else {
+			corrupt(size, info.Size()-size)
+			size = info.Size()
+		}
+	}
+	pack.size = size
+	return nil
+}
+
+// Saves length bytes of a pack that are not an intact record
+func (s *PackBlockStorage) quarantine(n int, file *os.File, offset int64, length int64) {
+	log.Println(SURF_SERVER, "skipping", length, "corrupt bytes of", s.packPath(n), "at", offset)
+	data := make([]byte, length)
+	_, err := file.ReadAt(data, offset)
+	if err == nil {
+		err = os.MkdirAll(filepath.Join(s.root, QUARANTINE_DIRNAME), 0700)
+	}
+	if err == nil {
+		name := filepath.Join(s.root, QUARANTINE_DIRNAME, fmt.Sprintf("pack-%08d-%d", n, offset))
+		err = os.WriteFile(name, data, 0600)
+	}
+	if err != nil {
+		log.Println(SURF_SERVER, "could not save corrupt pack bytes:", err)
+	}
+}
+
+func (s *PackBlockStorage) packPath(n int) string {
+	return filepath.Join(s.root, fmt.Sprintf("pack-%08d.pack", n))
+}
+
+// The caller must hold the lock.
+func (s *PackBlockStorage) packNumbers() []int {
+	numbers := make([]int, 0, len(s.packs))
+	for n := range s.packs {
+		numbers = append(numbers, n)
+	}
+	sort.Ints(numbers)
+	return numbers
+}
+
+// Calls visit with each intact record of the first size bytes of a pack.
+// Where something else is found, the scan carries on from the next intact
+// record, calling corrupt with the bytes skipped. Returns where the last
+// intact record ends; anything after it is torn or corrupt.
+func scanPack(file *os.File, size int64, visit func(kind byte, key string, loc packLocation, data []byte), corrupt func(offset int64, length int64)) (int64, error) {
+	reader := bufio.NewReader(io.NewSectionReader(file, 0, size))
+	var offset int64
+	header := make([]byte, packHeaderSize)
+	for {
+		if _, err := io.ReadFull(reader, header); err != nil {
+			return offset, nil
+		}
+		length := int64(binary.BigEndian.Uint32(header[0:4]))
+		keyLen := int64(binary.BigEndian.Uint16(header[8:10]))
+		var record []byte
+		if offset+packHeaderSize+keyLen+length <= size {
+			record = make([]byte, packHeaderSize+keyLen+length)
+			copy(record, header)
+			if _, err := io.ReadFull(reader, record[packHeaderSize:]); err != nil {
+				return offset, err
+			}
+		}
+		if record == nil || !intactRecord(record) {
+			next, err := nextRecord(file, offset+1, size)
+			if err != nil || next < 0 {
+				return offset, err
+			}
+			corrupt(offset, next-offset)
+			offset = next
+			reader.Reset(io.NewSectionReader(file, offset, size-offset))
+			continue
+		}
+		key := string(record[packHeaderSize : packHeaderSize+keyLen])
+		visit(record[10], key, packLocation{offset: offset, keyLen: int(keyLen), length: int(length)}, record[packHeaderSize+keyLen:])
+		offset += int64(len(record))
+	}
+}
+
+func intactRecord(record []byte) bool {
+	kind := record[10]
+	return packChecksum(record) == binary.BigEndian.Uint32(record[4:8]) &&
+		(kind == packRecordBlock || kind == packRecordDeleted)
+}
+
+// Returns the offset of the first intact record starting at or after from,
+// or -1 if there is none. Only runs after finding corruption, so it reads
+// the rest of the pack into memory rather than seeking record by record.
+func nextRecord(file *os.File, from int64, size int64) (int64, error) {
+	if from >= size {
+		return -1, nil
+	}
+	rest := make([]byte, size-from)
+	if _, err := file.ReadAt(rest, from); err != nil {
+		return -1, err
+	}
+	for start := 0; start+packHeaderSize <= len(rest); start++ {
+		header := rest[start : start+packHeaderSize]
+		end := start + packHeaderSize + int(binary.BigEndian.Uint16(header[8:10])) + int(binary.BigEndian.Uint32(header[0:4]))
+		if end > len(rest) || end < start {
+			continue
+		}
+		if intactRecord(rest[start:end]) {
+			return from + int64(start), nil
+		}
+	}
+	return -1, nil
+}
+
+// Covers the whole record except the checksum itself
+func packChecksum(record []byte) uint32 {
+	return crc32.Update(crc32.Checksum(record[8:], crcTable), crcTable, record[0:4])
+}
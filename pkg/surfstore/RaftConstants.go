@@ -2,7 +2,17 @@ package surfstore
 
 import (
 	"fmt"
+	"time"
 )
 
 var ERR_SERVER_CRASHED = fmt.Errorf("Server is crashed.")
 var ERR_NOT_LEADER = fmt.Errorf("Server is not the leader")
+
+// Timeout for a single AppendEntries call to a peer
+const RAFT_RPC_TIMEOUT = 500 * time.Millisecond
+
+// How long the leader waits before retrying replication of an uncommitted entry
+const RAFT_RETRY_INTERVAL = 100 * time.Millisecond
+
+// Maximum number of proposals the leader accepts before they are applied
+const MAX_PENDING_APPLIES = 64
@@ -2,40 +2,332 @@ package surfstore
 
 import (
 	context "context"
+	"log"
 	"sync"
+	"time"
 
+	grpc "google.golang.org/grpc"
 	emptypb "google.golang.org/protobuf/types/known/emptypb"
 )
 
+// A proposal waiting for its log entry to be applied to the MetaStore
+type pendingApply struct {
+	term   int64
+	result chan applyResult
+}
+
+type applyResult struct {
+	version *Version
+	err     error
+}
+
 type RaftSurfstore struct {
-	// TODO add any fields you need
 	isLeader bool
 	term     int64
 	log      []*UpdateOperation
 
+	id    int64
+	peers []string
+
+	// Index of the highest log entry known to be committed
+	commitIndex int64
+	// Index of the highest log entry applied to the MetaStore,
+	// only advanced by the apply loop
+	lastApplied int64
+
+	// Leader only, indexed by server id
+	nextIndex  []int64
+	matchIndex []int64
+
+	// Guards all of the Raft state above. commitCond is signalled
+	// whenever commitIndex or lastApplied moves.
+	raftStateMutex *sync.RWMutex
+	commitCond     *sync.Cond
+
+	// UpdateFile callers waiting on the apply loop, keyed by log index
+	pendingApplies map[int64]*pendingApply
+	// One slot per proposal that is not applied yet; a full channel
+	// makes UpdateFile wait for the apply loop to catch up
+	applySlots chan struct{}
+
 	metaStore *MetaStore
+	// Presented to peers when auth is enabled
+	peerToken string
+	// Secures the links to peers; nil dials them in plaintext
+	tls *TLSConfig
 
 	/*--------------- Chaos Monkey --------------*/
 	isCrashed      bool
-	isCrashedMutex sync.RWMutex
+	isCrashedMutex *sync.RWMutex
 	notCrashedCond *sync.Cond
 
-	//UnimplementedRaftSurfstoreServer
+	UnimplementedRaftSurfstoreServer
 }
 
 func (s *RaftSurfstore) GetFileInfoMap(ctx context.Context, empty *emptypb.Empty) (*FileInfoMap, error) {
-	panic("todo")
-	return nil, nil
+	if err := s.checkLeader(); err != nil {
+		return nil, err
+	}
+	return s.metaStore.GetFileInfoMap(ctx, empty)
 }
 
 func (s *RaftSurfstore) GetBlockStoreAddr(ctx context.Context, empty *emptypb.Empty) (*BlockStoreAddr, error) {
-	panic("todo")
-	return nil, nil
+	if err := s.checkLeader(); err != nil {
+		return nil, err
+	}
+	return s.metaStore.GetBlockStoreAddr(ctx, empty)
+}
+
+func (s *RaftSurfstore) GetBlockStoreAddrs(ctx context.Context, empty *emptypb.Empty) (*BlockStoreAddrs, error) {
+	if err := s.checkLeader(); err != nil {
+		return nil, err
+	}
+	return s.metaStore.GetBlockStoreAddrs(ctx, empty)
+}
+
+func (s *RaftSurfstore) GetStoragePolicies(ctx context.Context, empty *emptypb.Empty) (*StoragePolicies, error) {
+	if err := s.checkLeader(); err != nil {
+		return nil, err
+	}
+	return s.metaStore.GetStoragePolicies(ctx, empty)
+}
+
+// The ring changes through the log, so every replica falls back to the
+// same previous ring until the leader has moved the blocks
+func (s *RaftSurfstore) SetBlockStoreAddrs(ctx context.Context, addrs *BlockStoreAddrs) (*RebalanceStatus, error) {
+	if err := s.checkLeader(); err != nil {
+		return nil, err
+	}
+	if _, err := s.propose(ctx, blockStoreChange(addrs.GetAddrs())); err != nil {
+		return nil, err
+	}
+	return s.metaStore.GetRebalanceStatus(ctx, &emptypb.Empty{})
+}
+
+func (s *RaftSurfstore) GetRebalanceStatus(ctx context.Context, empty *emptypb.Empty) (*RebalanceStatus, error) {
+	if err := s.checkLeader(); err != nil {
+		return nil, err
+	}
+	return s.metaStore.GetRebalanceStatus(ctx, empty)
+}
+
+// The registry changes through the log like the ring it decides
+func (s *RaftSurfstore) RegisterBlockStore(ctx context.Context, addr *BlockStoreAddr) (*BlockStoreStatus, error) {
+	if err := s.proposeRegistration(ctx, addr.GetAddr(), BlockStoreState_ACTIVE); err != nil {
+		return nil, err
+	}
+	return s.metaStore.BlockStoreHeartbeat(ctx, addr)
+}
+
+// Any server takes heartbeats, so a new leader already knows which
+// BlockStores are alive
+func (s *RaftSurfstore) BlockStoreHeartbeat(ctx context.Context, addr *BlockStoreAddr) (*BlockStoreStatus, error) {
+	if s.crashed() {
+		return nil, ERR_SERVER_CRASHED
+	}
+	return s.metaStore.BlockStoreHeartbeat(ctx, addr)
+}
+
+func (s *RaftSurfstore) DrainBlockStore(ctx context.Context, addr *BlockStoreAddr) (*BlockStoreStatus, error) {
+	if err := s.proposeRegistration(ctx, addr.GetAddr(), BlockStoreState_DRAINING); err != nil {
+		return nil, err
+	}
+	return s.metaStore.blockStoreStatus(addr.GetAddr()), nil
+}
+
+func (s *RaftSurfstore) DecommissionBlockStore(ctx context.Context, addr *BlockStoreAddr) (*BlockStoreStatus, error) {
+	if err := s.proposeRegistration(ctx, addr.GetAddr(), BlockStoreState_DECOMMISSIONED); err != nil {
+		return nil, err
+	}
+	return s.metaStore.blockStoreStatus(addr.GetAddr()), nil
+}
+
+func (s *RaftSurfstore) GetBlockStoreStatuses(ctx context.Context, empty *emptypb.Empty) (*BlockStoreStatuses, error) {
+	if err := s.checkLeader(); err != nil {
+		return nil, err
+	}
+	return s.metaStore.GetBlockStoreStatuses(ctx, empty)
+}
+
+func (s *RaftSurfstore) proposeRegistration(ctx context.Context, addr string, state BlockStoreState) error {
+	if err := s.checkLeader(); err != nil {
+		return err
+	}
+	op, err := s.metaStore.registration(addr, state)
+	if err != nil || op == nil {
+		return err
+	}
+	_, err = s.propose(ctx, op)
+	return err
+}
+
+func (s *RaftSurfstore) GetRepairReport(ctx context.Context, empty *emptypb.Empty) (*RepairReport, error) {
+	if err := s.checkLeader(); err != nil {
+		return nil, err
+	}
+	return s.metaStore.GetRepairReport(ctx, empty)
+}
+
+func (s *RaftSurfstore) GetFileHistory(ctx context.Context, fileName *FileName) (*FileHistory, error) {
+	if err := s.checkLeader(); err != nil {
+		return nil, err
+	}
+	return s.metaStore.GetFileHistory(ctx, fileName)
+}
+
+func (s *RaftSurfstore) GetBlockReferences(ctx context.Context, blockHash *BlockHash) (*BlockReferences, error) {
+	if err := s.checkLeader(); err != nil {
+		return nil, err
+	}
+	return s.metaStore.GetBlockReferences(ctx, blockHash)
+}
+
+// The restore goes through the log as is, and every replica works out the
+// restored version when applying it, after every earlier entry
+func (s *RaftSurfstore) RestoreFileVersion(ctx context.Context, fileVersion *FileVersion) (*Version, error) {
+	if err := s.checkLeader(); err != nil {
+		return nil, err
+	}
+	op, err := s.metaStore.restoreOperation(ctx, fileVersion)
+	if err != nil {
+		return nil, err
+	}
+	return s.propose(ctx, op)
 }
 
 func (s *RaftSurfstore) UpdateFile(ctx context.Context, filemeta *FileMetaData) (*Version, error) {
-	panic("todo")
-	return nil, nil
+	if err := s.checkLeader(); err != nil {
+		return nil, err
+	}
+	namespace, err := NamespaceFromContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if !s.metaStore.Auth.canWrite(ctx, filemeta.GetFilename()) {
+		return nil, permissionDenied(ctx, filemeta.GetFilename())
+	}
+	setOwner(ctx, filemeta)
+	return s.propose(ctx, &UpdateOperation{
+		FileMetaData: filemeta,
+		Timestamp:    time.Now().UnixNano(),
+		Namespace:    namespace,
+	})
+}
+
+func (s *RaftSurfstore) GetChangesSince(ctx context.Context, revision *Revision) (*FileInfoDelta, error) {
+	if err := s.checkLeader(); err != nil {
+		return nil, err
+	}
+	return s.metaStore.GetChangesSince(ctx, revision)
+}
+
+func (s *RaftSurfstore) GetFileInfoMapAt(ctx context.Context, snapshotRequest *SnapshotRequest) (*FileInfoMap, error) {
+	if err := s.checkLeader(); err != nil {
+		return nil, err
+	}
+	return s.metaStore.GetFileInfoMapAt(ctx, snapshotRequest)
+}
+
+func (s *RaftSurfstore) AckSync(ctx context.Context, syncAck *SyncAck) (*Success, error) {
+	if err := s.checkLeader(); err != nil {
+		return nil, err
+	}
+	namespace, err := NamespaceFromContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if syncAck, err = s.metaStore.Auth.ownSyncAck(ctx, syncAck); err != nil {
+		return nil, err
+	}
+	if _, err := s.propose(ctx, &UpdateOperation{SyncAck: syncAck, Namespace: namespace}); err != nil {
+		return nil, err
+	}
+	return &Success{Flag: true}, nil
+}
+
+// Any replica can serve a watch since they all apply the same log, so a
+// watch survives leader changes. It ends if this server crashes.
+func (s *RaftSurfstore) WatchFileInfo(watchRequest *WatchRequest, stream RaftSurfstore_WatchFileInfoServer) error {
+	alive := func() error {
+		if s.crashed() {
+			return ERR_SERVER_CRASHED
+		}
+		return nil
+	}
+	send := func(change *FileChange) error {
+		if err := alive(); err != nil {
+			return err
+		}
+		return stream.Send(change)
+	}
+	return s.metaStore.watchFileInfo(stream.Context(), watchRequest.GetFromRevision(), send, alive)
+}
+
+// Appends the operation to the log, replicates it to a majority and waits
+// for the apply loop to run it against the MetaStore
+func (s *RaftSurfstore) propose(ctx context.Context, op *UpdateOperation) (*Version, error) {
+	// Backpressure: don't let proposals run ahead of the apply loop
+	select {
+	case s.applySlots <- struct{}{}:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+
+	s.raftStateMutex.Lock()
+	if !s.isLeader {
+		s.raftStateMutex.Unlock()
+		<-s.applySlots
+		return nil, ERR_NOT_LEADER
+	}
+	op.Term = s.term
+	s.log = append(s.log, op)
+	index := int64(len(s.log) - 1)
+	pending := &pendingApply{term: s.term, result: make(chan applyResult, 1)}
+	s.pendingApplies[index] = pending
+	s.raftStateMutex.Unlock()
+
+	// Keep replicating until the entry is committed
+	for {
+		s.sendAppendEntriesToPeers()
+
+		s.raftStateMutex.RLock()
+		committed := s.commitIndex >= index
+		isLeader := s.isLeader
+		s.raftStateMutex.RUnlock()
+
+		if committed {
+			break
+		}
+		if !isLeader || s.crashed() {
+			return nil, ERR_NOT_LEADER
+		}
+		select {
+		case <-time.After(RAFT_RETRY_INTERVAL):
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+
+	// Let the followers know about the new commit index
+	s.sendAppendEntriesToPeers()
+
+	select {
+	case res := <-pending.result:
+		return res.version, res.err
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// Commits an entry in the current term and waits for it to be applied.
+// Entries of earlier terms only count as committed once one of the
+// current term is, so afterwards the MetaStore has applied every entry
+// committed before the call.
+func (s *RaftSurfstore) barrier(timeout time.Duration) error {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	_, err := s.propose(ctx, &UpdateOperation{Barrier: true})
+	return err
 }
 
 //1. Reply false if term < currentTerm (§5.1)
@@ -47,21 +339,96 @@ func (s *RaftSurfstore) UpdateFile(ctx context.Context, filemeta *FileMetaData)
 //5. If leaderCommit > commitIndex, set commitIndex = min(leaderCommit, index
 //of last new entry)
 func (s *RaftSurfstore) AppendEntries(ctx context.Context, input *AppendEntryInput) (*AppendEntryOutput, error) {
-	panic("todo")
-	return nil, nil
+	if s.crashed() {
+		return nil, ERR_SERVER_CRASHED
+	}
+
+	s.raftStateMutex.Lock()
+	defer s.raftStateMutex.Unlock()
+
+	output := &AppendEntryOutput{
+		ServerId:     s.id,
+		Term:         s.term,
+		Success:      false,
+		MatchedIndex: -1,
+	}
+
+	if input.Term < s.term {
+		return output, nil
+	}
+	if input.Term > s.term {
+		s.term = input.Term
+		output.Term = s.term
+	}
+	s.isLeader = false
+
+	prevLogIndex := input.PrevLogIndex
+	if prevLogIndex >= int64(len(s.log)) ||
+		(prevLogIndex >= 0 && s.log[prevLogIndex].Term != input.PrevLogTerm) {
+		return output, nil
+	}
+
+	for i, entry := range input.Entries {
+		index := prevLogIndex + 1 + int64(i)
+		if index < int64(len(s.log)) {
+			if s.log[index].Term == entry.Term {
+				continue
+			}
+			s.truncateLog(index)
+		}
+		s.log = append(s.log, entry)
+	}
+
+	lastNewIndex := prevLogIndex + int64(len(input.Entries))
+	if input.LeaderCommit > s.commitIndex {
+		s.commitIndex = input.LeaderCommit
+		if lastNewIndex < s.commitIndex {
+			s.commitIndex = lastNewIndex
+		}
+		s.commitCond.Broadcast()
+	}
+
+	output.Success = true
+	output.MatchedIndex = lastNewIndex
+	return output, nil
 }
 
 // This should set the leader status and any related variables as if the node has just won an election
 func (s *RaftSurfstore) SetLeader(ctx context.Context, _ *emptypb.Empty) (*Success, error) {
-	panic("todo")
-	return nil, nil
+	if s.crashed() {
+		return nil, ERR_SERVER_CRASHED
+	}
+
+	s.raftStateMutex.Lock()
+	defer s.raftStateMutex.Unlock()
+
+	s.term++
+	s.isLeader = true
+	for idx := range s.peers {
+		s.nextIndex[idx] = int64(len(s.log))
+		s.matchIndex[idx] = -1
+	}
+
+	return &Success{Flag: true}, nil
 }
 
 // Send a 'Heartbeat" (AppendEntries with no log entries) to the other servers
 // Only leaders send heartbeats, if the node is not the leader you can return Success = false
 func (s *RaftSurfstore) SendHeartbeat(ctx context.Context, _ *emptypb.Empty) (*Success, error) {
-	panic("todo")
-	return nil, nil
+	if s.crashed() {
+		return nil, ERR_SERVER_CRASHED
+	}
+
+	s.raftStateMutex.RLock()
+	isLeader := s.isLeader
+	s.raftStateMutex.RUnlock()
+	if !isLeader {
+		return &Success{Flag: false}, nil
+	}
+
+	s.sendAppendEntriesToPeers()
+
+	return &Success{Flag: true}, nil
 }
 
 func (s *RaftSurfstore) Crash(ctx context.Context, _ *emptypb.Empty) (*Success, error) {
@@ -82,17 +449,271 @@ func (s *RaftSurfstore) Restore(ctx context.Context, _ *emptypb.Empty) (*Success
 }
 
 func (s *RaftSurfstore) IsCrashed(ctx context.Context, _ *emptypb.Empty) (*CrashedState, error) {
-	return &CrashedState{IsCrashed: s.isCrashed}, nil
+	return &CrashedState{IsCrashed: s.crashed()}, nil
 }
 
+// Waits for the apply loop to catch up with commitIndex so that MetaMap
+// reflects every committed entry
 func (s *RaftSurfstore) GetInternalState(ctx context.Context, empty *emptypb.Empty) (*RaftInternalState, error) {
-	fileInfoMap, _ := s.metaStore.GetFileInfoMap(ctx, empty)
-	return &RaftInternalState{
-		IsLeader: s.isLeader,
-		Term:     s.term,
-		Log:      s.log,
-		MetaMap:  fileInfoMap,
-	}, nil
+	s.raftStateMutex.Lock()
+	for s.lastApplied < s.commitIndex {
+		s.commitCond.Wait()
+	}
+	state := &RaftInternalState{
+		IsLeader:    s.isLeader,
+		Term:        s.term,
+		Log:         s.log,
+		CommitIndex: s.commitIndex,
+		LastApplied: s.lastApplied,
+	}
+	s.raftStateMutex.Unlock()
+
+	state.MetaMap, _ = s.metaStore.GetFileInfoMap(ctx, empty)
+	return state, nil
+}
+
+// Runs committed entries against the MetaStore in log order. It is the
+// only goroutine that touches the MetaStore's state or lastApplied, so
+// a slow apply never holds up AppendEntries or heartbeats.
+func (s *RaftSurfstore) applyCommittedEntries() {
+	for {
+		s.raftStateMutex.Lock()
+		for s.lastApplied >= s.commitIndex {
+			s.commitCond.Wait()
+		}
+		firstIndex := s.lastApplied + 1
+		entries := make([]*UpdateOperation, s.commitIndex-s.lastApplied)
+		copy(entries, s.log[firstIndex:s.commitIndex+1])
+		s.raftStateMutex.Unlock()
+
+		for i, entry := range entries {
+			version, err := s.metaStore.applyOperation(entry)
+
+			index := firstIndex + int64(i)
+			s.raftStateMutex.Lock()
+			s.lastApplied = index
+			pending, ok := s.pendingApplies[index]
+			delete(s.pendingApplies, index)
+			s.commitCond.Broadcast()
+			s.raftStateMutex.Unlock()
+
+			if ok {
+				if pending.term != entry.Term {
+					// Our proposal was replaced by another leader's entry
+					pending.result <- applyResult{err: ERR_NOT_LEADER}
+				} else {
+					pending.result <- applyResult{version: version, err: err}
+				}
+				<-s.applySlots
+			}
+		}
+	}
+}
+
+// While leader, periodically proposes pruning whatever the MetaStore's
+// retention policy allows, so that every replica prunes the same versions
+func (s *RaftSurfstore) pruneLoop(interval time.Duration) {
+	for range time.Tick(interval) {
+		if s.checkLeader() != nil {
+			continue
+		}
+		for _, op := range s.metaStore.pruneOperations(time.Now()) {
+			ctx, cancel := context.WithTimeout(context.Background(), interval)
+			s.propose(ctx, op)
+			cancel()
+		}
+	}
+}
+
+// While leader, periodically collects the blocks no retained version
+// references. Deleting blocks does not change the metadata, so unlike
+// pruning it does not go through the log, but it waits for the MetaStore
+// to catch up with the log first, since a block only an unapplied entry
+// references would look unreferenced.
+func (s *RaftSurfstore) GCLoop(interval time.Duration) {
+	for range time.Tick(interval) {
+		if s.checkLeader() != nil {
+			continue
+		}
+		if err := s.barrier(interval); err != nil {
+			log.Println(SURF_SERVER, "not collecting garbage:", err)
+			continue
+		}
+		deleted, err := s.metaStore.CollectGarbage()
+		log.Println(SURF_SERVER, "collected", deleted, "unreferenced blocks", err)
+	}
+}
+
+// While leader, periodically re-copies blocks that are missing from some
+// of their replicas. The report stays with the server that made it.
+func (s *RaftSurfstore) RepairLoop(interval time.Duration) {
+	for range time.Tick(interval) {
+		if s.checkLeader() != nil || s.metaStore.rebalancing() {
+			continue
+		}
+		report := s.metaStore.RepairBlocks()
+		log.Println(SURF_SERVER, "repair found", report.UnderReplicatedBlocks, "under-replicated and", len(report.LostBlocks), "lost blocks")
+	}
+}
+
+// While leader and rebalancing, periodically moves blocks to the current
+// ring, and ends the rebalance through the log once they are all there.
+// Progress is only tracked by the leader doing the moving, which first
+// catches up with the log so it moves the blocks of every committed file.
+func (s *RaftSurfstore) RebalanceLoop(interval time.Duration) {
+	for range time.Tick(interval) {
+		if s.checkLeader() != nil || !s.metaStore.rebalancing() {
+			continue
+		}
+		if err := s.barrier(interval); err != nil {
+			log.Println(SURF_SERVER, "not rebalancing:", err)
+			continue
+		}
+		status := s.metaStore.moveBlocks()
+		log.Println(SURF_SERVER, "rebalance moved", status.MovedBlocks, "blocks,", status.FailedBlocks, "failed,", len(status.LostBlocks), "lost")
+		if op := rebalanceFinished(status); op != nil {
+			ctx, cancel := context.WithTimeout(context.Background(), interval)
+			s.propose(ctx, op)
+			cancel()
+		}
+	}
+}
+
+// Drops log entries from index onwards and fails the proposals waiting
+// on them. The caller must hold raftStateMutex.
+func (s *RaftSurfstore) truncateLog(index int64) {
+	for i := index; i < int64(len(s.log)); i++ {
+		if pending, ok := s.pendingApplies[i]; ok {
+			delete(s.pendingApplies, i)
+			pending.result <- applyResult{err: ERR_NOT_LEADER}
+			<-s.applySlots
+		}
+	}
+	s.log = s.log[:index]
+}
+
+// Sends one round of AppendEntries to every follower and waits for the replies
+func (s *RaftSurfstore) sendAppendEntriesToPeers() {
+	var wg sync.WaitGroup
+	for idx := range s.peers {
+		if int64(idx) == s.id {
+			continue
+		}
+		wg.Add(1)
+		go func(peerId int64) {
+			defer wg.Done()
+			s.sendAppendEntries(peerId)
+		}(int64(idx))
+	}
+	wg.Wait()
+}
+
+// Brings a single follower up to date, backing nextIndex off until the
+// follower accepts the entries
+func (s *RaftSurfstore) sendAppendEntries(peerId int64) {
+	for {
+		if s.crashed() {
+			return
+		}
+
+		s.raftStateMutex.RLock()
+		if !s.isLeader {
+			s.raftStateMutex.RUnlock()
+			return
+		}
+		nextIndex := s.nextIndex[peerId]
+		input := &AppendEntryInput{
+			Term:         s.term,
+			PrevLogIndex: nextIndex - 1,
+			PrevLogTerm:  0,
+			Entries:      s.log[nextIndex:],
+			LeaderCommit: s.commitIndex,
+		}
+		if nextIndex > 0 {
+			input.PrevLogTerm = s.log[nextIndex-1].Term
+		}
+		s.raftStateMutex.RUnlock()
+
+		output, err := s.callAppendEntries(s.peers[peerId], input)
+		if err != nil {
+			return
+		}
+
+		s.raftStateMutex.Lock()
+		if output.Term > s.term {
+			s.term = output.Term
+			s.isLeader = false
+			s.raftStateMutex.Unlock()
+			return
+		}
+		if !s.isLeader || s.term != input.Term {
+			s.raftStateMutex.Unlock()
+			return
+		}
+		if output.Success {
+			s.matchIndex[peerId] = output.MatchedIndex
+			s.nextIndex[peerId] = output.MatchedIndex + 1
+			s.advanceCommitIndex()
+			s.raftStateMutex.Unlock()
+			return
+		}
+		if s.nextIndex[peerId] > 0 {
+			s.nextIndex[peerId]--
+		}
+		s.raftStateMutex.Unlock()
+	}
+}
+
+// Commits the highest entry from the current term that a majority has
+// replicated. The caller must hold raftStateMutex.
+func (s *RaftSurfstore) advanceCommitIndex() {
+	for index := int64(len(s.log) - 1); index > s.commitIndex; index-- {
+		if s.log[index].Term != s.term {
+			break
+		}
+		replicated := 1
+		for peerId, matched := range s.matchIndex {
+			if int64(peerId) != s.id && matched >= index {
+				replicated++
+			}
+		}
+		if replicated > len(s.peers)/2 {
+			s.commitIndex = index
+			s.commitCond.Broadcast()
+			return
+		}
+	}
+}
+
+func (s *RaftSurfstore) checkLeader() error {
+	if s.crashed() {
+		return ERR_SERVER_CRASHED
+	}
+	s.raftStateMutex.RLock()
+	defer s.raftStateMutex.RUnlock()
+	if !s.isLeader {
+		return ERR_NOT_LEADER
+	}
+	return nil
+}
+
+func (s *RaftSurfstore) crashed() bool {
+	s.isCrashedMutex.RLock()
+	defer s.isCrashedMutex.RUnlock()
+	return s.isCrashed
+}
+
+func (s *RaftSurfstore) callAppendEntries(addr string, input *AppendEntryInput) (*AppendEntryOutput, error) {
+	conn, err := grpc.Dial(addr, s.tls.DialOption())
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	c := NewRaftSurfstoreClient(conn)
+
+	ctx, cancel := context.WithTimeout(context.Background(), RAFT_RPC_TIMEOUT)
+	defer cancel()
+	return c.AppendEntries(WithToken(ctx, s.peerToken), input)
 }
 
 var _ RaftSurfstoreInterface = new(RaftSurfstore)
@@ -0,0 +1,253 @@
+package surfstore
+
+import (
+	context "context"
+	"net"
+	"testing"
+	"time"
+
+	grpc "google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+	emptypb "google.golang.org/protobuf/types/known/emptypb"
+)
+
+// Starts Raft servers in this process, so tests can reach into their state
+func startRaftServers(t *testing.T, n int) []*RaftSurfstore {
+	listeners := make([]net.Listener, n)
+	addrs := make([]string, n)
+	for i := range listeners {
+		ln, err := net.Listen("tcp", "localhost:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		listeners[i] = ln
+		addrs[i] = ln.Addr().String()
+	}
+	servers := make([]*RaftSurfstore, n)
+	for i, ln := range listeners {
+		server, err := NewRaftServer(int64(i), addrs, RaftServerOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		grpcServer := grpc.NewServer()
+		RegisterRaftSurfstoreServer(grpcServer, server)
+		go grpcServer.Serve(ln)
+		t.Cleanup(grpcServer.Stop)
+		servers[i] = server
+	}
+	return servers
+}
+
+func (s *RaftSurfstore) indexes() (commitIndex int64, lastApplied int64) {
+	s.raftStateMutex.RLock()
+	defer s.raftStateMutex.RUnlock()
+	return s.commitIndex, s.lastApplied
+}
+
+// Waits for cond to hold, failing the test after a few seconds
+func eventually(t *testing.T, what string, cond func() bool) {
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("Timed out waiting until %s", what)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// While the leader's apply loop is stuck, entries still commit, heartbeats
+// still reach the followers, and proposals stop once MAX_PENDING_APPLIES
+// are waiting. lastApplied trails commitIndex until the loop catches up.
+func TestApplyLoopDoesNotBlockReplication(t *testing.T) {
+	ctx := context.Background()
+	servers := startRaftServers(t, 3)
+	leader := servers[0]
+	leader.SetLeader(ctx, &emptypb.Empty{})
+
+	_, err := leader.UpdateFile(ctx, &FileMetaData{Filename: "a.txt", Version: 1, BlockHashList: []string{"h1"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if commitIndex, lastApplied := leader.indexes(); commitIndex != 0 || lastApplied != 0 {
+		t.Fatalf("Expected the first entry applied, got commitIndex %d lastApplied %d", commitIndex, lastApplied)
+	}
+
+	// Updates to the default namespace wait for its lock
+	leader.metaStore.Mutex.Lock()
+	results := make(chan error, MAX_PENDING_APPLIES)
+	go func() {
+		_, err := leader.UpdateFile(ctx, &FileMetaData{Filename: "a.txt", Version: 2, BlockHashList: []string{"h2"}})
+		results <- err
+	}()
+	eventually(t, "the update commits", func() bool {
+		commitIndex, _ := leader.indexes()
+		return commitIndex == 1
+	})
+	if _, lastApplied := leader.indexes(); lastApplied != 0 {
+		t.Fatalf("Expected lastApplied to trail commitIndex, got %d", lastApplied)
+	}
+
+	// Replication goes on without the apply loop
+	if succ, err := leader.SendHeartbeat(ctx, &emptypb.Empty{}); err != nil || !succ.Flag {
+		t.Fatalf("Heartbeat failed while applying was blocked: %v", err)
+	}
+	for _, follower := range servers[1:] {
+		eventually(t, "the followers apply the update", func() bool {
+			commitIndex, lastApplied := follower.indexes()
+			return commitIndex == 1 && lastApplied == 1
+		})
+	}
+
+	// Fill the remaining apply slots; the next proposal has to wait
+	for i := 1; i < MAX_PENDING_APPLIES; i++ {
+		go func() {
+			_, err := leader.propose(ctx, &UpdateOperation{SyncAck: &SyncAck{ClientId: "c", Revision: 1}})
+			results <- err
+		}()
+	}
+	eventually(t, "every slot is taken", func() bool {
+		return len(leader.applySlots) == MAX_PENDING_APPLIES
+	})
+	waitCtx, cancel := context.WithTimeout(ctx, 200*time.Millisecond)
+	_, err = leader.propose(waitCtx, &UpdateOperation{SyncAck: &SyncAck{ClientId: "c", Revision: 2}})
+	cancel()
+	if err != context.DeadlineExceeded {
+		t.Fatalf("Expected a proposal beyond the apply slots to wait, got %v", err)
+	}
+
+	leader.metaStore.Mutex.Unlock()
+	for i := 0; i < MAX_PENDING_APPLIES; i++ {
+		if err := <-results; err != nil {
+			t.Fatalf("Expected the blocked proposals to apply, got %v", err)
+		}
+	}
+	state, err := leader.GetInternalState(ctx, &emptypb.Empty{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if state.LastApplied != state.CommitIndex || state.CommitIndex != MAX_PENDING_APPLIES {
+		t.Fatalf("Expected lastApplied to catch up with commitIndex %d, got %d", state.CommitIndex, state.LastApplied)
+	}
+	if state.MetaMap.FileInfoMap["a.txt"].GetVersion() != 2 {
+		t.Fatalf("Expected the blocked update to be applied, got %v", state.MetaMap.FileInfoMap["a.txt"])
+	}
+}
+
+// A restore proposed while an earlier update is still being applied
+// builds on that update instead of failing its version check
+func TestRestoreAfterUnappliedUpdate(t *testing.T) {
+	ctx := context.Background()
+	servers := startRaftServers(t, 3)
+	leader := servers[0]
+	leader.SetLeader(ctx, &emptypb.Empty{})
+	_, err := leader.UpdateFile(ctx, &FileMetaData{Filename: "a.txt", Version: 1, BlockHashList: []string{"h1"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	leader.metaStore.Mutex.Lock()
+	updated := make(chan error, 1)
+	go func() {
+		_, err := leader.UpdateFile(ctx, &FileMetaData{Filename: "a.txt", Version: 2, BlockHashList: []string{"h2"}})
+		updated <- err
+	}()
+	eventually(t, "the update commits", func() bool {
+		commitIndex, _ := leader.indexes()
+		return commitIndex == 1
+	})
+	restored := make(chan *Version, 1)
+	go func() {
+		version, err := leader.RestoreFileVersion(ctx, &FileVersion{Filename: "a.txt", Version: 1})
+		if err != nil {
+			t.Error(err)
+		}
+		restored <- version
+	}()
+	eventually(t, "the restore commits", func() bool {
+		commitIndex, _ := leader.indexes()
+		return commitIndex == 2
+	})
+	leader.metaStore.Mutex.Unlock()
+
+	if err := <-updated; err != nil {
+		t.Fatal(err)
+	}
+	if version := <-restored; version.GetVersion() != 3 {
+		t.Fatalf("Expected the restore to become version 3, got %v", version)
+	}
+	current := leader.metaStore.FileMetaMap["a.txt"]
+	if current.GetVersion() != 3 || current.GetBlockHashList()[0] != "h1" {
+		t.Fatalf("Expected version 1's blocks as version 3, got %v", current)
+	}
+}
+
+// The barrier GC and rebalancing wait on only returns once every entry
+// committed before it has been applied
+func TestBarrierWaitsForApply(t *testing.T) {
+	ctx := context.Background()
+	servers := startRaftServers(t, 3)
+	leader := servers[0]
+	leader.SetLeader(ctx, &emptypb.Empty{})
+
+	leader.metaStore.Mutex.Lock()
+	go leader.UpdateFile(ctx, &FileMetaData{Filename: "a.txt", Version: 1, BlockHashList: []string{"h1"}})
+	eventually(t, "the update commits", func() bool {
+		commitIndex, _ := leader.indexes()
+		return commitIndex == 0
+	})
+	done := make(chan error, 1)
+	go func() {
+		done <- leader.barrier(5 * time.Second)
+	}()
+	select {
+	case err := <-done:
+		t.Fatalf("Expected the barrier to wait for the update to be applied, got %v", err)
+	case <-time.After(200 * time.Millisecond):
+	}
+	leader.metaStore.Mutex.Unlock()
+
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	if leader.metaStore.FileMetaMap["a.txt"].GetVersion() != 1 {
+		t.Fatalf("Expected the update to be applied before the barrier returned")
+	}
+}
+
+// Asking about a namespace nothing has been stored in does not create it
+// on any replica; storing a file does
+func TestReadsDoNotCreateNamespaces(t *testing.T) {
+	servers := startRaftServers(t, 3)
+	leader := servers[0]
+	leader.SetLeader(context.Background(), &emptypb.Empty{})
+	ctx := metadata.NewIncomingContext(context.Background(), metadata.Pairs(NAMESPACE_METADATA_KEY, "team"))
+
+	if _, err := leader.GetFileInfoMap(ctx, &emptypb.Empty{}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := leader.GetChangesSince(ctx, &Revision{}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := leader.GetFileHistory(ctx, &FileName{Filename: "a.txt"}); err == nil {
+		t.Fatalf("Expected no history in an unused namespace")
+	}
+	if _, err := leader.AckSync(ctx, &SyncAck{ClientId: "c", Revision: 1}); err != nil {
+		t.Fatal(err)
+	}
+	for i, server := range servers {
+		eventually(t, "the acknowledgement is applied", func() bool {
+			_, lastApplied := server.indexes()
+			return lastApplied == 0
+		})
+		if _, ok := server.metaStore.allNamespaces()["team"]; ok {
+			t.Fatalf("Expected server %d not to create the namespace on reads", i)
+		}
+	}
+
+	if _, err := leader.UpdateFile(ctx, &FileMetaData{Filename: "a.txt", Version: 1, BlockHashList: []string{"h1"}}); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := leader.metaStore.allNamespaces()["team"]; !ok {
+		t.Fatalf("Expected storing a file to create the namespace")
+	}
+}
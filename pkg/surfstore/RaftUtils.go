@@ -2,14 +2,17 @@ package surfstore
 
 import (
 	"bufio"
-	//	"google.golang.org/grpc"
+	"fmt"
 	"io"
 	"log"
-	//	"net"
+	"net"
 	"os"
 	"strconv"
 	"strings"
 	"sync"
+	"time"
+
+	grpc "google.golang.org/grpc"
 )
 
 func LoadRaftConfigFile(filename string) (ipList []string) {
@@ -45,27 +48,81 @@ func LoadRaftConfigFile(filename string) (ipList []string) {
 	return
 }
 
-func NewRaftServer(id int64, ips []string, blockStoreAddr string) (*RaftSurfstore, error) {
-	// TODO any initialization you need to do here
+// RaftServerOptions configures the MetaStore a Raft server replicates and
+// how the server talks to its peers. Zero values keep the MetaStore's
+// defaults.
+type RaftServerOptions struct {
+	// BlockStores placing blocks at startup; more can register later
+	BlockStoreAddrs []string
+	// Number of BlockStore servers each block is stored on
+	ReplicationFactor int
+	// Which files are erasure coded instead of replicated; nil replicates everything
+	StoragePolicies *StoragePolicyConfig
+	// Bytes per second a rebalance may move; zero is unlimited
+	RebalanceRate int64
+	// How long a registered BlockStore may go without a heartbeat
+	BlockStoreTimeout time.Duration
+	Retention         RetentionPolicy
+	// Decides who may call what; nil allows everyone
+	Auth *AuthConfig
+	// Secures every connection; nil serves and dials in plaintext
+	TLS *TLSConfig
+}
+
+func NewRaftServer(id int64, ips []string, opts RaftServerOptions) (*RaftSurfstore, error) {
+	isCrashedMutex := &sync.RWMutex{}
+	raftStateMutex := &sync.RWMutex{}
 
-	isCrashedMutex := sync.RWMutex{}
+	metaStore := NewMetaStore(opts.BlockStoreAddrs...)
+	if opts.ReplicationFactor > 0 {
+		metaStore.ReplicationFactor = opts.ReplicationFactor
+	}
+	if opts.BlockStoreTimeout > 0 {
+		metaStore.BlockStoreTimeout = opts.BlockStoreTimeout
+	}
+	metaStore.StoragePolicies = opts.StoragePolicies
+	metaStore.RebalanceRate = opts.RebalanceRate
+	metaStore.Retention = opts.Retention
+	metaStore.Auth = opts.Auth
+	metaStore.TLS = opts.TLS
 
 	server := RaftSurfstore{
-		// TODO initialize any fields you add here
 		isLeader:       false,
 		term:           0,
-		metaStore:      NewMetaStore(blockStoreAddr),
+		metaStore:      metaStore,
+		peerToken:      opts.Auth.ServerToken(),
+		tls:            opts.TLS,
 		log:            make([]*UpdateOperation, 0),
+		id:             id,
+		peers:          ips,
+		commitIndex:    -1,
+		lastApplied:    -1,
+		nextIndex:      make([]int64, len(ips)),
+		matchIndex:     make([]int64, len(ips)),
+		raftStateMutex: raftStateMutex,
+		commitCond:     sync.NewCond(raftStateMutex),
+		pendingApplies: make(map[int64]*pendingApply),
+		applySlots:     make(chan struct{}, MAX_PENDING_APPLIES),
 		isCrashed:      false,
-		notCrashedCond: sync.NewCond(&isCrashedMutex),
+		notCrashedCond: sync.NewCond(isCrashedMutex),
 		isCrashedMutex: isCrashedMutex,
 	}
 
+	go server.applyCommittedEntries()
+	go server.pruneLoop(PRUNE_INTERVAL)
+
 	return &server, nil
 }
 
-// TODO Start up the Raft server and any services here
+// Start up the Raft server and any services here
 func ServeRaftServer(server *RaftSurfstore) error {
-	panic("todo")
-	return nil
+	opts := append(server.tls.ServerOptions(), server.metaStore.Auth.ServerOptions()...)
+	grpcServer := grpc.NewServer(opts...)
+	RegisterRaftSurfstoreServer(grpcServer, server)
+
+	ln, err := net.Listen("tcp", server.peers[server.id])
+	if err != nil {
+		return fmt.Errorf("failed to listen: %v", err)
+	}
+	return grpcServer.Serve(ln)
 }
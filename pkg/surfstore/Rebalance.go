@@ -0,0 +1,366 @@
+package surfstore
+
+import (
+	context "context"
+	"fmt"
+	"log"
+	"sort"
+	"time"
+
+	grpc "google.golang.org/grpc"
+	"google.golang.org/protobuf/proto"
+	emptypb "google.golang.org/protobuf/types/known/emptypb"
+)
+
+var ERR_REBALANCE_IN_PROGRESS = fmt.Errorf("BlockStores cannot change until the current rebalance finishes.")
+var ERR_NO_BLOCKSTORES = fmt.Errorf("The ring needs at least one BlockStore.")
+
+// Changes the BlockStores blocks are placed on. Until the blocks have been
+// moved to their new servers in the background, clients are told about the
+// previous ring as well so they can still read them.
+func (m *MetaStore) SetBlockStoreAddrs(ctx context.Context, addrs *BlockStoreAddrs) (*RebalanceStatus, error) {
+	if _, err := m.applyOperation(blockStoreChange(addrs.GetAddrs())); err != nil {
+		return nil, err
+	}
+	return m.GetRebalanceStatus(ctx, &emptypb.Empty{})
+}
+
+// Returns the progress of the current rebalance, or of the last one if
+// none is in progress.
+func (m *MetaStore) GetRebalanceStatus(ctx context.Context, _ *emptypb.Empty) (*RebalanceStatus, error) {
+	m.Mutex.RLock()
+	defer m.Mutex.RUnlock()
+	status := proto.Clone(m.rebalanceStatus).(*RebalanceStatus)
+	status.InProgress = m.previousBlockStoreAddrs != nil
+	status.Addrs = append([]string(nil), m.BlockStoreAddrs...)
+	status.PreviousAddrs = append([]string(nil), m.previousBlockStoreAddrs...)
+	status.RateLimit = m.RebalanceRate
+	return status, nil
+}
+
+// Runs one rebalance pass over the standalone MetaStore, and finishes the
+// rebalance if every block made it.
+func (m *MetaStore) Rebalance() *RebalanceStatus {
+	status := m.moveBlocks()
+	if op := rebalanceFinished(status); op != nil {
+		if _, err := m.applyOperation(op); err != nil {
+			log.Println(SURF_SERVER, "could not finish the rebalance:", err)
+		}
+		status, _ = m.GetRebalanceStatus(context.Background(), &emptypb.Empty{})
+	}
+	return status
+}
+
+// Periodically moves blocks to the current ring while a rebalance is in
+// progress.
+func (m *MetaStore) RebalanceLoop(interval time.Duration) {
+	for range time.Tick(interval) {
+		if !m.rebalancing() {
+			continue
+		}
+		status := m.Rebalance()
+		log.Println(SURF_SERVER, "rebalance moved", status.MovedBlocks, "blocks,", status.FailedBlocks, "failed,", len(status.LostBlocks), "lost")
+	}
+}
+
+func blockStoreChange(addrs []string) *UpdateOperation {
+	return &UpdateOperation{
+		BlockStoreChange: &BlockStoreChange{Addrs: addrs},
+		Timestamp:        time.Now().UnixNano(),
+	}
+}
+
+// Returns the operation that ends the rebalance a pass worked on, or nil
+// if some blocks still have to move. Lost blocks cannot move, so they do
+// not hold the rebalance up.
+func rebalanceFinished(status *RebalanceStatus) *UpdateOperation {
+	if !status.GetInProgress() || status.GetFailedBlocks() > 0 {
+		return nil
+	}
+	return &UpdateOperation{
+		BlockStoreChange: &BlockStoreChange{Addrs: status.GetAddrs(), Migrated: true},
+		Timestamp:        time.Now().UnixNano(),
+	}
+}
+
+func (m *MetaStore) rebalancing() bool {
+	m.Mutex.RLock()
+	defer m.Mutex.RUnlock()
+	return m.previousBlockStoreAddrs != nil
+}
+
+func (m *MetaStore) currentBlockStoreAddrs() []string {
+	m.Mutex.RLock()
+	defer m.Mutex.RUnlock()
+	return m.BlockStoreAddrs
+}
+
+// A new ring has to wait for the blocks to reach the current one, since
+// clients only fall back one ring. The registry overrides the ring given
+// for the BlockStores it knows. The caller must hold the lock.
+func (m *MetaStore) checkBlockStoreChange(change *BlockStoreChange) error {
+	if change.GetMigrated() {
+		return nil
+	}
+	addrs := m.ringWithRegistry(change.GetAddrs(), nil)
+	switch {
+	case len(addrs) == 0:
+		return ERR_NO_BLOCKSTORES
+	case m.previousBlockStoreAddrs != nil && !sameAddrs(addrs, m.BlockStoreAddrs):
+		return ERR_REBALANCE_IN_PROGRESS
+	}
+	return nil
+}
+
+// The caller must hold the lock and have checked the change.
+func (m *MetaStore) changeBlockStores(change *BlockStoreChange, timestamp int64) {
+	if change.GetMigrated() {
+		// Ignore the end of a rebalance the ring has moved on from
+		if m.previousBlockStoreAddrs != nil && sameAddrs(change.GetAddrs(), m.BlockStoreAddrs) {
+			m.previousBlockStoreAddrs = nil
+			m.rebalanceStatus.FinishedAt = timestamp
+			// The registry may have changed meanwhile
+			m.reconcileBlockStores(timestamp)
+		}
+		return
+	}
+	addrs := m.ringWithRegistry(change.GetAddrs(), nil)
+	switch {
+	case len(addrs) == 0 || sameAddrs(addrs, m.BlockStoreAddrs):
+	case len(m.BlockStoreAddrs) == 0:
+		// No blocks can have been placed yet
+		m.BlockStoreAddrs = addrs
+	default:
+		m.previousBlockStoreAddrs = m.BlockStoreAddrs
+		m.BlockStoreAddrs = addrs
+		m.rebalanceStatus = &RebalanceStatus{StartedAt: timestamp}
+	}
+}
+
+// Reports whether a and b hold the same addresses in any order
+func sameAddrs(a []string, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	sortedA := append([]string(nil), a...)
+	sortedB := append([]string(nil), b...)
+	sort.Strings(sortedA)
+	sort.Strings(sortedB)
+	for i := range sortedA {
+		if sortedA[i] != sortedB[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// blockMove copies a block (or shard) to a server the current ring places
+// it on, from any of the servers the previous ring placed it on
+type blockMove struct {
+	hash string
+	from []string
+	to   string
+}
+
+// Copies every block and shard a retained version references to the
+// servers the current ring places it on, from the servers the previous
+// ring placed it on, unless they already have it. Returns the status
+// after the pass.
+func (m *MetaStore) moveBlocks() *RebalanceStatus {
+	m.Mutex.Lock()
+	previous, current := m.previousBlockStoreAddrs, m.BlockStoreAddrs
+	rate := m.RebalanceRate
+	if previous != nil {
+		m.rebalanceStatus.Passes++
+		m.rebalanceStatus.TotalBlocks = 0
+		m.rebalanceStatus.CheckedBlocks = 0
+		m.rebalanceStatus.FailedBlocks = 0
+		m.rebalanceStatus.LostBlocks = make([]string, 0)
+	}
+	m.Mutex.Unlock()
+	if previous != nil {
+		oldRing := NewConsistentHashRing(previous)
+		oldRing.ReplicationFactor = m.ReplicationFactor
+		newRing := NewConsistentHashRing(current)
+		newRing.ReplicationFactor = m.ReplicationFactor
+		mover := &blockMover{
+			blockRepairer: blockRepairer{metaStore: m, ring: newRing, conns: make(map[string]*grpc.ClientConn)},
+			rate:          rate,
+			started:       time.Now(),
+		}
+		namespaces := m.allNamespaces()
+		names := make([]string, 0, len(namespaces))
+		for namespace := range namespaces {
+			names = append(names, namespace)
+		}
+		sort.Strings(names)
+		for _, namespace := range names {
+			mover.moveNamespace(namespace, namespaces[namespace], oldRing)
+		}
+		mover.close()
+	}
+	status, _ := m.GetRebalanceStatus(context.Background(), &emptypb.Empty{})
+	return status
+}
+
+// blockMover runs one rebalance pass, keeping under the rate limit
+type blockMover struct {
+	blockRepairer
+	// Bytes per second, zero if unlimited
+	rate    int64
+	started time.Time
+	moved   int64
+}
+
+func (b *blockMover) moveNamespace(namespace string, ns *MetaStore, oldRing *ConsistentHashRing) {
+	moves := make([]blockMove, 0)
+	ns.Mutex.RLock()
+	hashes := make([]string, 0, len(ns.blockRefs))
+	for hash := range ns.blockRefs {
+		hashes = append(hashes, hash)
+	}
+	ns.Mutex.RUnlock()
+	sort.Strings(hashes)
+	for _, hash := range hashes {
+		from := oldRing.GetReplicaServers(hash)
+		for _, to := range b.ring.GetReplicaServers(hash) {
+			if !containsAddr(from, to) {
+				moves = append(moves, blockMove{hash: hash, from: from, to: to})
+			}
+		}
+	}
+	stripes, blockHashes := ns.retainedStripes()
+	for _, hash := range blockHashes {
+		stripe := stripes[hash]
+		from := oldRing.GetShardServers(hash, len(stripe.GetShardHashes()))
+		for i, to := range b.ring.GetShardServers(hash, len(stripe.GetShardHashes())) {
+			if from[i] != to {
+				moves = append(moves, blockMove{hash: stripe.GetShardHashes()[i], from: []string{from[i]}, to: to})
+			}
+		}
+	}
+
+	// Skip what the new servers already have, like blocks clients wrote
+	// there since the ring changed
+	byServer := make(map[string][]string)
+	for _, move := range moves {
+		byServer[move.to] = append(byServer[move.to], move.hash)
+	}
+	held := make(map[string]map[string]bool)
+	for addr, serverHashes := range byServer {
+		stored, err := b.hasBlocks(namespace, addr, serverHashes)
+		if err != nil {
+			log.Println(SURF_SERVER, "rebalance could not reach", addr+":", err)
+			continue
+		}
+		held[addr] = make(map[string]bool)
+		for _, hash := range stored {
+			held[addr][hash] = true
+		}
+	}
+	pending := make([]blockMove, 0, len(moves))
+	for _, move := range moves {
+		if !held[move.to][move.hash] {
+			pending = append(pending, move)
+		}
+	}
+	b.update(func(status *RebalanceStatus) { status.TotalBlocks += int64(len(pending)) })
+
+	// A block is lost if every previous server answers without it; one
+	// that cannot be reached may still have it, so that is a failure
+	sources := make(map[string][]string)
+	for _, move := range pending {
+		for _, addr := range move.from {
+			sources[addr] = append(sources[addr], move.hash)
+		}
+	}
+	stores := make(map[string]map[string]bool)
+	for addr, serverHashes := range sources {
+		stored, err := b.hasBlocks(namespace, addr, serverHashes)
+		if err != nil {
+			log.Println(SURF_SERVER, "rebalance could not reach", addr+":", err)
+			continue
+		}
+		stores[addr] = make(map[string]bool)
+		for _, hash := range stored {
+			stores[addr][hash] = true
+		}
+	}
+	lost := make(map[string]bool)
+
+	for _, move := range pending {
+		var block *Block
+		answered := 0
+		for _, addr := range move.from {
+			if stores[addr] != nil {
+				answered++
+				if !stores[addr][move.hash] {
+					continue
+				}
+			}
+			if block = b.getBlock(namespace, addr, move.hash); block != nil {
+				break
+			}
+		}
+		if block == nil && answered == len(move.from) {
+			log.Println(SURF_SERVER, "rebalance found", blockKey(namespace, move.hash), "on no previous server")
+			b.update(func(status *RebalanceStatus) {
+				status.CheckedBlocks++
+				if !lost[move.hash] {
+					status.LostBlocks = append(status.LostBlocks, blockKey(namespace, move.hash))
+				}
+			})
+			lost[move.hash] = true
+			continue
+		}
+		err := fmt.Errorf("no previous server could provide the block")
+		if block != nil {
+			err = b.putBlock(namespace, move.to, block)
+		}
+		if err != nil {
+			log.Println(SURF_SERVER, "rebalance could not move", blockKey(namespace, move.hash), "to", move.to+":", err)
+			b.update(func(status *RebalanceStatus) {
+				status.CheckedBlocks++
+				status.FailedBlocks++
+			})
+			continue
+		}
+		throttled := b.throttle(len(block.GetBlockData()))
+		b.update(func(status *RebalanceStatus) {
+			status.CheckedBlocks++
+			status.MovedBlocks++
+			status.MovedBytes += int64(len(block.GetBlockData()))
+			status.ThrottledNanos += throttled.Nanoseconds()
+		})
+	}
+}
+
+// Waits long enough after moving n bytes that the pass stays under the
+// rate limit, and returns how long that was
+func (b *blockMover) throttle(n int) time.Duration {
+	b.moved += int64(n)
+	if b.rate <= 0 {
+		return 0
+	}
+	ahead := time.Duration(b.moved*int64(time.Second)/b.rate) - time.Since(b.started)
+	if ahead <= 0 {
+		return 0
+	}
+	time.Sleep(ahead)
+	return ahead
+}
+
+func (b *blockMover) update(change func(status *RebalanceStatus)) {
+	b.metaStore.Mutex.Lock()
+	defer b.metaStore.Mutex.Unlock()
+	change(b.metaStore.rebalanceStatus)
+}
+
+func containsAddr(addrs []string, addr string) bool {
+	for _, a := range addrs {
+		if a == addr {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,233 @@
+package surfstore
+
+import "fmt"
+
+var ERR_TOO_FEW_SHARDS = fmt.Errorf("Too few shards to rebuild the block.")
+
+// ReedSolomon erasure codes data into data shards plus parity shards over
+// GF(256), such that any DataShards of the shards rebuild the data. The
+// code is systematic: the data shards are the data itself, cut into equal
+// pieces.
+type ReedSolomon struct {
+	DataShards   int
+	ParityShards int
+	// One row per shard, mapping the data shards to that shard; the
+	// first DataShards rows are the identity
+	matrix [][]byte
+}
+
+func NewReedSolomon(dataShards int, parityShards int) (*ReedSolomon, error) {
+	if dataShards <= 0 || parityShards < 0 || dataShards+parityShards > 256 {
+		return nil, fmt.Errorf("cannot code %d data and %d parity shards", dataShards, parityShards)
+	}
+	// Any DataShards rows of a Vandermonde matrix are independent, and
+	// multiplying by the inverse of its top keeps that while making the
+	// top the identity
+	vandermonde := make([][]byte, dataShards+parityShards)
+	for r := range vandermonde {
+		vandermonde[r] = make([]byte, dataShards)
+		for c := range vandermonde[r] {
+			vandermonde[r][c] = gfPow(byte(r), c)
+		}
+	}
+	topInverse, err := gfInvert(vandermonde[:dataShards])
+	if err != nil {
+		return nil, err
+	}
+	return &ReedSolomon{
+		DataShards:   dataShards,
+		ParityShards: parityShards,
+		matrix:       gfMultiply(vandermonde, topInverse),
+	}, nil
+}
+
+// Cuts data into zero-padded data shards and computes the parity shards
+func (rs *ReedSolomon) Encode(data []byte) [][]byte {
+	shardSize := (len(data) + rs.DataShards - 1) / rs.DataShards
+	if shardSize == 0 {
+		shardSize = 1
+	}
+	padded := make([]byte, shardSize*rs.DataShards)
+	copy(padded, data)
+	shards := make([][]byte, rs.DataShards+rs.ParityShards)
+	for i := 0; i < rs.DataShards; i++ {
+		shards[i] = padded[i*shardSize : (i+1)*shardSize]
+	}
+	for i := rs.DataShards; i < len(shards); i++ {
+		shards[i] = rs.codeShard(rs.matrix[i], shards[:rs.DataShards], shardSize)
+	}
+	return shards
+}
+
+// Fills in the missing (nil) shards from the ones present
+func (rs *ReedSolomon) Reconstruct(shards [][]byte) error {
+	if len(shards) != rs.DataShards+rs.ParityShards {
+		return fmt.Errorf("expected %d shards, got %d", rs.DataShards+rs.ParityShards, len(shards))
+	}
+	rows := make([][]byte, 0, rs.DataShards)
+	present := make([][]byte, 0, rs.DataShards)
+	shardSize := 0
+	for i, shard := range shards {
+		if shard != nil && len(rows) < rs.DataShards {
+			rows = append(rows, rs.matrix[i])
+			present = append(present, shard)
+			shardSize = len(shard)
+		}
+	}
+	if len(rows) < rs.DataShards {
+		return ERR_TOO_FEW_SHARDS
+	}
+	for _, shard := range present {
+		if len(shard) != shardSize {
+			return fmt.Errorf("shards have different sizes")
+		}
+	}
+
+	decode, err := gfInvert(rows)
+	if err != nil {
+		return err
+	}
+	data := make([][]byte, rs.DataShards)
+	for i := range data {
+		if shards[i] != nil {
+			data[i] = shards[i]
+		} else {
+			data[i] = rs.codeShard(decode[i], present, shardSize)
+		}
+	}
+	for i := range shards {
+		if shards[i] == nil {
+			if i < rs.DataShards {
+				shards[i] = data[i]
+			} else {
+				shards[i] = rs.codeShard(rs.matrix[i], data, shardSize)
+			}
+		}
+	}
+	return nil
+}
+
+// Rebuilds the first size bytes of data from the shards present
+func (rs *ReedSolomon) Decode(shards [][]byte, size int) ([]byte, error) {
+	if err := rs.Reconstruct(shards); err != nil {
+		return nil, err
+	}
+	data := make([]byte, 0, len(shards[0])*rs.DataShards)
+	for _, shard := range shards[:rs.DataShards] {
+		data = append(data, shard...)
+	}
+	if size > len(data) {
+		return nil, fmt.Errorf("shards hold %d bytes, expected %d", len(data), size)
+	}
+	return data[:size], nil
+}
+
+// Returns the sum of each input shard times its coefficient in row
+func (rs *ReedSolomon) codeShard(row []byte, inputs [][]byte, shardSize int) []byte {
+	out := make([]byte, shardSize)
+	for j, input := range inputs {
+		coefficient := row[j]
+		if coefficient == 0 {
+			continue
+		}
+		for b := 0; b < shardSize; b++ {
+			out[b] ^= gfMul(coefficient, input[b])
+		}
+	}
+	return out
+}
+
+// Arithmetic in GF(256) with the polynomial x^8 + x^4 + x^3 + x^2 + 1,
+// through tables of powers of its generator 2 and their logarithms
+var gfExp, gfLog = gfTables()
+
+func gfTables() ([510]byte, [256]int) {
+	var exp [510]byte
+	var log [256]int
+	x := 1
+	for i := 0; i < 255; i++ {
+		exp[i] = byte(x)
+		exp[i+255] = byte(x)
+		log[x] = i
+		x <<= 1
+		if x&0x100 != 0 {
+			x ^= 0x11d
+		}
+	}
+	return exp, log
+}
+
+func gfMul(a byte, b byte) byte {
+	if a == 0 || b == 0 {
+		return 0
+	}
+	return gfExp[gfLog[a]+gfLog[b]]
+}
+
+func gfInverse(a byte) byte {
+	return gfExp[255-gfLog[a]]
+}
+
+func gfPow(a byte, n int) byte {
+	if n == 0 {
+		return 1
+	}
+	if a == 0 {
+		return 0
+	}
+	return gfExp[(gfLog[a]*n)%255]
+}
+
+func gfMultiply(a [][]byte, b [][]byte) [][]byte {
+	out := make([][]byte, len(a))
+	for r := range a {
+		out[r] = make([]byte, len(b[0]))
+		for c := range out[r] {
+			var sum byte
+			for k := range b {
+				sum ^= gfMul(a[r][k], b[k][c])
+			}
+			out[r][c] = sum
+		}
+	}
+	return out
+}
+
+// Inverts a square matrix by Gauss-Jordan elimination
+func gfInvert(m [][]byte) ([][]byte, error) {
+	n := len(m)
+	work := make([][]byte, n)
+	for r := range m {
+		work[r] = make([]byte, 2*n)
+		copy(work[r], m[r])
+		work[r][n+r] = 1
+	}
+	for col := 0; col < n; col++ {
+		pivot := col
+		for pivot < n && work[pivot][col] == 0 {
+			pivot++
+		}
+		if pivot == n {
+			return nil, fmt.Errorf("matrix is singular")
+		}
+		work[col], work[pivot] = work[pivot], work[col]
+		scale := gfInverse(work[col][col])
+		for c := range work[col] {
+			work[col][c] = gfMul(work[col][c], scale)
+		}
+		for r := 0; r < n; r++ {
+			if r == col || work[r][col] == 0 {
+				continue
+			}
+			factor := work[r][col]
+			for c := range work[r] {
+				work[r][c] ^= gfMul(factor, work[col][c])
+			}
+		}
+	}
+	inverse := make([][]byte, n)
+	for r := range work {
+		inverse[r] = work[r][n:]
+	}
+	return inverse, nil
+}
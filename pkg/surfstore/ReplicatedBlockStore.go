@@ -0,0 +1,282 @@
+package surfstore
+
+import (
+	context "context"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	grpc "google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	emptypb "google.golang.org/protobuf/types/known/emptypb"
+)
+
+var ERR_NO_QUORUM = fmt.Errorf("Could not reach a quorum of block replicas.")
+var ERR_BLOCK_NOT_FOUND = fmt.Errorf("Block not found on any replica.")
+
+// How long a replica waits on a peer before counting it as failed
+const REPLICA_RPC_TIMEOUT = time.Second
+
+// ReplicatedBlockStore is one member of a group of BlockStore replicas.
+// A PutBlock succeeds once a majority of the group stores the block, and
+// any live replica can serve a GetBlock, fetching the block from its
+// peers if it missed the write.
+type ReplicatedBlockStore struct {
+	*BlockStore
+
+	id    int64
+	addrs []string
+	// Secures the links to peers; nil dials them in plaintext
+	TLS *TLSConfig
+
+	/*--------------- Chaos Monkey --------------*/
+	isCrashed      bool
+	isCrashedMutex *sync.RWMutex
+}
+
+func (rs *ReplicatedBlockStore) GetBlock(ctx context.Context, blockHash *BlockHash) (*Block, error) {
+	if rs.crashed() {
+		return nil, ERR_SERVER_CRASHED
+	}
+
+	namespace, err := rs.namespaceFromContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if rs.hasLocalBlock(namespace, blockHash.GetHash()) {
+		block, err := rs.BlockStore.GetBlock(ctx, blockHash)
+		if status.Code(err) != codes.DataLoss {
+			return block, err
+		}
+		// Our copy was corrupt and has been quarantined, so replace it from a peer
+	}
+
+	// We missed the write (e.g. we were crashed), so read from a peer and keep a copy
+	for idx, addr := range rs.addrs {
+		if int64(idx) == rs.id {
+			continue
+		}
+		block, err := rs.getBlockFromReplica(addr, namespace, blockHash.GetHash())
+		if err != nil || block == nil || GetBlockHashString(block.GetBlockData()) != blockHash.GetHash() {
+			continue
+		}
+		rs.BlockStore.PutBlock(ctx, block)
+		return block, nil
+	}
+	return nil, ERR_BLOCK_NOT_FOUND
+}
+
+// Stores the block locally and on the peers, returning once a majority of
+// the replicas (including this one) have it
+func (rs *ReplicatedBlockStore) PutBlock(ctx context.Context, block *Block) (*Success, error) {
+	if rs.crashed() {
+		return nil, ERR_SERVER_CRASHED
+	}
+	if block == nil {
+		return &Success{Flag: false}, ctx.Err()
+	}
+	namespace, err := rs.namespaceFromContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err := rs.BlockStore.PutBlock(ctx, block); err != nil {
+		return nil, err
+	}
+
+	quorum := len(rs.addrs)/2 + 1
+	acked := 1
+	if acked >= quorum {
+		return &Success{Flag: true}, nil
+	}
+
+	responses := make(chan bool, len(rs.addrs)-1)
+	for idx, addr := range rs.addrs {
+		if int64(idx) == rs.id {
+			continue
+		}
+		go func(addr string) {
+			responses <- rs.replicateBlockToReplica(addr, namespace, block) == nil
+		}(addr)
+	}
+
+	for pending := len(rs.addrs) - 1; pending > 0; pending-- {
+		if <-responses {
+			acked++
+		}
+		if acked >= quorum {
+			return &Success{Flag: true}, nil
+		}
+	}
+	return &Success{Flag: false}, ERR_NO_QUORUM
+}
+
+// Only reports the blocks held by this replica
+func (rs *ReplicatedBlockStore) HasBlocks(ctx context.Context, blockHashesIn *BlockHashes) (*BlockHashes, error) {
+	if rs.crashed() {
+		return nil, ERR_SERVER_CRASHED
+	}
+	return rs.BlockStore.HasBlocks(ctx, blockHashesIn)
+}
+
+// Only lists the blocks held by this replica
+func (rs *ReplicatedBlockStore) ListBlocks(ctx context.Context, empty *emptypb.Empty) (*BlockHashes, error) {
+	if rs.crashed() {
+		return nil, ERR_SERVER_CRASHED
+	}
+	return rs.BlockStore.ListBlocks(ctx, empty)
+}
+
+// Deletes this replica's copies, then has the peers delete theirs, so no
+// peer goes on serving the blocks to replicas that fall back on it.
+// Reports the blocks deleted here; a peer that cannot be reached keeps
+// its copies until the next collection.
+func (rs *ReplicatedBlockStore) DeleteBlocks(ctx context.Context, blockHashesIn *BlockHashes) (*BlockHashes, error) {
+	if rs.crashed() {
+		return nil, ERR_SERVER_CRASHED
+	}
+	namespace, err := rs.namespaceFromContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+	deleted, err := rs.BlockStore.DeleteBlocks(ctx, blockHashesIn)
+	if len(deleted.GetHashes()) == 0 {
+		return deleted, err
+	}
+
+	var wg sync.WaitGroup
+	for idx, addr := range rs.addrs {
+		if int64(idx) == rs.id {
+			continue
+		}
+		wg.Add(1)
+		go func(addr string) {
+			defer wg.Done()
+			if err := rs.deleteBlocksFromReplica(addr, namespace, deleted); err != nil {
+				log.Println(SURF_SERVER, "could not delete blocks from replica", addr, err)
+			}
+		}(addr)
+	}
+	wg.Wait()
+	return deleted, err
+}
+
+// Deletes the copies held by this replica, keeping the ones used within
+// its own grace period
+func (rs *ReplicatedBlockStore) DeleteReplicatedBlocks(ctx context.Context, blockHashesIn *BlockHashes) (*BlockHashes, error) {
+	if rs.crashed() {
+		return nil, ERR_SERVER_CRASHED
+	}
+	return rs.BlockStore.DeleteBlocks(ctx, blockHashesIn)
+}
+
+func (rs *ReplicatedBlockStore) ReplicateBlock(ctx context.Context, block *Block) (*Success, error) {
+	if rs.crashed() {
+		return nil, ERR_SERVER_CRASHED
+	}
+	return rs.BlockStore.PutBlock(ctx, block)
+}
+
+func (rs *ReplicatedBlockStore) Crash(ctx context.Context, _ *emptypb.Empty) (*Success, error) {
+	rs.isCrashedMutex.Lock()
+	rs.isCrashed = true
+	rs.isCrashedMutex.Unlock()
+
+	return &Success{Flag: true}, nil
+}
+
+func (rs *ReplicatedBlockStore) Restore(ctx context.Context, _ *emptypb.Empty) (*Success, error) {
+	rs.isCrashedMutex.Lock()
+	rs.isCrashed = false
+	rs.isCrashedMutex.Unlock()
+
+	return &Success{Flag: true}, nil
+}
+
+func (rs *ReplicatedBlockStore) IsCrashed(ctx context.Context, _ *emptypb.Empty) (*CrashedState, error) {
+	return &CrashedState{IsCrashed: rs.crashed()}, nil
+}
+
+func (rs *ReplicatedBlockStore) crashed() bool {
+	rs.isCrashedMutex.RLock()
+	defer rs.isCrashedMutex.RUnlock()
+	return rs.isCrashed
+}
+
+func (rs *ReplicatedBlockStore) hasLocalBlock(namespace string, hash string) bool {
+	ok, _ := rs.BlockStore.Storage.Has(namespace, hash)
+	return ok
+}
+
+func (rs *ReplicatedBlockStore) replicateBlockToReplica(addr string, namespace string, block *Block) error {
+	conn, err := grpc.Dial(addr, rs.TLS.DialOption())
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	c := NewBlockStoreClient(conn)
+
+	ctx, cancel := context.WithTimeout(context.Background(), REPLICA_RPC_TIMEOUT)
+	defer cancel()
+	succ, err := c.ReplicateBlock(WithToken(WithNamespace(ctx, namespace), rs.Auth.ServerToken()), block)
+	if err != nil {
+		return err
+	}
+	if !succ.Flag {
+		return fmt.Errorf("replica %s rejected block", addr)
+	}
+	return nil
+}
+
+func (rs *ReplicatedBlockStore) deleteBlocksFromReplica(addr string, namespace string, blockHashes *BlockHashes) error {
+	conn, err := grpc.Dial(addr, rs.TLS.DialOption())
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	c := NewBlockStoreClient(conn)
+
+	ctx, cancel := context.WithTimeout(context.Background(), REPLICA_RPC_TIMEOUT)
+	defer cancel()
+	_, err = c.DeleteReplicatedBlocks(WithToken(WithNamespace(ctx, namespace), rs.Auth.ServerToken()), blockHashes)
+	return err
+}
+
+// Peers are asked with HasBlocks first so that a replica which is also
+// missing the block does not go on to ask the rest of the group
+func (rs *ReplicatedBlockStore) getBlockFromReplica(addr string, namespace string, hash string) (*Block, error) {
+	conn, err := grpc.Dial(addr, rs.TLS.DialOption())
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	c := NewBlockStoreClient(conn)
+
+	// Only the namespace is passed on, not the caller's token or other metadata
+	ctx, cancel := context.WithTimeout(context.Background(), REPLICA_RPC_TIMEOUT)
+	defer cancel()
+	ctx = WithToken(WithNamespace(ctx, namespace), rs.Auth.ServerToken())
+	has, err := c.HasBlocks(ctx, &BlockHashes{Hashes: []string{hash}})
+	if err != nil {
+		return nil, err
+	}
+	if len(has.Hashes) == 0 {
+		return nil, ERR_BLOCK_NOT_FOUND
+	}
+	return c.GetBlock(ctx, &BlockHash{Hash: hash})
+}
+
+// This line guarantees all method for ReplicatedBlockStore are implemented
+var _ BlockStoreReplicaInterface = new(ReplicatedBlockStore)
+
+func NewReplicatedBlockStore(id int64, addrs []string) *ReplicatedBlockStore {
+	return &ReplicatedBlockStore{
+		BlockStore:     NewBlockStore(),
+		id:             id,
+		addrs:          addrs,
+		isCrashed:      false,
+		isCrashedMutex: &sync.RWMutex{},
+	}
+}
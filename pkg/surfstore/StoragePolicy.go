@@ -0,0 +1,131 @@
+package surfstore
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+)
+
+var ERR_INVALID_STRIPE = fmt.Errorf("Erasure stripe does not match a block of the file.")
+
+// StoragePolicyConfig decides which files are erasure coded instead of
+// replicated. A nil *StoragePolicyConfig replicates everything.
+//
+// The config file has one rule per line:
+//
+//	<namespace|*> <prefix|*> replicate
+//	<namespace|*> <prefix|*> erasure <data shards> <parity shards>
+//
+// A file follows the rule with the longest prefix it starts with; of two
+// rules with the same prefix, the one naming its namespace wins.
+type StoragePolicyConfig struct {
+	rules []storagePolicyRule
+}
+
+type storagePolicyRule struct {
+	namespace string
+	policy    *StoragePolicy
+}
+
+func LoadStoragePolicyFile(filename string) (*StoragePolicyConfig, error) {
+	configFD, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer configFD.Close()
+
+	config := &StoragePolicyConfig{}
+	scanner := bufio.NewScanner(configFD)
+	for lineNum := 1; scanner.Scan(); lineNum++ {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+		if len(fields) < 3 {
+			return nil, fmt.Errorf("%s:%d: malformed line", filename, lineNum)
+		}
+		rule := storagePolicyRule{namespace: fields[0], policy: &StoragePolicy{Prefix: fields[1]}}
+		if rule.namespace != AUTH_WILDCARD {
+			if err := ValidateNamespace(rule.namespace); err != nil {
+				return nil, fmt.Errorf("%s:%d: %v", filename, lineNum, err)
+			}
+		}
+		if rule.policy.Prefix == AUTH_WILDCARD {
+			rule.policy.Prefix = ""
+		}
+		switch {
+		case fields[2] == "replicate" && len(fields) == 3:
+		case fields[2] == "erasure" && len(fields) == 5:
+			dataShards, dataErr := strconv.Atoi(fields[3])
+			parityShards, parityErr := strconv.Atoi(fields[4])
+			if dataErr != nil || parityErr != nil {
+				return nil, fmt.Errorf("%s:%d: malformed shard counts", filename, lineNum)
+			}
+			if _, err := NewReedSolomon(dataShards, parityShards); err != nil {
+				return nil, fmt.Errorf("%s:%d: %v", filename, lineNum, err)
+			}
+			rule.policy.DataShards = int32(dataShards)
+			rule.policy.ParityShards = int32(parityShards)
+		default:
+			return nil, fmt.Errorf("%s:%d: malformed line", filename, lineNum)
+		}
+		config.rules = append(config.rules, rule)
+	}
+	return config, scanner.Err()
+}
+
+// Returns the policies that apply in a namespace, one per prefix
+func (c *StoragePolicyConfig) policiesFor(namespace string) []*StoragePolicy {
+	policies := make([]*StoragePolicy, 0)
+	if c == nil {
+		return policies
+	}
+	byPrefix := make(map[string]int)
+	for _, rule := range c.rules {
+		if rule.namespace != AUTH_WILDCARD && rule.namespace != namespace {
+			continue
+		}
+		i, ok := byPrefix[rule.policy.Prefix]
+		if !ok {
+			byPrefix[rule.policy.Prefix] = len(policies)
+			policies = append(policies, rule.policy)
+		} else if rule.namespace != AUTH_WILDCARD {
+			policies[i] = rule.policy
+		}
+	}
+	return policies
+}
+
+// Returns the policy with the longest prefix of the filename, or nil if
+// the file is replicated
+func storagePolicyFor(policies []*StoragePolicy, filename string) *StoragePolicy {
+	var best *StoragePolicy
+	for _, policy := range policies {
+		if strings.HasPrefix(filename, policy.GetPrefix()) &&
+			(best == nil || len(policy.GetPrefix()) > len(best.GetPrefix())) {
+			best = policy
+		}
+	}
+	if best.GetDataShards() == 0 {
+		return nil
+	}
+	return best
+}
+
+// Checks that each stripe encodes a block of the file into more shards
+// than it needs to rebuild the block
+func checkStripes(fileMetaData *FileMetaData) error {
+	blocks := make(map[string]bool)
+	for _, hash := range fileMetaData.GetBlockHashList() {
+		blocks[hash] = true
+	}
+	for _, stripe := range fileMetaData.GetErasureStripes() {
+		if !blocks[stripe.GetBlockHash()] || stripe.GetDataShards() <= 0 ||
+			len(stripe.GetShardHashes()) <= int(stripe.GetDataShards()) {
+			return ERR_INVALID_STRIPE
+		}
+	}
+	return nil
+}
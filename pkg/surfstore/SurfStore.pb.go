@@ -21,6 +21,57 @@ const (
 	_ = protoimpl.EnforceVersion(protoimpl.MaxVersion - 20)
 )
 
+type BlockStoreState int32
+
+const (
+	BlockStoreState_ACTIVE BlockStoreState = 0
+	// Leaving the ring; blocks move off it, but it still serves them
+	BlockStoreState_DRAINING BlockStoreState = 1
+	// Gone for good; it cannot register again
+	BlockStoreState_DECOMMISSIONED BlockStoreState = 2
+)
+
+// Enum value maps for BlockStoreState.
+var (
+	BlockStoreState_name = map[int32]string{
+		0: "ACTIVE",
+		1: "DRAINING",
+		2: "DECOMMISSIONED",
+	}
+	BlockStoreState_value = map[string]int32{
+		"ACTIVE":         0,
+		"DRAINING":       1,
+		"DECOMMISSIONED": 2,
+	}
+)
+
+func (x BlockStoreState) Enum() *BlockStoreState {
+	p := new(BlockStoreState)
+	*p = x
+	return p
+}
+
+func (x BlockStoreState) String() string {
+	return protoimpl.X.EnumStringOf(x.Descriptor(), protoreflect.EnumNumber(x))
+}
+
+func (BlockStoreState) Descriptor() protoreflect.EnumDescriptor {
+	return file_pkg_surfstore_SurfStore_proto_enumTypes[0].Descriptor()
+}
+
+func (BlockStoreState) Type() protoreflect.EnumType {
+	return &file_pkg_surfstore_SurfStore_proto_enumTypes[0]
+}
+
+func (x BlockStoreState) Number() protoreflect.EnumNumber {
+	return protoreflect.EnumNumber(x)
+}
+
+// Deprecated: Use BlockStoreState.Descriptor instead.
+func (BlockStoreState) EnumDescriptor() ([]byte, []int) {
+	return file_pkg_surfstore_SurfStore_proto_rawDescGZIP(), []int{0}
+}
+
 type BlockHash struct {
 	state         protoimpl.MessageState
 	sizeCache     protoimpl.SizeCache
@@ -225,6 +276,19 @@ type FileMetaData struct {
 	Filename      string   `protobuf:"bytes,1,opt,name=filename,proto3" json:"filename,omitempty"`
 	Version       int32    `protobuf:"varint,2,opt,name=version,proto3" json:"version,omitempty"`
 	BlockHashList []string `protobuf:"bytes,3,rep,name=blockHashList,proto3" json:"blockHashList,omitempty"`
+	// set by the MetaStore when the version is committed
+	Revision  int64 `protobuf:"varint,4,opt,name=revision,proto3" json:"revision,omitempty"`
+	Timestamp int64 `protobuf:"varint,5,opt,name=timestamp,proto3" json:"timestamp,omitempty"`
+	// permission bits, modification time in unix nanoseconds and size in
+	// bytes; symlinks have a target and no blocks
+	Mode          uint32 `protobuf:"varint,6,opt,name=mode,proto3" json:"mode,omitempty"`
+	Mtime         int64  `protobuf:"varint,7,opt,name=mtime,proto3" json:"mtime,omitempty"`
+	Size          int64  `protobuf:"varint,8,opt,name=size,proto3" json:"size,omitempty"`
+	SymlinkTarget string `protobuf:"bytes,9,opt,name=symlinkTarget,proto3" json:"symlinkTarget,omitempty"`
+	// identity that stored the version, set by the MetaStore
+	Owner string `protobuf:"bytes,10,opt,name=owner,proto3" json:"owner,omitempty"`
+	// the erasure-coded blocks of the file; the other blocks are replicated
+	ErasureStripes []*ErasureStripe `protobuf:"bytes,11,rep,name=erasureStripes,proto3" json:"erasureStripes,omitempty"`
 }
 
 func (x *FileMetaData) Reset() {
@@ -280,16 +344,79 @@ func (x *FileMetaData) GetBlockHashList() []string {
 	return nil
 }
 
-type FileInfoMap struct {
+func (x *FileMetaData) GetRevision() int64 {
+	if x != nil {
+		return x.Revision
+	}
+	return 0
+}
+
+func (x *FileMetaData) GetTimestamp() int64 {
+	if x != nil {
+		return x.Timestamp
+	}
+	return 0
+}
+
+func (x *FileMetaData) GetMode() uint32 {
+	if x != nil {
+		return x.Mode
+	}
+	return 0
+}
+
+func (x *FileMetaData) GetMtime() int64 {
+	if x != nil {
+		return x.Mtime
+	}
+	return 0
+}
+
+func (x *FileMetaData) GetSize() int64 {
+	if x != nil {
+		return x.Size
+	}
+	return 0
+}
+
+func (x *FileMetaData) GetSymlinkTarget() string {
+	if x != nil {
+		return x.SymlinkTarget
+	}
+	return ""
+}
+
+func (x *FileMetaData) GetOwner() string {
+	if x != nil {
+		return x.Owner
+	}
+	return ""
+}
+
+func (x *FileMetaData) GetErasureStripes() []*ErasureStripe {
+	if x != nil {
+		return x.ErasureStripes
+	}
+	return nil
+}
+
+// A block split into data shards plus parity shards, any dataShards of
+// which rebuild it. Shard i is stored on the i-th server found walking
+// the ring from the block's hash.
+type ErasureStripe struct {
 	state         protoimpl.MessageState
 	sizeCache     protoimpl.SizeCache
 	unknownFields protoimpl.UnknownFields
 
-	FileInfoMap map[string]*FileMetaData `protobuf:"bytes,1,rep,name=fileInfoMap,proto3" json:"fileInfoMap,omitempty" protobuf_key:"bytes,1,opt,name=key,proto3" protobuf_val:"bytes,2,opt,name=value,proto3"`
+	BlockHash  string `protobuf:"bytes,1,opt,name=blockHash,proto3" json:"blockHash,omitempty"`
+	BlockSize  int32  `protobuf:"varint,2,opt,name=blockSize,proto3" json:"blockSize,omitempty"`
+	DataShards int32  `protobuf:"varint,3,opt,name=dataShards,proto3" json:"dataShards,omitempty"`
+	// data shards first, then parity shards
+	ShardHashes []string `protobuf:"bytes,4,rep,name=shardHashes,proto3" json:"shardHashes,omitempty"`
 }
 
-func (x *FileInfoMap) Reset() {
-	*x = FileInfoMap{}
+func (x *ErasureStripe) Reset() {
+	*x = ErasureStripe{}
 	if protoimpl.UnsafeEnabled {
 		mi := &file_pkg_surfstore_SurfStore_proto_msgTypes[5]
 		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
@@ -297,13 +424,13 @@ func (x *FileInfoMap) Reset() {
 	}
 }
 
-func (x *FileInfoMap) String() string {
+func (x *ErasureStripe) String() string {
 	return protoimpl.X.MessageStringOf(x)
 }
 
-func (*FileInfoMap) ProtoMessage() {}
+func (*ErasureStripe) ProtoMessage() {}
 
-func (x *FileInfoMap) ProtoReflect() protoreflect.Message {
+func (x *ErasureStripe) ProtoReflect() protoreflect.Message {
 	mi := &file_pkg_surfstore_SurfStore_proto_msgTypes[5]
 	if protoimpl.UnsafeEnabled && x != nil {
 		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
@@ -315,28 +442,53 @@ func (x *FileInfoMap) ProtoReflect() protoreflect.Message {
 	return mi.MessageOf(x)
 }
 
-// Deprecated: Use FileInfoMap.ProtoReflect.Descriptor instead.
-func (*FileInfoMap) Descriptor() ([]byte, []int) {
+// Deprecated: Use ErasureStripe.ProtoReflect.Descriptor instead.
+func (*ErasureStripe) Descriptor() ([]byte, []int) {
 	return file_pkg_surfstore_SurfStore_proto_rawDescGZIP(), []int{5}
 }
 
-func (x *FileInfoMap) GetFileInfoMap() map[string]*FileMetaData {
+func (x *ErasureStripe) GetBlockHash() string {
 	if x != nil {
-		return x.FileInfoMap
+		return x.BlockHash
+	}
+	return ""
+}
+
+func (x *ErasureStripe) GetBlockSize() int32 {
+	if x != nil {
+		return x.BlockSize
+	}
+	return 0
+}
+
+func (x *ErasureStripe) GetDataShards() int32 {
+	if x != nil {
+		return x.DataShards
+	}
+	return 0
+}
+
+func (x *ErasureStripe) GetShardHashes() []string {
+	if x != nil {
+		return x.ShardHashes
 	}
 	return nil
 }
 
-type Version struct {
+// How files whose names start with prefix are stored: erasure coded if
+// dataShards is set, replicated otherwise
+type StoragePolicy struct {
 	state         protoimpl.MessageState
 	sizeCache     protoimpl.SizeCache
 	unknownFields protoimpl.UnknownFields
 
-	Version int32 `protobuf:"varint,1,opt,name=version,proto3" json:"version,omitempty"`
+	Prefix       string `protobuf:"bytes,1,opt,name=prefix,proto3" json:"prefix,omitempty"`
+	DataShards   int32  `protobuf:"varint,2,opt,name=dataShards,proto3" json:"dataShards,omitempty"`
+	ParityShards int32  `protobuf:"varint,3,opt,name=parityShards,proto3" json:"parityShards,omitempty"`
 }
 
-func (x *Version) Reset() {
-	*x = Version{}
+func (x *StoragePolicy) Reset() {
+	*x = StoragePolicy{}
 	if protoimpl.UnsafeEnabled {
 		mi := &file_pkg_surfstore_SurfStore_proto_msgTypes[6]
 		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
@@ -344,13 +496,13 @@ func (x *Version) Reset() {
 	}
 }
 
-func (x *Version) String() string {
+func (x *StoragePolicy) String() string {
 	return protoimpl.X.MessageStringOf(x)
 }
 
-func (*Version) ProtoMessage() {}
+func (*StoragePolicy) ProtoMessage() {}
 
-func (x *Version) ProtoReflect() protoreflect.Message {
+func (x *StoragePolicy) ProtoReflect() protoreflect.Message {
 	mi := &file_pkg_surfstore_SurfStore_proto_msgTypes[6]
 	if protoimpl.UnsafeEnabled && x != nil {
 		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
@@ -362,28 +514,42 @@ func (x *Version) ProtoReflect() protoreflect.Message {
 	return mi.MessageOf(x)
 }
 
-// Deprecated: Use Version.ProtoReflect.Descriptor instead.
-func (*Version) Descriptor() ([]byte, []int) {
+// Deprecated: Use StoragePolicy.ProtoReflect.Descriptor instead.
+func (*StoragePolicy) Descriptor() ([]byte, []int) {
 	return file_pkg_surfstore_SurfStore_proto_rawDescGZIP(), []int{6}
 }
 
-func (x *Version) GetVersion() int32 {
+func (x *StoragePolicy) GetPrefix() string {
 	if x != nil {
-		return x.Version
+		return x.Prefix
+	}
+	return ""
+}
+
+func (x *StoragePolicy) GetDataShards() int32 {
+	if x != nil {
+		return x.DataShards
 	}
 	return 0
 }
 
-type BlockStoreAddr struct {
+func (x *StoragePolicy) GetParityShards() int32 {
+	if x != nil {
+		return x.ParityShards
+	}
+	return 0
+}
+
+type StoragePolicies struct {
 	state         protoimpl.MessageState
 	sizeCache     protoimpl.SizeCache
 	unknownFields protoimpl.UnknownFields
 
-	Addr string `protobuf:"bytes,1,opt,name=addr,proto3" json:"addr,omitempty"`
+	Policies []*StoragePolicy `protobuf:"bytes,1,rep,name=policies,proto3" json:"policies,omitempty"`
 }
 
-func (x *BlockStoreAddr) Reset() {
-	*x = BlockStoreAddr{}
+func (x *StoragePolicies) Reset() {
+	*x = StoragePolicies{}
 	if protoimpl.UnsafeEnabled {
 		mi := &file_pkg_surfstore_SurfStore_proto_msgTypes[7]
 		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
@@ -391,13 +557,13 @@ func (x *BlockStoreAddr) Reset() {
 	}
 }
 
-func (x *BlockStoreAddr) String() string {
+func (x *StoragePolicies) String() string {
 	return protoimpl.X.MessageStringOf(x)
 }
 
-func (*BlockStoreAddr) ProtoMessage() {}
+func (*StoragePolicies) ProtoMessage() {}
 
-func (x *BlockStoreAddr) ProtoReflect() protoreflect.Message {
+func (x *StoragePolicies) ProtoReflect() protoreflect.Message {
 	mi := &file_pkg_surfstore_SurfStore_proto_msgTypes[7]
 	if protoimpl.UnsafeEnabled && x != nil {
 		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
@@ -409,28 +575,28 @@ func (x *BlockStoreAddr) ProtoReflect() protoreflect.Message {
 	return mi.MessageOf(x)
 }
 
-// Deprecated: Use BlockStoreAddr.ProtoReflect.Descriptor instead.
-func (*BlockStoreAddr) Descriptor() ([]byte, []int) {
+// Deprecated: Use StoragePolicies.ProtoReflect.Descriptor instead.
+func (*StoragePolicies) Descriptor() ([]byte, []int) {
 	return file_pkg_surfstore_SurfStore_proto_rawDescGZIP(), []int{7}
 }
 
-func (x *BlockStoreAddr) GetAddr() string {
+func (x *StoragePolicies) GetPolicies() []*StoragePolicy {
 	if x != nil {
-		return x.Addr
+		return x.Policies
 	}
-	return ""
+	return nil
 }
 
-type CrashedState struct {
+type FileName struct {
 	state         protoimpl.MessageState
 	sizeCache     protoimpl.SizeCache
 	unknownFields protoimpl.UnknownFields
 
-	IsCrashed bool `protobuf:"varint,1,opt,name=isCrashed,proto3" json:"isCrashed,omitempty"`
+	Filename string `protobuf:"bytes,1,opt,name=filename,proto3" json:"filename,omitempty"`
 }
 
-func (x *CrashedState) Reset() {
-	*x = CrashedState{}
+func (x *FileName) Reset() {
+	*x = FileName{}
 	if protoimpl.UnsafeEnabled {
 		mi := &file_pkg_surfstore_SurfStore_proto_msgTypes[8]
 		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
@@ -438,13 +604,13 @@ func (x *CrashedState) Reset() {
 	}
 }
 
-func (x *CrashedState) String() string {
+func (x *FileName) String() string {
 	return protoimpl.X.MessageStringOf(x)
 }
 
-func (*CrashedState) ProtoMessage() {}
+func (*FileName) ProtoMessage() {}
 
-func (x *CrashedState) ProtoReflect() protoreflect.Message {
+func (x *FileName) ProtoReflect() protoreflect.Message {
 	mi := &file_pkg_surfstore_SurfStore_proto_msgTypes[8]
 	if protoimpl.UnsafeEnabled && x != nil {
 		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
@@ -456,32 +622,29 @@ func (x *CrashedState) ProtoReflect() protoreflect.Message {
 	return mi.MessageOf(x)
 }
 
-// Deprecated: Use CrashedState.ProtoReflect.Descriptor instead.
-func (*CrashedState) Descriptor() ([]byte, []int) {
+// Deprecated: Use FileName.ProtoReflect.Descriptor instead.
+func (*FileName) Descriptor() ([]byte, []int) {
 	return file_pkg_surfstore_SurfStore_proto_rawDescGZIP(), []int{8}
 }
 
-func (x *CrashedState) GetIsCrashed() bool {
+func (x *FileName) GetFilename() string {
 	if x != nil {
-		return x.IsCrashed
+		return x.Filename
 	}
-	return false
+	return ""
 }
 
-type AppendEntryInput struct {
+type FileVersion struct {
 	state         protoimpl.MessageState
 	sizeCache     protoimpl.SizeCache
 	unknownFields protoimpl.UnknownFields
 
-	Term         int64              `protobuf:"varint,1,opt,name=term,proto3" json:"term,omitempty"`
-	PrevLogIndex int64              `protobuf:"varint,2,opt,name=prevLogIndex,proto3" json:"prevLogIndex,omitempty"`
-	PrevLogTerm  int64              `protobuf:"varint,3,opt,name=prevLogTerm,proto3" json:"prevLogTerm,omitempty"`
-	Entries      []*UpdateOperation `protobuf:"bytes,4,rep,name=entries,proto3" json:"entries,omitempty"`
-	LeaderCommit int64              `protobuf:"varint,5,opt,name=leaderCommit,proto3" json:"leaderCommit,omitempty"`
+	Filename string `protobuf:"bytes,1,opt,name=filename,proto3" json:"filename,omitempty"`
+	Version  int32  `protobuf:"varint,2,opt,name=version,proto3" json:"version,omitempty"`
 }
 
-func (x *AppendEntryInput) Reset() {
-	*x = AppendEntryInput{}
+func (x *FileVersion) Reset() {
+	*x = FileVersion{}
 	if protoimpl.UnsafeEnabled {
 		mi := &file_pkg_surfstore_SurfStore_proto_msgTypes[9]
 		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
@@ -489,13 +652,13 @@ func (x *AppendEntryInput) Reset() {
 	}
 }
 
-func (x *AppendEntryInput) String() string {
+func (x *FileVersion) String() string {
 	return protoimpl.X.MessageStringOf(x)
 }
 
-func (*AppendEntryInput) ProtoMessage() {}
+func (*FileVersion) ProtoMessage() {}
 
-func (x *AppendEntryInput) ProtoReflect() protoreflect.Message {
+func (x *FileVersion) ProtoReflect() protoreflect.Message {
 	mi := &file_pkg_surfstore_SurfStore_proto_msgTypes[9]
 	if protoimpl.UnsafeEnabled && x != nil {
 		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
@@ -507,59 +670,36 @@ func (x *AppendEntryInput) ProtoReflect() protoreflect.Message {
 	return mi.MessageOf(x)
 }
 
-// Deprecated: Use AppendEntryInput.ProtoReflect.Descriptor instead.
-func (*AppendEntryInput) Descriptor() ([]byte, []int) {
+// Deprecated: Use FileVersion.ProtoReflect.Descriptor instead.
+func (*FileVersion) Descriptor() ([]byte, []int) {
 	return file_pkg_surfstore_SurfStore_proto_rawDescGZIP(), []int{9}
 }
 
-func (x *AppendEntryInput) GetTerm() int64 {
-	if x != nil {
-		return x.Term
-	}
-	return 0
-}
-
-func (x *AppendEntryInput) GetPrevLogIndex() int64 {
-	if x != nil {
-		return x.PrevLogIndex
-	}
-	return 0
-}
-
-func (x *AppendEntryInput) GetPrevLogTerm() int64 {
-	if x != nil {
-		return x.PrevLogTerm
-	}
-	return 0
-}
-
-func (x *AppendEntryInput) GetEntries() []*UpdateOperation {
+func (x *FileVersion) GetFilename() string {
 	if x != nil {
-		return x.Entries
+		return x.Filename
 	}
-	return nil
+	return ""
 }
 
-func (x *AppendEntryInput) GetLeaderCommit() int64 {
+func (x *FileVersion) GetVersion() int32 {
 	if x != nil {
-		return x.LeaderCommit
+		return x.Version
 	}
 	return 0
 }
 
-type AppendEntryOutput struct {
+// The retained file versions whose block lists include a block
+type BlockReferences struct {
 	state         protoimpl.MessageState
 	sizeCache     protoimpl.SizeCache
 	unknownFields protoimpl.UnknownFields
 
-	ServerId     int64 `protobuf:"varint,1,opt,name=serverId,proto3" json:"serverId,omitempty"`
-	Term         int64 `protobuf:"varint,2,opt,name=term,proto3" json:"term,omitempty"`
-	Success      bool  `protobuf:"varint,3,opt,name=success,proto3" json:"success,omitempty"`
-	MatchedIndex int64 `protobuf:"varint,4,opt,name=matchedIndex,proto3" json:"matchedIndex,omitempty"`
+	References []*FileVersion `protobuf:"bytes,1,rep,name=references,proto3" json:"references,omitempty"`
 }
 
-func (x *AppendEntryOutput) Reset() {
-	*x = AppendEntryOutput{}
+func (x *BlockReferences) Reset() {
+	*x = BlockReferences{}
 	if protoimpl.UnsafeEnabled {
 		mi := &file_pkg_surfstore_SurfStore_proto_msgTypes[10]
 		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
@@ -567,13 +707,13 @@ func (x *AppendEntryOutput) Reset() {
 	}
 }
 
-func (x *AppendEntryOutput) String() string {
+func (x *BlockReferences) String() string {
 	return protoimpl.X.MessageStringOf(x)
 }
 
-func (*AppendEntryOutput) ProtoMessage() {}
+func (*BlockReferences) ProtoMessage() {}
 
-func (x *AppendEntryOutput) ProtoReflect() protoreflect.Message {
+func (x *BlockReferences) ProtoReflect() protoreflect.Message {
 	mi := &file_pkg_surfstore_SurfStore_proto_msgTypes[10]
 	if protoimpl.UnsafeEnabled && x != nil {
 		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
@@ -585,50 +725,28 @@ func (x *AppendEntryOutput) ProtoReflect() protoreflect.Message {
 	return mi.MessageOf(x)
 }
 
-// Deprecated: Use AppendEntryOutput.ProtoReflect.Descriptor instead.
-func (*AppendEntryOutput) Descriptor() ([]byte, []int) {
+// Deprecated: Use BlockReferences.ProtoReflect.Descriptor instead.
+func (*BlockReferences) Descriptor() ([]byte, []int) {
 	return file_pkg_surfstore_SurfStore_proto_rawDescGZIP(), []int{10}
 }
 
-func (x *AppendEntryOutput) GetServerId() int64 {
-	if x != nil {
-		return x.ServerId
-	}
-	return 0
-}
-
-func (x *AppendEntryOutput) GetTerm() int64 {
-	if x != nil {
-		return x.Term
-	}
-	return 0
-}
-
-func (x *AppendEntryOutput) GetSuccess() bool {
-	if x != nil {
-		return x.Success
-	}
-	return false
-}
-
-func (x *AppendEntryOutput) GetMatchedIndex() int64 {
+func (x *BlockReferences) GetReferences() []*FileVersion {
 	if x != nil {
-		return x.MatchedIndex
+		return x.References
 	}
-	return 0
+	return nil
 }
 
-type UpdateOperation struct {
+type FileHistory struct {
 	state         protoimpl.MessageState
 	sizeCache     protoimpl.SizeCache
 	unknownFields protoimpl.UnknownFields
 
-	Term         int64         `protobuf:"varint,1,opt,name=term,proto3" json:"term,omitempty"`
-	FileMetaData *FileMetaData `protobuf:"bytes,3,opt,name=fileMetaData,proto3" json:"fileMetaData,omitempty"`
+	Versions []*FileMetaData `protobuf:"bytes,1,rep,name=versions,proto3" json:"versions,omitempty"`
 }
 
-func (x *UpdateOperation) Reset() {
-	*x = UpdateOperation{}
+func (x *FileHistory) Reset() {
+	*x = FileHistory{}
 	if protoimpl.UnsafeEnabled {
 		mi := &file_pkg_surfstore_SurfStore_proto_msgTypes[11]
 		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
@@ -636,13 +754,13 @@ func (x *UpdateOperation) Reset() {
 	}
 }
 
-func (x *UpdateOperation) String() string {
+func (x *FileHistory) String() string {
 	return protoimpl.X.MessageStringOf(x)
 }
 
-func (*UpdateOperation) ProtoMessage() {}
+func (*FileHistory) ProtoMessage() {}
 
-func (x *UpdateOperation) ProtoReflect() protoreflect.Message {
+func (x *FileHistory) ProtoReflect() protoreflect.Message {
 	mi := &file_pkg_surfstore_SurfStore_proto_msgTypes[11]
 	if protoimpl.UnsafeEnabled && x != nil {
 		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
@@ -654,38 +772,29 @@ func (x *UpdateOperation) ProtoReflect() protoreflect.Message {
 	return mi.MessageOf(x)
 }
 
-// Deprecated: Use UpdateOperation.ProtoReflect.Descriptor instead.
-func (*UpdateOperation) Descriptor() ([]byte, []int) {
+// Deprecated: Use FileHistory.ProtoReflect.Descriptor instead.
+func (*FileHistory) Descriptor() ([]byte, []int) {
 	return file_pkg_surfstore_SurfStore_proto_rawDescGZIP(), []int{11}
 }
 
-func (x *UpdateOperation) GetTerm() int64 {
-	if x != nil {
-		return x.Term
-	}
-	return 0
-}
-
-func (x *UpdateOperation) GetFileMetaData() *FileMetaData {
+func (x *FileHistory) GetVersions() []*FileMetaData {
 	if x != nil {
-		return x.FileMetaData
+		return x.Versions
 	}
 	return nil
 }
 
-type RaftInternalState struct {
+type FileInfoMap struct {
 	state         protoimpl.MessageState
 	sizeCache     protoimpl.SizeCache
 	unknownFields protoimpl.UnknownFields
 
-	IsLeader bool               `protobuf:"varint,1,opt,name=isLeader,proto3" json:"isLeader,omitempty"`
-	Term     int64              `protobuf:"varint,2,opt,name=term,proto3" json:"term,omitempty"`
-	Log      []*UpdateOperation `protobuf:"bytes,3,rep,name=log,proto3" json:"log,omitempty"`
-	MetaMap  *FileInfoMap       `protobuf:"bytes,4,opt,name=metaMap,proto3" json:"metaMap,omitempty"`
+	FileInfoMap map[string]*FileMetaData `protobuf:"bytes,1,rep,name=fileInfoMap,proto3" json:"fileInfoMap,omitempty" protobuf_key:"bytes,1,opt,name=key,proto3" protobuf_val:"bytes,2,opt,name=value,proto3"`
+	Revision    int64                    `protobuf:"varint,2,opt,name=revision,proto3" json:"revision,omitempty"`
 }
 
-func (x *RaftInternalState) Reset() {
-	*x = RaftInternalState{}
+func (x *FileInfoMap) Reset() {
+	*x = FileInfoMap{}
 	if protoimpl.UnsafeEnabled {
 		mi := &file_pkg_surfstore_SurfStore_proto_msgTypes[12]
 		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
@@ -693,13 +802,13 @@ func (x *RaftInternalState) Reset() {
 	}
 }
 
-func (x *RaftInternalState) String() string {
+func (x *FileInfoMap) String() string {
 	return protoimpl.X.MessageStringOf(x)
 }
 
-func (*RaftInternalState) ProtoMessage() {}
+func (*FileInfoMap) ProtoMessage() {}
 
-func (x *RaftInternalState) ProtoReflect() protoreflect.Message {
+func (x *FileInfoMap) ProtoReflect() protoreflect.Message {
 	mi := &file_pkg_surfstore_SurfStore_proto_msgTypes[12]
 	if protoimpl.UnsafeEnabled && x != nil {
 		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
@@ -711,16 +820,1661 @@ func (x *RaftInternalState) ProtoReflect() protoreflect.Message {
 	return mi.MessageOf(x)
 }
 
-// Deprecated: Use RaftInternalState.ProtoReflect.Descriptor instead.
-func (*RaftInternalState) Descriptor() ([]byte, []int) {
+// Deprecated: Use FileInfoMap.ProtoReflect.Descriptor instead.
+func (*FileInfoMap) Descriptor() ([]byte, []int) {
 	return file_pkg_surfstore_SurfStore_proto_rawDescGZIP(), []int{12}
 }
 
-func (x *RaftInternalState) GetIsLeader() bool {
+func (x *FileInfoMap) GetFileInfoMap() map[string]*FileMetaData {
 	if x != nil {
-		return x.IsLeader
+		return x.FileInfoMap
 	}
-	return false
+	return nil
+}
+
+func (x *FileInfoMap) GetRevision() int64 {
+	if x != nil {
+		return x.Revision
+	}
+	return 0
+}
+
+type Revision struct {
+	state         protoimpl.MessageState
+	sizeCache     protoimpl.SizeCache
+	unknownFields protoimpl.UnknownFields
+
+	Revision int64 `protobuf:"varint,1,opt,name=revision,proto3" json:"revision,omitempty"`
+}
+
+func (x *Revision) Reset() {
+	*x = Revision{}
+	if protoimpl.UnsafeEnabled {
+		mi := &file_pkg_surfstore_SurfStore_proto_msgTypes[13]
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		ms.StoreMessageInfo(mi)
+	}
+}
+
+func (x *Revision) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*Revision) ProtoMessage() {}
+
+func (x *Revision) ProtoReflect() protoreflect.Message {
+	mi := &file_pkg_surfstore_SurfStore_proto_msgTypes[13]
+	if protoimpl.UnsafeEnabled && x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use Revision.ProtoReflect.Descriptor instead.
+func (*Revision) Descriptor() ([]byte, []int) {
+	return file_pkg_surfstore_SurfStore_proto_rawDescGZIP(), []int{13}
+}
+
+func (x *Revision) GetRevision() int64 {
+	if x != nil {
+		return x.Revision
+	}
+	return 0
+}
+
+type FileInfoDelta struct {
+	state         protoimpl.MessageState
+	sizeCache     protoimpl.SizeCache
+	unknownFields protoimpl.UnknownFields
+
+	// latest metadata of every file changed after the requested revision
+	Changes  map[string]*FileMetaData `protobuf:"bytes,1,rep,name=changes,proto3" json:"changes,omitempty" protobuf_key:"bytes,1,opt,name=key,proto3" protobuf_val:"bytes,2,opt,name=value,proto3"`
+	Revision int64                    `protobuf:"varint,2,opt,name=revision,proto3" json:"revision,omitempty"`
+	// set when the requested revision is too old to diff against; changes
+	// then holds the whole FileInfoMap
+	Full bool `protobuf:"varint,3,opt,name=full,proto3" json:"full,omitempty"`
+}
+
+func (x *FileInfoDelta) Reset() {
+	*x = FileInfoDelta{}
+	if protoimpl.UnsafeEnabled {
+		mi := &file_pkg_surfstore_SurfStore_proto_msgTypes[14]
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		ms.StoreMessageInfo(mi)
+	}
+}
+
+func (x *FileInfoDelta) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*FileInfoDelta) ProtoMessage() {}
+
+func (x *FileInfoDelta) ProtoReflect() protoreflect.Message {
+	mi := &file_pkg_surfstore_SurfStore_proto_msgTypes[14]
+	if protoimpl.UnsafeEnabled && x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use FileInfoDelta.ProtoReflect.Descriptor instead.
+func (*FileInfoDelta) Descriptor() ([]byte, []int) {
+	return file_pkg_surfstore_SurfStore_proto_rawDescGZIP(), []int{14}
+}
+
+func (x *FileInfoDelta) GetChanges() map[string]*FileMetaData {
+	if x != nil {
+		return x.Changes
+	}
+	return nil
+}
+
+func (x *FileInfoDelta) GetRevision() int64 {
+	if x != nil {
+		return x.Revision
+	}
+	return 0
+}
+
+func (x *FileInfoDelta) GetFull() bool {
+	if x != nil {
+		return x.Full
+	}
+	return false
+}
+
+type SnapshotRequest struct {
+	state         protoimpl.MessageState
+	sizeCache     protoimpl.SizeCache
+	unknownFields protoimpl.UnknownFields
+
+	// read the namespace as of this revision, or if it is 0, as of this
+	// time in unix nanoseconds
+	Revision  int64 `protobuf:"varint,1,opt,name=revision,proto3" json:"revision,omitempty"`
+	Timestamp int64 `protobuf:"varint,2,opt,name=timestamp,proto3" json:"timestamp,omitempty"`
+}
+
+func (x *SnapshotRequest) Reset() {
+	*x = SnapshotRequest{}
+	if protoimpl.UnsafeEnabled {
+		mi := &file_pkg_surfstore_SurfStore_proto_msgTypes[15]
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		ms.StoreMessageInfo(mi)
+	}
+}
+
+func (x *SnapshotRequest) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*SnapshotRequest) ProtoMessage() {}
+
+func (x *SnapshotRequest) ProtoReflect() protoreflect.Message {
+	mi := &file_pkg_surfstore_SurfStore_proto_msgTypes[15]
+	if protoimpl.UnsafeEnabled && x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use SnapshotRequest.ProtoReflect.Descriptor instead.
+func (*SnapshotRequest) Descriptor() ([]byte, []int) {
+	return file_pkg_surfstore_SurfStore_proto_rawDescGZIP(), []int{15}
+}
+
+func (x *SnapshotRequest) GetRevision() int64 {
+	if x != nil {
+		return x.Revision
+	}
+	return 0
+}
+
+func (x *SnapshotRequest) GetTimestamp() int64 {
+	if x != nil {
+		return x.Timestamp
+	}
+	return 0
+}
+
+type SyncAck struct {
+	state         protoimpl.MessageState
+	sizeCache     protoimpl.SizeCache
+	unknownFields protoimpl.UnknownFields
+
+	ClientId string `protobuf:"bytes,1,opt,name=clientId,proto3" json:"clientId,omitempty"`
+	Revision int64  `protobuf:"varint,2,opt,name=revision,proto3" json:"revision,omitempty"`
+}
+
+func (x *SyncAck) Reset() {
+	*x = SyncAck{}
+	if protoimpl.UnsafeEnabled {
+		mi := &file_pkg_surfstore_SurfStore_proto_msgTypes[16]
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		ms.StoreMessageInfo(mi)
+	}
+}
+
+func (x *SyncAck) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*SyncAck) ProtoMessage() {}
+
+func (x *SyncAck) ProtoReflect() protoreflect.Message {
+	mi := &file_pkg_surfstore_SurfStore_proto_msgTypes[16]
+	if protoimpl.UnsafeEnabled && x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use SyncAck.ProtoReflect.Descriptor instead.
+func (*SyncAck) Descriptor() ([]byte, []int) {
+	return file_pkg_surfstore_SurfStore_proto_rawDescGZIP(), []int{16}
+}
+
+func (x *SyncAck) GetClientId() string {
+	if x != nil {
+		return x.ClientId
+	}
+	return ""
+}
+
+func (x *SyncAck) GetRevision() int64 {
+	if x != nil {
+		return x.Revision
+	}
+	return 0
+}
+
+type WatchRequest struct {
+	state         protoimpl.MessageState
+	sizeCache     protoimpl.SizeCache
+	unknownFields protoimpl.UnknownFields
+
+	// only changes committed after this revision are sent
+	FromRevision int64 `protobuf:"varint,1,opt,name=fromRevision,proto3" json:"fromRevision,omitempty"`
+}
+
+func (x *WatchRequest) Reset() {
+	*x = WatchRequest{}
+	if protoimpl.UnsafeEnabled {
+		mi := &file_pkg_surfstore_SurfStore_proto_msgTypes[17]
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		ms.StoreMessageInfo(mi)
+	}
+}
+
+func (x *WatchRequest) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*WatchRequest) ProtoMessage() {}
+
+func (x *WatchRequest) ProtoReflect() protoreflect.Message {
+	mi := &file_pkg_surfstore_SurfStore_proto_msgTypes[17]
+	if protoimpl.UnsafeEnabled && x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use WatchRequest.ProtoReflect.Descriptor instead.
+func (*WatchRequest) Descriptor() ([]byte, []int) {
+	return file_pkg_surfstore_SurfStore_proto_rawDescGZIP(), []int{17}
+}
+
+func (x *WatchRequest) GetFromRevision() int64 {
+	if x != nil {
+		return x.FromRevision
+	}
+	return 0
+}
+
+type FileChange struct {
+	state         protoimpl.MessageState
+	sizeCache     protoimpl.SizeCache
+	unknownFields protoimpl.UnknownFields
+
+	FileMetaData *FileMetaData `protobuf:"bytes,1,opt,name=fileMetaData,proto3" json:"fileMetaData,omitempty"`
+	Revision     int64         `protobuf:"varint,2,opt,name=revision,proto3" json:"revision,omitempty"`
+}
+
+func (x *FileChange) Reset() {
+	*x = FileChange{}
+	if protoimpl.UnsafeEnabled {
+		mi := &file_pkg_surfstore_SurfStore_proto_msgTypes[18]
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		ms.StoreMessageInfo(mi)
+	}
+}
+
+func (x *FileChange) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*FileChange) ProtoMessage() {}
+
+func (x *FileChange) ProtoReflect() protoreflect.Message {
+	mi := &file_pkg_surfstore_SurfStore_proto_msgTypes[18]
+	if protoimpl.UnsafeEnabled && x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use FileChange.ProtoReflect.Descriptor instead.
+func (*FileChange) Descriptor() ([]byte, []int) {
+	return file_pkg_surfstore_SurfStore_proto_rawDescGZIP(), []int{18}
+}
+
+func (x *FileChange) GetFileMetaData() *FileMetaData {
+	if x != nil {
+		return x.FileMetaData
+	}
+	return nil
+}
+
+func (x *FileChange) GetRevision() int64 {
+	if x != nil {
+		return x.Revision
+	}
+	return 0
+}
+
+type PruneOperation struct {
+	state         protoimpl.MessageState
+	sizeCache     protoimpl.SizeCache
+	unknownFields protoimpl.UnknownFields
+
+	Versions []*FileVersion `protobuf:"bytes,1,rep,name=versions,proto3" json:"versions,omitempty"`
+}
+
+func (x *PruneOperation) Reset() {
+	*x = PruneOperation{}
+	if protoimpl.UnsafeEnabled {
+		mi := &file_pkg_surfstore_SurfStore_proto_msgTypes[19]
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		ms.StoreMessageInfo(mi)
+	}
+}
+
+func (x *PruneOperation) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*PruneOperation) ProtoMessage() {}
+
+func (x *PruneOperation) ProtoReflect() protoreflect.Message {
+	mi := &file_pkg_surfstore_SurfStore_proto_msgTypes[19]
+	if protoimpl.UnsafeEnabled && x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use PruneOperation.ProtoReflect.Descriptor instead.
+func (*PruneOperation) Descriptor() ([]byte, []int) {
+	return file_pkg_surfstore_SurfStore_proto_rawDescGZIP(), []int{19}
+}
+
+func (x *PruneOperation) GetVersions() []*FileVersion {
+	if x != nil {
+		return x.Versions
+	}
+	return nil
+}
+
+type Version struct {
+	state         protoimpl.MessageState
+	sizeCache     protoimpl.SizeCache
+	unknownFields protoimpl.UnknownFields
+
+	Version int32 `protobuf:"varint,1,opt,name=version,proto3" json:"version,omitempty"`
+}
+
+func (x *Version) Reset() {
+	*x = Version{}
+	if protoimpl.UnsafeEnabled {
+		mi := &file_pkg_surfstore_SurfStore_proto_msgTypes[20]
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		ms.StoreMessageInfo(mi)
+	}
+}
+
+func (x *Version) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*Version) ProtoMessage() {}
+
+func (x *Version) ProtoReflect() protoreflect.Message {
+	mi := &file_pkg_surfstore_SurfStore_proto_msgTypes[20]
+	if protoimpl.UnsafeEnabled && x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use Version.ProtoReflect.Descriptor instead.
+func (*Version) Descriptor() ([]byte, []int) {
+	return file_pkg_surfstore_SurfStore_proto_rawDescGZIP(), []int{20}
+}
+
+func (x *Version) GetVersion() int32 {
+	if x != nil {
+		return x.Version
+	}
+	return 0
+}
+
+type BlockStoreAddr struct {
+	state         protoimpl.MessageState
+	sizeCache     protoimpl.SizeCache
+	unknownFields protoimpl.UnknownFields
+
+	Addr string `protobuf:"bytes,1,opt,name=addr,proto3" json:"addr,omitempty"`
+}
+
+func (x *BlockStoreAddr) Reset() {
+	*x = BlockStoreAddr{}
+	if protoimpl.UnsafeEnabled {
+		mi := &file_pkg_surfstore_SurfStore_proto_msgTypes[21]
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		ms.StoreMessageInfo(mi)
+	}
+}
+
+func (x *BlockStoreAddr) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*BlockStoreAddr) ProtoMessage() {}
+
+func (x *BlockStoreAddr) ProtoReflect() protoreflect.Message {
+	mi := &file_pkg_surfstore_SurfStore_proto_msgTypes[21]
+	if protoimpl.UnsafeEnabled && x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use BlockStoreAddr.ProtoReflect.Descriptor instead.
+func (*BlockStoreAddr) Descriptor() ([]byte, []int) {
+	return file_pkg_surfstore_SurfStore_proto_rawDescGZIP(), []int{21}
+}
+
+func (x *BlockStoreAddr) GetAddr() string {
+	if x != nil {
+		return x.Addr
+	}
+	return ""
+}
+
+// Nodes of the Merkle tree over a BlockStore's blocks, numbered like a
+// heap: 1 is the root, node n has children 2n and 2n+1, and the leaves
+// are the hash-range buckets
+type MerkleNodes struct {
+	state         protoimpl.MessageState
+	sizeCache     protoimpl.SizeCache
+	unknownFields protoimpl.UnknownFields
+
+	Nodes []int32 `protobuf:"varint,1,rep,packed,name=nodes,proto3" json:"nodes,omitempty"`
+}
+
+func (x *MerkleNodes) Reset() {
+	*x = MerkleNodes{}
+	if protoimpl.UnsafeEnabled {
+		mi := &file_pkg_surfstore_SurfStore_proto_msgTypes[22]
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		ms.StoreMessageInfo(mi)
+	}
+}
+
+func (x *MerkleNodes) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*MerkleNodes) ProtoMessage() {}
+
+func (x *MerkleNodes) ProtoReflect() protoreflect.Message {
+	mi := &file_pkg_surfstore_SurfStore_proto_msgTypes[22]
+	if protoimpl.UnsafeEnabled && x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use MerkleNodes.ProtoReflect.Descriptor instead.
+func (*MerkleNodes) Descriptor() ([]byte, []int) {
+	return file_pkg_surfstore_SurfStore_proto_rawDescGZIP(), []int{22}
+}
+
+func (x *MerkleNodes) GetNodes() []int32 {
+	if x != nil {
+		return x.Nodes
+	}
+	return nil
+}
+
+// Hash of each node asked for, in the same order; empty for a node with
+// no blocks under it
+type MerkleHashes struct {
+	state         protoimpl.MessageState
+	sizeCache     protoimpl.SizeCache
+	unknownFields protoimpl.UnknownFields
+
+	Hashes []string `protobuf:"bytes,1,rep,name=hashes,proto3" json:"hashes,omitempty"`
+}
+
+func (x *MerkleHashes) Reset() {
+	*x = MerkleHashes{}
+	if protoimpl.UnsafeEnabled {
+		mi := &file_pkg_surfstore_SurfStore_proto_msgTypes[23]
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		ms.StoreMessageInfo(mi)
+	}
+}
+
+func (x *MerkleHashes) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*MerkleHashes) ProtoMessage() {}
+
+func (x *MerkleHashes) ProtoReflect() protoreflect.Message {
+	mi := &file_pkg_surfstore_SurfStore_proto_msgTypes[23]
+	if protoimpl.UnsafeEnabled && x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use MerkleHashes.ProtoReflect.Descriptor instead.
+func (*MerkleHashes) Descriptor() ([]byte, []int) {
+	return file_pkg_surfstore_SurfStore_proto_rawDescGZIP(), []int{23}
+}
+
+func (x *MerkleHashes) GetHashes() []string {
+	if x != nil {
+		return x.Hashes
+	}
+	return nil
+}
+
+// Keys (namespace/hash) of the blocks in some Merkle tree leaves, and of
+// the blocks in them deleted within BLOCK_TOMBSTONE_LIFETIME
+type MerkleBuckets struct {
+	state         protoimpl.MessageState
+	sizeCache     protoimpl.SizeCache
+	unknownFields protoimpl.UnknownFields
+
+	Keys        []string `protobuf:"bytes,1,rep,name=keys,proto3" json:"keys,omitempty"`
+	DeletedKeys []string `protobuf:"bytes,2,rep,name=deletedKeys,proto3" json:"deletedKeys,omitempty"`
+}
+
+func (x *MerkleBuckets) Reset() {
+	*x = MerkleBuckets{}
+	if protoimpl.UnsafeEnabled {
+		mi := &file_pkg_surfstore_SurfStore_proto_msgTypes[24]
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		ms.StoreMessageInfo(mi)
+	}
+}
+
+func (x *MerkleBuckets) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*MerkleBuckets) ProtoMessage() {}
+
+func (x *MerkleBuckets) ProtoReflect() protoreflect.Message {
+	mi := &file_pkg_surfstore_SurfStore_proto_msgTypes[24]
+	if protoimpl.UnsafeEnabled && x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use MerkleBuckets.ProtoReflect.Descriptor instead.
+func (*MerkleBuckets) Descriptor() ([]byte, []int) {
+	return file_pkg_surfstore_SurfStore_proto_rawDescGZIP(), []int{24}
+}
+
+func (x *MerkleBuckets) GetKeys() []string {
+	if x != nil {
+		return x.Keys
+	}
+	return nil
+}
+
+func (x *MerkleBuckets) GetDeletedKeys() []string {
+	if x != nil {
+		return x.DeletedKeys
+	}
+	return nil
+}
+
+// Every BlockStore server on the consistent-hash ring, and how many of
+// them each block is stored on
+type BlockStoreAddrs struct {
+	state         protoimpl.MessageState
+	sizeCache     protoimpl.SizeCache
+	unknownFields protoimpl.UnknownFields
+
+	Addrs             []string `protobuf:"bytes,1,rep,name=addrs,proto3" json:"addrs,omitempty"`
+	ReplicationFactor int32    `protobuf:"varint,2,opt,name=replicationFactor,proto3" json:"replicationFactor,omitempty"`
+	// The ring blocks are still moving away from, while rebalancing
+	PreviousAddrs []string `protobuf:"bytes,3,rep,name=previousAddrs,proto3" json:"previousAddrs,omitempty"`
+	// Servers on either ring that stopped sending heartbeats
+	UnhealthyAddrs []string `protobuf:"bytes,4,rep,name=unhealthyAddrs,proto3" json:"unhealthyAddrs,omitempty"`
+}
+
+func (x *BlockStoreAddrs) Reset() {
+	*x = BlockStoreAddrs{}
+	if protoimpl.UnsafeEnabled {
+		mi := &file_pkg_surfstore_SurfStore_proto_msgTypes[25]
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		ms.StoreMessageInfo(mi)
+	}
+}
+
+func (x *BlockStoreAddrs) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*BlockStoreAddrs) ProtoMessage() {}
+
+func (x *BlockStoreAddrs) ProtoReflect() protoreflect.Message {
+	mi := &file_pkg_surfstore_SurfStore_proto_msgTypes[25]
+	if protoimpl.UnsafeEnabled && x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use BlockStoreAddrs.ProtoReflect.Descriptor instead.
+func (*BlockStoreAddrs) Descriptor() ([]byte, []int) {
+	return file_pkg_surfstore_SurfStore_proto_rawDescGZIP(), []int{25}
+}
+
+func (x *BlockStoreAddrs) GetAddrs() []string {
+	if x != nil {
+		return x.Addrs
+	}
+	return nil
+}
+
+func (x *BlockStoreAddrs) GetReplicationFactor() int32 {
+	if x != nil {
+		return x.ReplicationFactor
+	}
+	return 0
+}
+
+func (x *BlockStoreAddrs) GetPreviousAddrs() []string {
+	if x != nil {
+		return x.PreviousAddrs
+	}
+	return nil
+}
+
+func (x *BlockStoreAddrs) GetUnhealthyAddrs() []string {
+	if x != nil {
+		return x.UnhealthyAddrs
+	}
+	return nil
+}
+
+// A BlockStore server that registered itself with the MetaStore
+type BlockStoreRegistration struct {
+	state         protoimpl.MessageState
+	sizeCache     protoimpl.SizeCache
+	unknownFields protoimpl.UnknownFields
+
+	Addr  string          `protobuf:"bytes,1,opt,name=addr,proto3" json:"addr,omitempty"`
+	State BlockStoreState `protobuf:"varint,2,opt,name=state,proto3,enum=surfstore.BlockStoreState" json:"state,omitempty"`
+}
+
+func (x *BlockStoreRegistration) Reset() {
+	*x = BlockStoreRegistration{}
+	if protoimpl.UnsafeEnabled {
+		mi := &file_pkg_surfstore_SurfStore_proto_msgTypes[26]
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		ms.StoreMessageInfo(mi)
+	}
+}
+
+func (x *BlockStoreRegistration) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*BlockStoreRegistration) ProtoMessage() {}
+
+func (x *BlockStoreRegistration) ProtoReflect() protoreflect.Message {
+	mi := &file_pkg_surfstore_SurfStore_proto_msgTypes[26]
+	if protoimpl.UnsafeEnabled && x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use BlockStoreRegistration.ProtoReflect.Descriptor instead.
+func (*BlockStoreRegistration) Descriptor() ([]byte, []int) {
+	return file_pkg_surfstore_SurfStore_proto_rawDescGZIP(), []int{26}
+}
+
+func (x *BlockStoreRegistration) GetAddr() string {
+	if x != nil {
+		return x.Addr
+	}
+	return ""
+}
+
+func (x *BlockStoreRegistration) GetState() BlockStoreState {
+	if x != nil {
+		return x.State
+	}
+	return BlockStoreState_ACTIVE
+}
+
+type BlockStoreStatus struct {
+	state         protoimpl.MessageState
+	sizeCache     protoimpl.SizeCache
+	unknownFields protoimpl.UnknownFields
+
+	Addr string `protobuf:"bytes,1,opt,name=addr,proto3" json:"addr,omitempty"`
+	// Servers given on the command line are on the ring without registering
+	Registered bool            `protobuf:"varint,2,opt,name=registered,proto3" json:"registered,omitempty"`
+	State      BlockStoreState `protobuf:"varint,3,opt,name=state,proto3,enum=surfstore.BlockStoreState" json:"state,omitempty"`
+	// Whether the server sent a heartbeat recently; servers that never
+	// registered are not expected to
+	Healthy bool `protobuf:"varint,4,opt,name=healthy,proto3" json:"healthy,omitempty"`
+	// zero if no heartbeat arrived since this MetaStore started
+	LastHeartbeat int64 `protobuf:"varint,5,opt,name=lastHeartbeat,proto3" json:"lastHeartbeat,omitempty"`
+	OnRing        bool  `protobuf:"varint,6,opt,name=onRing,proto3" json:"onRing,omitempty"`
+	// Draining, off both rings, so it can be decommissioned
+	Drained bool `protobuf:"varint,7,opt,name=drained,proto3" json:"drained,omitempty"`
+}
+
+func (x *BlockStoreStatus) Reset() {
+	*x = BlockStoreStatus{}
+	if protoimpl.UnsafeEnabled {
+		mi := &file_pkg_surfstore_SurfStore_proto_msgTypes[27]
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		ms.StoreMessageInfo(mi)
+	}
+}
+
+func (x *BlockStoreStatus) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*BlockStoreStatus) ProtoMessage() {}
+
+func (x *BlockStoreStatus) ProtoReflect() protoreflect.Message {
+	mi := &file_pkg_surfstore_SurfStore_proto_msgTypes[27]
+	if protoimpl.UnsafeEnabled && x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use BlockStoreStatus.ProtoReflect.Descriptor instead.
+func (*BlockStoreStatus) Descriptor() ([]byte, []int) {
+	return file_pkg_surfstore_SurfStore_proto_rawDescGZIP(), []int{27}
+}
+
+func (x *BlockStoreStatus) GetAddr() string {
+	if x != nil {
+		return x.Addr
+	}
+	return ""
+}
+
+func (x *BlockStoreStatus) GetRegistered() bool {
+	if x != nil {
+		return x.Registered
+	}
+	return false
+}
+
+func (x *BlockStoreStatus) GetState() BlockStoreState {
+	if x != nil {
+		return x.State
+	}
+	return BlockStoreState_ACTIVE
+}
+
+func (x *BlockStoreStatus) GetHealthy() bool {
+	if x != nil {
+		return x.Healthy
+	}
+	return false
+}
+
+func (x *BlockStoreStatus) GetLastHeartbeat() int64 {
+	if x != nil {
+		return x.LastHeartbeat
+	}
+	return 0
+}
+
+func (x *BlockStoreStatus) GetOnRing() bool {
+	if x != nil {
+		return x.OnRing
+	}
+	return false
+}
+
+func (x *BlockStoreStatus) GetDrained() bool {
+	if x != nil {
+		return x.Drained
+	}
+	return false
+}
+
+type BlockStoreStatuses struct {
+	state         protoimpl.MessageState
+	sizeCache     protoimpl.SizeCache
+	unknownFields protoimpl.UnknownFields
+
+	Statuses []*BlockStoreStatus `protobuf:"bytes,1,rep,name=statuses,proto3" json:"statuses,omitempty"`
+}
+
+func (x *BlockStoreStatuses) Reset() {
+	*x = BlockStoreStatuses{}
+	if protoimpl.UnsafeEnabled {
+		mi := &file_pkg_surfstore_SurfStore_proto_msgTypes[28]
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		ms.StoreMessageInfo(mi)
+	}
+}
+
+func (x *BlockStoreStatuses) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*BlockStoreStatuses) ProtoMessage() {}
+
+func (x *BlockStoreStatuses) ProtoReflect() protoreflect.Message {
+	mi := &file_pkg_surfstore_SurfStore_proto_msgTypes[28]
+	if protoimpl.UnsafeEnabled && x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use BlockStoreStatuses.ProtoReflect.Descriptor instead.
+func (*BlockStoreStatuses) Descriptor() ([]byte, []int) {
+	return file_pkg_surfstore_SurfStore_proto_rawDescGZIP(), []int{28}
+}
+
+func (x *BlockStoreStatuses) GetStatuses() []*BlockStoreStatus {
+	if x != nil {
+		return x.Statuses
+	}
+	return nil
+}
+
+// Progress of moving blocks to the servers the current ring places them on
+type RebalanceStatus struct {
+	state         protoimpl.MessageState
+	sizeCache     protoimpl.SizeCache
+	unknownFields protoimpl.UnknownFields
+
+	InProgress    bool     `protobuf:"varint,1,opt,name=inProgress,proto3" json:"inProgress,omitempty"`
+	Addrs         []string `protobuf:"bytes,2,rep,name=addrs,proto3" json:"addrs,omitempty"`
+	PreviousAddrs []string `protobuf:"bytes,3,rep,name=previousAddrs,proto3" json:"previousAddrs,omitempty"`
+	StartedAt     int64    `protobuf:"varint,4,opt,name=startedAt,proto3" json:"startedAt,omitempty"`
+	// zero until the rebalance finishes
+	FinishedAt int64 `protobuf:"varint,5,opt,name=finishedAt,proto3" json:"finishedAt,omitempty"`
+	Passes     int64 `protobuf:"varint,6,opt,name=passes,proto3" json:"passes,omitempty"`
+	// Blocks (and shards) the last pass found missing from a new server,
+	// and how many of those it has looked at and failed to move
+	TotalBlocks   int64 `protobuf:"varint,7,opt,name=totalBlocks,proto3" json:"totalBlocks,omitempty"`
+	CheckedBlocks int64 `protobuf:"varint,8,opt,name=checkedBlocks,proto3" json:"checkedBlocks,omitempty"`
+	FailedBlocks  int64 `protobuf:"varint,9,opt,name=failedBlocks,proto3" json:"failedBlocks,omitempty"`
+	// Over the whole rebalance
+	MovedBlocks int64 `protobuf:"varint,10,opt,name=movedBlocks,proto3" json:"movedBlocks,omitempty"`
+	MovedBytes  int64 `protobuf:"varint,11,opt,name=movedBytes,proto3" json:"movedBytes,omitempty"`
+	// Bytes per second, zero if unlimited
+	RateLimit int64 `protobuf:"varint,12,opt,name=rateLimit,proto3" json:"rateLimit,omitempty"`
+	// Time spent waiting to stay under the rate limit
+	ThrottledNanos int64 `protobuf:"varint,13,opt,name=throttledNanos,proto3" json:"throttledNanos,omitempty"`
+	// Blocks (namespace/hash) the last pass found on none of their
+	// previous servers; the rebalance finishes without them
+	LostBlocks []string `protobuf:"bytes,14,rep,name=lostBlocks,proto3" json:"lostBlocks,omitempty"`
+}
+
+func (x *RebalanceStatus) Reset() {
+	*x = RebalanceStatus{}
+	if protoimpl.UnsafeEnabled {
+		mi := &file_pkg_surfstore_SurfStore_proto_msgTypes[29]
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		ms.StoreMessageInfo(mi)
+	}
+}
+
+func (x *RebalanceStatus) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*RebalanceStatus) ProtoMessage() {}
+
+func (x *RebalanceStatus) ProtoReflect() protoreflect.Message {
+	mi := &file_pkg_surfstore_SurfStore_proto_msgTypes[29]
+	if protoimpl.UnsafeEnabled && x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use RebalanceStatus.ProtoReflect.Descriptor instead.
+func (*RebalanceStatus) Descriptor() ([]byte, []int) {
+	return file_pkg_surfstore_SurfStore_proto_rawDescGZIP(), []int{29}
+}
+
+func (x *RebalanceStatus) GetInProgress() bool {
+	if x != nil {
+		return x.InProgress
+	}
+	return false
+}
+
+func (x *RebalanceStatus) GetAddrs() []string {
+	if x != nil {
+		return x.Addrs
+	}
+	return nil
+}
+
+func (x *RebalanceStatus) GetPreviousAddrs() []string {
+	if x != nil {
+		return x.PreviousAddrs
+	}
+	return nil
+}
+
+func (x *RebalanceStatus) GetStartedAt() int64 {
+	if x != nil {
+		return x.StartedAt
+	}
+	return 0
+}
+
+func (x *RebalanceStatus) GetFinishedAt() int64 {
+	if x != nil {
+		return x.FinishedAt
+	}
+	return 0
+}
+
+func (x *RebalanceStatus) GetPasses() int64 {
+	if x != nil {
+		return x.Passes
+	}
+	return 0
+}
+
+func (x *RebalanceStatus) GetTotalBlocks() int64 {
+	if x != nil {
+		return x.TotalBlocks
+	}
+	return 0
+}
+
+func (x *RebalanceStatus) GetCheckedBlocks() int64 {
+	if x != nil {
+		return x.CheckedBlocks
+	}
+	return 0
+}
+
+func (x *RebalanceStatus) GetFailedBlocks() int64 {
+	if x != nil {
+		return x.FailedBlocks
+	}
+	return 0
+}
+
+func (x *RebalanceStatus) GetMovedBlocks() int64 {
+	if x != nil {
+		return x.MovedBlocks
+	}
+	return 0
+}
+
+func (x *RebalanceStatus) GetMovedBytes() int64 {
+	if x != nil {
+		return x.MovedBytes
+	}
+	return 0
+}
+
+func (x *RebalanceStatus) GetRateLimit() int64 {
+	if x != nil {
+		return x.RateLimit
+	}
+	return 0
+}
+
+func (x *RebalanceStatus) GetThrottledNanos() int64 {
+	if x != nil {
+		return x.ThrottledNanos
+	}
+	return 0
+}
+
+func (x *RebalanceStatus) GetLostBlocks() []string {
+	if x != nil {
+		return x.LostBlocks
+	}
+	return nil
+}
+
+// Outcome of the last check that every referenced block is stored on all
+// of its replicas
+type RepairReport struct {
+	state         protoimpl.MessageState
+	sizeCache     protoimpl.SizeCache
+	unknownFields protoimpl.UnknownFields
+
+	Timestamp             int64 `protobuf:"varint,1,opt,name=timestamp,proto3" json:"timestamp,omitempty"`
+	CheckedBlocks         int64 `protobuf:"varint,2,opt,name=checkedBlocks,proto3" json:"checkedBlocks,omitempty"`
+	UnderReplicatedBlocks int64 `protobuf:"varint,3,opt,name=underReplicatedBlocks,proto3" json:"underReplicatedBlocks,omitempty"`
+	RepairedCopies        int64 `protobuf:"varint,4,opt,name=repairedCopies,proto3" json:"repairedCopies,omitempty"`
+	FailedCopies          int64 `protobuf:"varint,5,opt,name=failedCopies,proto3" json:"failedCopies,omitempty"`
+	// Referenced blocks none of their replicas hold, as namespace/hash
+	LostBlocks []string `protobuf:"bytes,6,rep,name=lostBlocks,proto3" json:"lostBlocks,omitempty"`
+}
+
+func (x *RepairReport) Reset() {
+	*x = RepairReport{}
+	if protoimpl.UnsafeEnabled {
+		mi := &file_pkg_surfstore_SurfStore_proto_msgTypes[30]
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		ms.StoreMessageInfo(mi)
+	}
+}
+
+func (x *RepairReport) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*RepairReport) ProtoMessage() {}
+
+func (x *RepairReport) ProtoReflect() protoreflect.Message {
+	mi := &file_pkg_surfstore_SurfStore_proto_msgTypes[30]
+	if protoimpl.UnsafeEnabled && x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use RepairReport.ProtoReflect.Descriptor instead.
+func (*RepairReport) Descriptor() ([]byte, []int) {
+	return file_pkg_surfstore_SurfStore_proto_rawDescGZIP(), []int{30}
+}
+
+func (x *RepairReport) GetTimestamp() int64 {
+	if x != nil {
+		return x.Timestamp
+	}
+	return 0
+}
+
+func (x *RepairReport) GetCheckedBlocks() int64 {
+	if x != nil {
+		return x.CheckedBlocks
+	}
+	return 0
+}
+
+func (x *RepairReport) GetUnderReplicatedBlocks() int64 {
+	if x != nil {
+		return x.UnderReplicatedBlocks
+	}
+	return 0
+}
+
+func (x *RepairReport) GetRepairedCopies() int64 {
+	if x != nil {
+		return x.RepairedCopies
+	}
+	return 0
+}
+
+func (x *RepairReport) GetFailedCopies() int64 {
+	if x != nil {
+		return x.FailedCopies
+	}
+	return 0
+}
+
+func (x *RepairReport) GetLostBlocks() []string {
+	if x != nil {
+		return x.LostBlocks
+	}
+	return nil
+}
+
+type CrashedState struct {
+	state         protoimpl.MessageState
+	sizeCache     protoimpl.SizeCache
+	unknownFields protoimpl.UnknownFields
+
+	IsCrashed bool `protobuf:"varint,1,opt,name=isCrashed,proto3" json:"isCrashed,omitempty"`
+}
+
+func (x *CrashedState) Reset() {
+	*x = CrashedState{}
+	if protoimpl.UnsafeEnabled {
+		mi := &file_pkg_surfstore_SurfStore_proto_msgTypes[31]
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		ms.StoreMessageInfo(mi)
+	}
+}
+
+func (x *CrashedState) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*CrashedState) ProtoMessage() {}
+
+func (x *CrashedState) ProtoReflect() protoreflect.Message {
+	mi := &file_pkg_surfstore_SurfStore_proto_msgTypes[31]
+	if protoimpl.UnsafeEnabled && x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use CrashedState.ProtoReflect.Descriptor instead.
+func (*CrashedState) Descriptor() ([]byte, []int) {
+	return file_pkg_surfstore_SurfStore_proto_rawDescGZIP(), []int{31}
+}
+
+func (x *CrashedState) GetIsCrashed() bool {
+	if x != nil {
+		return x.IsCrashed
+	}
+	return false
+}
+
+type AppendEntryInput struct {
+	state         protoimpl.MessageState
+	sizeCache     protoimpl.SizeCache
+	unknownFields protoimpl.UnknownFields
+
+	Term         int64              `protobuf:"varint,1,opt,name=term,proto3" json:"term,omitempty"`
+	PrevLogIndex int64              `protobuf:"varint,2,opt,name=prevLogIndex,proto3" json:"prevLogIndex,omitempty"`
+	PrevLogTerm  int64              `protobuf:"varint,3,opt,name=prevLogTerm,proto3" json:"prevLogTerm,omitempty"`
+	Entries      []*UpdateOperation `protobuf:"bytes,4,rep,name=entries,proto3" json:"entries,omitempty"`
+	LeaderCommit int64              `protobuf:"varint,5,opt,name=leaderCommit,proto3" json:"leaderCommit,omitempty"`
+}
+
+func (x *AppendEntryInput) Reset() {
+	*x = AppendEntryInput{}
+	if protoimpl.UnsafeEnabled {
+		mi := &file_pkg_surfstore_SurfStore_proto_msgTypes[32]
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		ms.StoreMessageInfo(mi)
+	}
+}
+
+func (x *AppendEntryInput) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*AppendEntryInput) ProtoMessage() {}
+
+func (x *AppendEntryInput) ProtoReflect() protoreflect.Message {
+	mi := &file_pkg_surfstore_SurfStore_proto_msgTypes[32]
+	if protoimpl.UnsafeEnabled && x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use AppendEntryInput.ProtoReflect.Descriptor instead.
+func (*AppendEntryInput) Descriptor() ([]byte, []int) {
+	return file_pkg_surfstore_SurfStore_proto_rawDescGZIP(), []int{32}
+}
+
+func (x *AppendEntryInput) GetTerm() int64 {
+	if x != nil {
+		return x.Term
+	}
+	return 0
+}
+
+func (x *AppendEntryInput) GetPrevLogIndex() int64 {
+	if x != nil {
+		return x.PrevLogIndex
+	}
+	return 0
+}
+
+func (x *AppendEntryInput) GetPrevLogTerm() int64 {
+	if x != nil {
+		return x.PrevLogTerm
+	}
+	return 0
+}
+
+func (x *AppendEntryInput) GetEntries() []*UpdateOperation {
+	if x != nil {
+		return x.Entries
+	}
+	return nil
+}
+
+func (x *AppendEntryInput) GetLeaderCommit() int64 {
+	if x != nil {
+		return x.LeaderCommit
+	}
+	return 0
+}
+
+type AppendEntryOutput struct {
+	state         protoimpl.MessageState
+	sizeCache     protoimpl.SizeCache
+	unknownFields protoimpl.UnknownFields
+
+	ServerId     int64 `protobuf:"varint,1,opt,name=serverId,proto3" json:"serverId,omitempty"`
+	Term         int64 `protobuf:"varint,2,opt,name=term,proto3" json:"term,omitempty"`
+	Success      bool  `protobuf:"varint,3,opt,name=success,proto3" json:"success,omitempty"`
+	MatchedIndex int64 `protobuf:"varint,4,opt,name=matchedIndex,proto3" json:"matchedIndex,omitempty"`
+}
+
+func (x *AppendEntryOutput) Reset() {
+	*x = AppendEntryOutput{}
+	if protoimpl.UnsafeEnabled {
+		mi := &file_pkg_surfstore_SurfStore_proto_msgTypes[33]
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		ms.StoreMessageInfo(mi)
+	}
+}
+
+func (x *AppendEntryOutput) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*AppendEntryOutput) ProtoMessage() {}
+
+func (x *AppendEntryOutput) ProtoReflect() protoreflect.Message {
+	mi := &file_pkg_surfstore_SurfStore_proto_msgTypes[33]
+	if protoimpl.UnsafeEnabled && x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use AppendEntryOutput.ProtoReflect.Descriptor instead.
+func (*AppendEntryOutput) Descriptor() ([]byte, []int) {
+	return file_pkg_surfstore_SurfStore_proto_rawDescGZIP(), []int{33}
+}
+
+func (x *AppendEntryOutput) GetServerId() int64 {
+	if x != nil {
+		return x.ServerId
+	}
+	return 0
+}
+
+func (x *AppendEntryOutput) GetTerm() int64 {
+	if x != nil {
+		return x.Term
+	}
+	return 0
+}
+
+func (x *AppendEntryOutput) GetSuccess() bool {
+	if x != nil {
+		return x.Success
+	}
+	return false
+}
+
+func (x *AppendEntryOutput) GetMatchedIndex() int64 {
+	if x != nil {
+		return x.MatchedIndex
+	}
+	return 0
+}
+
+type UpdateOperation struct {
+	state         protoimpl.MessageState
+	sizeCache     protoimpl.SizeCache
+	unknownFields protoimpl.UnknownFields
+
+	Term         int64           `protobuf:"varint,1,opt,name=term,proto3" json:"term,omitempty"`
+	FileMetaData *FileMetaData   `protobuf:"bytes,3,opt,name=fileMetaData,proto3" json:"fileMetaData,omitempty"`
+	Timestamp    int64           `protobuf:"varint,4,opt,name=timestamp,proto3" json:"timestamp,omitempty"`
+	SyncAck      *SyncAck        `protobuf:"bytes,5,opt,name=syncAck,proto3" json:"syncAck,omitempty"`
+	Prune        *PruneOperation `protobuf:"bytes,6,opt,name=prune,proto3" json:"prune,omitempty"`
+	// empty for the default namespace
+	Namespace        string                  `protobuf:"bytes,7,opt,name=namespace,proto3" json:"namespace,omitempty"`
+	BlockStoreChange *BlockStoreChange       `protobuf:"bytes,8,opt,name=blockStoreChange,proto3" json:"blockStoreChange,omitempty"`
+	Registration     *BlockStoreRegistration `protobuf:"bytes,9,opt,name=registration,proto3" json:"registration,omitempty"`
+	Restore          *RestoreOperation       `protobuf:"bytes,10,opt,name=restore,proto3" json:"restore,omitempty"`
+	// Changes nothing; a new leader commits one to know its MetaStore has
+	// applied every entry an earlier term committed
+	Barrier bool `protobuf:"varint,11,opt,name=barrier,proto3" json:"barrier,omitempty"`
+}
+
+func (x *UpdateOperation) Reset() {
+	*x = UpdateOperation{}
+	if protoimpl.UnsafeEnabled {
+		mi := &file_pkg_surfstore_SurfStore_proto_msgTypes[34]
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		ms.StoreMessageInfo(mi)
+	}
+}
+
+func (x *UpdateOperation) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*UpdateOperation) ProtoMessage() {}
+
+func (x *UpdateOperation) ProtoReflect() protoreflect.Message {
+	mi := &file_pkg_surfstore_SurfStore_proto_msgTypes[34]
+	if protoimpl.UnsafeEnabled && x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use UpdateOperation.ProtoReflect.Descriptor instead.
+func (*UpdateOperation) Descriptor() ([]byte, []int) {
+	return file_pkg_surfstore_SurfStore_proto_rawDescGZIP(), []int{34}
+}
+
+func (x *UpdateOperation) GetTerm() int64 {
+	if x != nil {
+		return x.Term
+	}
+	return 0
+}
+
+func (x *UpdateOperation) GetFileMetaData() *FileMetaData {
+	if x != nil {
+		return x.FileMetaData
+	}
+	return nil
+}
+
+func (x *UpdateOperation) GetTimestamp() int64 {
+	if x != nil {
+		return x.Timestamp
+	}
+	return 0
+}
+
+func (x *UpdateOperation) GetSyncAck() *SyncAck {
+	if x != nil {
+		return x.SyncAck
+	}
+	return nil
+}
+
+func (x *UpdateOperation) GetPrune() *PruneOperation {
+	if x != nil {
+		return x.Prune
+	}
+	return nil
+}
+
+func (x *UpdateOperation) GetNamespace() string {
+	if x != nil {
+		return x.Namespace
+	}
+	return ""
+}
+
+func (x *UpdateOperation) GetBlockStoreChange() *BlockStoreChange {
+	if x != nil {
+		return x.BlockStoreChange
+	}
+	return nil
+}
+
+func (x *UpdateOperation) GetRegistration() *BlockStoreRegistration {
+	if x != nil {
+		return x.Registration
+	}
+	return nil
+}
+
+func (x *UpdateOperation) GetRestore() *RestoreOperation {
+	if x != nil {
+		return x.Restore
+	}
+	return nil
+}
+
+func (x *UpdateOperation) GetBarrier() bool {
+	if x != nil {
+		return x.Barrier
+	}
+	return false
+}
+
+// Stores an older version of a file as its newest one. The new version
+// number is worked out when the operation is applied.
+type RestoreOperation struct {
+	state         protoimpl.MessageState
+	sizeCache     protoimpl.SizeCache
+	unknownFields protoimpl.UnknownFields
+
+	FileVersion *FileVersion `protobuf:"bytes,1,opt,name=fileVersion,proto3" json:"fileVersion,omitempty"`
+	Owner       string       `protobuf:"bytes,2,opt,name=owner,proto3" json:"owner,omitempty"`
+}
+
+func (x *RestoreOperation) Reset() {
+	*x = RestoreOperation{}
+	if protoimpl.UnsafeEnabled {
+		mi := &file_pkg_surfstore_SurfStore_proto_msgTypes[35]
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		ms.StoreMessageInfo(mi)
+	}
+}
+
+func (x *RestoreOperation) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*RestoreOperation) ProtoMessage() {}
+
+func (x *RestoreOperation) ProtoReflect() protoreflect.Message {
+	mi := &file_pkg_surfstore_SurfStore_proto_msgTypes[35]
+	if protoimpl.UnsafeEnabled && x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use RestoreOperation.ProtoReflect.Descriptor instead.
+func (*RestoreOperation) Descriptor() ([]byte, []int) {
+	return file_pkg_surfstore_SurfStore_proto_rawDescGZIP(), []int{35}
+}
+
+func (x *RestoreOperation) GetFileVersion() *FileVersion {
+	if x != nil {
+		return x.FileVersion
+	}
+	return nil
+}
+
+func (x *RestoreOperation) GetOwner() string {
+	if x != nil {
+		return x.Owner
+	}
+	return ""
+}
+
+// Moves blocks to a new ring, or with migrated set, records that every
+// block has reached the servers of the ring given
+type BlockStoreChange struct {
+	state         protoimpl.MessageState
+	sizeCache     protoimpl.SizeCache
+	unknownFields protoimpl.UnknownFields
+
+	Addrs    []string `protobuf:"bytes,1,rep,name=addrs,proto3" json:"addrs,omitempty"`
+	Migrated bool     `protobuf:"varint,2,opt,name=migrated,proto3" json:"migrated,omitempty"`
+}
+
+func (x *BlockStoreChange) Reset() {
+	*x = BlockStoreChange{}
+	if protoimpl.UnsafeEnabled {
+		mi := &file_pkg_surfstore_SurfStore_proto_msgTypes[36]
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		ms.StoreMessageInfo(mi)
+	}
+}
+
+func (x *BlockStoreChange) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*BlockStoreChange) ProtoMessage() {}
+
+func (x *BlockStoreChange) ProtoReflect() protoreflect.Message {
+	mi := &file_pkg_surfstore_SurfStore_proto_msgTypes[36]
+	if protoimpl.UnsafeEnabled && x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use BlockStoreChange.ProtoReflect.Descriptor instead.
+func (*BlockStoreChange) Descriptor() ([]byte, []int) {
+	return file_pkg_surfstore_SurfStore_proto_rawDescGZIP(), []int{36}
+}
+
+func (x *BlockStoreChange) GetAddrs() []string {
+	if x != nil {
+		return x.Addrs
+	}
+	return nil
+}
+
+func (x *BlockStoreChange) GetMigrated() bool {
+	if x != nil {
+		return x.Migrated
+	}
+	return false
+}
+
+type RaftInternalState struct {
+	state         protoimpl.MessageState
+	sizeCache     protoimpl.SizeCache
+	unknownFields protoimpl.UnknownFields
+
+	IsLeader    bool               `protobuf:"varint,1,opt,name=isLeader,proto3" json:"isLeader,omitempty"`
+	Term        int64              `protobuf:"varint,2,opt,name=term,proto3" json:"term,omitempty"`
+	Log         []*UpdateOperation `protobuf:"bytes,3,rep,name=log,proto3" json:"log,omitempty"`
+	MetaMap     *FileInfoMap       `protobuf:"bytes,4,opt,name=metaMap,proto3" json:"metaMap,omitempty"`
+	CommitIndex int64              `protobuf:"varint,5,opt,name=commitIndex,proto3" json:"commitIndex,omitempty"`
+	LastApplied int64              `protobuf:"varint,6,opt,name=lastApplied,proto3" json:"lastApplied,omitempty"`
+}
+
+func (x *RaftInternalState) Reset() {
+	*x = RaftInternalState{}
+	if protoimpl.UnsafeEnabled {
+		mi := &file_pkg_surfstore_SurfStore_proto_msgTypes[37]
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		ms.StoreMessageInfo(mi)
+	}
+}
+
+func (x *RaftInternalState) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*RaftInternalState) ProtoMessage() {}
+
+func (x *RaftInternalState) ProtoReflect() protoreflect.Message {
+	mi := &file_pkg_surfstore_SurfStore_proto_msgTypes[37]
+	if protoimpl.UnsafeEnabled && x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use RaftInternalState.ProtoReflect.Descriptor instead.
+func (*RaftInternalState) Descriptor() ([]byte, []int) {
+	return file_pkg_surfstore_SurfStore_proto_rawDescGZIP(), []int{37}
+}
+
+func (x *RaftInternalState) GetIsLeader() bool {
+	if x != nil {
+		return x.IsLeader
+	}
+	return false
 }
 
 func (x *RaftInternalState) GetTerm() int64 {
@@ -744,6 +2498,191 @@ func (x *RaftInternalState) GetMetaMap() *FileInfoMap {
 	return nil
 }
 
+func (x *RaftInternalState) GetCommitIndex() int64 {
+	if x != nil {
+		return x.CommitIndex
+	}
+	return 0
+}
+
+func (x *RaftInternalState) GetLastApplied() int64 {
+	if x != nil {
+		return x.LastApplied
+	}
+	return 0
+}
+
+// Everything a durable MetaStore needs to come back after a restart,
+// written out so that its journal can be truncated
+type MetaStoreCheckpoint struct {
+	state         protoimpl.MessageState
+	sizeCache     protoimpl.SizeCache
+	unknownFields protoimpl.UnknownFields
+
+	Namespaces              []*NamespaceCheckpoint    `protobuf:"bytes,1,rep,name=namespaces,proto3" json:"namespaces,omitempty"`
+	BlockStoreAddrs         []string                  `protobuf:"bytes,2,rep,name=blockStoreAddrs,proto3" json:"blockStoreAddrs,omitempty"`
+	PreviousBlockStoreAddrs []string                  `protobuf:"bytes,3,rep,name=previousBlockStoreAddrs,proto3" json:"previousBlockStoreAddrs,omitempty"`
+	BlockStoreRegistry      []*BlockStoreRegistration `protobuf:"bytes,4,rep,name=blockStoreRegistry,proto3" json:"blockStoreRegistry,omitempty"`
+}
+
+func (x *MetaStoreCheckpoint) Reset() {
+	*x = MetaStoreCheckpoint{}
+	if protoimpl.UnsafeEnabled {
+		mi := &file_pkg_surfstore_SurfStore_proto_msgTypes[38]
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		ms.StoreMessageInfo(mi)
+	}
+}
+
+func (x *MetaStoreCheckpoint) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*MetaStoreCheckpoint) ProtoMessage() {}
+
+func (x *MetaStoreCheckpoint) ProtoReflect() protoreflect.Message {
+	mi := &file_pkg_surfstore_SurfStore_proto_msgTypes[38]
+	if protoimpl.UnsafeEnabled && x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use MetaStoreCheckpoint.ProtoReflect.Descriptor instead.
+func (*MetaStoreCheckpoint) Descriptor() ([]byte, []int) {
+	return file_pkg_surfstore_SurfStore_proto_rawDescGZIP(), []int{38}
+}
+
+func (x *MetaStoreCheckpoint) GetNamespaces() []*NamespaceCheckpoint {
+	if x != nil {
+		return x.Namespaces
+	}
+	return nil
+}
+
+func (x *MetaStoreCheckpoint) GetBlockStoreAddrs() []string {
+	if x != nil {
+		return x.BlockStoreAddrs
+	}
+	return nil
+}
+
+func (x *MetaStoreCheckpoint) GetPreviousBlockStoreAddrs() []string {
+	if x != nil {
+		return x.PreviousBlockStoreAddrs
+	}
+	return nil
+}
+
+func (x *MetaStoreCheckpoint) GetBlockStoreRegistry() []*BlockStoreRegistration {
+	if x != nil {
+		return x.BlockStoreRegistry
+	}
+	return nil
+}
+
+type NamespaceCheckpoint struct {
+	state         protoimpl.MessageState
+	sizeCache     protoimpl.SizeCache
+	unknownFields protoimpl.UnknownFields
+
+	Namespace         string `protobuf:"bytes,1,opt,name=namespace,proto3" json:"namespace,omitempty"`
+	Revision          int64  `protobuf:"varint,2,opt,name=revision,proto3" json:"revision,omitempty"`
+	CompactedRevision int64  `protobuf:"varint,3,opt,name=compactedRevision,proto3" json:"compactedRevision,omitempty"`
+	SnapshotHorizon   int64  `protobuf:"varint,4,opt,name=snapshotHorizon,proto3" json:"snapshotHorizon,omitempty"`
+	// retained versions in commit order
+	Changes         []*FileMetaData  `protobuf:"bytes,5,rep,name=changes,proto3" json:"changes,omitempty"`
+	ClientRevisions map[string]int64 `protobuf:"bytes,6,rep,name=clientRevisions,proto3" json:"clientRevisions,omitempty" protobuf_key:"bytes,1,opt,name=key,proto3" protobuf_val:"varint,2,opt,name=value,proto3"`
+	// deleted files whose history is retained but which have dropped out
+	// of the FileInfoMap
+	ForgottenFiles []string `protobuf:"bytes,7,rep,name=forgottenFiles,proto3" json:"forgottenFiles,omitempty"`
+}
+
+func (x *NamespaceCheckpoint) Reset() {
+	*x = NamespaceCheckpoint{}
+	if protoimpl.UnsafeEnabled {
+		mi := &file_pkg_surfstore_SurfStore_proto_msgTypes[39]
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		ms.StoreMessageInfo(mi)
+	}
+}
+
+func (x *NamespaceCheckpoint) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*NamespaceCheckpoint) ProtoMessage() {}
+
+func (x *NamespaceCheckpoint) ProtoReflect() protoreflect.Message {
+	mi := &file_pkg_surfstore_SurfStore_proto_msgTypes[39]
+	if protoimpl.UnsafeEnabled && x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use NamespaceCheckpoint.ProtoReflect.Descriptor instead.
+func (*NamespaceCheckpoint) Descriptor() ([]byte, []int) {
+	return file_pkg_surfstore_SurfStore_proto_rawDescGZIP(), []int{39}
+}
+
+func (x *NamespaceCheckpoint) GetNamespace() string {
+	if x != nil {
+		return x.Namespace
+	}
+	return ""
+}
+
+func (x *NamespaceCheckpoint) GetRevision() int64 {
+	if x != nil {
+		return x.Revision
+	}
+	return 0
+}
+
+func (x *NamespaceCheckpoint) GetCompactedRevision() int64 {
+	if x != nil {
+		return x.CompactedRevision
+	}
+	return 0
+}
+
+func (x *NamespaceCheckpoint) GetSnapshotHorizon() int64 {
+	if x != nil {
+		return x.SnapshotHorizon
+	}
+	return 0
+}
+
+func (x *NamespaceCheckpoint) GetChanges() []*FileMetaData {
+	if x != nil {
+		return x.Changes
+	}
+	return nil
+}
+
+func (x *NamespaceCheckpoint) GetClientRevisions() map[string]int64 {
+	if x != nil {
+		return x.ClientRevisions
+	}
+	return nil
+}
+
+func (x *NamespaceCheckpoint) GetForgottenFiles() []string {
+	if x != nil {
+		return x.ForgottenFiles
+	}
+	return nil
+}
+
 var File_pkg_surfstore_SurfStore_proto protoreflect.FileDescriptor
 
 var file_pkg_surfstore_SurfStore_proto_rawDesc = []byte{
@@ -762,70 +2701,339 @@ var file_pkg_surfstore_SurfStore_proto_rawDesc = []byte{
 	0x69, 0x7a, 0x65, 0x18, 0x02, 0x20, 0x01, 0x28, 0x05, 0x52, 0x09, 0x62, 0x6c, 0x6f, 0x63, 0x6b,
 	0x53, 0x69, 0x7a, 0x65, 0x22, 0x1d, 0x0a, 0x07, 0x53, 0x75, 0x63, 0x63, 0x65, 0x73, 0x73, 0x12,
 	0x12, 0x0a, 0x04, 0x66, 0x6c, 0x61, 0x67, 0x18, 0x01, 0x20, 0x01, 0x28, 0x08, 0x52, 0x04, 0x66,
-	0x6c, 0x61, 0x67, 0x22, 0x6a, 0x0a, 0x0c, 0x46, 0x69, 0x6c, 0x65, 0x4d, 0x65, 0x74, 0x61, 0x44,
-	0x61, 0x74, 0x61, 0x12, 0x1a, 0x0a, 0x08, 0x66, 0x69, 0x6c, 0x65, 0x6e, 0x61, 0x6d, 0x65, 0x18,
+	0x6c, 0x61, 0x67, 0x22, 0xe0, 0x02, 0x0a, 0x0c, 0x46, 0x69, 0x6c, 0x65, 0x4d, 0x65, 0x74, 0x61,
+	0x44, 0x61, 0x74, 0x61, 0x12, 0x1a, 0x0a, 0x08, 0x66, 0x69, 0x6c, 0x65, 0x6e, 0x61, 0x6d, 0x65,
+	0x18, 0x01, 0x20, 0x01, 0x28, 0x09, 0x52, 0x08, 0x66, 0x69, 0x6c, 0x65, 0x6e, 0x61, 0x6d, 0x65,
+	0x12, 0x18, 0x0a, 0x07, 0x76, 0x65, 0x72, 0x73, 0x69, 0x6f, 0x6e, 0x18, 0x02, 0x20, 0x01, 0x28,
+	0x05, 0x52, 0x07, 0x76, 0x65, 0x72, 0x73, 0x69, 0x6f, 0x6e, 0x12, 0x24, 0x0a, 0x0d, 0x62, 0x6c,
+	0x6f, 0x63, 0x6b, 0x48, 0x61, 0x73, 0x68, 0x4c, 0x69, 0x73, 0x74, 0x18, 0x03, 0x20, 0x03, 0x28,
+	0x09, 0x52, 0x0d, 0x62, 0x6c, 0x6f, 0x63, 0x6b, 0x48, 0x61, 0x73, 0x68, 0x4c, 0x69, 0x73, 0x74,
+	0x12, 0x1a, 0x0a, 0x08, 0x72, 0x65, 0x76, 0x69, 0x73, 0x69, 0x6f, 0x6e, 0x18, 0x04, 0x20, 0x01,
+	0x28, 0x03, 0x52, 0x08, 0x72, 0x65, 0x76, 0x69, 0x73, 0x69, 0x6f, 0x6e, 0x12, 0x1c, 0x0a, 0x09,
+	0x74, 0x69, 0x6d, 0x65, 0x73, 0x74, 0x61, 0x6d, 0x70, 0x18, 0x05, 0x20, 0x01, 0x28, 0x03, 0x52,
+	0x09, 0x74, 0x69, 0x6d, 0x65, 0x73, 0x74, 0x61, 0x6d, 0x70, 0x12, 0x12, 0x0a, 0x04, 0x6d, 0x6f,
+	0x64, 0x65, 0x18, 0x06, 0x20, 0x01, 0x28, 0x0d, 0x52, 0x04, 0x6d, 0x6f, 0x64, 0x65, 0x12, 0x14,
+	0x0a, 0x05, 0x6d, 0x74, 0x69, 0x6d, 0x65, 0x18, 0x07, 0x20, 0x01, 0x28, 0x03, 0x52, 0x05, 0x6d,
+	0x74, 0x69, 0x6d, 0x65, 0x12, 0x12, 0x0a, 0x04, 0x73, 0x69, 0x7a, 0x65, 0x18, 0x08, 0x20, 0x01,
+	0x28, 0x03, 0x52, 0x04, 0x73, 0x69, 0x7a, 0x65, 0x12, 0x24, 0x0a, 0x0d, 0x73, 0x79, 0x6d, 0x6c,
+	0x69, 0x6e, 0x6b, 0x54, 0x61, 0x72, 0x67, 0x65, 0x74, 0x18, 0x09, 0x20, 0x01, 0x28, 0x09, 0x52,
+	0x0d, 0x73, 0x79, 0x6d, 0x6c, 0x69, 0x6e, 0x6b, 0x54, 0x61, 0x72, 0x67, 0x65, 0x74, 0x12, 0x14,
+	0x0a, 0x05, 0x6f, 0x77, 0x6e, 0x65, 0x72, 0x18, 0x0a, 0x20, 0x01, 0x28, 0x09, 0x52, 0x05, 0x6f,
+	0x77, 0x6e, 0x65, 0x72, 0x12, 0x40, 0x0a, 0x0e, 0x65, 0x72, 0x61, 0x73, 0x75, 0x72, 0x65, 0x53,
+	0x74, 0x72, 0x69, 0x70, 0x65, 0x73, 0x18, 0x0b, 0x20, 0x03, 0x28, 0x0b, 0x32, 0x18, 0x2e, 0x73,
+	0x75, 0x72, 0x66, 0x73, 0x74, 0x6f, 0x72, 0x65, 0x2e, 0x45, 0x72, 0x61, 0x73, 0x75, 0x72, 0x65,
+	0x53, 0x74, 0x72, 0x69, 0x70, 0x65, 0x52, 0x0e, 0x65, 0x72, 0x61, 0x73, 0x75, 0x72, 0x65, 0x53,
+	0x74, 0x72, 0x69, 0x70, 0x65, 0x73, 0x22, 0x8d, 0x01, 0x0a, 0x0d, 0x45, 0x72, 0x61, 0x73, 0x75,
+	0x72, 0x65, 0x53, 0x74, 0x72, 0x69, 0x70, 0x65, 0x12, 0x1c, 0x0a, 0x09, 0x62, 0x6c, 0x6f, 0x63,
+	0x6b, 0x48, 0x61, 0x73, 0x68, 0x18, 0x01, 0x20, 0x01, 0x28, 0x09, 0x52, 0x09, 0x62, 0x6c, 0x6f,
+	0x63, 0x6b, 0x48, 0x61, 0x73, 0x68, 0x12, 0x1c, 0x0a, 0x09, 0x62, 0x6c, 0x6f, 0x63, 0x6b, 0x53,
+	0x69, 0x7a, 0x65, 0x18, 0x02, 0x20, 0x01, 0x28, 0x05, 0x52, 0x09, 0x62, 0x6c, 0x6f, 0x63, 0x6b,
+	0x53, 0x69, 0x7a, 0x65, 0x12, 0x1e, 0x0a, 0x0a, 0x64, 0x61, 0x74, 0x61, 0x53, 0x68, 0x61, 0x72,
+	0x64, 0x73, 0x18, 0x03, 0x20, 0x01, 0x28, 0x05, 0x52, 0x0a, 0x64, 0x61, 0x74, 0x61, 0x53, 0x68,
+	0x61, 0x72, 0x64, 0x73, 0x12, 0x20, 0x0a, 0x0b, 0x73, 0x68, 0x61, 0x72, 0x64, 0x48, 0x61, 0x73,
+	0x68, 0x65, 0x73, 0x18, 0x04, 0x20, 0x03, 0x28, 0x09, 0x52, 0x0b, 0x73, 0x68, 0x61, 0x72, 0x64,
+	0x48, 0x61, 0x73, 0x68, 0x65, 0x73, 0x22, 0x6b, 0x0a, 0x0d, 0x53, 0x74, 0x6f, 0x72, 0x61, 0x67,
+	0x65, 0x50, 0x6f, 0x6c, 0x69, 0x63, 0x79, 0x12, 0x16, 0x0a, 0x06, 0x70, 0x72, 0x65, 0x66, 0x69,
+	0x78, 0x18, 0x01, 0x20, 0x01, 0x28, 0x09, 0x52, 0x06, 0x70, 0x72, 0x65, 0x66, 0x69, 0x78, 0x12,
+	0x1e, 0x0a, 0x0a, 0x64, 0x61, 0x74, 0x61, 0x53, 0x68, 0x61, 0x72, 0x64, 0x73, 0x18, 0x02, 0x20,
+	0x01, 0x28, 0x05, 0x52, 0x0a, 0x64, 0x61, 0x74, 0x61, 0x53, 0x68, 0x61, 0x72, 0x64, 0x73, 0x12,
+	0x22, 0x0a, 0x0c, 0x70, 0x61, 0x72, 0x69, 0x74, 0x79, 0x53, 0x68, 0x61, 0x72, 0x64, 0x73, 0x18,
+	0x03, 0x20, 0x01, 0x28, 0x05, 0x52, 0x0c, 0x70, 0x61, 0x72, 0x69, 0x74, 0x79, 0x53, 0x68, 0x61,
+	0x72, 0x64, 0x73, 0x22, 0x47, 0x0a, 0x0f, 0x53, 0x74, 0x6f, 0x72, 0x61, 0x67, 0x65, 0x50, 0x6f,
+	0x6c, 0x69, 0x63, 0x69, 0x65, 0x73, 0x12, 0x34, 0x0a, 0x08, 0x70, 0x6f, 0x6c, 0x69, 0x63, 0x69,
+	0x65, 0x73, 0x18, 0x01, 0x20, 0x03, 0x28, 0x0b, 0x32, 0x18, 0x2e, 0x73, 0x75, 0x72, 0x66, 0x73,
+	0x74, 0x6f, 0x72, 0x65, 0x2e, 0x53, 0x74, 0x6f, 0x72, 0x61, 0x67, 0x65, 0x50, 0x6f, 0x6c, 0x69,
+	0x63, 0x79, 0x52, 0x08, 0x70, 0x6f, 0x6c, 0x69, 0x63, 0x69, 0x65, 0x73, 0x22, 0x26, 0x0a, 0x08,
+	0x46, 0x69, 0x6c, 0x65, 0x4e, 0x61, 0x6d, 0x65, 0x12, 0x1a, 0x0a, 0x08, 0x66, 0x69, 0x6c, 0x65,
+	0x6e, 0x61, 0x6d, 0x65, 0x18, 0x01, 0x20, 0x01, 0x28, 0x09, 0x52, 0x08, 0x66, 0x69, 0x6c, 0x65,
+	0x6e, 0x61, 0x6d, 0x65, 0x22, 0x43, 0x0a, 0x0b, 0x46, 0x69, 0x6c, 0x65, 0x56, 0x65, 0x72, 0x73,
+	0x69, 0x6f, 0x6e, 0x12, 0x1a, 0x0a, 0x08, 0x66, 0x69, 0x6c, 0x65, 0x6e, 0x61, 0x6d, 0x65, 0x18,
 	0x01, 0x20, 0x01, 0x28, 0x09, 0x52, 0x08, 0x66, 0x69, 0x6c, 0x65, 0x6e, 0x61, 0x6d, 0x65, 0x12,
 	0x18, 0x0a, 0x07, 0x76, 0x65, 0x72, 0x73, 0x69, 0x6f, 0x6e, 0x18, 0x02, 0x20, 0x01, 0x28, 0x05,
-	0x52, 0x07, 0x76, 0x65, 0x72, 0x73, 0x69, 0x6f, 0x6e, 0x12, 0x24, 0x0a, 0x0d, 0x62, 0x6c, 0x6f,
-	0x63, 0x6b, 0x48, 0x61, 0x73, 0x68, 0x4c, 0x69, 0x73, 0x74, 0x18, 0x03, 0x20, 0x03, 0x28, 0x09,
-	0x52, 0x0d, 0x62, 0x6c, 0x6f, 0x63, 0x6b, 0x48, 0x61, 0x73, 0x68, 0x4c, 0x69, 0x73, 0x74, 0x22,
-	0xb1, 0x01, 0x0a, 0x0b, 0x46, 0x69, 0x6c, 0x65, 0x49, 0x6e, 0x66, 0x6f, 0x4d, 0x61, 0x70, 0x12,
-	0x49, 0x0a, 0x0b, 0x66, 0x69, 0x6c, 0x65, 0x49, 0x6e, 0x66, 0x6f, 0x4d, 0x61, 0x70, 0x18, 0x01,
-	0x20, 0x03, 0x28, 0x0b, 0x32, 0x27, 0x2e, 0x73, 0x75, 0x72, 0x66, 0x73, 0x74, 0x6f, 0x72, 0x65,
-	0x2e, 0x46, 0x69, 0x6c, 0x65, 0x49, 0x6e, 0x66, 0x6f, 0x4d, 0x61, 0x70, 0x2e, 0x46, 0x69, 0x6c,
-	0x65, 0x49, 0x6e, 0x66, 0x6f, 0x4d, 0x61, 0x70, 0x45, 0x6e, 0x74, 0x72, 0x79, 0x52, 0x0b, 0x66,
-	0x69, 0x6c, 0x65, 0x49, 0x6e, 0x66, 0x6f, 0x4d, 0x61, 0x70, 0x1a, 0x57, 0x0a, 0x10, 0x46, 0x69,
-	0x6c, 0x65, 0x49, 0x6e, 0x66, 0x6f, 0x4d, 0x61, 0x70, 0x45, 0x6e, 0x74, 0x72, 0x79, 0x12, 0x10,
-	0x0a, 0x03, 0x6b, 0x65, 0x79, 0x18, 0x01, 0x20, 0x01, 0x28, 0x09, 0x52, 0x03, 0x6b, 0x65, 0x79,
-	0x12, 0x2d, 0x0a, 0x05, 0x76, 0x61, 0x6c, 0x75, 0x65, 0x18, 0x02, 0x20, 0x01, 0x28, 0x0b, 0x32,
-	0x17, 0x2e, 0x73, 0x75, 0x72, 0x66, 0x73, 0x74, 0x6f, 0x72, 0x65, 0x2e, 0x46, 0x69, 0x6c, 0x65,
-	0x4d, 0x65, 0x74, 0x61, 0x44, 0x61, 0x74, 0x61, 0x52, 0x05, 0x76, 0x61, 0x6c, 0x75, 0x65, 0x3a,
-	0x02, 0x38, 0x01, 0x22, 0x23, 0x0a, 0x07, 0x56, 0x65, 0x72, 0x73, 0x69, 0x6f, 0x6e, 0x12, 0x18,
-	0x0a, 0x07, 0x76, 0x65, 0x72, 0x73, 0x69, 0x6f, 0x6e, 0x18, 0x01, 0x20, 0x01, 0x28, 0x05, 0x52,
-	0x07, 0x76, 0x65, 0x72, 0x73, 0x69, 0x6f, 0x6e, 0x22, 0x24, 0x0a, 0x0e, 0x42, 0x6c, 0x6f, 0x63,
-	0x6b, 0x53, 0x74, 0x6f, 0x72, 0x65, 0x41, 0x64, 0x64, 0x72, 0x12, 0x12, 0x0a, 0x04, 0x61, 0x64,
-	0x64, 0x72, 0x18, 0x01, 0x20, 0x01, 0x28, 0x09, 0x52, 0x04, 0x61, 0x64, 0x64, 0x72, 0x22, 0x2c,
-	0x0a, 0x0c, 0x43, 0x72, 0x61, 0x73, 0x68, 0x65, 0x64, 0x53, 0x74, 0x61, 0x74, 0x65, 0x12, 0x1c,
-	0x0a, 0x09, 0x69, 0x73, 0x43, 0x72, 0x61, 0x73, 0x68, 0x65, 0x64, 0x18, 0x01, 0x20, 0x01, 0x28,
-	0x08, 0x52, 0x09, 0x69, 0x73, 0x43, 0x72, 0x61, 0x73, 0x68, 0x65, 0x64, 0x22, 0xc6, 0x01, 0x0a,
-	0x10, 0x41, 0x70, 0x70, 0x65, 0x6e, 0x64, 0x45, 0x6e, 0x74, 0x72, 0x79, 0x49, 0x6e, 0x70, 0x75,
-	0x74, 0x12, 0x12, 0x0a, 0x04, 0x74, 0x65, 0x72, 0x6d, 0x18, 0x01, 0x20, 0x01, 0x28, 0x03, 0x52,
-	0x04, 0x74, 0x65, 0x72, 0x6d, 0x12, 0x22, 0x0a, 0x0c, 0x70, 0x72, 0x65, 0x76, 0x4c, 0x6f, 0x67,
-	0x49, 0x6e, 0x64, 0x65, 0x78, 0x18, 0x02, 0x20, 0x01, 0x28, 0x03, 0x52, 0x0c, 0x70, 0x72, 0x65,
-	0x76, 0x4c, 0x6f, 0x67, 0x49, 0x6e, 0x64, 0x65, 0x78, 0x12, 0x20, 0x0a, 0x0b, 0x70, 0x72, 0x65,
-	0x76, 0x4c, 0x6f, 0x67, 0x54, 0x65, 0x72, 0x6d, 0x18, 0x03, 0x20, 0x01, 0x28, 0x03, 0x52, 0x0b,
-	0x70, 0x72, 0x65, 0x76, 0x4c, 0x6f, 0x67, 0x54, 0x65, 0x72, 0x6d, 0x12, 0x34, 0x0a, 0x07, 0x65,
-	0x6e, 0x74, 0x72, 0x69, 0x65, 0x73, 0x18, 0x04, 0x20, 0x03, 0x28, 0x0b, 0x32, 0x1a, 0x2e, 0x73,
-	0x75, 0x72, 0x66, 0x73, 0x74, 0x6f, 0x72, 0x65, 0x2e, 0x55, 0x70, 0x64, 0x61, 0x74, 0x65, 0x4f,
-	0x70, 0x65, 0x72, 0x61, 0x74, 0x69, 0x6f, 0x6e, 0x52, 0x07, 0x65, 0x6e, 0x74, 0x72, 0x69, 0x65,
-	0x73, 0x12, 0x22, 0x0a, 0x0c, 0x6c, 0x65, 0x61, 0x64, 0x65, 0x72, 0x43, 0x6f, 0x6d, 0x6d, 0x69,
-	0x74, 0x18, 0x05, 0x20, 0x01, 0x28, 0x03, 0x52, 0x0c, 0x6c, 0x65, 0x61, 0x64, 0x65, 0x72, 0x43,
-	0x6f, 0x6d, 0x6d, 0x69, 0x74, 0x22, 0x81, 0x01, 0x0a, 0x11, 0x41, 0x70, 0x70, 0x65, 0x6e, 0x64,
-	0x45, 0x6e, 0x74, 0x72, 0x79, 0x4f, 0x75, 0x74, 0x70, 0x75, 0x74, 0x12, 0x1a, 0x0a, 0x08, 0x73,
-	0x65, 0x72, 0x76, 0x65, 0x72, 0x49, 0x64, 0x18, 0x01, 0x20, 0x01, 0x28, 0x03, 0x52, 0x08, 0x73,
-	0x65, 0x72, 0x76, 0x65, 0x72, 0x49, 0x64, 0x12, 0x12, 0x0a, 0x04, 0x74, 0x65, 0x72, 0x6d, 0x18,
-	0x02, 0x20, 0x01, 0x28, 0x03, 0x52, 0x04, 0x74, 0x65, 0x72, 0x6d, 0x12, 0x18, 0x0a, 0x07, 0x73,
-	0x75, 0x63, 0x63, 0x65, 0x73, 0x73, 0x18, 0x03, 0x20, 0x01, 0x28, 0x08, 0x52, 0x07, 0x73, 0x75,
-	0x63, 0x63, 0x65, 0x73, 0x73, 0x12, 0x22, 0x0a, 0x0c, 0x6d, 0x61, 0x74, 0x63, 0x68, 0x65, 0x64,
-	0x49, 0x6e, 0x64, 0x65, 0x78, 0x18, 0x04, 0x20, 0x01, 0x28, 0x03, 0x52, 0x0c, 0x6d, 0x61, 0x74,
-	0x63, 0x68, 0x65, 0x64, 0x49, 0x6e, 0x64, 0x65, 0x78, 0x22, 0x62, 0x0a, 0x0f, 0x55, 0x70, 0x64,
-	0x61, 0x74, 0x65, 0x4f, 0x70, 0x65, 0x72, 0x61, 0x74, 0x69, 0x6f, 0x6e, 0x12, 0x12, 0x0a, 0x04,
-	0x74, 0x65, 0x72, 0x6d, 0x18, 0x01, 0x20, 0x01, 0x28, 0x03, 0x52, 0x04, 0x74, 0x65, 0x72, 0x6d,
-	0x12, 0x3b, 0x0a, 0x0c, 0x66, 0x69, 0x6c, 0x65, 0x4d, 0x65, 0x74, 0x61, 0x44, 0x61, 0x74, 0x61,
-	0x18, 0x03, 0x20, 0x01, 0x28, 0x0b, 0x32, 0x17, 0x2e, 0x73, 0x75, 0x72, 0x66, 0x73, 0x74, 0x6f,
-	0x72, 0x65, 0x2e, 0x46, 0x69, 0x6c, 0x65, 0x4d, 0x65, 0x74, 0x61, 0x44, 0x61, 0x74, 0x61, 0x52,
-	0x0c, 0x66, 0x69, 0x6c, 0x65, 0x4d, 0x65, 0x74, 0x61, 0x44, 0x61, 0x74, 0x61, 0x22, 0xa3, 0x01,
-	0x0a, 0x11, 0x52, 0x61, 0x66, 0x74, 0x49, 0x6e, 0x74, 0x65, 0x72, 0x6e, 0x61, 0x6c, 0x53, 0x74,
-	0x61, 0x74, 0x65, 0x12, 0x1a, 0x0a, 0x08, 0x69, 0x73, 0x4c, 0x65, 0x61, 0x64, 0x65, 0x72, 0x18,
-	0x01, 0x20, 0x01, 0x28, 0x08, 0x52, 0x08, 0x69, 0x73, 0x4c, 0x65, 0x61, 0x64, 0x65, 0x72, 0x12,
-	0x12, 0x0a, 0x04, 0x74, 0x65, 0x72, 0x6d, 0x18, 0x02, 0x20, 0x01, 0x28, 0x03, 0x52, 0x04, 0x74,
-	0x65, 0x72, 0x6d, 0x12, 0x2c, 0x0a, 0x03, 0x6c, 0x6f, 0x67, 0x18, 0x03, 0x20, 0x03, 0x28, 0x0b,
-	0x32, 0x1a, 0x2e, 0x73, 0x75, 0x72, 0x66, 0x73, 0x74, 0x6f, 0x72, 0x65, 0x2e, 0x55, 0x70, 0x64,
-	0x61, 0x74, 0x65, 0x4f, 0x70, 0x65, 0x72, 0x61, 0x74, 0x69, 0x6f, 0x6e, 0x52, 0x03, 0x6c, 0x6f,
-	0x67, 0x12, 0x30, 0x0a, 0x07, 0x6d, 0x65, 0x74, 0x61, 0x4d, 0x61, 0x70, 0x18, 0x04, 0x20, 0x01,
-	0x28, 0x0b, 0x32, 0x16, 0x2e, 0x73, 0x75, 0x72, 0x66, 0x73, 0x74, 0x6f, 0x72, 0x65, 0x2e, 0x46,
-	0x69, 0x6c, 0x65, 0x49, 0x6e, 0x66, 0x6f, 0x4d, 0x61, 0x70, 0x52, 0x07, 0x6d, 0x65, 0x74, 0x61,
-	0x4d, 0x61, 0x70, 0x32, 0xb5, 0x01, 0x0a, 0x0a, 0x42, 0x6c, 0x6f, 0x63, 0x6b, 0x53, 0x74, 0x6f,
+	0x52, 0x07, 0x76, 0x65, 0x72, 0x73, 0x69, 0x6f, 0x6e, 0x22, 0x49, 0x0a, 0x0f, 0x42, 0x6c, 0x6f,
+	0x63, 0x6b, 0x52, 0x65, 0x66, 0x65, 0x72, 0x65, 0x6e, 0x63, 0x65, 0x73, 0x12, 0x36, 0x0a, 0x0a,
+	0x72, 0x65, 0x66, 0x65, 0x72, 0x65, 0x6e, 0x63, 0x65, 0x73, 0x18, 0x01, 0x20, 0x03, 0x28, 0x0b,
+	0x32, 0x16, 0x2e, 0x73, 0x75, 0x72, 0x66, 0x73, 0x74, 0x6f, 0x72, 0x65, 0x2e, 0x46, 0x69, 0x6c,
+	0x65, 0x56, 0x65, 0x72, 0x73, 0x69, 0x6f, 0x6e, 0x52, 0x0a, 0x72, 0x65, 0x66, 0x65, 0x72, 0x65,
+	0x6e, 0x63, 0x65, 0x73, 0x22, 0x42, 0x0a, 0x0b, 0x46, 0x69, 0x6c, 0x65, 0x48, 0x69, 0x73, 0x74,
+	0x6f, 0x72, 0x79, 0x12, 0x33, 0x0a, 0x08, 0x76, 0x65, 0x72, 0x73, 0x69, 0x6f, 0x6e, 0x73, 0x18,
+	0x01, 0x20, 0x03, 0x28, 0x0b, 0x32, 0x17, 0x2e, 0x73, 0x75, 0x72, 0x66, 0x73, 0x74, 0x6f, 0x72,
+	0x65, 0x2e, 0x46, 0x69, 0x6c, 0x65, 0x4d, 0x65, 0x74, 0x61, 0x44, 0x61, 0x74, 0x61, 0x52, 0x08,
+	0x76, 0x65, 0x72, 0x73, 0x69, 0x6f, 0x6e, 0x73, 0x22, 0xcd, 0x01, 0x0a, 0x0b, 0x46, 0x69, 0x6c,
+	0x65, 0x49, 0x6e, 0x66, 0x6f, 0x4d, 0x61, 0x70, 0x12, 0x49, 0x0a, 0x0b, 0x66, 0x69, 0x6c, 0x65,
+	0x49, 0x6e, 0x66, 0x6f, 0x4d, 0x61, 0x70, 0x18, 0x01, 0x20, 0x03, 0x28, 0x0b, 0x32, 0x27, 0x2e,
+	0x73, 0x75, 0x72, 0x66, 0x73, 0x74, 0x6f, 0x72, 0x65, 0x2e, 0x46, 0x69, 0x6c, 0x65, 0x49, 0x6e,
+	0x66, 0x6f, 0x4d, 0x61, 0x70, 0x2e, 0x46, 0x69, 0x6c, 0x65, 0x49, 0x6e, 0x66, 0x6f, 0x4d, 0x61,
+	0x70, 0x45, 0x6e, 0x74, 0x72, 0x79, 0x52, 0x0b, 0x66, 0x69, 0x6c, 0x65, 0x49, 0x6e, 0x66, 0x6f,
+	0x4d, 0x61, 0x70, 0x12, 0x1a, 0x0a, 0x08, 0x72, 0x65, 0x76, 0x69, 0x73, 0x69, 0x6f, 0x6e, 0x18,
+	0x02, 0x20, 0x01, 0x28, 0x03, 0x52, 0x08, 0x72, 0x65, 0x76, 0x69, 0x73, 0x69, 0x6f, 0x6e, 0x1a,
+	0x57, 0x0a, 0x10, 0x46, 0x69, 0x6c, 0x65, 0x49, 0x6e, 0x66, 0x6f, 0x4d, 0x61, 0x70, 0x45, 0x6e,
+	0x74, 0x72, 0x79, 0x12, 0x10, 0x0a, 0x03, 0x6b, 0x65, 0x79, 0x18, 0x01, 0x20, 0x01, 0x28, 0x09,
+	0x52, 0x03, 0x6b, 0x65, 0x79, 0x12, 0x2d, 0x0a, 0x05, 0x76, 0x61, 0x6c, 0x75, 0x65, 0x18, 0x02,
+	0x20, 0x01, 0x28, 0x0b, 0x32, 0x17, 0x2e, 0x73, 0x75, 0x72, 0x66, 0x73, 0x74, 0x6f, 0x72, 0x65,
+	0x2e, 0x46, 0x69, 0x6c, 0x65, 0x4d, 0x65, 0x74, 0x61, 0x44, 0x61, 0x74, 0x61, 0x52, 0x05, 0x76,
+	0x61, 0x6c, 0x75, 0x65, 0x3a, 0x02, 0x38, 0x01, 0x22, 0x26, 0x0a, 0x08, 0x52, 0x65, 0x76, 0x69,
+	0x73, 0x69, 0x6f, 0x6e, 0x12, 0x1a, 0x0a, 0x08, 0x72, 0x65, 0x76, 0x69, 0x73, 0x69, 0x6f, 0x6e,
+	0x18, 0x01, 0x20, 0x01, 0x28, 0x03, 0x52, 0x08, 0x72, 0x65, 0x76, 0x69, 0x73, 0x69, 0x6f, 0x6e,
+	0x22, 0xd5, 0x01, 0x0a, 0x0d, 0x46, 0x69, 0x6c, 0x65, 0x49, 0x6e, 0x66, 0x6f, 0x44, 0x65, 0x6c,
+	0x74, 0x61, 0x12, 0x3f, 0x0a, 0x07, 0x63, 0x68, 0x61, 0x6e, 0x67, 0x65, 0x73, 0x18, 0x01, 0x20,
+	0x03, 0x28, 0x0b, 0x32, 0x25, 0x2e, 0x73, 0x75, 0x72, 0x66, 0x73, 0x74, 0x6f, 0x72, 0x65, 0x2e,
+	0x46, 0x69, 0x6c, 0x65, 0x49, 0x6e, 0x66, 0x6f, 0x44, 0x65, 0x6c, 0x74, 0x61, 0x2e, 0x43, 0x68,
+	0x61, 0x6e, 0x67, 0x65, 0x73, 0x45, 0x6e, 0x74, 0x72, 0x79, 0x52, 0x07, 0x63, 0x68, 0x61, 0x6e,
+	0x67, 0x65, 0x73, 0x12, 0x1a, 0x0a, 0x08, 0x72, 0x65, 0x76, 0x69, 0x73, 0x69, 0x6f, 0x6e, 0x18,
+	0x02, 0x20, 0x01, 0x28, 0x03, 0x52, 0x08, 0x72, 0x65, 0x76, 0x69, 0x73, 0x69, 0x6f, 0x6e, 0x12,
+	0x12, 0x0a, 0x04, 0x66, 0x75, 0x6c, 0x6c, 0x18, 0x03, 0x20, 0x01, 0x28, 0x08, 0x52, 0x04, 0x66,
+	0x75, 0x6c, 0x6c, 0x1a, 0x53, 0x0a, 0x0c, 0x43, 0x68, 0x61, 0x6e, 0x67, 0x65, 0x73, 0x45, 0x6e,
+	0x74, 0x72, 0x79, 0x12, 0x10, 0x0a, 0x03, 0x6b, 0x65, 0x79, 0x18, 0x01, 0x20, 0x01, 0x28, 0x09,
+	0x52, 0x03, 0x6b, 0x65, 0x79, 0x12, 0x2d, 0x0a, 0x05, 0x76, 0x61, 0x6c, 0x75, 0x65, 0x18, 0x02,
+	0x20, 0x01, 0x28, 0x0b, 0x32, 0x17, 0x2e, 0x73, 0x75, 0x72, 0x66, 0x73, 0x74, 0x6f, 0x72, 0x65,
+	0x2e, 0x46, 0x69, 0x6c, 0x65, 0x4d, 0x65, 0x74, 0x61, 0x44, 0x61, 0x74, 0x61, 0x52, 0x05, 0x76,
+	0x61, 0x6c, 0x75, 0x65, 0x3a, 0x02, 0x38, 0x01, 0x22, 0x4b, 0x0a, 0x0f, 0x53, 0x6e, 0x61, 0x70,
+	0x73, 0x68, 0x6f, 0x74, 0x52, 0x65, 0x71, 0x75, 0x65, 0x73, 0x74, 0x12, 0x1a, 0x0a, 0x08, 0x72,
+	0x65, 0x76, 0x69, 0x73, 0x69, 0x6f, 0x6e, 0x18, 0x01, 0x20, 0x01, 0x28, 0x03, 0x52, 0x08, 0x72,
+	0x65, 0x76, 0x69, 0x73, 0x69, 0x6f, 0x6e, 0x12, 0x1c, 0x0a, 0x09, 0x74, 0x69, 0x6d, 0x65, 0x73,
+	0x74, 0x61, 0x6d, 0x70, 0x18, 0x02, 0x20, 0x01, 0x28, 0x03, 0x52, 0x09, 0x74, 0x69, 0x6d, 0x65,
+	0x73, 0x74, 0x61, 0x6d, 0x70, 0x22, 0x41, 0x0a, 0x07, 0x53, 0x79, 0x6e, 0x63, 0x41, 0x63, 0x6b,
+	0x12, 0x1a, 0x0a, 0x08, 0x63, 0x6c, 0x69, 0x65, 0x6e, 0x74, 0x49, 0x64, 0x18, 0x01, 0x20, 0x01,
+	0x28, 0x09, 0x52, 0x08, 0x63, 0x6c, 0x69, 0x65, 0x6e, 0x74, 0x49, 0x64, 0x12, 0x1a, 0x0a, 0x08,
+	0x72, 0x65, 0x76, 0x69, 0x73, 0x69, 0x6f, 0x6e, 0x18, 0x02, 0x20, 0x01, 0x28, 0x03, 0x52, 0x08,
+	0x72, 0x65, 0x76, 0x69, 0x73, 0x69, 0x6f, 0x6e, 0x22, 0x32, 0x0a, 0x0c, 0x57, 0x61, 0x74, 0x63,
+	0x68, 0x52, 0x65, 0x71, 0x75, 0x65, 0x73, 0x74, 0x12, 0x22, 0x0a, 0x0c, 0x66, 0x72, 0x6f, 0x6d,
+	0x52, 0x65, 0x76, 0x69, 0x73, 0x69, 0x6f, 0x6e, 0x18, 0x01, 0x20, 0x01, 0x28, 0x03, 0x52, 0x0c,
+	0x66, 0x72, 0x6f, 0x6d, 0x52, 0x65, 0x76, 0x69, 0x73, 0x69, 0x6f, 0x6e, 0x22, 0x65, 0x0a, 0x0a,
+	0x46, 0x69, 0x6c, 0x65, 0x43, 0x68, 0x61, 0x6e, 0x67, 0x65, 0x12, 0x3b, 0x0a, 0x0c, 0x66, 0x69,
+	0x6c, 0x65, 0x4d, 0x65, 0x74, 0x61, 0x44, 0x61, 0x74, 0x61, 0x18, 0x01, 0x20, 0x01, 0x28, 0x0b,
+	0x32, 0x17, 0x2e, 0x73, 0x75, 0x72, 0x66, 0x73, 0x74, 0x6f, 0x72, 0x65, 0x2e, 0x46, 0x69, 0x6c,
+	0x65, 0x4d, 0x65, 0x74, 0x61, 0x44, 0x61, 0x74, 0x61, 0x52, 0x0c, 0x66, 0x69, 0x6c, 0x65, 0x4d,
+	0x65, 0x74, 0x61, 0x44, 0x61, 0x74, 0x61, 0x12, 0x1a, 0x0a, 0x08, 0x72, 0x65, 0x76, 0x69, 0x73,
+	0x69, 0x6f, 0x6e, 0x18, 0x02, 0x20, 0x01, 0x28, 0x03, 0x52, 0x08, 0x72, 0x65, 0x76, 0x69, 0x73,
+	0x69, 0x6f, 0x6e, 0x22, 0x44, 0x0a, 0x0e, 0x50, 0x72, 0x75, 0x6e, 0x65, 0x4f, 0x70, 0x65, 0x72,
+	0x61, 0x74, 0x69, 0x6f, 0x6e, 0x12, 0x32, 0x0a, 0x08, 0x76, 0x65, 0x72, 0x73, 0x69, 0x6f, 0x6e,
+	0x73, 0x18, 0x01, 0x20, 0x03, 0x28, 0x0b, 0x32, 0x16, 0x2e, 0x73, 0x75, 0x72, 0x66, 0x73, 0x74,
+	0x6f, 0x72, 0x65, 0x2e, 0x46, 0x69, 0x6c, 0x65, 0x56, 0x65, 0x72, 0x73, 0x69, 0x6f, 0x6e, 0x52,
+	0x08, 0x76, 0x65, 0x72, 0x73, 0x69, 0x6f, 0x6e, 0x73, 0x22, 0x23, 0x0a, 0x07, 0x56, 0x65, 0x72,
+	0x73, 0x69, 0x6f, 0x6e, 0x12, 0x18, 0x0a, 0x07, 0x76, 0x65, 0x72, 0x73, 0x69, 0x6f, 0x6e, 0x18,
+	0x01, 0x20, 0x01, 0x28, 0x05, 0x52, 0x07, 0x76, 0x65, 0x72, 0x73, 0x69, 0x6f, 0x6e, 0x22, 0x24,
+	0x0a, 0x0e, 0x42, 0x6c, 0x6f, 0x63, 0x6b, 0x53, 0x74, 0x6f, 0x72, 0x65, 0x41, 0x64, 0x64, 0x72,
+	0x12, 0x12, 0x0a, 0x04, 0x61, 0x64, 0x64, 0x72, 0x18, 0x01, 0x20, 0x01, 0x28, 0x09, 0x52, 0x04,
+	0x61, 0x64, 0x64, 0x72, 0x22, 0x23, 0x0a, 0x0b, 0x4d, 0x65, 0x72, 0x6b, 0x6c, 0x65, 0x4e, 0x6f,
+	0x64, 0x65, 0x73, 0x12, 0x14, 0x0a, 0x05, 0x6e, 0x6f, 0x64, 0x65, 0x73, 0x18, 0x01, 0x20, 0x03,
+	0x28, 0x05, 0x52, 0x05, 0x6e, 0x6f, 0x64, 0x65, 0x73, 0x22, 0x26, 0x0a, 0x0c, 0x4d, 0x65, 0x72,
+	0x6b, 0x6c, 0x65, 0x48, 0x61, 0x73, 0x68, 0x65, 0x73, 0x12, 0x16, 0x0a, 0x06, 0x68, 0x61, 0x73,
+	0x68, 0x65, 0x73, 0x18, 0x01, 0x20, 0x03, 0x28, 0x09, 0x52, 0x06, 0x68, 0x61, 0x73, 0x68, 0x65,
+	0x73, 0x22, 0x45, 0x0a, 0x0d, 0x4d, 0x65, 0x72, 0x6b, 0x6c, 0x65, 0x42, 0x75, 0x63, 0x6b, 0x65,
+	0x74, 0x73, 0x12, 0x12, 0x0a, 0x04, 0x6b, 0x65, 0x79, 0x73, 0x18, 0x01, 0x20, 0x03, 0x28, 0x09,
+	0x52, 0x04, 0x6b, 0x65, 0x79, 0x73, 0x12, 0x20, 0x0a, 0x0b, 0x64, 0x65, 0x6c, 0x65, 0x74, 0x65,
+	0x64, 0x4b, 0x65, 0x79, 0x73, 0x18, 0x02, 0x20, 0x03, 0x28, 0x09, 0x52, 0x0b, 0x64, 0x65, 0x6c,
+	0x65, 0x74, 0x65, 0x64, 0x4b, 0x65, 0x79, 0x73, 0x22, 0xa3, 0x01, 0x0a, 0x0f, 0x42, 0x6c, 0x6f,
+	0x63, 0x6b, 0x53, 0x74, 0x6f, 0x72, 0x65, 0x41, 0x64, 0x64, 0x72, 0x73, 0x12, 0x14, 0x0a, 0x05,
+	0x61, 0x64, 0x64, 0x72, 0x73, 0x18, 0x01, 0x20, 0x03, 0x28, 0x09, 0x52, 0x05, 0x61, 0x64, 0x64,
+	0x72, 0x73, 0x12, 0x2c, 0x0a, 0x11, 0x72, 0x65, 0x70, 0x6c, 0x69, 0x63, 0x61, 0x74, 0x69, 0x6f,
+	0x6e, 0x46, 0x61, 0x63, 0x74, 0x6f, 0x72, 0x18, 0x02, 0x20, 0x01, 0x28, 0x05, 0x52, 0x11, 0x72,
+	0x65, 0x70, 0x6c, 0x69, 0x63, 0x61, 0x74, 0x69, 0x6f, 0x6e, 0x46, 0x61, 0x63, 0x74, 0x6f, 0x72,
+	0x12, 0x24, 0x0a, 0x0d, 0x70, 0x72, 0x65, 0x76, 0x69, 0x6f, 0x75, 0x73, 0x41, 0x64, 0x64, 0x72,
+	0x73, 0x18, 0x03, 0x20, 0x03, 0x28, 0x09, 0x52, 0x0d, 0x70, 0x72, 0x65, 0x76, 0x69, 0x6f, 0x75,
+	0x73, 0x41, 0x64, 0x64, 0x72, 0x73, 0x12, 0x26, 0x0a, 0x0e, 0x75, 0x6e, 0x68, 0x65, 0x61, 0x6c,
+	0x74, 0x68, 0x79, 0x41, 0x64, 0x64, 0x72, 0x73, 0x18, 0x04, 0x20, 0x03, 0x28, 0x09, 0x52, 0x0e,
+	0x75, 0x6e, 0x68, 0x65, 0x61, 0x6c, 0x74, 0x68, 0x79, 0x41, 0x64, 0x64, 0x72, 0x73, 0x22, 0x5e,
+	0x0a, 0x16, 0x42, 0x6c, 0x6f, 0x63, 0x6b, 0x53, 0x74, 0x6f, 0x72, 0x65, 0x52, 0x65, 0x67, 0x69,
+	0x73, 0x74, 0x72, 0x61, 0x74, 0x69, 0x6f, 0x6e, 0x12, 0x12, 0x0a, 0x04, 0x61, 0x64, 0x64, 0x72,
+	0x18, 0x01, 0x20, 0x01, 0x28, 0x09, 0x52, 0x04, 0x61, 0x64, 0x64, 0x72, 0x12, 0x30, 0x0a, 0x05,
+	0x73, 0x74, 0x61, 0x74, 0x65, 0x18, 0x02, 0x20, 0x01, 0x28, 0x0e, 0x32, 0x1a, 0x2e, 0x73, 0x75,
+	0x72, 0x66, 0x73, 0x74, 0x6f, 0x72, 0x65, 0x2e, 0x42, 0x6c, 0x6f, 0x63, 0x6b, 0x53, 0x74, 0x6f,
+	0x72, 0x65, 0x53, 0x74, 0x61, 0x74, 0x65, 0x52, 0x05, 0x73, 0x74, 0x61, 0x74, 0x65, 0x22, 0xea,
+	0x01, 0x0a, 0x10, 0x42, 0x6c, 0x6f, 0x63, 0x6b, 0x53, 0x74, 0x6f, 0x72, 0x65, 0x53, 0x74, 0x61,
+	0x74, 0x75, 0x73, 0x12, 0x12, 0x0a, 0x04, 0x61, 0x64, 0x64, 0x72, 0x18, 0x01, 0x20, 0x01, 0x28,
+	0x09, 0x52, 0x04, 0x61, 0x64, 0x64, 0x72, 0x12, 0x1e, 0x0a, 0x0a, 0x72, 0x65, 0x67, 0x69, 0x73,
+	0x74, 0x65, 0x72, 0x65, 0x64, 0x18, 0x02, 0x20, 0x01, 0x28, 0x08, 0x52, 0x0a, 0x72, 0x65, 0x67,
+	0x69, 0x73, 0x74, 0x65, 0x72, 0x65, 0x64, 0x12, 0x30, 0x0a, 0x05, 0x73, 0x74, 0x61, 0x74, 0x65,
+	0x18, 0x03, 0x20, 0x01, 0x28, 0x0e, 0x32, 0x1a, 0x2e, 0x73, 0x75, 0x72, 0x66, 0x73, 0x74, 0x6f,
+	0x72, 0x65, 0x2e, 0x42, 0x6c, 0x6f, 0x63, 0x6b, 0x53, 0x74, 0x6f, 0x72, 0x65, 0x53, 0x74, 0x61,
+	0x74, 0x65, 0x52, 0x05, 0x73, 0x74, 0x61, 0x74, 0x65, 0x12, 0x18, 0x0a, 0x07, 0x68, 0x65, 0x61,
+	0x6c, 0x74, 0x68, 0x79, 0x18, 0x04, 0x20, 0x01, 0x28, 0x08, 0x52, 0x07, 0x68, 0x65, 0x61, 0x6c,
+	0x74, 0x68, 0x79, 0x12, 0x24, 0x0a, 0x0d, 0x6c, 0x61, 0x73, 0x74, 0x48, 0x65, 0x61, 0x72, 0x74,
+	0x62, 0x65, 0x61, 0x74, 0x18, 0x05, 0x20, 0x01, 0x28, 0x03, 0x52, 0x0d, 0x6c, 0x61, 0x73, 0x74,
+	0x48, 0x65, 0x61, 0x72, 0x74, 0x62, 0x65, 0x61, 0x74, 0x12, 0x16, 0x0a, 0x06, 0x6f, 0x6e, 0x52,
+	0x69, 0x6e, 0x67, 0x18, 0x06, 0x20, 0x01, 0x28, 0x08, 0x52, 0x06, 0x6f, 0x6e, 0x52, 0x69, 0x6e,
+	0x67, 0x12, 0x18, 0x0a, 0x07, 0x64, 0x72, 0x61, 0x69, 0x6e, 0x65, 0x64, 0x18, 0x07, 0x20, 0x01,
+	0x28, 0x08, 0x52, 0x07, 0x64, 0x72, 0x61, 0x69, 0x6e, 0x65, 0x64, 0x22, 0x4d, 0x0a, 0x12, 0x42,
+	0x6c, 0x6f, 0x63, 0x6b, 0x53, 0x74, 0x6f, 0x72, 0x65, 0x53, 0x74, 0x61, 0x74, 0x75, 0x73, 0x65,
+	0x73, 0x12, 0x37, 0x0a, 0x08, 0x73, 0x74, 0x61, 0x74, 0x75, 0x73, 0x65, 0x73, 0x18, 0x01, 0x20,
+	0x03, 0x28, 0x0b, 0x32, 0x1b, 0x2e, 0x73, 0x75, 0x72, 0x66, 0x73, 0x74, 0x6f, 0x72, 0x65, 0x2e,
+	0x42, 0x6c, 0x6f, 0x63, 0x6b, 0x53, 0x74, 0x6f, 0x72, 0x65, 0x53, 0x74, 0x61, 0x74, 0x75, 0x73,
+	0x52, 0x08, 0x73, 0x74, 0x61, 0x74, 0x75, 0x73, 0x65, 0x73, 0x22, 0xd7, 0x03, 0x0a, 0x0f, 0x52,
+	0x65, 0x62, 0x61, 0x6c, 0x61, 0x6e, 0x63, 0x65, 0x53, 0x74, 0x61, 0x74, 0x75, 0x73, 0x12, 0x1e,
+	0x0a, 0x0a, 0x69, 0x6e, 0x50, 0x72, 0x6f, 0x67, 0x72, 0x65, 0x73, 0x73, 0x18, 0x01, 0x20, 0x01,
+	0x28, 0x08, 0x52, 0x0a, 0x69, 0x6e, 0x50, 0x72, 0x6f, 0x67, 0x72, 0x65, 0x73, 0x73, 0x12, 0x14,
+	0x0a, 0x05, 0x61, 0x64, 0x64, 0x72, 0x73, 0x18, 0x02, 0x20, 0x03, 0x28, 0x09, 0x52, 0x05, 0x61,
+	0x64, 0x64, 0x72, 0x73, 0x12, 0x24, 0x0a, 0x0d, 0x70, 0x72, 0x65, 0x76, 0x69, 0x6f, 0x75, 0x73,
+	0x41, 0x64, 0x64, 0x72, 0x73, 0x18, 0x03, 0x20, 0x03, 0x28, 0x09, 0x52, 0x0d, 0x70, 0x72, 0x65,
+	0x76, 0x69, 0x6f, 0x75, 0x73, 0x41, 0x64, 0x64, 0x72, 0x73, 0x12, 0x1c, 0x0a, 0x09, 0x73, 0x74,
+	0x61, 0x72, 0x74, 0x65, 0x64, 0x41, 0x74, 0x18, 0x04, 0x20, 0x01, 0x28, 0x03, 0x52, 0x09, 0x73,
+	0x74, 0x61, 0x72, 0x74, 0x65, 0x64, 0x41, 0x74, 0x12, 0x1e, 0x0a, 0x0a, 0x66, 0x69, 0x6e, 0x69,
+	0x73, 0x68, 0x65, 0x64, 0x41, 0x74, 0x18, 0x05, 0x20, 0x01, 0x28, 0x03, 0x52, 0x0a, 0x66, 0x69,
+	0x6e, 0x69, 0x73, 0x68, 0x65, 0x64, 0x41, 0x74, 0x12, 0x16, 0x0a, 0x06, 0x70, 0x61, 0x73, 0x73,
+	0x65, 0x73, 0x18, 0x06, 0x20, 0x01, 0x28, 0x03, 0x52, 0x06, 0x70, 0x61, 0x73, 0x73, 0x65, 0x73,
+	0x12, 0x20, 0x0a, 0x0b, 0x74, 0x6f, 0x74, 0x61, 0x6c, 0x42, 0x6c, 0x6f, 0x63, 0x6b, 0x73, 0x18,
+	0x07, 0x20, 0x01, 0x28, 0x03, 0x52, 0x0b, 0x74, 0x6f, 0x74, 0x61, 0x6c, 0x42, 0x6c, 0x6f, 0x63,
+	0x6b, 0x73, 0x12, 0x24, 0x0a, 0x0d, 0x63, 0x68, 0x65, 0x63, 0x6b, 0x65, 0x64, 0x42, 0x6c, 0x6f,
+	0x63, 0x6b, 0x73, 0x18, 0x08, 0x20, 0x01, 0x28, 0x03, 0x52, 0x0d, 0x63, 0x68, 0x65, 0x63, 0x6b,
+	0x65, 0x64, 0x42, 0x6c, 0x6f, 0x63, 0x6b, 0x73, 0x12, 0x22, 0x0a, 0x0c, 0x66, 0x61, 0x69, 0x6c,
+	0x65, 0x64, 0x42, 0x6c, 0x6f, 0x63, 0x6b, 0x73, 0x18, 0x09, 0x20, 0x01, 0x28, 0x03, 0x52, 0x0c,
+	0x66, 0x61, 0x69, 0x6c, 0x65, 0x64, 0x42, 0x6c, 0x6f, 0x63, 0x6b, 0x73, 0x12, 0x20, 0x0a, 0x0b,
+	0x6d, 0x6f, 0x76, 0x65, 0x64, 0x42, 0x6c, 0x6f, 0x63, 0x6b, 0x73, 0x18, 0x0a, 0x20, 0x01, 0x28,
+	0x03, 0x52, 0x0b, 0x6d, 0x6f, 0x76, 0x65, 0x64, 0x42, 0x6c, 0x6f, 0x63, 0x6b, 0x73, 0x12, 0x1e,
+	0x0a, 0x0a, 0x6d, 0x6f, 0x76, 0x65, 0x64, 0x42, 0x79, 0x74, 0x65, 0x73, 0x18, 0x0b, 0x20, 0x01,
+	0x28, 0x03, 0x52, 0x0a, 0x6d, 0x6f, 0x76, 0x65, 0x64, 0x42, 0x79, 0x74, 0x65, 0x73, 0x12, 0x1c,
+	0x0a, 0x09, 0x72, 0x61, 0x74, 0x65, 0x4c, 0x69, 0x6d, 0x69, 0x74, 0x18, 0x0c, 0x20, 0x01, 0x28,
+	0x03, 0x52, 0x09, 0x72, 0x61, 0x74, 0x65, 0x4c, 0x69, 0x6d, 0x69, 0x74, 0x12, 0x26, 0x0a, 0x0e,
+	0x74, 0x68, 0x72, 0x6f, 0x74, 0x74, 0x6c, 0x65, 0x64, 0x4e, 0x61, 0x6e, 0x6f, 0x73, 0x18, 0x0d,
+	0x20, 0x01, 0x28, 0x03, 0x52, 0x0e, 0x74, 0x68, 0x72, 0x6f, 0x74, 0x74, 0x6c, 0x65, 0x64, 0x4e,
+	0x61, 0x6e, 0x6f, 0x73, 0x12, 0x1e, 0x0a, 0x0a, 0x6c, 0x6f, 0x73, 0x74, 0x42, 0x6c, 0x6f, 0x63,
+	0x6b, 0x73, 0x18, 0x0e, 0x20, 0x03, 0x28, 0x09, 0x52, 0x0a, 0x6c, 0x6f, 0x73, 0x74, 0x42, 0x6c,
+	0x6f, 0x63, 0x6b, 0x73, 0x22, 0xf4, 0x01, 0x0a, 0x0c, 0x52, 0x65, 0x70, 0x61, 0x69, 0x72, 0x52,
+	0x65, 0x70, 0x6f, 0x72, 0x74, 0x12, 0x1c, 0x0a, 0x09, 0x74, 0x69, 0x6d, 0x65, 0x73, 0x74, 0x61,
+	0x6d, 0x70, 0x18, 0x01, 0x20, 0x01, 0x28, 0x03, 0x52, 0x09, 0x74, 0x69, 0x6d, 0x65, 0x73, 0x74,
+	0x61, 0x6d, 0x70, 0x12, 0x24, 0x0a, 0x0d, 0x63, 0x68, 0x65, 0x63, 0x6b, 0x65, 0x64, 0x42, 0x6c,
+	0x6f, 0x63, 0x6b, 0x73, 0x18, 0x02, 0x20, 0x01, 0x28, 0x03, 0x52, 0x0d, 0x63, 0x68, 0x65, 0x63,
+	0x6b, 0x65, 0x64, 0x42, 0x6c, 0x6f, 0x63, 0x6b, 0x73, 0x12, 0x34, 0x0a, 0x15, 0x75, 0x6e, 0x64,
+	0x65, 0x72, 0x52, 0x65, 0x70, 0x6c, 0x69, 0x63, 0x61, 0x74, 0x65, 0x64, 0x42, 0x6c, 0x6f, 0x63,
+	0x6b, 0x73, 0x18, 0x03, 0x20, 0x01, 0x28, 0x03, 0x52, 0x15, 0x75, 0x6e, 0x64, 0x65, 0x72, 0x52,
+	0x65, 0x70, 0x6c, 0x69, 0x63, 0x61, 0x74, 0x65, 0x64, 0x42, 0x6c, 0x6f, 0x63, 0x6b, 0x73, 0x12,
+	0x26, 0x0a, 0x0e, 0x72, 0x65, 0x70, 0x61, 0x69, 0x72, 0x65, 0x64, 0x43, 0x6f, 0x70, 0x69, 0x65,
+	0x73, 0x18, 0x04, 0x20, 0x01, 0x28, 0x03, 0x52, 0x0e, 0x72, 0x65, 0x70, 0x61, 0x69, 0x72, 0x65,
+	0x64, 0x43, 0x6f, 0x70, 0x69, 0x65, 0x73, 0x12, 0x22, 0x0a, 0x0c, 0x66, 0x61, 0x69, 0x6c, 0x65,
+	0x64, 0x43, 0x6f, 0x70, 0x69, 0x65, 0x73, 0x18, 0x05, 0x20, 0x01, 0x28, 0x03, 0x52, 0x0c, 0x66,
+	0x61, 0x69, 0x6c, 0x65, 0x64, 0x43, 0x6f, 0x70, 0x69, 0x65, 0x73, 0x12, 0x1e, 0x0a, 0x0a, 0x6c,
+	0x6f, 0x73, 0x74, 0x42, 0x6c, 0x6f, 0x63, 0x6b, 0x73, 0x18, 0x06, 0x20, 0x03, 0x28, 0x09, 0x52,
+	0x0a, 0x6c, 0x6f, 0x73, 0x74, 0x42, 0x6c, 0x6f, 0x63, 0x6b, 0x73, 0x22, 0x2c, 0x0a, 0x0c, 0x43,
+	0x72, 0x61, 0x73, 0x68, 0x65, 0x64, 0x53, 0x74, 0x61, 0x74, 0x65, 0x12, 0x1c, 0x0a, 0x09, 0x69,
+	0x73, 0x43, 0x72, 0x61, 0x73, 0x68, 0x65, 0x64, 0x18, 0x01, 0x20, 0x01, 0x28, 0x08, 0x52, 0x09,
+	0x69, 0x73, 0x43, 0x72, 0x61, 0x73, 0x68, 0x65, 0x64, 0x22, 0xc6, 0x01, 0x0a, 0x10, 0x41, 0x70,
+	0x70, 0x65, 0x6e, 0x64, 0x45, 0x6e, 0x74, 0x72, 0x79, 0x49, 0x6e, 0x70, 0x75, 0x74, 0x12, 0x12,
+	0x0a, 0x04, 0x74, 0x65, 0x72, 0x6d, 0x18, 0x01, 0x20, 0x01, 0x28, 0x03, 0x52, 0x04, 0x74, 0x65,
+	0x72, 0x6d, 0x12, 0x22, 0x0a, 0x0c, 0x70, 0x72, 0x65, 0x76, 0x4c, 0x6f, 0x67, 0x49, 0x6e, 0x64,
+	0x65, 0x78, 0x18, 0x02, 0x20, 0x01, 0x28, 0x03, 0x52, 0x0c, 0x70, 0x72, 0x65, 0x76, 0x4c, 0x6f,
+	0x67, 0x49, 0x6e, 0x64, 0x65, 0x78, 0x12, 0x20, 0x0a, 0x0b, 0x70, 0x72, 0x65, 0x76, 0x4c, 0x6f,
+	0x67, 0x54, 0x65, 0x72, 0x6d, 0x18, 0x03, 0x20, 0x01, 0x28, 0x03, 0x52, 0x0b, 0x70, 0x72, 0x65,
+	0x76, 0x4c, 0x6f, 0x67, 0x54, 0x65, 0x72, 0x6d, 0x12, 0x34, 0x0a, 0x07, 0x65, 0x6e, 0x74, 0x72,
+	0x69, 0x65, 0x73, 0x18, 0x04, 0x20, 0x03, 0x28, 0x0b, 0x32, 0x1a, 0x2e, 0x73, 0x75, 0x72, 0x66,
+	0x73, 0x74, 0x6f, 0x72, 0x65, 0x2e, 0x55, 0x70, 0x64, 0x61, 0x74, 0x65, 0x4f, 0x70, 0x65, 0x72,
+	0x61, 0x74, 0x69, 0x6f, 0x6e, 0x52, 0x07, 0x65, 0x6e, 0x74, 0x72, 0x69, 0x65, 0x73, 0x12, 0x22,
+	0x0a, 0x0c, 0x6c, 0x65, 0x61, 0x64, 0x65, 0x72, 0x43, 0x6f, 0x6d, 0x6d, 0x69, 0x74, 0x18, 0x05,
+	0x20, 0x01, 0x28, 0x03, 0x52, 0x0c, 0x6c, 0x65, 0x61, 0x64, 0x65, 0x72, 0x43, 0x6f, 0x6d, 0x6d,
+	0x69, 0x74, 0x22, 0x81, 0x01, 0x0a, 0x11, 0x41, 0x70, 0x70, 0x65, 0x6e, 0x64, 0x45, 0x6e, 0x74,
+	0x72, 0x79, 0x4f, 0x75, 0x74, 0x70, 0x75, 0x74, 0x12, 0x1a, 0x0a, 0x08, 0x73, 0x65, 0x72, 0x76,
+	0x65, 0x72, 0x49, 0x64, 0x18, 0x01, 0x20, 0x01, 0x28, 0x03, 0x52, 0x08, 0x73, 0x65, 0x72, 0x76,
+	0x65, 0x72, 0x49, 0x64, 0x12, 0x12, 0x0a, 0x04, 0x74, 0x65, 0x72, 0x6d, 0x18, 0x02, 0x20, 0x01,
+	0x28, 0x03, 0x52, 0x04, 0x74, 0x65, 0x72, 0x6d, 0x12, 0x18, 0x0a, 0x07, 0x73, 0x75, 0x63, 0x63,
+	0x65, 0x73, 0x73, 0x18, 0x03, 0x20, 0x01, 0x28, 0x08, 0x52, 0x07, 0x73, 0x75, 0x63, 0x63, 0x65,
+	0x73, 0x73, 0x12, 0x22, 0x0a, 0x0c, 0x6d, 0x61, 0x74, 0x63, 0x68, 0x65, 0x64, 0x49, 0x6e, 0x64,
+	0x65, 0x78, 0x18, 0x04, 0x20, 0x01, 0x28, 0x03, 0x52, 0x0c, 0x6d, 0x61, 0x74, 0x63, 0x68, 0x65,
+	0x64, 0x49, 0x6e, 0x64, 0x65, 0x78, 0x22, 0xde, 0x03, 0x0a, 0x0f, 0x55, 0x70, 0x64, 0x61, 0x74,
+	0x65, 0x4f, 0x70, 0x65, 0x72, 0x61, 0x74, 0x69, 0x6f, 0x6e, 0x12, 0x12, 0x0a, 0x04, 0x74, 0x65,
+	0x72, 0x6d, 0x18, 0x01, 0x20, 0x01, 0x28, 0x03, 0x52, 0x04, 0x74, 0x65, 0x72, 0x6d, 0x12, 0x3b,
+	0x0a, 0x0c, 0x66, 0x69, 0x6c, 0x65, 0x4d, 0x65, 0x74, 0x61, 0x44, 0x61, 0x74, 0x61, 0x18, 0x03,
+	0x20, 0x01, 0x28, 0x0b, 0x32, 0x17, 0x2e, 0x73, 0x75, 0x72, 0x66, 0x73, 0x74, 0x6f, 0x72, 0x65,
+	0x2e, 0x46, 0x69, 0x6c, 0x65, 0x4d, 0x65, 0x74, 0x61, 0x44, 0x61, 0x74, 0x61, 0x52, 0x0c, 0x66,
+	0x69, 0x6c, 0x65, 0x4d, 0x65, 0x74, 0x61, 0x44, 0x61, 0x74, 0x61, 0x12, 0x1c, 0x0a, 0x09, 0x74,
+	0x69, 0x6d, 0x65, 0x73, 0x74, 0x61, 0x6d, 0x70, 0x18, 0x04, 0x20, 0x01, 0x28, 0x03, 0x52, 0x09,
+	0x74, 0x69, 0x6d, 0x65, 0x73, 0x74, 0x61, 0x6d, 0x70, 0x12, 0x2c, 0x0a, 0x07, 0x73, 0x79, 0x6e,
+	0x63, 0x41, 0x63, 0x6b, 0x18, 0x05, 0x20, 0x01, 0x28, 0x0b, 0x32, 0x12, 0x2e, 0x73, 0x75, 0x72,
+	0x66, 0x73, 0x74, 0x6f, 0x72, 0x65, 0x2e, 0x53, 0x79, 0x6e, 0x63, 0x41, 0x63, 0x6b, 0x52, 0x07,
+	0x73, 0x79, 0x6e, 0x63, 0x41, 0x63, 0x6b, 0x12, 0x2f, 0x0a, 0x05, 0x70, 0x72, 0x75, 0x6e, 0x65,
+	0x18, 0x06, 0x20, 0x01, 0x28, 0x0b, 0x32, 0x19, 0x2e, 0x73, 0x75, 0x72, 0x66, 0x73, 0x74, 0x6f,
+	0x72, 0x65, 0x2e, 0x50, 0x72, 0x75, 0x6e, 0x65, 0x4f, 0x70, 0x65, 0x72, 0x61, 0x74, 0x69, 0x6f,
+	0x6e, 0x52, 0x05, 0x70, 0x72, 0x75, 0x6e, 0x65, 0x12, 0x1c, 0x0a, 0x09, 0x6e, 0x61, 0x6d, 0x65,
+	0x73, 0x70, 0x61, 0x63, 0x65, 0x18, 0x07, 0x20, 0x01, 0x28, 0x09, 0x52, 0x09, 0x6e, 0x61, 0x6d,
+	0x65, 0x73, 0x70, 0x61, 0x63, 0x65, 0x12, 0x47, 0x0a, 0x10, 0x62, 0x6c, 0x6f, 0x63, 0x6b, 0x53,
+	0x74, 0x6f, 0x72, 0x65, 0x43, 0x68, 0x61, 0x6e, 0x67, 0x65, 0x18, 0x08, 0x20, 0x01, 0x28, 0x0b,
+	0x32, 0x1b, 0x2e, 0x73, 0x75, 0x72, 0x66, 0x73, 0x74, 0x6f, 0x72, 0x65, 0x2e, 0x42, 0x6c, 0x6f,
+	0x63, 0x6b, 0x53, 0x74, 0x6f, 0x72, 0x65, 0x43, 0x68, 0x61, 0x6e, 0x67, 0x65, 0x52, 0x10, 0x62,
+	0x6c, 0x6f, 0x63, 0x6b, 0x53, 0x74, 0x6f, 0x72, 0x65, 0x43, 0x68, 0x61, 0x6e, 0x67, 0x65, 0x12,
+	0x45, 0x0a, 0x0c, 0x72, 0x65, 0x67, 0x69, 0x73, 0x74, 0x72, 0x61, 0x74, 0x69, 0x6f, 0x6e, 0x18,
+	0x09, 0x20, 0x01, 0x28, 0x0b, 0x32, 0x21, 0x2e, 0x73, 0x75, 0x72, 0x66, 0x73, 0x74, 0x6f, 0x72,
+	0x65, 0x2e, 0x42, 0x6c, 0x6f, 0x63, 0x6b, 0x53, 0x74, 0x6f, 0x72, 0x65, 0x52, 0x65, 0x67, 0x69,
+	0x73, 0x74, 0x72, 0x61, 0x74, 0x69, 0x6f, 0x6e, 0x52, 0x0c, 0x72, 0x65, 0x67, 0x69, 0x73, 0x74,
+	0x72, 0x61, 0x74, 0x69, 0x6f, 0x6e, 0x12, 0x35, 0x0a, 0x07, 0x72, 0x65, 0x73, 0x74, 0x6f, 0x72,
+	0x65, 0x18, 0x0a, 0x20, 0x01, 0x28, 0x0b, 0x32, 0x1b, 0x2e, 0x73, 0x75, 0x72, 0x66, 0x73, 0x74,
+	0x6f, 0x72, 0x65, 0x2e, 0x52, 0x65, 0x73, 0x74, 0x6f, 0x72, 0x65, 0x4f, 0x70, 0x65, 0x72, 0x61,
+	0x74, 0x69, 0x6f, 0x6e, 0x52, 0x07, 0x72, 0x65, 0x73, 0x74, 0x6f, 0x72, 0x65, 0x12, 0x18, 0x0a,
+	0x07, 0x62, 0x61, 0x72, 0x72, 0x69, 0x65, 0x72, 0x18, 0x0b, 0x20, 0x01, 0x28, 0x08, 0x52, 0x07,
+	0x62, 0x61, 0x72, 0x72, 0x69, 0x65, 0x72, 0x22, 0x62, 0x0a, 0x10, 0x52, 0x65, 0x73, 0x74, 0x6f,
+	0x72, 0x65, 0x4f, 0x70, 0x65, 0x72, 0x61, 0x74, 0x69, 0x6f, 0x6e, 0x12, 0x38, 0x0a, 0x0b, 0x66,
+	0x69, 0x6c, 0x65, 0x56, 0x65, 0x72, 0x73, 0x69, 0x6f, 0x6e, 0x18, 0x01, 0x20, 0x01, 0x28, 0x0b,
+	0x32, 0x16, 0x2e, 0x73, 0x75, 0x72, 0x66, 0x73, 0x74, 0x6f, 0x72, 0x65, 0x2e, 0x46, 0x69, 0x6c,
+	0x65, 0x56, 0x65, 0x72, 0x73, 0x69, 0x6f, 0x6e, 0x52, 0x0b, 0x66, 0x69, 0x6c, 0x65, 0x56, 0x65,
+	0x72, 0x73, 0x69, 0x6f, 0x6e, 0x12, 0x14, 0x0a, 0x05, 0x6f, 0x77, 0x6e, 0x65, 0x72, 0x18, 0x02,
+	0x20, 0x01, 0x28, 0x09, 0x52, 0x05, 0x6f, 0x77, 0x6e, 0x65, 0x72, 0x22, 0x44, 0x0a, 0x10, 0x42,
+	0x6c, 0x6f, 0x63, 0x6b, 0x53, 0x74, 0x6f, 0x72, 0x65, 0x43, 0x68, 0x61, 0x6e, 0x67, 0x65, 0x12,
+	0x14, 0x0a, 0x05, 0x61, 0x64, 0x64, 0x72, 0x73, 0x18, 0x01, 0x20, 0x03, 0x28, 0x09, 0x52, 0x05,
+	0x61, 0x64, 0x64, 0x72, 0x73, 0x12, 0x1a, 0x0a, 0x08, 0x6d, 0x69, 0x67, 0x72, 0x61, 0x74, 0x65,
+	0x64, 0x18, 0x02, 0x20, 0x01, 0x28, 0x08, 0x52, 0x08, 0x6d, 0x69, 0x67, 0x72, 0x61, 0x74, 0x65,
+	0x64, 0x22, 0xe7, 0x01, 0x0a, 0x11, 0x52, 0x61, 0x66, 0x74, 0x49, 0x6e, 0x74, 0x65, 0x72, 0x6e,
+	0x61, 0x6c, 0x53, 0x74, 0x61, 0x74, 0x65, 0x12, 0x1a, 0x0a, 0x08, 0x69, 0x73, 0x4c, 0x65, 0x61,
+	0x64, 0x65, 0x72, 0x18, 0x01, 0x20, 0x01, 0x28, 0x08, 0x52, 0x08, 0x69, 0x73, 0x4c, 0x65, 0x61,
+	0x64, 0x65, 0x72, 0x12, 0x12, 0x0a, 0x04, 0x74, 0x65, 0x72, 0x6d, 0x18, 0x02, 0x20, 0x01, 0x28,
+	0x03, 0x52, 0x04, 0x74, 0x65, 0x72, 0x6d, 0x12, 0x2c, 0x0a, 0x03, 0x6c, 0x6f, 0x67, 0x18, 0x03,
+	0x20, 0x03, 0x28, 0x0b, 0x32, 0x1a, 0x2e, 0x73, 0x75, 0x72, 0x66, 0x73, 0x74, 0x6f, 0x72, 0x65,
+	0x2e, 0x55, 0x70, 0x64, 0x61, 0x74, 0x65, 0x4f, 0x70, 0x65, 0x72, 0x61, 0x74, 0x69, 0x6f, 0x6e,
+	0x52, 0x03, 0x6c, 0x6f, 0x67, 0x12, 0x30, 0x0a, 0x07, 0x6d, 0x65, 0x74, 0x61, 0x4d, 0x61, 0x70,
+	0x18, 0x04, 0x20, 0x01, 0x28, 0x0b, 0x32, 0x16, 0x2e, 0x73, 0x75, 0x72, 0x66, 0x73, 0x74, 0x6f,
+	0x72, 0x65, 0x2e, 0x46, 0x69, 0x6c, 0x65, 0x49, 0x6e, 0x66, 0x6f, 0x4d, 0x61, 0x70, 0x52, 0x07,
+	0x6d, 0x65, 0x74, 0x61, 0x4d, 0x61, 0x70, 0x12, 0x20, 0x0a, 0x0b, 0x63, 0x6f, 0x6d, 0x6d, 0x69,
+	0x74, 0x49, 0x6e, 0x64, 0x65, 0x78, 0x18, 0x05, 0x20, 0x01, 0x28, 0x03, 0x52, 0x0b, 0x63, 0x6f,
+	0x6d, 0x6d, 0x69, 0x74, 0x49, 0x6e, 0x64, 0x65, 0x78, 0x12, 0x20, 0x0a, 0x0b, 0x6c, 0x61, 0x73,
+	0x74, 0x41, 0x70, 0x70, 0x6c, 0x69, 0x65, 0x64, 0x18, 0x06, 0x20, 0x01, 0x28, 0x03, 0x52, 0x0b,
+	0x6c, 0x61, 0x73, 0x74, 0x41, 0x70, 0x70, 0x6c, 0x69, 0x65, 0x64, 0x22, 0x8c, 0x02, 0x0a, 0x13,
+	0x4d, 0x65, 0x74, 0x61, 0x53, 0x74, 0x6f, 0x72, 0x65, 0x43, 0x68, 0x65, 0x63, 0x6b, 0x70, 0x6f,
+	0x69, 0x6e, 0x74, 0x12, 0x3e, 0x0a, 0x0a, 0x6e, 0x61, 0x6d, 0x65, 0x73, 0x70, 0x61, 0x63, 0x65,
+	0x73, 0x18, 0x01, 0x20, 0x03, 0x28, 0x0b, 0x32, 0x1e, 0x2e, 0x73, 0x75, 0x72, 0x66, 0x73, 0x74,
+	0x6f, 0x72, 0x65, 0x2e, 0x4e, 0x61, 0x6d, 0x65, 0x73, 0x70, 0x61, 0x63, 0x65, 0x43, 0x68, 0x65,
+	0x63, 0x6b, 0x70, 0x6f, 0x69, 0x6e, 0x74, 0x52, 0x0a, 0x6e, 0x61, 0x6d, 0x65, 0x73, 0x70, 0x61,
+	0x63, 0x65, 0x73, 0x12, 0x28, 0x0a, 0x0f, 0x62, 0x6c, 0x6f, 0x63, 0x6b, 0x53, 0x74, 0x6f, 0x72,
+	0x65, 0x41, 0x64, 0x64, 0x72, 0x73, 0x18, 0x02, 0x20, 0x03, 0x28, 0x09, 0x52, 0x0f, 0x62, 0x6c,
+	0x6f, 0x63, 0x6b, 0x53, 0x74, 0x6f, 0x72, 0x65, 0x41, 0x64, 0x64, 0x72, 0x73, 0x12, 0x38, 0x0a,
+	0x17, 0x70, 0x72, 0x65, 0x76, 0x69, 0x6f, 0x75, 0x73, 0x42, 0x6c, 0x6f, 0x63, 0x6b, 0x53, 0x74,
+	0x6f, 0x72, 0x65, 0x41, 0x64, 0x64, 0x72, 0x73, 0x18, 0x03, 0x20, 0x03, 0x28, 0x09, 0x52, 0x17,
+	0x70, 0x72, 0x65, 0x76, 0x69, 0x6f, 0x75, 0x73, 0x42, 0x6c, 0x6f, 0x63, 0x6b, 0x53, 0x74, 0x6f,
+	0x72, 0x65, 0x41, 0x64, 0x64, 0x72, 0x73, 0x12, 0x51, 0x0a, 0x12, 0x62, 0x6c, 0x6f, 0x63, 0x6b,
+	0x53, 0x74, 0x6f, 0x72, 0x65, 0x52, 0x65, 0x67, 0x69, 0x73, 0x74, 0x72, 0x79, 0x18, 0x04, 0x20,
+	0x03, 0x28, 0x0b, 0x32, 0x21, 0x2e, 0x73, 0x75, 0x72, 0x66, 0x73, 0x74, 0x6f, 0x72, 0x65, 0x2e,
+	0x42, 0x6c, 0x6f, 0x63, 0x6b, 0x53, 0x74, 0x6f, 0x72, 0x65, 0x52, 0x65, 0x67, 0x69, 0x73, 0x74,
+	0x72, 0x61, 0x74, 0x69, 0x6f, 0x6e, 0x52, 0x12, 0x62, 0x6c, 0x6f, 0x63, 0x6b, 0x53, 0x74, 0x6f,
+	0x72, 0x65, 0x52, 0x65, 0x67, 0x69, 0x73, 0x74, 0x72, 0x79, 0x22, 0xa5, 0x03, 0x0a, 0x13, 0x4e,
+	0x61, 0x6d, 0x65, 0x73, 0x70, 0x61, 0x63, 0x65, 0x43, 0x68, 0x65, 0x63, 0x6b, 0x70, 0x6f, 0x69,
+	0x6e, 0x74, 0x12, 0x1c, 0x0a, 0x09, 0x6e, 0x61, 0x6d, 0x65, 0x73, 0x70, 0x61, 0x63, 0x65, 0x18,
+	0x01, 0x20, 0x01, 0x28, 0x09, 0x52, 0x09, 0x6e, 0x61, 0x6d, 0x65, 0x73, 0x70, 0x61, 0x63, 0x65,
+	0x12, 0x1a, 0x0a, 0x08, 0x72, 0x65, 0x76, 0x69, 0x73, 0x69, 0x6f, 0x6e, 0x18, 0x02, 0x20, 0x01,
+	0x28, 0x03, 0x52, 0x08, 0x72, 0x65, 0x76, 0x69, 0x73, 0x69, 0x6f, 0x6e, 0x12, 0x2c, 0x0a, 0x11,
+	0x63, 0x6f, 0x6d, 0x70, 0x61, 0x63, 0x74, 0x65, 0x64, 0x52, 0x65, 0x76, 0x69, 0x73, 0x69, 0x6f,
+	0x6e, 0x18, 0x03, 0x20, 0x01, 0x28, 0x03, 0x52, 0x11, 0x63, 0x6f, 0x6d, 0x70, 0x61, 0x63, 0x74,
+	0x65, 0x64, 0x52, 0x65, 0x76, 0x69, 0x73, 0x69, 0x6f, 0x6e, 0x12, 0x28, 0x0a, 0x0f, 0x73, 0x6e,
+	0x61, 0x70, 0x73, 0x68, 0x6f, 0x74, 0x48, 0x6f, 0x72, 0x69, 0x7a, 0x6f, 0x6e, 0x18, 0x04, 0x20,
+	0x01, 0x28, 0x03, 0x52, 0x0f, 0x73, 0x6e, 0x61, 0x70, 0x73, 0x68, 0x6f, 0x74, 0x48, 0x6f, 0x72,
+	0x69, 0x7a, 0x6f, 0x6e, 0x12, 0x31, 0x0a, 0x07, 0x63, 0x68, 0x61, 0x6e, 0x67, 0x65, 0x73, 0x18,
+	0x05, 0x20, 0x03, 0x28, 0x0b, 0x32, 0x17, 0x2e, 0x73, 0x75, 0x72, 0x66, 0x73, 0x74, 0x6f, 0x72,
+	0x65, 0x2e, 0x46, 0x69, 0x6c, 0x65, 0x4d, 0x65, 0x74, 0x61, 0x44, 0x61, 0x74, 0x61, 0x52, 0x07,
+	0x63, 0x68, 0x61, 0x6e, 0x67, 0x65, 0x73, 0x12, 0x5d, 0x0a, 0x0f, 0x63, 0x6c, 0x69, 0x65, 0x6e,
+	0x74, 0x52, 0x65, 0x76, 0x69, 0x73, 0x69, 0x6f, 0x6e, 0x73, 0x18, 0x06, 0x20, 0x03, 0x28, 0x0b,
+	0x32, 0x33, 0x2e, 0x73, 0x75, 0x72, 0x66, 0x73, 0x74, 0x6f, 0x72, 0x65, 0x2e, 0x4e, 0x61, 0x6d,
+	0x65, 0x73, 0x70, 0x61, 0x63, 0x65, 0x43, 0x68, 0x65, 0x63, 0x6b, 0x70, 0x6f, 0x69, 0x6e, 0x74,
+	0x2e, 0x43, 0x6c, 0x69, 0x65, 0x6e, 0x74, 0x52, 0x65, 0x76, 0x69, 0x73, 0x69, 0x6f, 0x6e, 0x73,
+	0x45, 0x6e, 0x74, 0x72, 0x79, 0x52, 0x0f, 0x63, 0x6c, 0x69, 0x65, 0x6e, 0x74, 0x52, 0x65, 0x76,
+	0x69, 0x73, 0x69, 0x6f, 0x6e, 0x73, 0x12, 0x26, 0x0a, 0x0e, 0x66, 0x6f, 0x72, 0x67, 0x6f, 0x74,
+	0x74, 0x65, 0x6e, 0x46, 0x69, 0x6c, 0x65, 0x73, 0x18, 0x07, 0x20, 0x03, 0x28, 0x09, 0x52, 0x0e,
+	0x66, 0x6f, 0x72, 0x67, 0x6f, 0x74, 0x74, 0x65, 0x6e, 0x46, 0x69, 0x6c, 0x65, 0x73, 0x1a, 0x42,
+	0x0a, 0x14, 0x43, 0x6c, 0x69, 0x65, 0x6e, 0x74, 0x52, 0x65, 0x76, 0x69, 0x73, 0x69, 0x6f, 0x6e,
+	0x73, 0x45, 0x6e, 0x74, 0x72, 0x79, 0x12, 0x10, 0x0a, 0x03, 0x6b, 0x65, 0x79, 0x18, 0x01, 0x20,
+	0x01, 0x28, 0x09, 0x52, 0x03, 0x6b, 0x65, 0x79, 0x12, 0x14, 0x0a, 0x05, 0x76, 0x61, 0x6c, 0x75,
+	0x65, 0x18, 0x02, 0x20, 0x01, 0x28, 0x03, 0x52, 0x05, 0x76, 0x61, 0x6c, 0x75, 0x65, 0x3a, 0x02,
+	0x38, 0x01, 0x2a, 0x3f, 0x0a, 0x0f, 0x42, 0x6c, 0x6f, 0x63, 0x6b, 0x53, 0x74, 0x6f, 0x72, 0x65,
+	0x53, 0x74, 0x61, 0x74, 0x65, 0x12, 0x0a, 0x0a, 0x06, 0x41, 0x43, 0x54, 0x49, 0x56, 0x45, 0x10,
+	0x00, 0x12, 0x0c, 0x0a, 0x08, 0x44, 0x52, 0x41, 0x49, 0x4e, 0x49, 0x4e, 0x47, 0x10, 0x01, 0x12,
+	0x12, 0x0a, 0x0e, 0x44, 0x45, 0x43, 0x4f, 0x4d, 0x4d, 0x49, 0x53, 0x53, 0x49, 0x4f, 0x4e, 0x45,
+	0x44, 0x10, 0x02, 0x32, 0xfb, 0x05, 0x0a, 0x0a, 0x42, 0x6c, 0x6f, 0x63, 0x6b, 0x53, 0x74, 0x6f,
 	0x72, 0x65, 0x12, 0x34, 0x0a, 0x08, 0x47, 0x65, 0x74, 0x42, 0x6c, 0x6f, 0x63, 0x6b, 0x12, 0x14,
 	0x2e, 0x73, 0x75, 0x72, 0x66, 0x73, 0x74, 0x6f, 0x72, 0x65, 0x2e, 0x42, 0x6c, 0x6f, 0x63, 0x6b,
 	0x48, 0x61, 0x73, 0x68, 0x1a, 0x10, 0x2e, 0x73, 0x75, 0x72, 0x66, 0x73, 0x74, 0x6f, 0x72, 0x65,
@@ -836,8 +3044,149 @@ var file_pkg_surfstore_SurfStore_proto_rawDesc = []byte{
 	0x48, 0x61, 0x73, 0x42, 0x6c, 0x6f, 0x63, 0x6b, 0x73, 0x12, 0x16, 0x2e, 0x73, 0x75, 0x72, 0x66,
 	0x73, 0x74, 0x6f, 0x72, 0x65, 0x2e, 0x42, 0x6c, 0x6f, 0x63, 0x6b, 0x48, 0x61, 0x73, 0x68, 0x65,
 	0x73, 0x1a, 0x16, 0x2e, 0x73, 0x75, 0x72, 0x66, 0x73, 0x74, 0x6f, 0x72, 0x65, 0x2e, 0x42, 0x6c,
-	0x6f, 0x63, 0x6b, 0x48, 0x61, 0x73, 0x68, 0x65, 0x73, 0x22, 0x00, 0x32, 0xd6, 0x01, 0x0a, 0x09,
-	0x4d, 0x65, 0x74, 0x61, 0x53, 0x74, 0x6f, 0x72, 0x65, 0x12, 0x42, 0x0a, 0x0e, 0x47, 0x65, 0x74,
+	0x6f, 0x63, 0x6b, 0x48, 0x61, 0x73, 0x68, 0x65, 0x73, 0x22, 0x00, 0x12, 0x3e, 0x0a, 0x0a, 0x4c,
+	0x69, 0x73, 0x74, 0x42, 0x6c, 0x6f, 0x63, 0x6b, 0x73, 0x12, 0x16, 0x2e, 0x67, 0x6f, 0x6f, 0x67,
+	0x6c, 0x65, 0x2e, 0x70, 0x72, 0x6f, 0x74, 0x6f, 0x62, 0x75, 0x66, 0x2e, 0x45, 0x6d, 0x70, 0x74,
+	0x79, 0x1a, 0x16, 0x2e, 0x73, 0x75, 0x72, 0x66, 0x73, 0x74, 0x6f, 0x72, 0x65, 0x2e, 0x42, 0x6c,
+	0x6f, 0x63, 0x6b, 0x48, 0x61, 0x73, 0x68, 0x65, 0x73, 0x22, 0x00, 0x12, 0x40, 0x0a, 0x0c, 0x44,
+	0x65, 0x6c, 0x65, 0x74, 0x65, 0x42, 0x6c, 0x6f, 0x63, 0x6b, 0x73, 0x12, 0x16, 0x2e, 0x73, 0x75,
+	0x72, 0x66, 0x73, 0x74, 0x6f, 0x72, 0x65, 0x2e, 0x42, 0x6c, 0x6f, 0x63, 0x6b, 0x48, 0x61, 0x73,
+	0x68, 0x65, 0x73, 0x1a, 0x16, 0x2e, 0x73, 0x75, 0x72, 0x66, 0x73, 0x74, 0x6f, 0x72, 0x65, 0x2e,
+	0x42, 0x6c, 0x6f, 0x63, 0x6b, 0x48, 0x61, 0x73, 0x68, 0x65, 0x73, 0x22, 0x00, 0x12, 0x38, 0x0a,
+	0x0e, 0x52, 0x65, 0x70, 0x6c, 0x69, 0x63, 0x61, 0x74, 0x65, 0x42, 0x6c, 0x6f, 0x63, 0x6b, 0x12,
+	0x10, 0x2e, 0x73, 0x75, 0x72, 0x66, 0x73, 0x74, 0x6f, 0x72, 0x65, 0x2e, 0x42, 0x6c, 0x6f, 0x63,
+	0x6b, 0x1a, 0x12, 0x2e, 0x73, 0x75, 0x72, 0x66, 0x73, 0x74, 0x6f, 0x72, 0x65, 0x2e, 0x53, 0x75,
+	0x63, 0x63, 0x65, 0x73, 0x73, 0x22, 0x00, 0x12, 0x4a, 0x0a, 0x16, 0x44, 0x65, 0x6c, 0x65, 0x74,
+	0x65, 0x52, 0x65, 0x70, 0x6c, 0x69, 0x63, 0x61, 0x74, 0x65, 0x64, 0x42, 0x6c, 0x6f, 0x63, 0x6b,
+	0x73, 0x12, 0x16, 0x2e, 0x73, 0x75, 0x72, 0x66, 0x73, 0x74, 0x6f, 0x72, 0x65, 0x2e, 0x42, 0x6c,
+	0x6f, 0x63, 0x6b, 0x48, 0x61, 0x73, 0x68, 0x65, 0x73, 0x1a, 0x16, 0x2e, 0x73, 0x75, 0x72, 0x66,
+	0x73, 0x74, 0x6f, 0x72, 0x65, 0x2e, 0x42, 0x6c, 0x6f, 0x63, 0x6b, 0x48, 0x61, 0x73, 0x68, 0x65,
+	0x73, 0x22, 0x00, 0x12, 0x44, 0x0a, 0x0f, 0x47, 0x65, 0x74, 0x4d, 0x65, 0x72, 0x6b, 0x6c, 0x65,
+	0x48, 0x61, 0x73, 0x68, 0x65, 0x73, 0x12, 0x16, 0x2e, 0x73, 0x75, 0x72, 0x66, 0x73, 0x74, 0x6f,
+	0x72, 0x65, 0x2e, 0x4d, 0x65, 0x72, 0x6b, 0x6c, 0x65, 0x4e, 0x6f, 0x64, 0x65, 0x73, 0x1a, 0x17,
+	0x2e, 0x73, 0x75, 0x72, 0x66, 0x73, 0x74, 0x6f, 0x72, 0x65, 0x2e, 0x4d, 0x65, 0x72, 0x6b, 0x6c,
+	0x65, 0x48, 0x61, 0x73, 0x68, 0x65, 0x73, 0x22, 0x00, 0x12, 0x46, 0x0a, 0x10, 0x47, 0x65, 0x74,
+	0x4d, 0x65, 0x72, 0x6b, 0x6c, 0x65, 0x42, 0x75, 0x63, 0x6b, 0x65, 0x74, 0x73, 0x12, 0x16, 0x2e,
+	0x73, 0x75, 0x72, 0x66, 0x73, 0x74, 0x6f, 0x72, 0x65, 0x2e, 0x4d, 0x65, 0x72, 0x6b, 0x6c, 0x65,
+	0x4e, 0x6f, 0x64, 0x65, 0x73, 0x1a, 0x18, 0x2e, 0x73, 0x75, 0x72, 0x66, 0x73, 0x74, 0x6f, 0x72,
+	0x65, 0x2e, 0x4d, 0x65, 0x72, 0x6b, 0x6c, 0x65, 0x42, 0x75, 0x63, 0x6b, 0x65, 0x74, 0x73, 0x22,
+	0x00, 0x12, 0x3e, 0x0a, 0x09, 0x49, 0x73, 0x43, 0x72, 0x61, 0x73, 0x68, 0x65, 0x64, 0x12, 0x16,
+	0x2e, 0x67, 0x6f, 0x6f, 0x67, 0x6c, 0x65, 0x2e, 0x70, 0x72, 0x6f, 0x74, 0x6f, 0x62, 0x75, 0x66,
+	0x2e, 0x45, 0x6d, 0x70, 0x74, 0x79, 0x1a, 0x17, 0x2e, 0x73, 0x75, 0x72, 0x66, 0x73, 0x74, 0x6f,
+	0x72, 0x65, 0x2e, 0x43, 0x72, 0x61, 0x73, 0x68, 0x65, 0x64, 0x53, 0x74, 0x61, 0x74, 0x65, 0x22,
+	0x00, 0x12, 0x37, 0x0a, 0x07, 0x52, 0x65, 0x73, 0x74, 0x6f, 0x72, 0x65, 0x12, 0x16, 0x2e, 0x67,
+	0x6f, 0x6f, 0x67, 0x6c, 0x65, 0x2e, 0x70, 0x72, 0x6f, 0x74, 0x6f, 0x62, 0x75, 0x66, 0x2e, 0x45,
+	0x6d, 0x70, 0x74, 0x79, 0x1a, 0x12, 0x2e, 0x73, 0x75, 0x72, 0x66, 0x73, 0x74, 0x6f, 0x72, 0x65,
+	0x2e, 0x53, 0x75, 0x63, 0x63, 0x65, 0x73, 0x73, 0x22, 0x00, 0x12, 0x35, 0x0a, 0x05, 0x43, 0x72,
+	0x61, 0x73, 0x68, 0x12, 0x16, 0x2e, 0x67, 0x6f, 0x6f, 0x67, 0x6c, 0x65, 0x2e, 0x70, 0x72, 0x6f,
+	0x74, 0x6f, 0x62, 0x75, 0x66, 0x2e, 0x45, 0x6d, 0x70, 0x74, 0x79, 0x1a, 0x12, 0x2e, 0x73, 0x75,
+	0x72, 0x66, 0x73, 0x74, 0x6f, 0x72, 0x65, 0x2e, 0x53, 0x75, 0x63, 0x63, 0x65, 0x73, 0x73, 0x22,
+	0x00, 0x32, 0xbb, 0x0b, 0x0a, 0x09, 0x4d, 0x65, 0x74, 0x61, 0x53, 0x74, 0x6f, 0x72, 0x65, 0x12,
+	0x42, 0x0a, 0x0e, 0x47, 0x65, 0x74, 0x46, 0x69, 0x6c, 0x65, 0x49, 0x6e, 0x66, 0x6f, 0x4d, 0x61,
+	0x70, 0x12, 0x16, 0x2e, 0x67, 0x6f, 0x6f, 0x67, 0x6c, 0x65, 0x2e, 0x70, 0x72, 0x6f, 0x74, 0x6f,
+	0x62, 0x75, 0x66, 0x2e, 0x45, 0x6d, 0x70, 0x74, 0x79, 0x1a, 0x16, 0x2e, 0x73, 0x75, 0x72, 0x66,
+	0x73, 0x74, 0x6f, 0x72, 0x65, 0x2e, 0x46, 0x69, 0x6c, 0x65, 0x49, 0x6e, 0x66, 0x6f, 0x4d, 0x61,
+	0x70, 0x22, 0x00, 0x12, 0x3b, 0x0a, 0x0a, 0x55, 0x70, 0x64, 0x61, 0x74, 0x65, 0x46, 0x69, 0x6c,
+	0x65, 0x12, 0x17, 0x2e, 0x73, 0x75, 0x72, 0x66, 0x73, 0x74, 0x6f, 0x72, 0x65, 0x2e, 0x46, 0x69,
+	0x6c, 0x65, 0x4d, 0x65, 0x74, 0x61, 0x44, 0x61, 0x74, 0x61, 0x1a, 0x12, 0x2e, 0x73, 0x75, 0x72,
+	0x66, 0x73, 0x74, 0x6f, 0x72, 0x65, 0x2e, 0x56, 0x65, 0x72, 0x73, 0x69, 0x6f, 0x6e, 0x22, 0x00,
+	0x12, 0x48, 0x0a, 0x11, 0x47, 0x65, 0x74, 0x42, 0x6c, 0x6f, 0x63, 0x6b, 0x53, 0x74, 0x6f, 0x72,
+	0x65, 0x41, 0x64, 0x64, 0x72, 0x12, 0x16, 0x2e, 0x67, 0x6f, 0x6f, 0x67, 0x6c, 0x65, 0x2e, 0x70,
+	0x72, 0x6f, 0x74, 0x6f, 0x62, 0x75, 0x66, 0x2e, 0x45, 0x6d, 0x70, 0x74, 0x79, 0x1a, 0x19, 0x2e,
+	0x73, 0x75, 0x72, 0x66, 0x73, 0x74, 0x6f, 0x72, 0x65, 0x2e, 0x42, 0x6c, 0x6f, 0x63, 0x6b, 0x53,
+	0x74, 0x6f, 0x72, 0x65, 0x41, 0x64, 0x64, 0x72, 0x22, 0x00, 0x12, 0x4a, 0x0a, 0x12, 0x47, 0x65,
+	0x74, 0x42, 0x6c, 0x6f, 0x63, 0x6b, 0x53, 0x74, 0x6f, 0x72, 0x65, 0x41, 0x64, 0x64, 0x72, 0x73,
+	0x12, 0x16, 0x2e, 0x67, 0x6f, 0x6f, 0x67, 0x6c, 0x65, 0x2e, 0x70, 0x72, 0x6f, 0x74, 0x6f, 0x62,
+	0x75, 0x66, 0x2e, 0x45, 0x6d, 0x70, 0x74, 0x79, 0x1a, 0x1a, 0x2e, 0x73, 0x75, 0x72, 0x66, 0x73,
+	0x74, 0x6f, 0x72, 0x65, 0x2e, 0x42, 0x6c, 0x6f, 0x63, 0x6b, 0x53, 0x74, 0x6f, 0x72, 0x65, 0x41,
+	0x64, 0x64, 0x72, 0x73, 0x22, 0x00, 0x12, 0x3f, 0x0a, 0x0e, 0x47, 0x65, 0x74, 0x46, 0x69, 0x6c,
+	0x65, 0x48, 0x69, 0x73, 0x74, 0x6f, 0x72, 0x79, 0x12, 0x13, 0x2e, 0x73, 0x75, 0x72, 0x66, 0x73,
+	0x74, 0x6f, 0x72, 0x65, 0x2e, 0x46, 0x69, 0x6c, 0x65, 0x4e, 0x61, 0x6d, 0x65, 0x1a, 0x16, 0x2e,
+	0x73, 0x75, 0x72, 0x66, 0x73, 0x74, 0x6f, 0x72, 0x65, 0x2e, 0x46, 0x69, 0x6c, 0x65, 0x48, 0x69,
+	0x73, 0x74, 0x6f, 0x72, 0x79, 0x22, 0x00, 0x12, 0x42, 0x0a, 0x12, 0x52, 0x65, 0x73, 0x74, 0x6f,
+	0x72, 0x65, 0x46, 0x69, 0x6c, 0x65, 0x56, 0x65, 0x72, 0x73, 0x69, 0x6f, 0x6e, 0x12, 0x16, 0x2e,
+	0x73, 0x75, 0x72, 0x66, 0x73, 0x74, 0x6f, 0x72, 0x65, 0x2e, 0x46, 0x69, 0x6c, 0x65, 0x56, 0x65,
+	0x72, 0x73, 0x69, 0x6f, 0x6e, 0x1a, 0x12, 0x2e, 0x73, 0x75, 0x72, 0x66, 0x73, 0x74, 0x6f, 0x72,
+	0x65, 0x2e, 0x56, 0x65, 0x72, 0x73, 0x69, 0x6f, 0x6e, 0x22, 0x00, 0x12, 0x33, 0x0a, 0x07, 0x41,
+	0x63, 0x6b, 0x53, 0x79, 0x6e, 0x63, 0x12, 0x12, 0x2e, 0x73, 0x75, 0x72, 0x66, 0x73, 0x74, 0x6f,
+	0x72, 0x65, 0x2e, 0x53, 0x79, 0x6e, 0x63, 0x41, 0x63, 0x6b, 0x1a, 0x12, 0x2e, 0x73, 0x75, 0x72,
+	0x66, 0x73, 0x74, 0x6f, 0x72, 0x65, 0x2e, 0x53, 0x75, 0x63, 0x63, 0x65, 0x73, 0x73, 0x22, 0x00,
+	0x12, 0x43, 0x0a, 0x0d, 0x57, 0x61, 0x74, 0x63, 0x68, 0x46, 0x69, 0x6c, 0x65, 0x49, 0x6e, 0x66,
+	0x6f, 0x12, 0x17, 0x2e, 0x73, 0x75, 0x72, 0x66, 0x73, 0x74, 0x6f, 0x72, 0x65, 0x2e, 0x57, 0x61,
+	0x74, 0x63, 0x68, 0x52, 0x65, 0x71, 0x75, 0x65, 0x73, 0x74, 0x1a, 0x15, 0x2e, 0x73, 0x75, 0x72,
+	0x66, 0x73, 0x74, 0x6f, 0x72, 0x65, 0x2e, 0x46, 0x69, 0x6c, 0x65, 0x43, 0x68, 0x61, 0x6e, 0x67,
+	0x65, 0x22, 0x00, 0x30, 0x01, 0x12, 0x42, 0x0a, 0x0f, 0x47, 0x65, 0x74, 0x43, 0x68, 0x61, 0x6e,
+	0x67, 0x65, 0x73, 0x53, 0x69, 0x6e, 0x63, 0x65, 0x12, 0x13, 0x2e, 0x73, 0x75, 0x72, 0x66, 0x73,
+	0x74, 0x6f, 0x72, 0x65, 0x2e, 0x52, 0x65, 0x76, 0x69, 0x73, 0x69, 0x6f, 0x6e, 0x1a, 0x18, 0x2e,
+	0x73, 0x75, 0x72, 0x66, 0x73, 0x74, 0x6f, 0x72, 0x65, 0x2e, 0x46, 0x69, 0x6c, 0x65, 0x49, 0x6e,
+	0x66, 0x6f, 0x44, 0x65, 0x6c, 0x74, 0x61, 0x22, 0x00, 0x12, 0x48, 0x0a, 0x10, 0x47, 0x65, 0x74,
+	0x46, 0x69, 0x6c, 0x65, 0x49, 0x6e, 0x66, 0x6f, 0x4d, 0x61, 0x70, 0x41, 0x74, 0x12, 0x1a, 0x2e,
+	0x73, 0x75, 0x72, 0x66, 0x73, 0x74, 0x6f, 0x72, 0x65, 0x2e, 0x53, 0x6e, 0x61, 0x70, 0x73, 0x68,
+	0x6f, 0x74, 0x52, 0x65, 0x71, 0x75, 0x65, 0x73, 0x74, 0x1a, 0x16, 0x2e, 0x73, 0x75, 0x72, 0x66,
+	0x73, 0x74, 0x6f, 0x72, 0x65, 0x2e, 0x46, 0x69, 0x6c, 0x65, 0x49, 0x6e, 0x66, 0x6f, 0x4d, 0x61,
+	0x70, 0x22, 0x00, 0x12, 0x48, 0x0a, 0x12, 0x47, 0x65, 0x74, 0x42, 0x6c, 0x6f, 0x63, 0x6b, 0x52,
+	0x65, 0x66, 0x65, 0x72, 0x65, 0x6e, 0x63, 0x65, 0x73, 0x12, 0x14, 0x2e, 0x73, 0x75, 0x72, 0x66,
+	0x73, 0x74, 0x6f, 0x72, 0x65, 0x2e, 0x42, 0x6c, 0x6f, 0x63, 0x6b, 0x48, 0x61, 0x73, 0x68, 0x1a,
+	0x1a, 0x2e, 0x73, 0x75, 0x72, 0x66, 0x73, 0x74, 0x6f, 0x72, 0x65, 0x2e, 0x42, 0x6c, 0x6f, 0x63,
+	0x6b, 0x52, 0x65, 0x66, 0x65, 0x72, 0x65, 0x6e, 0x63, 0x65, 0x73, 0x22, 0x00, 0x12, 0x44, 0x0a,
+	0x0f, 0x47, 0x65, 0x74, 0x52, 0x65, 0x70, 0x61, 0x69, 0x72, 0x52, 0x65, 0x70, 0x6f, 0x72, 0x74,
+	0x12, 0x16, 0x2e, 0x67, 0x6f, 0x6f, 0x67, 0x6c, 0x65, 0x2e, 0x70, 0x72, 0x6f, 0x74, 0x6f, 0x62,
+	0x75, 0x66, 0x2e, 0x45, 0x6d, 0x70, 0x74, 0x79, 0x1a, 0x17, 0x2e, 0x73, 0x75, 0x72, 0x66, 0x73,
+	0x74, 0x6f, 0x72, 0x65, 0x2e, 0x52, 0x65, 0x70, 0x61, 0x69, 0x72, 0x52, 0x65, 0x70, 0x6f, 0x72,
+	0x74, 0x22, 0x00, 0x12, 0x4a, 0x0a, 0x12, 0x47, 0x65, 0x74, 0x53, 0x74, 0x6f, 0x72, 0x61, 0x67,
+	0x65, 0x50, 0x6f, 0x6c, 0x69, 0x63, 0x69, 0x65, 0x73, 0x12, 0x16, 0x2e, 0x67, 0x6f, 0x6f, 0x67,
+	0x6c, 0x65, 0x2e, 0x70, 0x72, 0x6f, 0x74, 0x6f, 0x62, 0x75, 0x66, 0x2e, 0x45, 0x6d, 0x70, 0x74,
+	0x79, 0x1a, 0x1a, 0x2e, 0x73, 0x75, 0x72, 0x66, 0x73, 0x74, 0x6f, 0x72, 0x65, 0x2e, 0x53, 0x74,
+	0x6f, 0x72, 0x61, 0x67, 0x65, 0x50, 0x6f, 0x6c, 0x69, 0x63, 0x69, 0x65, 0x73, 0x22, 0x00, 0x12,
+	0x4e, 0x0a, 0x12, 0x53, 0x65, 0x74, 0x42, 0x6c, 0x6f, 0x63, 0x6b, 0x53, 0x74, 0x6f, 0x72, 0x65,
+	0x41, 0x64, 0x64, 0x72, 0x73, 0x12, 0x1a, 0x2e, 0x73, 0x75, 0x72, 0x66, 0x73, 0x74, 0x6f, 0x72,
+	0x65, 0x2e, 0x42, 0x6c, 0x6f, 0x63, 0x6b, 0x53, 0x74, 0x6f, 0x72, 0x65, 0x41, 0x64, 0x64, 0x72,
+	0x73, 0x1a, 0x1a, 0x2e, 0x73, 0x75, 0x72, 0x66, 0x73, 0x74, 0x6f, 0x72, 0x65, 0x2e, 0x52, 0x65,
+	0x62, 0x61, 0x6c, 0x61, 0x6e, 0x63, 0x65, 0x53, 0x74, 0x61, 0x74, 0x75, 0x73, 0x22, 0x00, 0x12,
+	0x4a, 0x0a, 0x12, 0x47, 0x65, 0x74, 0x52, 0x65, 0x62, 0x61, 0x6c, 0x61, 0x6e, 0x63, 0x65, 0x53,
+	0x74, 0x61, 0x74, 0x75, 0x73, 0x12, 0x16, 0x2e, 0x67, 0x6f, 0x6f, 0x67, 0x6c, 0x65, 0x2e, 0x70,
+	0x72, 0x6f, 0x74, 0x6f, 0x62, 0x75, 0x66, 0x2e, 0x45, 0x6d, 0x70, 0x74, 0x79, 0x1a, 0x1a, 0x2e,
+	0x73, 0x75, 0x72, 0x66, 0x73, 0x74, 0x6f, 0x72, 0x65, 0x2e, 0x52, 0x65, 0x62, 0x61, 0x6c, 0x61,
+	0x6e, 0x63, 0x65, 0x53, 0x74, 0x61, 0x74, 0x75, 0x73, 0x22, 0x00, 0x12, 0x4e, 0x0a, 0x12, 0x52,
+	0x65, 0x67, 0x69, 0x73, 0x74, 0x65, 0x72, 0x42, 0x6c, 0x6f, 0x63, 0x6b, 0x53, 0x74, 0x6f, 0x72,
+	0x65, 0x12, 0x19, 0x2e, 0x73, 0x75, 0x72, 0x66, 0x73, 0x74, 0x6f, 0x72, 0x65, 0x2e, 0x42, 0x6c,
+	0x6f, 0x63, 0x6b, 0x53, 0x74, 0x6f, 0x72, 0x65, 0x41, 0x64, 0x64, 0x72, 0x1a, 0x1b, 0x2e, 0x73,
+	0x75, 0x72, 0x66, 0x73, 0x74, 0x6f, 0x72, 0x65, 0x2e, 0x42, 0x6c, 0x6f, 0x63, 0x6b, 0x53, 0x74,
+	0x6f, 0x72, 0x65, 0x53, 0x74, 0x61, 0x74, 0x75, 0x73, 0x22, 0x00, 0x12, 0x4f, 0x0a, 0x13, 0x42,
+	0x6c, 0x6f, 0x63, 0x6b, 0x53, 0x74, 0x6f, 0x72, 0x65, 0x48, 0x65, 0x61, 0x72, 0x74, 0x62, 0x65,
+	0x61, 0x74, 0x12, 0x19, 0x2e, 0x73, 0x75, 0x72, 0x66, 0x73, 0x74, 0x6f, 0x72, 0x65, 0x2e, 0x42,
+	0x6c, 0x6f, 0x63, 0x6b, 0x53, 0x74, 0x6f, 0x72, 0x65, 0x41, 0x64, 0x64, 0x72, 0x1a, 0x1b, 0x2e,
+	0x73, 0x75, 0x72, 0x66, 0x73, 0x74, 0x6f, 0x72, 0x65, 0x2e, 0x42, 0x6c, 0x6f, 0x63, 0x6b, 0x53,
+	0x74, 0x6f, 0x72, 0x65, 0x53, 0x74, 0x61, 0x74, 0x75, 0x73, 0x22, 0x00, 0x12, 0x4b, 0x0a, 0x0f,
+	0x44, 0x72, 0x61, 0x69, 0x6e, 0x42, 0x6c, 0x6f, 0x63, 0x6b, 0x53, 0x74, 0x6f, 0x72, 0x65, 0x12,
+	0x19, 0x2e, 0x73, 0x75, 0x72, 0x66, 0x73, 0x74, 0x6f, 0x72, 0x65, 0x2e, 0x42, 0x6c, 0x6f, 0x63,
+	0x6b, 0x53, 0x74, 0x6f, 0x72, 0x65, 0x41, 0x64, 0x64, 0x72, 0x1a, 0x1b, 0x2e, 0x73, 0x75, 0x72,
+	0x66, 0x73, 0x74, 0x6f, 0x72, 0x65, 0x2e, 0x42, 0x6c, 0x6f, 0x63, 0x6b, 0x53, 0x74, 0x6f, 0x72,
+	0x65, 0x53, 0x74, 0x61, 0x74, 0x75, 0x73, 0x22, 0x00, 0x12, 0x52, 0x0a, 0x16, 0x44, 0x65, 0x63,
+	0x6f, 0x6d, 0x6d, 0x69, 0x73, 0x73, 0x69, 0x6f, 0x6e, 0x42, 0x6c, 0x6f, 0x63, 0x6b, 0x53, 0x74,
+	0x6f, 0x72, 0x65, 0x12, 0x19, 0x2e, 0x73, 0x75, 0x72, 0x66, 0x73, 0x74, 0x6f, 0x72, 0x65, 0x2e,
+	0x42, 0x6c, 0x6f, 0x63, 0x6b, 0x53, 0x74, 0x6f, 0x72, 0x65, 0x41, 0x64, 0x64, 0x72, 0x1a, 0x1b,
+	0x2e, 0x73, 0x75, 0x72, 0x66, 0x73, 0x74, 0x6f, 0x72, 0x65, 0x2e, 0x42, 0x6c, 0x6f, 0x63, 0x6b,
+	0x53, 0x74, 0x6f, 0x72, 0x65, 0x53, 0x74, 0x61, 0x74, 0x75, 0x73, 0x22, 0x00, 0x12, 0x50, 0x0a,
+	0x15, 0x47, 0x65, 0x74, 0x42, 0x6c, 0x6f, 0x63, 0x6b, 0x53, 0x74, 0x6f, 0x72, 0x65, 0x53, 0x74,
+	0x61, 0x74, 0x75, 0x73, 0x65, 0x73, 0x12, 0x16, 0x2e, 0x67, 0x6f, 0x6f, 0x67, 0x6c, 0x65, 0x2e,
+	0x70, 0x72, 0x6f, 0x74, 0x6f, 0x62, 0x75, 0x66, 0x2e, 0x45, 0x6d, 0x70, 0x74, 0x79, 0x1a, 0x1d,
+	0x2e, 0x73, 0x75, 0x72, 0x66, 0x73, 0x74, 0x6f, 0x72, 0x65, 0x2e, 0x42, 0x6c, 0x6f, 0x63, 0x6b,
+	0x53, 0x74, 0x6f, 0x72, 0x65, 0x53, 0x74, 0x61, 0x74, 0x75, 0x73, 0x65, 0x73, 0x22, 0x00, 0x32,
+	0x83, 0x0f, 0x0a, 0x0d, 0x52, 0x61, 0x66, 0x74, 0x53, 0x75, 0x72, 0x66, 0x73, 0x74, 0x6f, 0x72,
+	0x65, 0x12, 0x4c, 0x0a, 0x0d, 0x41, 0x70, 0x70, 0x65, 0x6e, 0x64, 0x45, 0x6e, 0x74, 0x72, 0x69,
+	0x65, 0x73, 0x12, 0x1b, 0x2e, 0x73, 0x75, 0x72, 0x66, 0x73, 0x74, 0x6f, 0x72, 0x65, 0x2e, 0x41,
+	0x70, 0x70, 0x65, 0x6e, 0x64, 0x45, 0x6e, 0x74, 0x72, 0x79, 0x49, 0x6e, 0x70, 0x75, 0x74, 0x1a,
+	0x1c, 0x2e, 0x73, 0x75, 0x72, 0x66, 0x73, 0x74, 0x6f, 0x72, 0x65, 0x2e, 0x41, 0x70, 0x70, 0x65,
+	0x6e, 0x64, 0x45, 0x6e, 0x74, 0x72, 0x79, 0x4f, 0x75, 0x74, 0x70, 0x75, 0x74, 0x22, 0x00, 0x12,
+	0x39, 0x0a, 0x09, 0x53, 0x65, 0x74, 0x4c, 0x65, 0x61, 0x64, 0x65, 0x72, 0x12, 0x16, 0x2e, 0x67,
+	0x6f, 0x6f, 0x67, 0x6c, 0x65, 0x2e, 0x70, 0x72, 0x6f, 0x74, 0x6f, 0x62, 0x75, 0x66, 0x2e, 0x45,
+	0x6d, 0x70, 0x74, 0x79, 0x1a, 0x12, 0x2e, 0x73, 0x75, 0x72, 0x66, 0x73, 0x74, 0x6f, 0x72, 0x65,
+	0x2e, 0x53, 0x75, 0x63, 0x63, 0x65, 0x73, 0x73, 0x22, 0x00, 0x12, 0x3d, 0x0a, 0x0d, 0x53, 0x65,
+	0x6e, 0x64, 0x48, 0x65, 0x61, 0x72, 0x74, 0x62, 0x65, 0x61, 0x74, 0x12, 0x16, 0x2e, 0x67, 0x6f,
+	0x6f, 0x67, 0x6c, 0x65, 0x2e, 0x70, 0x72, 0x6f, 0x74, 0x6f, 0x62, 0x75, 0x66, 0x2e, 0x45, 0x6d,
+	0x70, 0x74, 0x79, 0x1a, 0x12, 0x2e, 0x73, 0x75, 0x72, 0x66, 0x73, 0x74, 0x6f, 0x72, 0x65, 0x2e,
+	0x53, 0x75, 0x63, 0x63, 0x65, 0x73, 0x73, 0x22, 0x00, 0x12, 0x42, 0x0a, 0x0e, 0x47, 0x65, 0x74,
 	0x46, 0x69, 0x6c, 0x65, 0x49, 0x6e, 0x66, 0x6f, 0x4d, 0x61, 0x70, 0x12, 0x16, 0x2e, 0x67, 0x6f,
 	0x6f, 0x67, 0x6c, 0x65, 0x2e, 0x70, 0x72, 0x6f, 0x74, 0x6f, 0x62, 0x75, 0x66, 0x2e, 0x45, 0x6d,
 	0x70, 0x74, 0x79, 0x1a, 0x16, 0x2e, 0x73, 0x75, 0x72, 0x66, 0x73, 0x74, 0x6f, 0x72, 0x65, 0x2e,
@@ -850,33 +3199,85 @@ var file_pkg_surfstore_SurfStore_proto_rawDesc = []byte{
 	0x16, 0x2e, 0x67, 0x6f, 0x6f, 0x67, 0x6c, 0x65, 0x2e, 0x70, 0x72, 0x6f, 0x74, 0x6f, 0x62, 0x75,
 	0x66, 0x2e, 0x45, 0x6d, 0x70, 0x74, 0x79, 0x1a, 0x19, 0x2e, 0x73, 0x75, 0x72, 0x66, 0x73, 0x74,
 	0x6f, 0x72, 0x65, 0x2e, 0x42, 0x6c, 0x6f, 0x63, 0x6b, 0x53, 0x74, 0x6f, 0x72, 0x65, 0x41, 0x64,
-	0x64, 0x72, 0x22, 0x00, 0x32, 0x9e, 0x05, 0x0a, 0x0d, 0x52, 0x61, 0x66, 0x74, 0x53, 0x75, 0x72,
-	0x66, 0x73, 0x74, 0x6f, 0x72, 0x65, 0x12, 0x4c, 0x0a, 0x0d, 0x41, 0x70, 0x70, 0x65, 0x6e, 0x64,
-	0x45, 0x6e, 0x74, 0x72, 0x69, 0x65, 0x73, 0x12, 0x1b, 0x2e, 0x73, 0x75, 0x72, 0x66, 0x73, 0x74,
-	0x6f, 0x72, 0x65, 0x2e, 0x41, 0x70, 0x70, 0x65, 0x6e, 0x64, 0x45, 0x6e, 0x74, 0x72, 0x79, 0x49,
-	0x6e, 0x70, 0x75, 0x74, 0x1a, 0x1c, 0x2e, 0x73, 0x75, 0x72, 0x66, 0x73, 0x74, 0x6f, 0x72, 0x65,
-	0x2e, 0x41, 0x70, 0x70, 0x65, 0x6e, 0x64, 0x45, 0x6e, 0x74, 0x72, 0x79, 0x4f, 0x75, 0x74, 0x70,
-	0x75, 0x74, 0x22, 0x00, 0x12, 0x39, 0x0a, 0x09, 0x53, 0x65, 0x74, 0x4c, 0x65, 0x61, 0x64, 0x65,
-	0x72, 0x12, 0x16, 0x2e, 0x67, 0x6f, 0x6f, 0x67, 0x6c, 0x65, 0x2e, 0x70, 0x72, 0x6f, 0x74, 0x6f,
-	0x62, 0x75, 0x66, 0x2e, 0x45, 0x6d, 0x70, 0x74, 0x79, 0x1a, 0x12, 0x2e, 0x73, 0x75, 0x72, 0x66,
-	0x73, 0x74, 0x6f, 0x72, 0x65, 0x2e, 0x53, 0x75, 0x63, 0x63, 0x65, 0x73, 0x73, 0x22, 0x00, 0x12,
-	0x3d, 0x0a, 0x0d, 0x53, 0x65, 0x6e, 0x64, 0x48, 0x65, 0x61, 0x72, 0x74, 0x62, 0x65, 0x61, 0x74,
-	0x12, 0x16, 0x2e, 0x67, 0x6f, 0x6f, 0x67, 0x6c, 0x65, 0x2e, 0x70, 0x72, 0x6f, 0x74, 0x6f, 0x62,
-	0x75, 0x66, 0x2e, 0x45, 0x6d, 0x70, 0x74, 0x79, 0x1a, 0x12, 0x2e, 0x73, 0x75, 0x72, 0x66, 0x73,
-	0x74, 0x6f, 0x72, 0x65, 0x2e, 0x53, 0x75, 0x63, 0x63, 0x65, 0x73, 0x73, 0x22, 0x00, 0x12, 0x42,
-	0x0a, 0x0e, 0x47, 0x65, 0x74, 0x46, 0x69, 0x6c, 0x65, 0x49, 0x6e, 0x66, 0x6f, 0x4d, 0x61, 0x70,
-	0x12, 0x16, 0x2e, 0x67, 0x6f, 0x6f, 0x67, 0x6c, 0x65, 0x2e, 0x70, 0x72, 0x6f, 0x74, 0x6f, 0x62,
-	0x75, 0x66, 0x2e, 0x45, 0x6d, 0x70, 0x74, 0x79, 0x1a, 0x16, 0x2e, 0x73, 0x75, 0x72, 0x66, 0x73,
-	0x74, 0x6f, 0x72, 0x65, 0x2e, 0x46, 0x69, 0x6c, 0x65, 0x49, 0x6e, 0x66, 0x6f, 0x4d, 0x61, 0x70,
-	0x22, 0x00, 0x12, 0x3b, 0x0a, 0x0a, 0x55, 0x70, 0x64, 0x61, 0x74, 0x65, 0x46, 0x69, 0x6c, 0x65,
-	0x12, 0x17, 0x2e, 0x73, 0x75, 0x72, 0x66, 0x73, 0x74, 0x6f, 0x72, 0x65, 0x2e, 0x46, 0x69, 0x6c,
-	0x65, 0x4d, 0x65, 0x74, 0x61, 0x44, 0x61, 0x74, 0x61, 0x1a, 0x12, 0x2e, 0x73, 0x75, 0x72, 0x66,
-	0x73, 0x74, 0x6f, 0x72, 0x65, 0x2e, 0x56, 0x65, 0x72, 0x73, 0x69, 0x6f, 0x6e, 0x22, 0x00, 0x12,
-	0x48, 0x0a, 0x11, 0x47, 0x65, 0x74, 0x42, 0x6c, 0x6f, 0x63, 0x6b, 0x53, 0x74, 0x6f, 0x72, 0x65,
-	0x41, 0x64, 0x64, 0x72, 0x12, 0x16, 0x2e, 0x67, 0x6f, 0x6f, 0x67, 0x6c, 0x65, 0x2e, 0x70, 0x72,
-	0x6f, 0x74, 0x6f, 0x62, 0x75, 0x66, 0x2e, 0x45, 0x6d, 0x70, 0x74, 0x79, 0x1a, 0x19, 0x2e, 0x73,
+	0x64, 0x72, 0x22, 0x00, 0x12, 0x4a, 0x0a, 0x12, 0x47, 0x65, 0x74, 0x42, 0x6c, 0x6f, 0x63, 0x6b,
+	0x53, 0x74, 0x6f, 0x72, 0x65, 0x41, 0x64, 0x64, 0x72, 0x73, 0x12, 0x16, 0x2e, 0x67, 0x6f, 0x6f,
+	0x67, 0x6c, 0x65, 0x2e, 0x70, 0x72, 0x6f, 0x74, 0x6f, 0x62, 0x75, 0x66, 0x2e, 0x45, 0x6d, 0x70,
+	0x74, 0x79, 0x1a, 0x1a, 0x2e, 0x73, 0x75, 0x72, 0x66, 0x73, 0x74, 0x6f, 0x72, 0x65, 0x2e, 0x42,
+	0x6c, 0x6f, 0x63, 0x6b, 0x53, 0x74, 0x6f, 0x72, 0x65, 0x41, 0x64, 0x64, 0x72, 0x73, 0x22, 0x00,
+	0x12, 0x3f, 0x0a, 0x0e, 0x47, 0x65, 0x74, 0x46, 0x69, 0x6c, 0x65, 0x48, 0x69, 0x73, 0x74, 0x6f,
+	0x72, 0x79, 0x12, 0x13, 0x2e, 0x73, 0x75, 0x72, 0x66, 0x73, 0x74, 0x6f, 0x72, 0x65, 0x2e, 0x46,
+	0x69, 0x6c, 0x65, 0x4e, 0x61, 0x6d, 0x65, 0x1a, 0x16, 0x2e, 0x73, 0x75, 0x72, 0x66, 0x73, 0x74,
+	0x6f, 0x72, 0x65, 0x2e, 0x46, 0x69, 0x6c, 0x65, 0x48, 0x69, 0x73, 0x74, 0x6f, 0x72, 0x79, 0x22,
+	0x00, 0x12, 0x42, 0x0a, 0x12, 0x52, 0x65, 0x73, 0x74, 0x6f, 0x72, 0x65, 0x46, 0x69, 0x6c, 0x65,
+	0x56, 0x65, 0x72, 0x73, 0x69, 0x6f, 0x6e, 0x12, 0x16, 0x2e, 0x73, 0x75, 0x72, 0x66, 0x73, 0x74,
+	0x6f, 0x72, 0x65, 0x2e, 0x46, 0x69, 0x6c, 0x65, 0x56, 0x65, 0x72, 0x73, 0x69, 0x6f, 0x6e, 0x1a,
+	0x12, 0x2e, 0x73, 0x75, 0x72, 0x66, 0x73, 0x74, 0x6f, 0x72, 0x65, 0x2e, 0x56, 0x65, 0x72, 0x73,
+	0x69, 0x6f, 0x6e, 0x22, 0x00, 0x12, 0x33, 0x0a, 0x07, 0x41, 0x63, 0x6b, 0x53, 0x79, 0x6e, 0x63,
+	0x12, 0x12, 0x2e, 0x73, 0x75, 0x72, 0x66, 0x73, 0x74, 0x6f, 0x72, 0x65, 0x2e, 0x53, 0x79, 0x6e,
+	0x63, 0x41, 0x63, 0x6b, 0x1a, 0x12, 0x2e, 0x73, 0x75, 0x72, 0x66, 0x73, 0x74, 0x6f, 0x72, 0x65,
+	0x2e, 0x53, 0x75, 0x63, 0x63, 0x65, 0x73, 0x73, 0x22, 0x00, 0x12, 0x43, 0x0a, 0x0d, 0x57, 0x61,
+	0x74, 0x63, 0x68, 0x46, 0x69, 0x6c, 0x65, 0x49, 0x6e, 0x66, 0x6f, 0x12, 0x17, 0x2e, 0x73, 0x75,
+	0x72, 0x66, 0x73, 0x74, 0x6f, 0x72, 0x65, 0x2e, 0x57, 0x61, 0x74, 0x63, 0x68, 0x52, 0x65, 0x71,
+	0x75, 0x65, 0x73, 0x74, 0x1a, 0x15, 0x2e, 0x73, 0x75, 0x72, 0x66, 0x73, 0x74, 0x6f, 0x72, 0x65,
+	0x2e, 0x46, 0x69, 0x6c, 0x65, 0x43, 0x68, 0x61, 0x6e, 0x67, 0x65, 0x22, 0x00, 0x30, 0x01, 0x12,
+	0x42, 0x0a, 0x0f, 0x47, 0x65, 0x74, 0x43, 0x68, 0x61, 0x6e, 0x67, 0x65, 0x73, 0x53, 0x69, 0x6e,
+	0x63, 0x65, 0x12, 0x13, 0x2e, 0x73, 0x75, 0x72, 0x66, 0x73, 0x74, 0x6f, 0x72, 0x65, 0x2e, 0x52,
+	0x65, 0x76, 0x69, 0x73, 0x69, 0x6f, 0x6e, 0x1a, 0x18, 0x2e, 0x73, 0x75, 0x72, 0x66, 0x73, 0x74,
+	0x6f, 0x72, 0x65, 0x2e, 0x46, 0x69, 0x6c, 0x65, 0x49, 0x6e, 0x66, 0x6f, 0x44, 0x65, 0x6c, 0x74,
+	0x61, 0x22, 0x00, 0x12, 0x48, 0x0a, 0x10, 0x47, 0x65, 0x74, 0x46, 0x69, 0x6c, 0x65, 0x49, 0x6e,
+	0x66, 0x6f, 0x4d, 0x61, 0x70, 0x41, 0x74, 0x12, 0x1a, 0x2e, 0x73, 0x75, 0x72, 0x66, 0x73, 0x74,
+	0x6f, 0x72, 0x65, 0x2e, 0x53, 0x6e, 0x61, 0x70, 0x73, 0x68, 0x6f, 0x74, 0x52, 0x65, 0x71, 0x75,
+	0x65, 0x73, 0x74, 0x1a, 0x16, 0x2e, 0x73, 0x75, 0x72, 0x66, 0x73, 0x74, 0x6f, 0x72, 0x65, 0x2e,
+	0x46, 0x69, 0x6c, 0x65, 0x49, 0x6e, 0x66, 0x6f, 0x4d, 0x61, 0x70, 0x22, 0x00, 0x12, 0x48, 0x0a,
+	0x12, 0x47, 0x65, 0x74, 0x42, 0x6c, 0x6f, 0x63, 0x6b, 0x52, 0x65, 0x66, 0x65, 0x72, 0x65, 0x6e,
+	0x63, 0x65, 0x73, 0x12, 0x14, 0x2e, 0x73, 0x75, 0x72, 0x66, 0x73, 0x74, 0x6f, 0x72, 0x65, 0x2e,
+	0x42, 0x6c, 0x6f, 0x63, 0x6b, 0x48, 0x61, 0x73, 0x68, 0x1a, 0x1a, 0x2e, 0x73, 0x75, 0x72, 0x66,
+	0x73, 0x74, 0x6f, 0x72, 0x65, 0x2e, 0x42, 0x6c, 0x6f, 0x63, 0x6b, 0x52, 0x65, 0x66, 0x65, 0x72,
+	0x65, 0x6e, 0x63, 0x65, 0x73, 0x22, 0x00, 0x12, 0x44, 0x0a, 0x0f, 0x47, 0x65, 0x74, 0x52, 0x65,
+	0x70, 0x61, 0x69, 0x72, 0x52, 0x65, 0x70, 0x6f, 0x72, 0x74, 0x12, 0x16, 0x2e, 0x67, 0x6f, 0x6f,
+	0x67, 0x6c, 0x65, 0x2e, 0x70, 0x72, 0x6f, 0x74, 0x6f, 0x62, 0x75, 0x66, 0x2e, 0x45, 0x6d, 0x70,
+	0x74, 0x79, 0x1a, 0x17, 0x2e, 0x73, 0x75, 0x72, 0x66, 0x73, 0x74, 0x6f, 0x72, 0x65, 0x2e, 0x52,
+	0x65, 0x70, 0x61, 0x69, 0x72, 0x52, 0x65, 0x70, 0x6f, 0x72, 0x74, 0x22, 0x00, 0x12, 0x4a, 0x0a,
+	0x12, 0x47, 0x65, 0x74, 0x53, 0x74, 0x6f, 0x72, 0x61, 0x67, 0x65, 0x50, 0x6f, 0x6c, 0x69, 0x63,
+	0x69, 0x65, 0x73, 0x12, 0x16, 0x2e, 0x67, 0x6f, 0x6f, 0x67, 0x6c, 0x65, 0x2e, 0x70, 0x72, 0x6f,
+	0x74, 0x6f, 0x62, 0x75, 0x66, 0x2e, 0x45, 0x6d, 0x70, 0x74, 0x79, 0x1a, 0x1a, 0x2e, 0x73, 0x75,
+	0x72, 0x66, 0x73, 0x74, 0x6f, 0x72, 0x65, 0x2e, 0x53, 0x74, 0x6f, 0x72, 0x61, 0x67, 0x65, 0x50,
+	0x6f, 0x6c, 0x69, 0x63, 0x69, 0x65, 0x73, 0x22, 0x00, 0x12, 0x4e, 0x0a, 0x12, 0x53, 0x65, 0x74,
+	0x42, 0x6c, 0x6f, 0x63, 0x6b, 0x53, 0x74, 0x6f, 0x72, 0x65, 0x41, 0x64, 0x64, 0x72, 0x73, 0x12,
+	0x1a, 0x2e, 0x73, 0x75, 0x72, 0x66, 0x73, 0x74, 0x6f, 0x72, 0x65, 0x2e, 0x42, 0x6c, 0x6f, 0x63,
+	0x6b, 0x53, 0x74, 0x6f, 0x72, 0x65, 0x41, 0x64, 0x64, 0x72, 0x73, 0x1a, 0x1a, 0x2e, 0x73, 0x75,
+	0x72, 0x66, 0x73, 0x74, 0x6f, 0x72, 0x65, 0x2e, 0x52, 0x65, 0x62, 0x61, 0x6c, 0x61, 0x6e, 0x63,
+	0x65, 0x53, 0x74, 0x61, 0x74, 0x75, 0x73, 0x22, 0x00, 0x12, 0x4a, 0x0a, 0x12, 0x47, 0x65, 0x74,
+	0x52, 0x65, 0x62, 0x61, 0x6c, 0x61, 0x6e, 0x63, 0x65, 0x53, 0x74, 0x61, 0x74, 0x75, 0x73, 0x12,
+	0x16, 0x2e, 0x67, 0x6f, 0x6f, 0x67, 0x6c, 0x65, 0x2e, 0x70, 0x72, 0x6f, 0x74, 0x6f, 0x62, 0x75,
+	0x66, 0x2e, 0x45, 0x6d, 0x70, 0x74, 0x79, 0x1a, 0x1a, 0x2e, 0x73, 0x75, 0x72, 0x66, 0x73, 0x74,
+	0x6f, 0x72, 0x65, 0x2e, 0x52, 0x65, 0x62, 0x61, 0x6c, 0x61, 0x6e, 0x63, 0x65, 0x53, 0x74, 0x61,
+	0x74, 0x75, 0x73, 0x22, 0x00, 0x12, 0x4e, 0x0a, 0x12, 0x52, 0x65, 0x67, 0x69, 0x73, 0x74, 0x65,
+	0x72, 0x42, 0x6c, 0x6f, 0x63, 0x6b, 0x53, 0x74, 0x6f, 0x72, 0x65, 0x12, 0x19, 0x2e, 0x73, 0x75,
+	0x72, 0x66, 0x73, 0x74, 0x6f, 0x72, 0x65, 0x2e, 0x42, 0x6c, 0x6f, 0x63, 0x6b, 0x53, 0x74, 0x6f,
+	0x72, 0x65, 0x41, 0x64, 0x64, 0x72, 0x1a, 0x1b, 0x2e, 0x73, 0x75, 0x72, 0x66, 0x73, 0x74, 0x6f,
+	0x72, 0x65, 0x2e, 0x42, 0x6c, 0x6f, 0x63, 0x6b, 0x53, 0x74, 0x6f, 0x72, 0x65, 0x53, 0x74, 0x61,
+	0x74, 0x75, 0x73, 0x22, 0x00, 0x12, 0x4f, 0x0a, 0x13, 0x42, 0x6c, 0x6f, 0x63, 0x6b, 0x53, 0x74,
+	0x6f, 0x72, 0x65, 0x48, 0x65, 0x61, 0x72, 0x74, 0x62, 0x65, 0x61, 0x74, 0x12, 0x19, 0x2e, 0x73,
 	0x75, 0x72, 0x66, 0x73, 0x74, 0x6f, 0x72, 0x65, 0x2e, 0x42, 0x6c, 0x6f, 0x63, 0x6b, 0x53, 0x74,
-	0x6f, 0x72, 0x65, 0x41, 0x64, 0x64, 0x72, 0x22, 0x00, 0x12, 0x4a, 0x0a, 0x10, 0x47, 0x65, 0x74,
+	0x6f, 0x72, 0x65, 0x41, 0x64, 0x64, 0x72, 0x1a, 0x1b, 0x2e, 0x73, 0x75, 0x72, 0x66, 0x73, 0x74,
+	0x6f, 0x72, 0x65, 0x2e, 0x42, 0x6c, 0x6f, 0x63, 0x6b, 0x53, 0x74, 0x6f, 0x72, 0x65, 0x53, 0x74,
+	0x61, 0x74, 0x75, 0x73, 0x22, 0x00, 0x12, 0x4b, 0x0a, 0x0f, 0x44, 0x72, 0x61, 0x69, 0x6e, 0x42,
+	0x6c, 0x6f, 0x63, 0x6b, 0x53, 0x74, 0x6f, 0x72, 0x65, 0x12, 0x19, 0x2e, 0x73, 0x75, 0x72, 0x66,
+	0x73, 0x74, 0x6f, 0x72, 0x65, 0x2e, 0x42, 0x6c, 0x6f, 0x63, 0x6b, 0x53, 0x74, 0x6f, 0x72, 0x65,
+	0x41, 0x64, 0x64, 0x72, 0x1a, 0x1b, 0x2e, 0x73, 0x75, 0x72, 0x66, 0x73, 0x74, 0x6f, 0x72, 0x65,
+	0x2e, 0x42, 0x6c, 0x6f, 0x63, 0x6b, 0x53, 0x74, 0x6f, 0x72, 0x65, 0x53, 0x74, 0x61, 0x74, 0x75,
+	0x73, 0x22, 0x00, 0x12, 0x52, 0x0a, 0x16, 0x44, 0x65, 0x63, 0x6f, 0x6d, 0x6d, 0x69, 0x73, 0x73,
+	0x69, 0x6f, 0x6e, 0x42, 0x6c, 0x6f, 0x63, 0x6b, 0x53, 0x74, 0x6f, 0x72, 0x65, 0x12, 0x19, 0x2e,
+	0x73, 0x75, 0x72, 0x66, 0x73, 0x74, 0x6f, 0x72, 0x65, 0x2e, 0x42, 0x6c, 0x6f, 0x63, 0x6b, 0x53,
+	0x74, 0x6f, 0x72, 0x65, 0x41, 0x64, 0x64, 0x72, 0x1a, 0x1b, 0x2e, 0x73, 0x75, 0x72, 0x66, 0x73,
+	0x74, 0x6f, 0x72, 0x65, 0x2e, 0x42, 0x6c, 0x6f, 0x63, 0x6b, 0x53, 0x74, 0x6f, 0x72, 0x65, 0x53,
+	0x74, 0x61, 0x74, 0x75, 0x73, 0x22, 0x00, 0x12, 0x50, 0x0a, 0x15, 0x47, 0x65, 0x74, 0x42, 0x6c,
+	0x6f, 0x63, 0x6b, 0x53, 0x74, 0x6f, 0x72, 0x65, 0x53, 0x74, 0x61, 0x74, 0x75, 0x73, 0x65, 0x73,
+	0x12, 0x16, 0x2e, 0x67, 0x6f, 0x6f, 0x67, 0x6c, 0x65, 0x2e, 0x70, 0x72, 0x6f, 0x74, 0x6f, 0x62,
+	0x75, 0x66, 0x2e, 0x45, 0x6d, 0x70, 0x74, 0x79, 0x1a, 0x1d, 0x2e, 0x73, 0x75, 0x72, 0x66, 0x73,
+	0x74, 0x6f, 0x72, 0x65, 0x2e, 0x42, 0x6c, 0x6f, 0x63, 0x6b, 0x53, 0x74, 0x6f, 0x72, 0x65, 0x53,
+	0x74, 0x61, 0x74, 0x75, 0x73, 0x65, 0x73, 0x22, 0x00, 0x12, 0x4a, 0x0a, 0x10, 0x47, 0x65, 0x74,
 	0x49, 0x6e, 0x74, 0x65, 0x72, 0x6e, 0x61, 0x6c, 0x53, 0x74, 0x61, 0x74, 0x65, 0x12, 0x16, 0x2e,
 	0x67, 0x6f, 0x6f, 0x67, 0x6c, 0x65, 0x2e, 0x70, 0x72, 0x6f, 0x74, 0x6f, 0x62, 0x75, 0x66, 0x2e,
 	0x45, 0x6d, 0x70, 0x74, 0x79, 0x1a, 0x1c, 0x2e, 0x73, 0x75, 0x72, 0x66, 0x73, 0x74, 0x6f, 0x72,
@@ -909,68 +3310,206 @@ func file_pkg_surfstore_SurfStore_proto_rawDescGZIP() []byte {
 	return file_pkg_surfstore_SurfStore_proto_rawDescData
 }
 
-var file_pkg_surfstore_SurfStore_proto_msgTypes = make([]protoimpl.MessageInfo, 14)
+var file_pkg_surfstore_SurfStore_proto_enumTypes = make([]protoimpl.EnumInfo, 1)
+var file_pkg_surfstore_SurfStore_proto_msgTypes = make([]protoimpl.MessageInfo, 43)
 var file_pkg_surfstore_SurfStore_proto_goTypes = []interface{}{
-	(*BlockHash)(nil),         // 0: surfstore.BlockHash
-	(*BlockHashes)(nil),       // 1: surfstore.BlockHashes
-	(*Block)(nil),             // 2: surfstore.Block
-	(*Success)(nil),           // 3: surfstore.Success
-	(*FileMetaData)(nil),      // 4: surfstore.FileMetaData
-	(*FileInfoMap)(nil),       // 5: surfstore.FileInfoMap
-	(*Version)(nil),           // 6: surfstore.Version
-	(*BlockStoreAddr)(nil),    // 7: surfstore.BlockStoreAddr
-	(*CrashedState)(nil),      // 8: surfstore.CrashedState
-	(*AppendEntryInput)(nil),  // 9: surfstore.AppendEntryInput
-	(*AppendEntryOutput)(nil), // 10: surfstore.AppendEntryOutput
-	(*UpdateOperation)(nil),   // 11: surfstore.UpdateOperation
-	(*RaftInternalState)(nil), // 12: surfstore.RaftInternalState
-	nil,                       // 13: surfstore.FileInfoMap.FileInfoMapEntry
-	(*emptypb.Empty)(nil),     // 14: google.protobuf.Empty
+	(BlockStoreState)(0),           // 0: surfstore.BlockStoreState
+	(*BlockHash)(nil),              // 1: surfstore.BlockHash
+	(*BlockHashes)(nil),            // 2: surfstore.BlockHashes
+	(*Block)(nil),                  // 3: surfstore.Block
+	(*Success)(nil),                // 4: surfstore.Success
+	(*FileMetaData)(nil),           // 5: surfstore.FileMetaData
+	(*ErasureStripe)(nil),          // 6: surfstore.ErasureStripe
+	(*StoragePolicy)(nil),          // 7: surfstore.StoragePolicy
+	(*StoragePolicies)(nil),        // 8: surfstore.StoragePolicies
+	(*FileName)(nil),               // 9: surfstore.FileName
+	(*FileVersion)(nil),            // 10: surfstore.FileVersion
+	(*BlockReferences)(nil),        // 11: surfstore.BlockReferences
+	(*FileHistory)(nil),            // 12: surfstore.FileHistory
+	(*FileInfoMap)(nil),            // 13: surfstore.FileInfoMap
+	(*Revision)(nil),               // 14: surfstore.Revision
+	(*FileInfoDelta)(nil),          // 15: surfstore.FileInfoDelta
+	(*SnapshotRequest)(nil),        // 16: surfstore.SnapshotRequest
+	(*SyncAck)(nil),                // 17: surfstore.SyncAck
+	(*WatchRequest)(nil),           // 18: surfstore.WatchRequest
+	(*FileChange)(nil),             // 19: surfstore.FileChange
+	(*PruneOperation)(nil),         // 20: surfstore.PruneOperation
+	(*Version)(nil),                // 21: surfstore.Version
+	(*BlockStoreAddr)(nil),         // 22: surfstore.BlockStoreAddr
+	(*MerkleNodes)(nil),            // 23: surfstore.MerkleNodes
+	(*MerkleHashes)(nil),           // 24: surfstore.MerkleHashes
+	(*MerkleBuckets)(nil),          // 25: surfstore.MerkleBuckets
+	(*BlockStoreAddrs)(nil),        // 26: surfstore.BlockStoreAddrs
+	(*BlockStoreRegistration)(nil), // 27: surfstore.BlockStoreRegistration
+	(*BlockStoreStatus)(nil),       // 28: surfstore.BlockStoreStatus
+	(*BlockStoreStatuses)(nil),     // 29: surfstore.BlockStoreStatuses
+	(*RebalanceStatus)(nil),        // 30: surfstore.RebalanceStatus
+	(*RepairReport)(nil),           // 31: surfstore.RepairReport
+	(*CrashedState)(nil),           // 32: surfstore.CrashedState
+	(*AppendEntryInput)(nil),       // 33: surfstore.AppendEntryInput
+	(*AppendEntryOutput)(nil),      // 34: surfstore.AppendEntryOutput
+	(*UpdateOperation)(nil),        // 35: surfstore.UpdateOperation
+	(*RestoreOperation)(nil),       // 36: surfstore.RestoreOperation
+	(*BlockStoreChange)(nil),       // 37: surfstore.BlockStoreChange
+	(*RaftInternalState)(nil),      // 38: surfstore.RaftInternalState
+	(*MetaStoreCheckpoint)(nil),    // 39: surfstore.MetaStoreCheckpoint
+	(*NamespaceCheckpoint)(nil),    // 40: surfstore.NamespaceCheckpoint
+	nil,                            // 41: surfstore.FileInfoMap.FileInfoMapEntry
+	nil,                            // 42: surfstore.FileInfoDelta.ChangesEntry
+	nil,                            // 43: surfstore.NamespaceCheckpoint.ClientRevisionsEntry
+	(*emptypb.Empty)(nil),          // 44: google.protobuf.Empty
 }
 var file_pkg_surfstore_SurfStore_proto_depIdxs = []int32{
-	13, // 0: surfstore.FileInfoMap.fileInfoMap:type_name -> surfstore.FileInfoMap.FileInfoMapEntry
-	11, // 1: surfstore.AppendEntryInput.entries:type_name -> surfstore.UpdateOperation
-	4,  // 2: surfstore.UpdateOperation.fileMetaData:type_name -> surfstore.FileMetaData
-	11, // 3: surfstore.RaftInternalState.log:type_name -> surfstore.UpdateOperation
-	5,  // 4: surfstore.RaftInternalState.metaMap:type_name -> surfstore.FileInfoMap
-	4,  // 5: surfstore.FileInfoMap.FileInfoMapEntry.value:type_name -> surfstore.FileMetaData
-	0,  // 6: surfstore.BlockStore.GetBlock:input_type -> surfstore.BlockHash
-	2,  // 7: surfstore.BlockStore.PutBlock:input_type -> surfstore.Block
-	1,  // 8: surfstore.BlockStore.HasBlocks:input_type -> surfstore.BlockHashes
-	14, // 9: surfstore.MetaStore.GetFileInfoMap:input_type -> google.protobuf.Empty
-	4,  // 10: surfstore.MetaStore.UpdateFile:input_type -> surfstore.FileMetaData
-	14, // 11: surfstore.MetaStore.GetBlockStoreAddr:input_type -> google.protobuf.Empty
-	9,  // 12: surfstore.RaftSurfstore.AppendEntries:input_type -> surfstore.AppendEntryInput
-	14, // 13: surfstore.RaftSurfstore.SetLeader:input_type -> google.protobuf.Empty
-	14, // 14: surfstore.RaftSurfstore.SendHeartbeat:input_type -> google.protobuf.Empty
-	14, // 15: surfstore.RaftSurfstore.GetFileInfoMap:input_type -> google.protobuf.Empty
-	4,  // 16: surfstore.RaftSurfstore.UpdateFile:input_type -> surfstore.FileMetaData
-	14, // 17: surfstore.RaftSurfstore.GetBlockStoreAddr:input_type -> google.protobuf.Empty
-	14, // 18: surfstore.RaftSurfstore.GetInternalState:input_type -> google.protobuf.Empty
-	14, // 19: surfstore.RaftSurfstore.IsCrashed:input_type -> google.protobuf.Empty
-	14, // 20: surfstore.RaftSurfstore.Restore:input_type -> google.protobuf.Empty
-	14, // 21: surfstore.RaftSurfstore.Crash:input_type -> google.protobuf.Empty
-	2,  // 22: surfstore.BlockStore.GetBlock:output_type -> surfstore.Block
-	3,  // 23: surfstore.BlockStore.PutBlock:output_type -> surfstore.Success
-	1,  // 24: surfstore.BlockStore.HasBlocks:output_type -> surfstore.BlockHashes
-	5,  // 25: surfstore.MetaStore.GetFileInfoMap:output_type -> surfstore.FileInfoMap
-	6,  // 26: surfstore.MetaStore.UpdateFile:output_type -> surfstore.Version
-	7,  // 27: surfstore.MetaStore.GetBlockStoreAddr:output_type -> surfstore.BlockStoreAddr
-	10, // 28: surfstore.RaftSurfstore.AppendEntries:output_type -> surfstore.AppendEntryOutput
-	3,  // 29: surfstore.RaftSurfstore.SetLeader:output_type -> surfstore.Success
-	3,  // 30: surfstore.RaftSurfstore.SendHeartbeat:output_type -> surfstore.Success
-	5,  // 31: surfstore.RaftSurfstore.GetFileInfoMap:output_type -> surfstore.FileInfoMap
-	6,  // 32: surfstore.RaftSurfstore.UpdateFile:output_type -> surfstore.Version
-	7,  // 33: surfstore.RaftSurfstore.GetBlockStoreAddr:output_type -> surfstore.BlockStoreAddr
-	12, // 34: surfstore.RaftSurfstore.GetInternalState:output_type -> surfstore.RaftInternalState
-	8,  // 35: surfstore.RaftSurfstore.IsCrashed:output_type -> surfstore.CrashedState
-	3,  // 36: surfstore.RaftSurfstore.Restore:output_type -> surfstore.Success
-	3,  // 37: surfstore.RaftSurfstore.Crash:output_type -> surfstore.Success
-	22, // [22:38] is the sub-list for method output_type
-	6,  // [6:22] is the sub-list for method input_type
-	6,  // [6:6] is the sub-list for extension type_name
-	6,  // [6:6] is the sub-list for extension extendee
-	0,  // [0:6] is the sub-list for field type_name
+	6,  // 0: surfstore.FileMetaData.erasureStripes:type_name -> surfstore.ErasureStripe
+	7,  // 1: surfstore.StoragePolicies.policies:type_name -> surfstore.StoragePolicy
+	10, // 2: surfstore.BlockReferences.references:type_name -> surfstore.FileVersion
+	5,  // 3: surfstore.FileHistory.versions:type_name -> surfstore.FileMetaData
+	41, // 4: surfstore.FileInfoMap.fileInfoMap:type_name -> surfstore.FileInfoMap.FileInfoMapEntry
+	42, // 5: surfstore.FileInfoDelta.changes:type_name -> surfstore.FileInfoDelta.ChangesEntry
+	5,  // 6: surfstore.FileChange.fileMetaData:type_name -> surfstore.FileMetaData
+	10, // 7: surfstore.PruneOperation.versions:type_name -> surfstore.FileVersion
+	0,  // 8: surfstore.BlockStoreRegistration.state:type_name -> surfstore.BlockStoreState
+	0,  // 9: surfstore.BlockStoreStatus.state:type_name -> surfstore.BlockStoreState
+	28, // 10: surfstore.BlockStoreStatuses.statuses:type_name -> surfstore.BlockStoreStatus
+	35, // 11: surfstore.AppendEntryInput.entries:type_name -> surfstore.UpdateOperation
+	5,  // 12: surfstore.UpdateOperation.fileMetaData:type_name -> surfstore.FileMetaData
+	17, // 13: surfstore.UpdateOperation.syncAck:type_name -> surfstore.SyncAck
+	20, // 14: surfstore.UpdateOperation.prune:type_name -> surfstore.PruneOperation
+	37, // 15: surfstore.UpdateOperation.blockStoreChange:type_name -> surfstore.BlockStoreChange
+	27, // 16: surfstore.UpdateOperation.registration:type_name -> surfstore.BlockStoreRegistration
+	36, // 17: surfstore.UpdateOperation.restore:type_name -> surfstore.RestoreOperation
+	10, // 18: surfstore.RestoreOperation.fileVersion:type_name -> surfstore.FileVersion
+	35, // 19: surfstore.RaftInternalState.log:type_name -> surfstore.UpdateOperation
+	13, // 20: surfstore.RaftInternalState.metaMap:type_name -> surfstore.FileInfoMap
+	40, // 21: surfstore.MetaStoreCheckpoint.namespaces:type_name -> surfstore.NamespaceCheckpoint
+	27, // 22: surfstore.MetaStoreCheckpoint.blockStoreRegistry:type_name -> surfstore.BlockStoreRegistration
+	5,  // 23: surfstore.NamespaceCheckpoint.changes:type_name -> surfstore.FileMetaData
+	43, // 24: surfstore.NamespaceCheckpoint.clientRevisions:type_name -> surfstore.NamespaceCheckpoint.ClientRevisionsEntry
+	5,  // 25: surfstore.FileInfoMap.FileInfoMapEntry.value:type_name -> surfstore.FileMetaData
+	5,  // 26: surfstore.FileInfoDelta.ChangesEntry.value:type_name -> surfstore.FileMetaData
+	1,  // 27: surfstore.BlockStore.GetBlock:input_type -> surfstore.BlockHash
+	3,  // 28: surfstore.BlockStore.PutBlock:input_type -> surfstore.Block
+	2,  // 29: surfstore.BlockStore.HasBlocks:input_type -> surfstore.BlockHashes
+	44, // 30: surfstore.BlockStore.ListBlocks:input_type -> google.protobuf.Empty
+	2,  // 31: surfstore.BlockStore.DeleteBlocks:input_type -> surfstore.BlockHashes
+	3,  // 32: surfstore.BlockStore.ReplicateBlock:input_type -> surfstore.Block
+	2,  // 33: surfstore.BlockStore.DeleteReplicatedBlocks:input_type -> surfstore.BlockHashes
+	23, // 34: surfstore.BlockStore.GetMerkleHashes:input_type -> surfstore.MerkleNodes
+	23, // 35: surfstore.BlockStore.GetMerkleBuckets:input_type -> surfstore.MerkleNodes
+	44, // 36: surfstore.BlockStore.IsCrashed:input_type -> google.protobuf.Empty
+	44, // 37: surfstore.BlockStore.Restore:input_type -> google.protobuf.Empty
+	44, // 38: surfstore.BlockStore.Crash:input_type -> google.protobuf.Empty
+	44, // 39: surfstore.MetaStore.GetFileInfoMap:input_type -> google.protobuf.Empty
+	5,  // 40: surfstore.MetaStore.UpdateFile:input_type -> surfstore.FileMetaData
+	44, // 41: surfstore.MetaStore.GetBlockStoreAddr:input_type -> google.protobuf.Empty
+	44, // 42: surfstore.MetaStore.GetBlockStoreAddrs:input_type -> google.protobuf.Empty
+	9,  // 43: surfstore.MetaStore.GetFileHistory:input_type -> surfstore.FileName
+	10, // 44: surfstore.MetaStore.RestoreFileVersion:input_type -> surfstore.FileVersion
+	17, // 45: surfstore.MetaStore.AckSync:input_type -> surfstore.SyncAck
+	18, // 46: surfstore.MetaStore.WatchFileInfo:input_type -> surfstore.WatchRequest
+	14, // 47: surfstore.MetaStore.GetChangesSince:input_type -> surfstore.Revision
+	16, // 48: surfstore.MetaStore.GetFileInfoMapAt:input_type -> surfstore.SnapshotRequest
+	1,  // 49: surfstore.MetaStore.GetBlockReferences:input_type -> surfstore.BlockHash
+	44, // 50: surfstore.MetaStore.GetRepairReport:input_type -> google.protobuf.Empty
+	44, // 51: surfstore.MetaStore.GetStoragePolicies:input_type -> google.protobuf.Empty
+	26, // 52: surfstore.MetaStore.SetBlockStoreAddrs:input_type -> surfstore.BlockStoreAddrs
+	44, // 53: surfstore.MetaStore.GetRebalanceStatus:input_type -> google.protobuf.Empty
+	22, // 54: surfstore.MetaStore.RegisterBlockStore:input_type -> surfstore.BlockStoreAddr
+	22, // 55: surfstore.MetaStore.BlockStoreHeartbeat:input_type -> surfstore.BlockStoreAddr
+	22, // 56: surfstore.MetaStore.DrainBlockStore:input_type -> surfstore.BlockStoreAddr
+	22, // 57: surfstore.MetaStore.DecommissionBlockStore:input_type -> surfstore.BlockStoreAddr
+	44, // 58: surfstore.MetaStore.GetBlockStoreStatuses:input_type -> google.protobuf.Empty
+	33, // 59: surfstore.RaftSurfstore.AppendEntries:input_type -> surfstore.AppendEntryInput
+	44, // 60: surfstore.RaftSurfstore.SetLeader:input_type -> google.protobuf.Empty
+	44, // 61: surfstore.RaftSurfstore.SendHeartbeat:input_type -> google.protobuf.Empty
+	44, // 62: surfstore.RaftSurfstore.GetFileInfoMap:input_type -> google.protobuf.Empty
+	5,  // 63: surfstore.RaftSurfstore.UpdateFile:input_type -> surfstore.FileMetaData
+	44, // 64: surfstore.RaftSurfstore.GetBlockStoreAddr:input_type -> google.protobuf.Empty
+	44, // 65: surfstore.RaftSurfstore.GetBlockStoreAddrs:input_type -> google.protobuf.Empty
+	9,  // 66: surfstore.RaftSurfstore.GetFileHistory:input_type -> surfstore.FileName
+	10, // 67: surfstore.RaftSurfstore.RestoreFileVersion:input_type -> surfstore.FileVersion
+	17, // 68: surfstore.RaftSurfstore.AckSync:input_type -> surfstore.SyncAck
+	18, // 69: surfstore.RaftSurfstore.WatchFileInfo:input_type -> surfstore.WatchRequest
+	14, // 70: surfstore.RaftSurfstore.GetChangesSince:input_type -> surfstore.Revision
+	16, // 71: surfstore.RaftSurfstore.GetFileInfoMapAt:input_type -> surfstore.SnapshotRequest
+	1,  // 72: surfstore.RaftSurfstore.GetBlockReferences:input_type -> surfstore.BlockHash
+	44, // 73: surfstore.RaftSurfstore.GetRepairReport:input_type -> google.protobuf.Empty
+	44, // 74: surfstore.RaftSurfstore.GetStoragePolicies:input_type -> google.protobuf.Empty
+	26, // 75: surfstore.RaftSurfstore.SetBlockStoreAddrs:input_type -> surfstore.BlockStoreAddrs
+	44, // 76: surfstore.RaftSurfstore.GetRebalanceStatus:input_type -> google.protobuf.Empty
+	22, // 77: surfstore.RaftSurfstore.RegisterBlockStore:input_type -> surfstore.BlockStoreAddr
+	22, // 78: surfstore.RaftSurfstore.BlockStoreHeartbeat:input_type -> surfstore.BlockStoreAddr
+	22, // 79: surfstore.RaftSurfstore.DrainBlockStore:input_type -> surfstore.BlockStoreAddr
+	22, // 80: surfstore.RaftSurfstore.DecommissionBlockStore:input_type -> surfstore.BlockStoreAddr
+	44, // 81: surfstore.RaftSurfstore.GetBlockStoreStatuses:input_type -> google.protobuf.Empty
+	44, // 82: surfstore.RaftSurfstore.GetInternalState:input_type -> google.protobuf.Empty
+	44, // 83: surfstore.RaftSurfstore.IsCrashed:input_type -> google.protobuf.Empty
+	44, // 84: surfstore.RaftSurfstore.Restore:input_type -> google.protobuf.Empty
+	44, // 85: surfstore.RaftSurfstore.Crash:input_type -> google.protobuf.Empty
+	3,  // 86: surfstore.BlockStore.GetBlock:output_type -> surfstore.Block
+	4,  // 87: surfstore.BlockStore.PutBlock:output_type -> surfstore.Success
+	2,  // 88: surfstore.BlockStore.HasBlocks:output_type -> surfstore.BlockHashes
+	2,  // 89: surfstore.BlockStore.ListBlocks:output_type -> surfstore.BlockHashes
+	2,  // 90: surfstore.BlockStore.DeleteBlocks:output_type -> surfstore.BlockHashes
+	4,  // 91: surfstore.BlockStore.ReplicateBlock:output_type -> surfstore.Success
+	2,  // 92: surfstore.BlockStore.DeleteReplicatedBlocks:output_type -> surfstore.BlockHashes
+	24, // 93: surfstore.BlockStore.GetMerkleHashes:output_type -> surfstore.MerkleHashes
+	25, // 94: surfstore.BlockStore.GetMerkleBuckets:output_type -> surfstore.MerkleBuckets
+	32, // 95: surfstore.BlockStore.IsCrashed:output_type -> surfstore.CrashedState
+	4,  // 96: surfstore.BlockStore.Restore:output_type -> surfstore.Success
+	4,  // 97: surfstore.BlockStore.Crash:output_type -> surfstore.Success
+	13, // 98: surfstore.MetaStore.GetFileInfoMap:output_type -> surfstore.FileInfoMap
+	21, // 99: surfstore.MetaStore.UpdateFile:output_type -> surfstore.Version
+	22, // 100: surfstore.MetaStore.GetBlockStoreAddr:output_type -> surfstore.BlockStoreAddr
+	26, // 101: surfstore.MetaStore.GetBlockStoreAddrs:output_type -> surfstore.BlockStoreAddrs
+	12, // 102: surfstore.MetaStore.GetFileHistory:output_type -> surfstore.FileHistory
+	21, // 103: surfstore.MetaStore.RestoreFileVersion:output_type -> surfstore.Version
+	4,  // 104: surfstore.MetaStore.AckSync:output_type -> surfstore.Success
+	19, // 105: surfstore.MetaStore.WatchFileInfo:output_type -> surfstore.FileChange
+	15, // 106: surfstore.MetaStore.GetChangesSince:output_type -> surfstore.FileInfoDelta
+	13, // 107: surfstore.MetaStore.GetFileInfoMapAt:output_type -> surfstore.FileInfoMap
+	11, // 108: surfstore.MetaStore.GetBlockReferences:output_type -> surfstore.BlockReferences
+	31, // 109: surfstore.MetaStore.GetRepairReport:output_type -> surfstore.RepairReport
+	8,  // 110: surfstore.MetaStore.GetStoragePolicies:output_type -> surfstore.StoragePolicies
+	30, // 111: surfstore.MetaStore.SetBlockStoreAddrs:output_type -> surfstore.RebalanceStatus
+	30, // 112: surfstore.MetaStore.GetRebalanceStatus:output_type -> surfstore.RebalanceStatus
+	28, // 113: surfstore.MetaStore.RegisterBlockStore:output_type -> surfstore.BlockStoreStatus
+	28, // 114: surfstore.MetaStore.BlockStoreHeartbeat:output_type -> surfstore.BlockStoreStatus
+	28, // 115: surfstore.MetaStore.DrainBlockStore:output_type -> surfstore.BlockStoreStatus
+	28, // 116: surfstore.MetaStore.DecommissionBlockStore:output_type -> surfstore.BlockStoreStatus
+	29, // 117: surfstore.MetaStore.GetBlockStoreStatuses:output_type -> surfstore.BlockStoreStatuses
+	34, // 118: surfstore.RaftSurfstore.AppendEntries:output_type -> surfstore.AppendEntryOutput
+	4,  // 119: surfstore.RaftSurfstore.SetLeader:output_type -> surfstore.Success
+	4,  // 120: surfstore.RaftSurfstore.SendHeartbeat:output_type -> surfstore.Success
+	13, // 121: surfstore.RaftSurfstore.GetFileInfoMap:output_type -> surfstore.FileInfoMap
+	21, // 122: surfstore.RaftSurfstore.UpdateFile:output_type -> surfstore.Version
+	22, // 123: surfstore.RaftSurfstore.GetBlockStoreAddr:output_type -> surfstore.BlockStoreAddr
+	26, // 124: surfstore.RaftSurfstore.GetBlockStoreAddrs:output_type -> surfstore.BlockStoreAddrs
+	12, // 125: surfstore.RaftSurfstore.GetFileHistory:output_type -> surfstore.FileHistory
+	21, // 126: surfstore.RaftSurfstore.RestoreFileVersion:output_type -> surfstore.Version
+	4,  // 127: surfstore.RaftSurfstore.AckSync:output_type -> surfstore.Success
+	19, // 128: surfstore.RaftSurfstore.WatchFileInfo:output_type -> surfstore.FileChange
+	15, // 129: surfstore.RaftSurfstore.GetChangesSince:output_type -> surfstore.FileInfoDelta
+	13, // 130: surfstore.RaftSurfstore.GetFileInfoMapAt:output_type -> surfstore.FileInfoMap
+	11, // 131: surfstore.RaftSurfstore.GetBlockReferences:output_type -> surfstore.BlockReferences
+	31, // 132: surfstore.RaftSurfstore.GetRepairReport:output_type -> surfstore.RepairReport
+	8,  // 133: surfstore.RaftSurfstore.GetStoragePolicies:output_type -> surfstore.StoragePolicies
+	30, // 134: surfstore.RaftSurfstore.SetBlockStoreAddrs:output_type -> surfstore.RebalanceStatus
+	30, // 135: surfstore.RaftSurfstore.GetRebalanceStatus:output_type -> surfstore.RebalanceStatus
+	28, // 136: surfstore.RaftSurfstore.RegisterBlockStore:output_type -> surfstore.BlockStoreStatus
+	28, // 137: surfstore.RaftSurfstore.BlockStoreHeartbeat:output_type -> surfstore.BlockStoreStatus
+	28, // 138: surfstore.RaftSurfstore.DrainBlockStore:output_type -> surfstore.BlockStoreStatus
+	28, // 139: surfstore.RaftSurfstore.DecommissionBlockStore:output_type -> surfstore.BlockStoreStatus
+	29, // 140: surfstore.RaftSurfstore.GetBlockStoreStatuses:output_type -> surfstore.BlockStoreStatuses
+	38, // 141: surfstore.RaftSurfstore.GetInternalState:output_type -> surfstore.RaftInternalState
+	32, // 142: surfstore.RaftSurfstore.IsCrashed:output_type -> surfstore.CrashedState
+	4,  // 143: surfstore.RaftSurfstore.Restore:output_type -> surfstore.Success
+	4,  // 144: surfstore.RaftSurfstore.Crash:output_type -> surfstore.Success
+	86, // [86:145] is the sub-list for method output_type
+	27, // [27:86] is the sub-list for method input_type
+	27, // [27:27] is the sub-list for extension type_name
+	27, // [27:27] is the sub-list for extension extendee
+	0,  // [0:27] is the sub-list for field type_name
 }
 
 func init() { file_pkg_surfstore_SurfStore_proto_init() }
@@ -991,8 +3530,56 @@ func file_pkg_surfstore_SurfStore_proto_init() {
 				return nil
 			}
 		}
-		file_pkg_surfstore_SurfStore_proto_msgTypes[1].Exporter = func(v interface{}, i int) interface{} {
-			switch v := v.(*BlockHashes); i {
+		file_pkg_surfstore_SurfStore_proto_msgTypes[1].Exporter = func(v interface{}, i int) interface{} {
+			switch v := v.(*BlockHashes); i {
+			case 0:
+				return &v.state
+			case 1:
+				return &v.sizeCache
+			case 2:
+				return &v.unknownFields
+			default:
+				return nil
+			}
+		}
+		file_pkg_surfstore_SurfStore_proto_msgTypes[2].Exporter = func(v interface{}, i int) interface{} {
+			switch v := v.(*Block); i {
+			case 0:
+				return &v.state
+			case 1:
+				return &v.sizeCache
+			case 2:
+				return &v.unknownFields
+			default:
+				return nil
+			}
+		}
+		file_pkg_surfstore_SurfStore_proto_msgTypes[3].Exporter = func(v interface{}, i int) interface{} {
+			switch v := v.(*Success); i {
+			case 0:
+				return &v.state
+			case 1:
+				return &v.sizeCache
+			case 2:
+				return &v.unknownFields
+			default:
+				return nil
+			}
+		}
+		file_pkg_surfstore_SurfStore_proto_msgTypes[4].Exporter = func(v interface{}, i int) interface{} {
+			switch v := v.(*FileMetaData); i {
+			case 0:
+				return &v.state
+			case 1:
+				return &v.sizeCache
+			case 2:
+				return &v.unknownFields
+			default:
+				return nil
+			}
+		}
+		file_pkg_surfstore_SurfStore_proto_msgTypes[5].Exporter = func(v interface{}, i int) interface{} {
+			switch v := v.(*ErasureStripe); i {
 			case 0:
 				return &v.state
 			case 1:
@@ -1003,8 +3590,8 @@ func file_pkg_surfstore_SurfStore_proto_init() {
 				return nil
 			}
 		}
-		file_pkg_surfstore_SurfStore_proto_msgTypes[2].Exporter = func(v interface{}, i int) interface{} {
-			switch v := v.(*Block); i {
+		file_pkg_surfstore_SurfStore_proto_msgTypes[6].Exporter = func(v interface{}, i int) interface{} {
+			switch v := v.(*StoragePolicy); i {
 			case 0:
 				return &v.state
 			case 1:
@@ -1015,8 +3602,8 @@ func file_pkg_surfstore_SurfStore_proto_init() {
 				return nil
 			}
 		}
-		file_pkg_surfstore_SurfStore_proto_msgTypes[3].Exporter = func(v interface{}, i int) interface{} {
-			switch v := v.(*Success); i {
+		file_pkg_surfstore_SurfStore_proto_msgTypes[7].Exporter = func(v interface{}, i int) interface{} {
+			switch v := v.(*StoragePolicies); i {
 			case 0:
 				return &v.state
 			case 1:
@@ -1027,8 +3614,8 @@ func file_pkg_surfstore_SurfStore_proto_init() {
 				return nil
 			}
 		}
-		file_pkg_surfstore_SurfStore_proto_msgTypes[4].Exporter = func(v interface{}, i int) interface{} {
-			switch v := v.(*FileMetaData); i {
+		file_pkg_surfstore_SurfStore_proto_msgTypes[8].Exporter = func(v interface{}, i int) interface{} {
+			switch v := v.(*FileName); i {
 			case 0:
 				return &v.state
 			case 1:
@@ -1039,7 +3626,43 @@ func file_pkg_surfstore_SurfStore_proto_init() {
 				return nil
 			}
 		}
-		file_pkg_surfstore_SurfStore_proto_msgTypes[5].Exporter = func(v interface{}, i int) interface{} {
+		file_pkg_surfstore_SurfStore_proto_msgTypes[9].Exporter = func(v interface{}, i int) interface{} {
+			switch v := v.(*FileVersion); i {
+			case 0:
+				return &v.state
+			case 1:
+				return &v.sizeCache
+			case 2:
+				return &v.unknownFields
+			default:
+				return nil
+			}
+		}
+		file_pkg_surfstore_SurfStore_proto_msgTypes[10].Exporter = func(v interface{}, i int) interface{} {
+			switch v := v.(*BlockReferences); i {
+			case 0:
+				return &v.state
+			case 1:
+				return &v.sizeCache
+			case 2:
+				return &v.unknownFields
+			default:
+				return nil
+			}
+		}
+		file_pkg_surfstore_SurfStore_proto_msgTypes[11].Exporter = func(v interface{}, i int) interface{} {
+			switch v := v.(*FileHistory); i {
+			case 0:
+				return &v.state
+			case 1:
+				return &v.sizeCache
+			case 2:
+				return &v.unknownFields
+			default:
+				return nil
+			}
+		}
+		file_pkg_surfstore_SurfStore_proto_msgTypes[12].Exporter = func(v interface{}, i int) interface{} {
 			switch v := v.(*FileInfoMap); i {
 			case 0:
 				return &v.state
@@ -1051,7 +3674,91 @@ func file_pkg_surfstore_SurfStore_proto_init() {
 				return nil
 			}
 		}
-		file_pkg_surfstore_SurfStore_proto_msgTypes[6].Exporter = func(v interface{}, i int) interface{} {
+		file_pkg_surfstore_SurfStore_proto_msgTypes[13].Exporter = func(v interface{}, i int) interface{} {
+			switch v := v.(*Revision); i {
+			case 0:
+				return &v.state
+			case 1:
+				return &v.sizeCache
+			case 2:
+				return &v.unknownFields
+			default:
+				return nil
+			}
+		}
+		file_pkg_surfstore_SurfStore_proto_msgTypes[14].Exporter = func(v interface{}, i int) interface{} {
+			switch v := v.(*FileInfoDelta); i {
+			case 0:
+				return &v.state
+			case 1:
+				return &v.sizeCache
+			case 2:
+				return &v.unknownFields
+			default:
+				return nil
+			}
+		}
+		file_pkg_surfstore_SurfStore_proto_msgTypes[15].Exporter = func(v interface{}, i int) interface{} {
+			switch v := v.(*SnapshotRequest); i {
+			case 0:
+				return &v.state
+			case 1:
+				return &v.sizeCache
+			case 2:
+				return &v.unknownFields
+			default:
+				return nil
+			}
+		}
+		file_pkg_surfstore_SurfStore_proto_msgTypes[16].Exporter = func(v interface{}, i int) interface{} {
+			switch v := v.(*SyncAck); i {
+			case 0:
+				return &v.state
+			case 1:
+				return &v.sizeCache
+			case 2:
+				return &v.unknownFields
+			default:
+				return nil
+			}
+		}
+		file_pkg_surfstore_SurfStore_proto_msgTypes[17].Exporter = func(v interface{}, i int) interface{} {
+			switch v := v.(*WatchRequest); i {
+			case 0:
+				return &v.state
+			case 1:
+				return &v.sizeCache
+			case 2:
+				return &v.unknownFields
+			default:
+				return nil
+			}
+		}
+		file_pkg_surfstore_SurfStore_proto_msgTypes[18].Exporter = func(v interface{}, i int) interface{} {
+			switch v := v.(*FileChange); i {
+			case 0:
+				return &v.state
+			case 1:
+				return &v.sizeCache
+			case 2:
+				return &v.unknownFields
+			default:
+				return nil
+			}
+		}
+		file_pkg_surfstore_SurfStore_proto_msgTypes[19].Exporter = func(v interface{}, i int) interface{} {
+			switch v := v.(*PruneOperation); i {
+			case 0:
+				return &v.state
+			case 1:
+				return &v.sizeCache
+			case 2:
+				return &v.unknownFields
+			default:
+				return nil
+			}
+		}
+		file_pkg_surfstore_SurfStore_proto_msgTypes[20].Exporter = func(v interface{}, i int) interface{} {
 			switch v := v.(*Version); i {
 			case 0:
 				return &v.state
@@ -1063,7 +3770,7 @@ func file_pkg_surfstore_SurfStore_proto_init() {
 				return nil
 			}
 		}
-		file_pkg_surfstore_SurfStore_proto_msgTypes[7].Exporter = func(v interface{}, i int) interface{} {
+		file_pkg_surfstore_SurfStore_proto_msgTypes[21].Exporter = func(v interface{}, i int) interface{} {
 			switch v := v.(*BlockStoreAddr); i {
 			case 0:
 				return &v.state
@@ -1075,7 +3782,115 @@ func file_pkg_surfstore_SurfStore_proto_init() {
 				return nil
 			}
 		}
-		file_pkg_surfstore_SurfStore_proto_msgTypes[8].Exporter = func(v interface{}, i int) interface{} {
+		file_pkg_surfstore_SurfStore_proto_msgTypes[22].Exporter = func(v interface{}, i int) interface{} {
+			switch v := v.(*MerkleNodes); i {
+			case 0:
+				return &v.state
+			case 1:
+				return &v.sizeCache
+			case 2:
+				return &v.unknownFields
+			default:
+				return nil
+			}
+		}
+		file_pkg_surfstore_SurfStore_proto_msgTypes[23].Exporter = func(v interface{}, i int) interface{} {
+			switch v := v.(*MerkleHashes); i {
+			case 0:
+				return &v.state
+			case 1:
+				return &v.sizeCache
+			case 2:
+				return &v.unknownFields
+			default:
+				return nil
+			}
+		}
+		file_pkg_surfstore_SurfStore_proto_msgTypes[24].Exporter = func(v interface{}, i int) interface{} {
+			switch v := v.(*MerkleBuckets); i {
+			case 0:
+				return &v.state
+			case 1:
+				return &v.sizeCache
+			case 2:
+				return &v.unknownFields
+			default:
+				return nil
+			}
+		}
+		file_pkg_surfstore_SurfStore_proto_msgTypes[25].Exporter = func(v interface{}, i int) interface{} {
+			switch v := v.(*BlockStoreAddrs); i {
+			case 0:
+				return &v.state
+			case 1:
+				return &v.sizeCache
+			case 2:
+				return &v.unknownFields
+			default:
+				return nil
+			}
+		}
+		file_pkg_surfstore_SurfStore_proto_msgTypes[26].Exporter = func(v interface{}, i int) interface{} {
+			switch v := v.(*BlockStoreRegistration); i {
+			case 0:
+				return &v.state
+			case 1:
+				return &v.sizeCache
+			case 2:
+				return &v.unknownFields
+			default:
+				return nil
+			}
+		}
+		file_pkg_surfstore_SurfStore_proto_msgTypes[27].Exporter = func(v interface{}, i int) interface{} {
+			switch v := v.(*BlockStoreStatus); i {
+			case 0:
+				return &v.state
+			case 1:
+				return &v.sizeCache
+			case 2:
+				return &v.unknownFields
+			default:
+				return nil
+			}
+		}
+		file_pkg_surfstore_SurfStore_proto_msgTypes[28].Exporter = func(v interface{}, i int) interface{} {
+			switch v := v.(*BlockStoreStatuses); i {
+			case 0:
+				return &v.state
+			case 1:
+				return &v.sizeCache
+			case 2:
+				return &v.unknownFields
+			default:
+				return nil
+			}
+		}
+		file_pkg_surfstore_SurfStore_proto_msgTypes[29].Exporter = func(v interface{}, i int) interface{} {
+			switch v := v.(*RebalanceStatus); i {
+			case 0:
+				return &v.state
+			case 1:
+				return &v.sizeCache
+			case 2:
+				return &v.unknownFields
+			default:
+				return nil
+			}
+		}
+		file_pkg_surfstore_SurfStore_proto_msgTypes[30].Exporter = func(v interface{}, i int) interface{} {
+			switch v := v.(*RepairReport); i {
+			case 0:
+				return &v.state
+			case 1:
+				return &v.sizeCache
+			case 2:
+				return &v.unknownFields
+			default:
+				return nil
+			}
+		}
+		file_pkg_surfstore_SurfStore_proto_msgTypes[31].Exporter = func(v interface{}, i int) interface{} {
 			switch v := v.(*CrashedState); i {
 			case 0:
 				return &v.state
@@ -1087,7 +3902,7 @@ func file_pkg_surfstore_SurfStore_proto_init() {
 				return nil
 			}
 		}
-		file_pkg_surfstore_SurfStore_proto_msgTypes[9].Exporter = func(v interface{}, i int) interface{} {
+		file_pkg_surfstore_SurfStore_proto_msgTypes[32].Exporter = func(v interface{}, i int) interface{} {
 			switch v := v.(*AppendEntryInput); i {
 			case 0:
 				return &v.state
@@ -1099,7 +3914,7 @@ func file_pkg_surfstore_SurfStore_proto_init() {
 				return nil
 			}
 		}
-		file_pkg_surfstore_SurfStore_proto_msgTypes[10].Exporter = func(v interface{}, i int) interface{} {
+		file_pkg_surfstore_SurfStore_proto_msgTypes[33].Exporter = func(v interface{}, i int) interface{} {
 			switch v := v.(*AppendEntryOutput); i {
 			case 0:
 				return &v.state
@@ -1111,7 +3926,7 @@ func file_pkg_surfstore_SurfStore_proto_init() {
 				return nil
 			}
 		}
-		file_pkg_surfstore_SurfStore_proto_msgTypes[11].Exporter = func(v interface{}, i int) interface{} {
+		file_pkg_surfstore_SurfStore_proto_msgTypes[34].Exporter = func(v interface{}, i int) interface{} {
 			switch v := v.(*UpdateOperation); i {
 			case 0:
 				return &v.state
@@ -1123,7 +3938,31 @@ func file_pkg_surfstore_SurfStore_proto_init() {
 				return nil
 			}
 		}
-		file_pkg_surfstore_SurfStore_proto_msgTypes[12].Exporter = func(v interface{}, i int) interface{} {
+		file_pkg_surfstore_SurfStore_proto_msgTypes[35].Exporter = func(v interface{}, i int) interface{} {
+			switch v := v.(*RestoreOperation); i {
+			case 0:
+				return &v.state
+			case 1:
+				return &v.sizeCache
+			case 2:
+				return &v.unknownFields
+			default:
+				return nil
+			}
+		}
+		file_pkg_surfstore_SurfStore_proto_msgTypes[36].Exporter = func(v interface{}, i int) interface{} {
+			switch v := v.(*BlockStoreChange); i {
+			case 0:
+				return &v.state
+			case 1:
+				return &v.sizeCache
+			case 2:
+				return &v.unknownFields
+			default:
+				return nil
+			}
+		}
+		file_pkg_surfstore_SurfStore_proto_msgTypes[37].Exporter = func(v interface{}, i int) interface{} {
 			switch v := v.(*RaftInternalState); i {
 			case 0:
 				return &v.state
@@ -1135,19 +3974,44 @@ func file_pkg_surfstore_SurfStore_proto_init() {
 				return nil
 			}
 		}
+		file_pkg_surfstore_SurfStore_proto_msgTypes[38].Exporter = func(v interface{}, i int) interface{} {
+			switch v := v.(*MetaStoreCheckpoint); i {
+			case 0:
+				return &v.state
+			case 1:
+				return &v.sizeCache
+			case 2:
+				return &v.unknownFields
+			default:
+				return nil
+			}
+		}
+		file_pkg_surfstore_SurfStore_proto_msgTypes[39].Exporter = func(v interface{}, i int) interface{} {
+			switch v := v.(*NamespaceCheckpoint); i {
+			case 0:
+				return &v.state
+			case 1:
+				return &v.sizeCache
+			case 2:
+				return &v.unknownFields
+			default:
+				return nil
+			}
+		}
 	}
 	type x struct{}
 	out := protoimpl.TypeBuilder{
 		File: protoimpl.DescBuilder{
 			GoPackagePath: reflect.TypeOf(x{}).PkgPath(),
 			RawDescriptor: file_pkg_surfstore_SurfStore_proto_rawDesc,
-			NumEnums:      0,
-			NumMessages:   14,
+			NumEnums:      1,
+			NumMessages:   43,
 			NumExtensions: 0,
 			NumServices:   3,
 		},
 		GoTypes:           file_pkg_surfstore_SurfStore_proto_goTypes,
 		DependencyIndexes: file_pkg_surfstore_SurfStore_proto_depIdxs,
+		EnumInfos:         file_pkg_surfstore_SurfStore_proto_enumTypes,
 		MessageInfos:      file_pkg_surfstore_SurfStore_proto_msgTypes,
 	}.Build()
 	File_pkg_surfstore_SurfStore_proto = out.File
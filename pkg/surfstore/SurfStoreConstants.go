@@ -1,10 +1,121 @@
 package surfstore
 
+import "time"
+
 const DEFAULT_META_FILENAME string = "index.txt"
+const DEFAULT_REVISION_FILENAME string = "revision.txt"
+
+// Files a durable MetaStore keeps in its data directory
+const JOURNAL_FILENAME string = "journal"
+const CHECKPOINT_FILENAME string = "checkpoint"
+
+// Directory under the data directory that a filesystem BlockStore keeps its blocks in
+const BLOCKS_DIRNAME string = "blocks"
+
+// Directory under the data directory that corrupt blocks are moved to
+const QUARANTINE_DIRNAME string = "quarantine"
+
+// Directory under the data directory that a packfile BlockStore keeps its packs in
+const PACKS_DIRNAME string = "packs"
+
+// Size at which a packfile BlockStore starts appending to a new pack
+const PACK_SEGMENT_BYTES int64 = 64 << 20
+
+// Number of journaled operations after which a durable MetaStore
+// checkpoints and empties its journal
+const CHECKPOINT_INTERVAL int = 1024
 
 const FILENAME_INDEX int = 0
 const VERSION_INDEX int = 1
 const HASH_LIST_INDEX int = 2
+const MODE_INDEX int = 3
+const MTIME_INDEX int = 4
+const SIZE_INDEX int = 5
+const SYMLINK_TARGET_INDEX int = 6
 
 const CONFIG_DELIMITER string = ","
 const HASH_DELIMITER string = " "
+
+// gRPC metadata key selecting the namespace an RPC works in
+const NAMESPACE_METADATA_KEY string = "namespace"
+
+// gRPC metadata key carrying a client's token, sent as AUTH_TOKEN_PREFIX + token
+const AUTH_METADATA_KEY string = "authorization"
+const AUTH_TOKEN_PREFIX string = "Bearer "
+
+// Namespace used when an RPC does not select one
+const DEFAULT_NAMESPACE string = ""
+
+const SURF_CLIENT string = "[Surfstore RPCClient]:"
+const SURF_SERVER string = "[Surfstore Server]:"
+
+// Block hash list of a deleted file
+const TOMBSTONE_HASH string = "0"
+
+// Directories are synced as entries whose name ends with this and that have
+// no blocks
+const DIRECTORY_SUFFIX string = "/"
+
+// Files are downloaded under this suffix and then renamed into place
+const DOWNLOAD_SUFFIX string = ".surfdownload"
+
+// How often the metadata server applies its retention policy
+const PRUNE_INTERVAL = 30 * time.Second
+
+// How often a BlockStore re-hashes its blocks by default
+const SCRUB_INTERVAL = time.Hour
+
+// Number of hash-range buckets at the leaves of a BlockStore's Merkle
+// tree; a power of two, so the tree is complete
+const MERKLE_BUCKETS = 256
+
+// How often a BlockStore replica compares its blocks with its peers by default
+const ANTI_ENTROPY_INTERVAL = time.Minute
+
+// How often a BlockStore that registered itself sends heartbeats by default
+const BLOCKSTORE_HEARTBEAT_INTERVAL = 5 * time.Second
+
+// How long a registered BlockStore may go without a heartbeat before the
+// metadata server stops handing it out
+const BLOCKSTORE_TIMEOUT = 15 * time.Second
+
+// How often a tiered BlockStore logs how its memory tier is doing
+const TIERED_STATS_INTERVAL = 5 * time.Minute
+
+// How often a packfile BlockStore looks for packs worth repacking
+const REPACK_INTERVAL = 5 * time.Minute
+
+// How often an idle watch checks that its server is still serving
+const WATCH_POLL_INTERVAL = time.Second
+
+// How long a client waits before resuming a failed watch on the next server
+const WATCH_RETRY_INTERVAL = 500 * time.Millisecond
+
+// How long a caching BlockStore waits on its upstream BlockStore
+const CACHE_UPSTREAM_TIMEOUT = time.Minute
+
+// How long a BlockStore keeps an unreferenced block after it was last
+// stored or asked about, so uploads not yet committed are not collected
+const GC_GRACE_PERIOD = time.Hour
+
+// How long a BlockStore remembers deleting a block, so that anti-entropy
+// deletes the copies of replicas that missed the delete instead of
+// copying the block back
+const BLOCK_TOMBSTONE_LIFETIME = 24 * time.Hour
+
+// How long a BlockStore serves peers the same Merkle tree while its blocks
+// do not change, so one anti-entropy exchange walks the storage once
+const MERKLE_TREE_CACHE_TTL = 10 * time.Second
+
+// How long the metadata server waits on the BlockStore while collecting garbage
+const GC_RPC_TIMEOUT = time.Minute
+
+// Points each BlockStore server gets on the consistent-hash ring, so that
+// blocks spread evenly even across a few servers
+const RING_VIRTUAL_NODES int = 64
+
+// How often the metadata server checks that every block is on all its replicas by default
+const REPAIR_INTERVAL = 10 * time.Minute
+
+// How often the metadata server tries to finish a rebalance by default
+const REBALANCE_INTERVAL = 30 * time.Second
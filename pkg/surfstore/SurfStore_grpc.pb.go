@@ -22,6 +22,19 @@ type BlockStoreClient interface {
 	GetBlock(ctx context.Context, in *BlockHash, opts ...grpc.CallOption) (*Block, error)
 	PutBlock(ctx context.Context, in *Block, opts ...grpc.CallOption) (*Success, error)
 	HasBlocks(ctx context.Context, in *BlockHashes, opts ...grpc.CallOption) (*BlockHashes, error)
+	// garbage collection
+	ListBlocks(ctx context.Context, in *emptypb.Empty, opts ...grpc.CallOption) (*BlockHashes, error)
+	DeleteBlocks(ctx context.Context, in *BlockHashes, opts ...grpc.CallOption) (*BlockHashes, error)
+	// replication
+	ReplicateBlock(ctx context.Context, in *Block, opts ...grpc.CallOption) (*Success, error)
+	DeleteReplicatedBlocks(ctx context.Context, in *BlockHashes, opts ...grpc.CallOption) (*BlockHashes, error)
+	// anti-entropy
+	GetMerkleHashes(ctx context.Context, in *MerkleNodes, opts ...grpc.CallOption) (*MerkleHashes, error)
+	GetMerkleBuckets(ctx context.Context, in *MerkleNodes, opts ...grpc.CallOption) (*MerkleBuckets, error)
+	// testing interface
+	IsCrashed(ctx context.Context, in *emptypb.Empty, opts ...grpc.CallOption) (*CrashedState, error)
+	Restore(ctx context.Context, in *emptypb.Empty, opts ...grpc.CallOption) (*Success, error)
+	Crash(ctx context.Context, in *emptypb.Empty, opts ...grpc.CallOption) (*Success, error)
 }
 
 type blockStoreClient struct {
@@ -59,6 +72,87 @@ func (c *blockStoreClient) HasBlocks(ctx context.Context, in *BlockHashes, opts
 	return out, nil
 }
 
+func (c *blockStoreClient) ListBlocks(ctx context.Context, in *emptypb.Empty, opts ...grpc.CallOption) (*BlockHashes, error) {
+	out := new(BlockHashes)
+	err := c.cc.Invoke(ctx, "/surfstore.BlockStore/ListBlocks", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *blockStoreClient) DeleteBlocks(ctx context.Context, in *BlockHashes, opts ...grpc.CallOption) (*BlockHashes, error) {
+	out := new(BlockHashes)
+	err := c.cc.Invoke(ctx, "/surfstore.BlockStore/DeleteBlocks", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *blockStoreClient) ReplicateBlock(ctx context.Context, in *Block, opts ...grpc.CallOption) (*Success, error) {
+	out := new(Success)
+	err := c.cc.Invoke(ctx, "/surfstore.BlockStore/ReplicateBlock", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *blockStoreClient) DeleteReplicatedBlocks(ctx context.Context, in *BlockHashes, opts ...grpc.CallOption) (*BlockHashes, error) {
+	out := new(BlockHashes)
+	err := c.cc.Invoke(ctx, "/surfstore.BlockStore/DeleteReplicatedBlocks", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *blockStoreClient) GetMerkleHashes(ctx context.Context, in *MerkleNodes, opts ...grpc.CallOption) (*MerkleHashes, error) {
+	out := new(MerkleHashes)
+	err := c.cc.Invoke(ctx, "/surfstore.BlockStore/GetMerkleHashes", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *blockStoreClient) GetMerkleBuckets(ctx context.Context, in *MerkleNodes, opts ...grpc.CallOption) (*MerkleBuckets, error) {
+	out := new(MerkleBuckets)
+	err := c.cc.Invoke(ctx, "/surfstore.BlockStore/GetMerkleBuckets", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *blockStoreClient) IsCrashed(ctx context.Context, in *emptypb.Empty, opts ...grpc.CallOption) (*CrashedState, error) {
+	out := new(CrashedState)
+	err := c.cc.Invoke(ctx, "/surfstore.BlockStore/IsCrashed", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *blockStoreClient) Restore(ctx context.Context, in *emptypb.Empty, opts ...grpc.CallOption) (*Success, error) {
+	out := new(Success)
+	err := c.cc.Invoke(ctx, "/surfstore.BlockStore/Restore", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *blockStoreClient) Crash(ctx context.Context, in *emptypb.Empty, opts ...grpc.CallOption) (*Success, error) {
+	out := new(Success)
+	err := c.cc.Invoke(ctx, "/surfstore.BlockStore/Crash", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
 // BlockStoreServer is the server API for BlockStore service.
 // All implementations must embed UnimplementedBlockStoreServer
 // for forward compatibility
@@ -66,6 +160,19 @@ type BlockStoreServer interface {
 	GetBlock(context.Context, *BlockHash) (*Block, error)
 	PutBlock(context.Context, *Block) (*Success, error)
 	HasBlocks(context.Context, *BlockHashes) (*BlockHashes, error)
+	// garbage collection
+	ListBlocks(context.Context, *emptypb.Empty) (*BlockHashes, error)
+	DeleteBlocks(context.Context, *BlockHashes) (*BlockHashes, error)
+	// replication
+	ReplicateBlock(context.Context, *Block) (*Success, error)
+	DeleteReplicatedBlocks(context.Context, *BlockHashes) (*BlockHashes, error)
+	// anti-entropy
+	GetMerkleHashes(context.Context, *MerkleNodes) (*MerkleHashes, error)
+	GetMerkleBuckets(context.Context, *MerkleNodes) (*MerkleBuckets, error)
+	// testing interface
+	IsCrashed(context.Context, *emptypb.Empty) (*CrashedState, error)
+	Restore(context.Context, *emptypb.Empty) (*Success, error)
+	Crash(context.Context, *emptypb.Empty) (*Success, error)
 	mustEmbedUnimplementedBlockStoreServer()
 }
 
@@ -82,6 +189,33 @@ func (UnimplementedBlockStoreServer) PutBlock(context.Context, *Block) (*Success
 func (UnimplementedBlockStoreServer) HasBlocks(context.Context, *BlockHashes) (*BlockHashes, error) {
 	return nil, status.Errorf(codes.Unimplemented, "method HasBlocks not implemented")
 }
+func (UnimplementedBlockStoreServer) ListBlocks(context.Context, *emptypb.Empty) (*BlockHashes, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method ListBlocks not implemented")
+}
+func (UnimplementedBlockStoreServer) DeleteBlocks(context.Context, *BlockHashes) (*BlockHashes, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method DeleteBlocks not implemented")
+}
+func (UnimplementedBlockStoreServer) ReplicateBlock(context.Context, *Block) (*Success, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method ReplicateBlock not implemented")
+}
+func (UnimplementedBlockStoreServer) DeleteReplicatedBlocks(context.Context, *BlockHashes) (*BlockHashes, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method DeleteReplicatedBlocks not implemented")
+}
+func (UnimplementedBlockStoreServer) GetMerkleHashes(context.Context, *MerkleNodes) (*MerkleHashes, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method GetMerkleHashes not implemented")
+}
+func (UnimplementedBlockStoreServer) GetMerkleBuckets(context.Context, *MerkleNodes) (*MerkleBuckets, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method GetMerkleBuckets not implemented")
+}
+func (UnimplementedBlockStoreServer) IsCrashed(context.Context, *emptypb.Empty) (*CrashedState, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method IsCrashed not implemented")
+}
+func (UnimplementedBlockStoreServer) Restore(context.Context, *emptypb.Empty) (*Success, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method Restore not implemented")
+}
+func (UnimplementedBlockStoreServer) Crash(context.Context, *emptypb.Empty) (*Success, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method Crash not implemented")
+}
 func (UnimplementedBlockStoreServer) mustEmbedUnimplementedBlockStoreServer() {}
 
 // UnsafeBlockStoreServer may be embedded to opt out of forward compatibility for this service.
@@ -149,6 +283,168 @@ func _BlockStore_HasBlocks_Handler(srv interface{}, ctx context.Context, dec fun
 	return interceptor(ctx, in, info, handler)
 }
 
+func _BlockStore_ListBlocks_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(emptypb.Empty)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(BlockStoreServer).ListBlocks(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/surfstore.BlockStore/ListBlocks",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(BlockStoreServer).ListBlocks(ctx, req.(*emptypb.Empty))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _BlockStore_DeleteBlocks_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(BlockHashes)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(BlockStoreServer).DeleteBlocks(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/surfstore.BlockStore/DeleteBlocks",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(BlockStoreServer).DeleteBlocks(ctx, req.(*BlockHashes))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _BlockStore_ReplicateBlock_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(Block)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(BlockStoreServer).ReplicateBlock(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/surfstore.BlockStore/ReplicateBlock",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(BlockStoreServer).ReplicateBlock(ctx, req.(*Block))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _BlockStore_DeleteReplicatedBlocks_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(BlockHashes)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(BlockStoreServer).DeleteReplicatedBlocks(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/surfstore.BlockStore/DeleteReplicatedBlocks",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(BlockStoreServer).DeleteReplicatedBlocks(ctx, req.(*BlockHashes))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _BlockStore_GetMerkleHashes_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(MerkleNodes)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(BlockStoreServer).GetMerkleHashes(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/surfstore.BlockStore/GetMerkleHashes",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(BlockStoreServer).GetMerkleHashes(ctx, req.(*MerkleNodes))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _BlockStore_GetMerkleBuckets_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(MerkleNodes)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(BlockStoreServer).GetMerkleBuckets(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/surfstore.BlockStore/GetMerkleBuckets",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(BlockStoreServer).GetMerkleBuckets(ctx, req.(*MerkleNodes))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _BlockStore_IsCrashed_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(emptypb.Empty)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(BlockStoreServer).IsCrashed(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/surfstore.BlockStore/IsCrashed",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(BlockStoreServer).IsCrashed(ctx, req.(*emptypb.Empty))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _BlockStore_Restore_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(emptypb.Empty)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(BlockStoreServer).Restore(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/surfstore.BlockStore/Restore",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(BlockStoreServer).Restore(ctx, req.(*emptypb.Empty))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _BlockStore_Crash_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(emptypb.Empty)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(BlockStoreServer).Crash(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/surfstore.BlockStore/Crash",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(BlockStoreServer).Crash(ctx, req.(*emptypb.Empty))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
 // BlockStore_ServiceDesc is the grpc.ServiceDesc for BlockStore service.
 // It's only intended for direct use with grpc.RegisterService,
 // and not to be introspected or modified (even as a copy)
@@ -168,6 +464,42 @@ var BlockStore_ServiceDesc = grpc.ServiceDesc{
 			MethodName: "HasBlocks",
 			Handler:    _BlockStore_HasBlocks_Handler,
 		},
+		{
+			MethodName: "ListBlocks",
+			Handler:    _BlockStore_ListBlocks_Handler,
+		},
+		{
+			MethodName: "DeleteBlocks",
+			Handler:    _BlockStore_DeleteBlocks_Handler,
+		},
+		{
+			MethodName: "ReplicateBlock",
+			Handler:    _BlockStore_ReplicateBlock_Handler,
+		},
+		{
+			MethodName: "DeleteReplicatedBlocks",
+			Handler:    _BlockStore_DeleteReplicatedBlocks_Handler,
+		},
+		{
+			MethodName: "GetMerkleHashes",
+			Handler:    _BlockStore_GetMerkleHashes_Handler,
+		},
+		{
+			MethodName: "GetMerkleBuckets",
+			Handler:    _BlockStore_GetMerkleBuckets_Handler,
+		},
+		{
+			MethodName: "IsCrashed",
+			Handler:    _BlockStore_IsCrashed_Handler,
+		},
+		{
+			MethodName: "Restore",
+			Handler:    _BlockStore_Restore_Handler,
+		},
+		{
+			MethodName: "Crash",
+			Handler:    _BlockStore_Crash_Handler,
+		},
 	},
 	Streams:  []grpc.StreamDesc{},
 	Metadata: "pkg/surfstore/SurfStore.proto",
@@ -180,13 +512,30 @@ type MetaStoreClient interface {
 	GetFileInfoMap(ctx context.Context, in *emptypb.Empty, opts ...grpc.CallOption) (*FileInfoMap, error)
 	UpdateFile(ctx context.Context, in *FileMetaData, opts ...grpc.CallOption) (*Version, error)
 	GetBlockStoreAddr(ctx context.Context, in *emptypb.Empty, opts ...grpc.CallOption) (*BlockStoreAddr, error)
+	GetBlockStoreAddrs(ctx context.Context, in *emptypb.Empty, opts ...grpc.CallOption) (*BlockStoreAddrs, error)
+	GetFileHistory(ctx context.Context, in *FileName, opts ...grpc.CallOption) (*FileHistory, error)
+	RestoreFileVersion(ctx context.Context, in *FileVersion, opts ...grpc.CallOption) (*Version, error)
+	AckSync(ctx context.Context, in *SyncAck, opts ...grpc.CallOption) (*Success, error)
+	WatchFileInfo(ctx context.Context, in *WatchRequest, opts ...grpc.CallOption) (MetaStore_WatchFileInfoClient, error)
+	GetChangesSince(ctx context.Context, in *Revision, opts ...grpc.CallOption) (*FileInfoDelta, error)
+	GetFileInfoMapAt(ctx context.Context, in *SnapshotRequest, opts ...grpc.CallOption) (*FileInfoMap, error)
+	GetBlockReferences(ctx context.Context, in *BlockHash, opts ...grpc.CallOption) (*BlockReferences, error)
+	GetRepairReport(ctx context.Context, in *emptypb.Empty, opts ...grpc.CallOption) (*RepairReport, error)
+	GetStoragePolicies(ctx context.Context, in *emptypb.Empty, opts ...grpc.CallOption) (*StoragePolicies, error)
+	SetBlockStoreAddrs(ctx context.Context, in *BlockStoreAddrs, opts ...grpc.CallOption) (*RebalanceStatus, error)
+	GetRebalanceStatus(ctx context.Context, in *emptypb.Empty, opts ...grpc.CallOption) (*RebalanceStatus, error)
+	RegisterBlockStore(ctx context.Context, in *BlockStoreAddr, opts ...grpc.CallOption) (*BlockStoreStatus, error)
+	BlockStoreHeartbeat(ctx context.Context, in *BlockStoreAddr, opts ...grpc.CallOption) (*BlockStoreStatus, error)
+	DrainBlockStore(ctx context.Context, in *BlockStoreAddr, opts ...grpc.CallOption) (*BlockStoreStatus, error)
+	DecommissionBlockStore(ctx context.Context, in *BlockStoreAddr, opts ...grpc.CallOption) (*BlockStoreStatus, error)
+	GetBlockStoreStatuses(ctx context.Context, in *emptypb.Empty, opts ...grpc.CallOption) (*BlockStoreStatuses, error)
 }
 
 type metaStoreClient struct {
 	cc grpc.ClientConnInterface
 }
 
-func NewRaftSurfstoreClient(cc grpc.ClientConnInterface) MetaStoreClient {
+func NewMetaStoreClient(cc grpc.ClientConnInterface) MetaStoreClient {
 	return &metaStoreClient{cc}
 }
 
@@ -217,116 +566,1795 @@ func (c *metaStoreClient) GetBlockStoreAddr(ctx context.Context, in *emptypb.Emp
 	return out, nil
 }
 
-// MetaStoreServer is the server API for MetaStore service.
-// All implementations must embed UnimplementedMetaStoreServer
-// for forward compatibility
-type MetaStoreServer interface {
-	GetFileInfoMap(context.Context, *emptypb.Empty) (*FileInfoMap, error)
-	UpdateFile(context.Context, *FileMetaData) (*Version, error)
-	GetBlockStoreAddr(context.Context, *emptypb.Empty) (*BlockStoreAddr, error)
-	mustEmbedUnimplementedMetaStoreServer()
+func (c *metaStoreClient) GetBlockStoreAddrs(ctx context.Context, in *emptypb.Empty, opts ...grpc.CallOption) (*BlockStoreAddrs, error) {
+	out := new(BlockStoreAddrs)
+	err := c.cc.Invoke(ctx, "/surfstore.MetaStore/GetBlockStoreAddrs", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
 }
 
-// UnimplementedMetaStoreServer must be embedded to have forward compatible implementations.
-type UnimplementedMetaStoreServer struct {
+func (c *metaStoreClient) GetFileHistory(ctx context.Context, in *FileName, opts ...grpc.CallOption) (*FileHistory, error) {
+	out := new(FileHistory)
+	err := c.cc.Invoke(ctx, "/surfstore.MetaStore/GetFileHistory", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
 }
 
-func (UnimplementedMetaStoreServer) GetFileInfoMap(context.Context, *emptypb.Empty) (*FileInfoMap, error) {
-	return nil, status.Errorf(codes.Unimplemented, "method GetFileInfoMap not implemented")
-}
-func (UnimplementedMetaStoreServer) UpdateFile(context.Context, *FileMetaData) (*Version, error) {
-	return nil, status.Errorf(codes.Unimplemented, "method UpdateFile not implemented")
-}
-func (UnimplementedMetaStoreServer) GetBlockStoreAddr(context.Context, *emptypb.Empty) (*BlockStoreAddr, error) {
-	return nil, status.Errorf(codes.Unimplemented, "method GetBlockStoreAddr not implemented")
+func (c *metaStoreClient) RestoreFileVersion(ctx context.Context, in *FileVersion, opts ...grpc.CallOption) (*Version, error) {
+	out := new(Version)
+	err := c.cc.Invoke(ctx, "/surfstore.MetaStore/RestoreFileVersion", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
 }
-func (UnimplementedMetaStoreServer) mustEmbedUnimplementedMetaStoreServer() {}
 
-// UnsafeMetaStoreServer may be embedded to opt out of forward compatibility for this service.
-// Use of this interface is not recommended, as added methods to MetaStoreServer will
-// result in compilation errors.
-type UnsafeMetaStoreServer interface {
-	mustEmbedUnimplementedMetaStoreServer()
+func (c *metaStoreClient) AckSync(ctx context.Context, in *SyncAck, opts ...grpc.CallOption) (*Success, error) {
+	out := new(Success)
+	err := c.cc.Invoke(ctx, "/surfstore.MetaStore/AckSync", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
 }
 
-func RegisterMetaStoreServer(s grpc.ServiceRegistrar, srv MetaStoreServer) {
-	s.RegisterService(&MetaStore_ServiceDesc, srv)
-}
+func (c *metaStoreClient) WatchFileInfo(ctx context.Context, in *WatchRequest, opts ...grpc.CallOption) (MetaStore_WatchFileInfoClient, error) {
+	stream, err := c.cc.NewStream(ctx, &MetaStore_ServiceDesc.Streams[0], "/surfstore.MetaStore/WatchFileInfo", opts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &metaStoreWatchFileInfoClient{stream}
+	if err := x.ClientStream.SendMsg(in); err != nil {
+		return nil, err
+	}
+	if err := x.ClientStream.CloseSend(); err != nil {
+		return nil, err
+	}
+	return x, nil
+}
+
+type MetaStore_WatchFileInfoClient interface {
+	Recv() (*FileChange, error)
+	grpc.ClientStream
+}
+
+type metaStoreWatchFileInfoClient struct {
+	grpc.ClientStream
+}
+
+func (x *metaStoreWatchFileInfoClient) Recv() (*FileChange, error) {
+	m := new(FileChange)
+	if err := x.ClientStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func (c *metaStoreClient) GetChangesSince(ctx context.Context, in *Revision, opts ...grpc.CallOption) (*FileInfoDelta, error) {
+	out := new(FileInfoDelta)
+	err := c.cc.Invoke(ctx, "/surfstore.MetaStore/GetChangesSince", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *metaStoreClient) GetFileInfoMapAt(ctx context.Context, in *SnapshotRequest, opts ...grpc.CallOption) (*FileInfoMap, error) {
+	out := new(FileInfoMap)
+	err := c.cc.Invoke(ctx, "/surfstore.MetaStore/GetFileInfoMapAt", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *metaStoreClient) GetBlockReferences(ctx context.Context, in *BlockHash, opts ...grpc.CallOption) (*BlockReferences, error) {
+	out := new(BlockReferences)
+	err := c.cc.Invoke(ctx, "/surfstore.MetaStore/GetBlockReferences", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *metaStoreClient) GetRepairReport(ctx context.Context, in *emptypb.Empty, opts ...grpc.CallOption) (*RepairReport, error) {
+	out := new(RepairReport)
+	err := c.cc.Invoke(ctx, "/surfstore.MetaStore/GetRepairReport", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *metaStoreClient) GetStoragePolicies(ctx context.Context, in *emptypb.Empty, opts ...grpc.CallOption) (*StoragePolicies, error) {
+	out := new(StoragePolicies)
+	err := c.cc.Invoke(ctx, "/surfstore.MetaStore/GetStoragePolicies", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *metaStoreClient) SetBlockStoreAddrs(ctx context.Context, in *BlockStoreAddrs, opts ...grpc.CallOption) (*RebalanceStatus, error) {
+	out := new(RebalanceStatus)
+	err := c.cc.Invoke(ctx, "/surfstore.MetaStore/SetBlockStoreAddrs", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *metaStoreClient) GetRebalanceStatus(ctx context.Context, in *emptypb.Empty, opts ...grpc.CallOption) (*RebalanceStatus, error) {
+	out := new(RebalanceStatus)
+	err := c.cc.Invoke(ctx, "/surfstore.MetaStore/GetRebalanceStatus", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *metaStoreClient) RegisterBlockStore(ctx context.Context, in *BlockStoreAddr, opts ...grpc.CallOption) (*BlockStoreStatus, error) {
+	out := new(BlockStoreStatus)
+	err := c.cc.Invoke(ctx, "/surfstore.MetaStore/RegisterBlockStore", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *metaStoreClient) BlockStoreHeartbeat(ctx context.Context, in *BlockStoreAddr, opts ...grpc.CallOption) (*BlockStoreStatus, error) {
+	out := new(BlockStoreStatus)
+	err := c.cc.Invoke(ctx, "/surfstore.MetaStore/BlockStoreHeartbeat", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *metaStoreClient) DrainBlockStore(ctx context.Context, in *BlockStoreAddr, opts ...grpc.CallOption) (*BlockStoreStatus, error) {
+	out := new(BlockStoreStatus)
+	err := c.cc.Invoke(ctx, "/surfstore.MetaStore/DrainBlockStore", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *metaStoreClient) DecommissionBlockStore(ctx context.Context, in *BlockStoreAddr, opts ...grpc.CallOption) (*BlockStoreStatus, error) {
+	out := new(BlockStoreStatus)
+	err := c.cc.Invoke(ctx, "/surfstore.MetaStore/DecommissionBlockStore", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *metaStoreClient) GetBlockStoreStatuses(ctx context.Context, in *emptypb.Empty, opts ...grpc.CallOption) (*BlockStoreStatuses, error) {
+	out := new(BlockStoreStatuses)
+	err := c.cc.Invoke(ctx, "/surfstore.MetaStore/GetBlockStoreStatuses", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// MetaStoreServer is the server API for MetaStore service.
+// All implementations must embed UnimplementedMetaStoreServer
+// for forward compatibility
+type MetaStoreServer interface {
+	GetFileInfoMap(context.Context, *emptypb.Empty) (*FileInfoMap, error)
+	UpdateFile(context.Context, *FileMetaData) (*Version, error)
+	GetBlockStoreAddr(context.Context, *emptypb.Empty) (*BlockStoreAddr, error)
+	GetBlockStoreAddrs(context.Context, *emptypb.Empty) (*BlockStoreAddrs, error)
+	GetFileHistory(context.Context, *FileName) (*FileHistory, error)
+	RestoreFileVersion(context.Context, *FileVersion) (*Version, error)
+	AckSync(context.Context, *SyncAck) (*Success, error)
+	WatchFileInfo(*WatchRequest, MetaStore_WatchFileInfoServer) error
+	GetChangesSince(context.Context, *Revision) (*FileInfoDelta, error)
+	GetFileInfoMapAt(context.Context, *SnapshotRequest) (*FileInfoMap, error)
+	GetBlockReferences(context.Context, *BlockHash) (*BlockReferences, error)
+	GetRepairReport(context.Context, *emptypb.Empty) (*RepairReport, error)
+	GetStoragePolicies(context.Context, *emptypb.Empty) (*StoragePolicies, error)
+	SetBlockStoreAddrs(context.Context, *BlockStoreAddrs) (*RebalanceStatus, error)
+	GetRebalanceStatus(context.Context, *emptypb.Empty) (*RebalanceStatus, error)
+	RegisterBlockStore(context.Context, *BlockStoreAddr) (*BlockStoreStatus, error)
+	BlockStoreHeartbeat(context.Context, *BlockStoreAddr) (*BlockStoreStatus, error)
+	DrainBlockStore(context.Context, *BlockStoreAddr) (*BlockStoreStatus, error)
+	DecommissionBlockStore(context.Context, *BlockStoreAddr) (*BlockStoreStatus, error)
+	GetBlockStoreStatuses(context.Context, *emptypb.Empty) (*BlockStoreStatuses, error)
+	mustEmbedUnimplementedMetaStoreServer()
+}
+
+// UnimplementedMetaStoreServer must be embedded to have forward compatible implementations.
+type UnimplementedMetaStoreServer struct {
+}
+
+func (UnimplementedMetaStoreServer) GetFileInfoMap(context.Context, *emptypb.Empty) (*FileInfoMap, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method GetFileInfoMap not implemented")
+}
+func (UnimplementedMetaStoreServer) UpdateFile(context.Context, *FileMetaData) (*Version, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method UpdateFile not implemented")
+}
+func (UnimplementedMetaStoreServer) GetBlockStoreAddr(context.Context, *emptypb.Empty) (*BlockStoreAddr, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method GetBlockStoreAddr not implemented")
+}
+func (UnimplementedMetaStoreServer) GetBlockStoreAddrs(context.Context, *emptypb.Empty) (*BlockStoreAddrs, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method GetBlockStoreAddrs not implemented")
+}
+func (UnimplementedMetaStoreServer) GetFileHistory(context.Context, *FileName) (*FileHistory, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method GetFileHistory not implemented")
+}
+func (UnimplementedMetaStoreServer) RestoreFileVersion(context.Context, *FileVersion) (*Version, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method RestoreFileVersion not implemented")
+}
+func (UnimplementedMetaStoreServer) AckSync(context.Context, *SyncAck) (*Success, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method AckSync not implemented")
+}
+func (UnimplementedMetaStoreServer) WatchFileInfo(*WatchRequest, MetaStore_WatchFileInfoServer) error {
+	return status.Errorf(codes.Unimplemented, "method WatchFileInfo not implemented")
+}
+func (UnimplementedMetaStoreServer) GetChangesSince(context.Context, *Revision) (*FileInfoDelta, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method GetChangesSince not implemented")
+}
+func (UnimplementedMetaStoreServer) GetFileInfoMapAt(context.Context, *SnapshotRequest) (*FileInfoMap, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method GetFileInfoMapAt not implemented")
+}
+func (UnimplementedMetaStoreServer) GetBlockReferences(context.Context, *BlockHash) (*BlockReferences, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method GetBlockReferences not implemented")
+}
+func (UnimplementedMetaStoreServer) GetRepairReport(context.Context, *emptypb.Empty) (*RepairReport, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method GetRepairReport not implemented")
+}
+func (UnimplementedMetaStoreServer) GetStoragePolicies(context.Context, *emptypb.Empty) (*StoragePolicies, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method GetStoragePolicies not implemented")
+}
+func (UnimplementedMetaStoreServer) SetBlockStoreAddrs(context.Context, *BlockStoreAddrs) (*RebalanceStatus, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method SetBlockStoreAddrs not implemented")
+}
+func (UnimplementedMetaStoreServer) GetRebalanceStatus(context.Context, *emptypb.Empty) (*RebalanceStatus, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method GetRebalanceStatus not implemented")
+}
+func (UnimplementedMetaStoreServer) RegisterBlockStore(context.Context, *BlockStoreAddr) (*BlockStoreStatus, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method RegisterBlockStore not implemented")
+}
+func (UnimplementedMetaStoreServer) BlockStoreHeartbeat(context.Context, *BlockStoreAddr) (*BlockStoreStatus, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method BlockStoreHeartbeat not implemented")
+}
+func (UnimplementedMetaStoreServer) DrainBlockStore(context.Context, *BlockStoreAddr) (*BlockStoreStatus, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method DrainBlockStore not implemented")
+}
+func (UnimplementedMetaStoreServer) DecommissionBlockStore(context.Context, *BlockStoreAddr) (*BlockStoreStatus, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method DecommissionBlockStore not implemented")
+}
+func (UnimplementedMetaStoreServer) GetBlockStoreStatuses(context.Context, *emptypb.Empty) (*BlockStoreStatuses, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method GetBlockStoreStatuses not implemented")
+}
+func (UnimplementedMetaStoreServer) mustEmbedUnimplementedMetaStoreServer() {}
+
+// UnsafeMetaStoreServer may be embedded to opt out of forward compatibility for this service.
+// Use of this interface is not recommended, as added methods to MetaStoreServer will
+// result in compilation errors.
+type UnsafeMetaStoreServer interface {
+	mustEmbedUnimplementedMetaStoreServer()
+}
+
+func RegisterMetaStoreServer(s grpc.ServiceRegistrar, srv MetaStoreServer) {
+	s.RegisterService(&MetaStore_ServiceDesc, srv)
+}
+
+func _MetaStore_GetFileInfoMap_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(emptypb.Empty)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(MetaStoreServer).GetFileInfoMap(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/surfstore.MetaStore/GetFileInfoMap",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(MetaStoreServer).GetFileInfoMap(ctx, req.(*emptypb.Empty))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _MetaStore_UpdateFile_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(FileMetaData)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(MetaStoreServer).UpdateFile(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/surfstore.MetaStore/UpdateFile",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(MetaStoreServer).UpdateFile(ctx, req.(*FileMetaData))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _MetaStore_GetBlockStoreAddr_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(emptypb.Empty)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(MetaStoreServer).GetBlockStoreAddr(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/surfstore.MetaStore/GetBlockStoreAddr",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(MetaStoreServer).GetBlockStoreAddr(ctx, req.(*emptypb.Empty))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _MetaStore_GetBlockStoreAddrs_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(emptypb.Empty)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(MetaStoreServer).GetBlockStoreAddrs(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/surfstore.MetaStore/GetBlockStoreAddrs",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(MetaStoreServer).GetBlockStoreAddrs(ctx, req.(*emptypb.Empty))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _MetaStore_GetFileHistory_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(FileName)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(MetaStoreServer).GetFileHistory(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/surfstore.MetaStore/GetFileHistory",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(MetaStoreServer).GetFileHistory(ctx, req.(*FileName))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _MetaStore_RestoreFileVersion_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(FileVersion)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(MetaStoreServer).RestoreFileVersion(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/surfstore.MetaStore/RestoreFileVersion",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(MetaStoreServer).RestoreFileVersion(ctx, req.(*FileVersion))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _MetaStore_AckSync_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(SyncAck)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(MetaStoreServer).AckSync(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/surfstore.MetaStore/AckSync",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(MetaStoreServer).AckSync(ctx, req.(*SyncAck))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _MetaStore_WatchFileInfo_Handler(srv interface{}, stream grpc.ServerStream) error {
+	m := new(WatchRequest)
+	if err := stream.RecvMsg(m); err != nil {
+		return err
+	}
+	return srv.(MetaStoreServer).WatchFileInfo(m, &metaStoreWatchFileInfoServer{stream})
+}
+
+type MetaStore_WatchFileInfoServer interface {
+	Send(*FileChange) error
+	grpc.ServerStream
+}
+
+type metaStoreWatchFileInfoServer struct {
+	grpc.ServerStream
+}
+
+func (x *metaStoreWatchFileInfoServer) Send(m *FileChange) error {
+	return x.ServerStream.SendMsg(m)
+}
+
+func _MetaStore_GetChangesSince_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(Revision)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(MetaStoreServer).GetChangesSince(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/surfstore.MetaStore/GetChangesSince",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(MetaStoreServer).GetChangesSince(ctx, req.(*Revision))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _MetaStore_GetFileInfoMapAt_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(SnapshotRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(MetaStoreServer).GetFileInfoMapAt(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/surfstore.MetaStore/GetFileInfoMapAt",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(MetaStoreServer).GetFileInfoMapAt(ctx, req.(*SnapshotRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _MetaStore_GetBlockReferences_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(BlockHash)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(MetaStoreServer).GetBlockReferences(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/surfstore.MetaStore/GetBlockReferences",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(MetaStoreServer).GetBlockReferences(ctx, req.(*BlockHash))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _MetaStore_GetRepairReport_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(emptypb.Empty)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(MetaStoreServer).GetRepairReport(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/surfstore.MetaStore/GetRepairReport",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(MetaStoreServer).GetRepairReport(ctx, req.(*emptypb.Empty))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _MetaStore_GetStoragePolicies_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(emptypb.Empty)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(MetaStoreServer).GetStoragePolicies(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/surfstore.MetaStore/GetStoragePolicies",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(MetaStoreServer).GetStoragePolicies(ctx, req.(*emptypb.Empty))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _MetaStore_SetBlockStoreAddrs_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(BlockStoreAddrs)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(MetaStoreServer).SetBlockStoreAddrs(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/surfstore.MetaStore/SetBlockStoreAddrs",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(MetaStoreServer).SetBlockStoreAddrs(ctx, req.(*BlockStoreAddrs))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _MetaStore_GetRebalanceStatus_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(emptypb.Empty)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(MetaStoreServer).GetRebalanceStatus(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/surfstore.MetaStore/GetRebalanceStatus",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(MetaStoreServer).GetRebalanceStatus(ctx, req.(*emptypb.Empty))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _MetaStore_RegisterBlockStore_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(BlockStoreAddr)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(MetaStoreServer).RegisterBlockStore(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/surfstore.MetaStore/RegisterBlockStore",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(MetaStoreServer).RegisterBlockStore(ctx, req.(*BlockStoreAddr))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _MetaStore_BlockStoreHeartbeat_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(BlockStoreAddr)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(MetaStoreServer).BlockStoreHeartbeat(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/surfstore.MetaStore/BlockStoreHeartbeat",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(MetaStoreServer).BlockStoreHeartbeat(ctx, req.(*BlockStoreAddr))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _MetaStore_DrainBlockStore_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(BlockStoreAddr)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(MetaStoreServer).DrainBlockStore(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/surfstore.MetaStore/DrainBlockStore",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(MetaStoreServer).DrainBlockStore(ctx, req.(*BlockStoreAddr))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _MetaStore_DecommissionBlockStore_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(BlockStoreAddr)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(MetaStoreServer).DecommissionBlockStore(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/surfstore.MetaStore/DecommissionBlockStore",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(MetaStoreServer).DecommissionBlockStore(ctx, req.(*BlockStoreAddr))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _MetaStore_GetBlockStoreStatuses_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(emptypb.Empty)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(MetaStoreServer).GetBlockStoreStatuses(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/surfstore.MetaStore/GetBlockStoreStatuses",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(MetaStoreServer).GetBlockStoreStatuses(ctx, req.(*emptypb.Empty))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+// MetaStore_ServiceDesc is the grpc.ServiceDesc for MetaStore service.
+// It's only intended for direct use with grpc.RegisterService,
+// and not to be introspected or modified (even as a copy)
+var MetaStore_ServiceDesc = grpc.ServiceDesc{
+	ServiceName: "surfstore.MetaStore",
+	HandlerType: (*MetaStoreServer)(nil),
+	Methods: []grpc.MethodDesc{
+		{
+			MethodName: "GetFileInfoMap",
+			Handler:    _MetaStore_GetFileInfoMap_Handler,
+		},
+		{
+			MethodName: "UpdateFile",
+			Handler:    _MetaStore_UpdateFile_Handler,
+		},
+		{
+			MethodName: "GetBlockStoreAddr",
+			Handler:    _MetaStore_GetBlockStoreAddr_Handler,
+		},
+		{
+			MethodName: "GetBlockStoreAddrs",
+			Handler:    _MetaStore_GetBlockStoreAddrs_Handler,
+		},
+		{
+			MethodName: "GetFileHistory",
+			Handler:    _MetaStore_GetFileHistory_Handler,
+		},
+		{
+			MethodName: "RestoreFileVersion",
+			Handler:    _MetaStore_RestoreFileVersion_Handler,
+		},
+		{
+			MethodName: "AckSync",
+			Handler:    _MetaStore_AckSync_Handler,
+		},
+		{
+			MethodName: "GetChangesSince",
+			Handler:    _MetaStore_GetChangesSince_Handler,
+		},
+		{
+			MethodName: "GetFileInfoMapAt",
+			Handler:    _MetaStore_GetFileInfoMapAt_Handler,
+		},
+		{
+			MethodName: "GetBlockReferences",
+			Handler:    _MetaStore_GetBlockReferences_Handler,
+		},
+		{
+			MethodName: "GetRepairReport",
+			Handler:    _MetaStore_GetRepairReport_Handler,
+		},
+		{
+			MethodName: "GetStoragePolicies",
+			Handler:    _MetaStore_GetStoragePolicies_Handler,
+		},
+		{
+			MethodName: "SetBlockStoreAddrs",
+			Handler:    _MetaStore_SetBlockStoreAddrs_Handler,
+		},
+		{
+			MethodName: "GetRebalanceStatus",
+			Handler:    _MetaStore_GetRebalanceStatus_Handler,
+		},
+		{
+			MethodName: "RegisterBlockStore",
+			Handler:    _MetaStore_RegisterBlockStore_Handler,
+		},
+		{
+			MethodName: "BlockStoreHeartbeat",
+			Handler:    _MetaStore_BlockStoreHeartbeat_Handler,
+		},
+		{
+			MethodName: "DrainBlockStore",
+			Handler:    _MetaStore_DrainBlockStore_Handler,
+		},
+		{
+			MethodName: "DecommissionBlockStore",
+			Handler:    _MetaStore_DecommissionBlockStore_Handler,
+		},
+		{
+			MethodName: "GetBlockStoreStatuses",
+			Handler:    _MetaStore_GetBlockStoreStatuses_Handler,
+		},
+	},
+	Streams: []grpc.StreamDesc{
+		{
+			StreamName:    "WatchFileInfo",
+			Handler:       _MetaStore_WatchFileInfo_Handler,
+			ServerStreams: true,
+		},
+	},
+	Metadata: "pkg/surfstore/SurfStore.proto",
+}
+
+// RaftSurfstoreClient is the client API for RaftSurfstore service.
+//
+// For semantics around ctx use and closing/ending streaming RPCs, please refer to https://pkg.go.dev/google.golang.org/grpc/?tab=doc#ClientConn.NewStream.
+type RaftSurfstoreClient interface {
+	// raft
+	AppendEntries(ctx context.Context, in *AppendEntryInput, opts ...grpc.CallOption) (*AppendEntryOutput, error)
+	SetLeader(ctx context.Context, in *emptypb.Empty, opts ...grpc.CallOption) (*Success, error)
+	SendHeartbeat(ctx context.Context, in *emptypb.Empty, opts ...grpc.CallOption) (*Success, error)
+	// metastore
+	GetFileInfoMap(ctx context.Context, in *emptypb.Empty, opts ...grpc.CallOption) (*FileInfoMap, error)
+	UpdateFile(ctx context.Context, in *FileMetaData, opts ...grpc.CallOption) (*Version, error)
+	GetBlockStoreAddr(ctx context.Context, in *emptypb.Empty, opts ...grpc.CallOption) (*BlockStoreAddr, error)
+	GetBlockStoreAddrs(ctx context.Context, in *emptypb.Empty, opts ...grpc.CallOption) (*BlockStoreAddrs, error)
+	GetFileHistory(ctx context.Context, in *FileName, opts ...grpc.CallOption) (*FileHistory, error)
+	RestoreFileVersion(ctx context.Context, in *FileVersion, opts ...grpc.CallOption) (*Version, error)
+	AckSync(ctx context.Context, in *SyncAck, opts ...grpc.CallOption) (*Success, error)
+	WatchFileInfo(ctx context.Context, in *WatchRequest, opts ...grpc.CallOption) (RaftSurfstore_WatchFileInfoClient, error)
+	GetChangesSince(ctx context.Context, in *Revision, opts ...grpc.CallOption) (*FileInfoDelta, error)
+	GetFileInfoMapAt(ctx context.Context, in *SnapshotRequest, opts ...grpc.CallOption) (*FileInfoMap, error)
+	GetBlockReferences(ctx context.Context, in *BlockHash, opts ...grpc.CallOption) (*BlockReferences, error)
+	GetRepairReport(ctx context.Context, in *emptypb.Empty, opts ...grpc.CallOption) (*RepairReport, error)
+	GetStoragePolicies(ctx context.Context, in *emptypb.Empty, opts ...grpc.CallOption) (*StoragePolicies, error)
+	SetBlockStoreAddrs(ctx context.Context, in *BlockStoreAddrs, opts ...grpc.CallOption) (*RebalanceStatus, error)
+	GetRebalanceStatus(ctx context.Context, in *emptypb.Empty, opts ...grpc.CallOption) (*RebalanceStatus, error)
+	RegisterBlockStore(ctx context.Context, in *BlockStoreAddr, opts ...grpc.CallOption) (*BlockStoreStatus, error)
+	BlockStoreHeartbeat(ctx context.Context, in *BlockStoreAddr, opts ...grpc.CallOption) (*BlockStoreStatus, error)
+	DrainBlockStore(ctx context.Context, in *BlockStoreAddr, opts ...grpc.CallOption) (*BlockStoreStatus, error)
+	DecommissionBlockStore(ctx context.Context, in *BlockStoreAddr, opts ...grpc.CallOption) (*BlockStoreStatus, error)
+	GetBlockStoreStatuses(ctx context.Context, in *emptypb.Empty, opts ...grpc.CallOption) (*BlockStoreStatuses, error)
+	// testing interface
+	GetInternalState(ctx context.Context, in *emptypb.Empty, opts ...grpc.CallOption) (*RaftInternalState, error)
+	IsCrashed(ctx context.Context, in *emptypb.Empty, opts ...grpc.CallOption) (*CrashedState, error)
+	Restore(ctx context.Context, in *emptypb.Empty, opts ...grpc.CallOption) (*Success, error)
+	Crash(ctx context.Context, in *emptypb.Empty, opts ...grpc.CallOption) (*Success, error)
+}
+
+type raftSurfstoreClient struct {
+	cc grpc.ClientConnInterface
+}
+
+func NewRaftSurfstoreClient(cc grpc.ClientConnInterface) RaftSurfstoreClient {
+	return &raftSurfstoreClient{cc}
+}
+
+func (c *raftSurfstoreClient) AppendEntries(ctx context.Context, in *AppendEntryInput, opts ...grpc.CallOption) (*AppendEntryOutput, error) {
+	out := new(AppendEntryOutput)
+	err := c.cc.Invoke(ctx, "/surfstore.RaftSurfstore/AppendEntries", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *raftSurfstoreClient) SetLeader(ctx context.Context, in *emptypb.Empty, opts ...grpc.CallOption) (*Success, error) {
+	out := new(Success)
+	err := c.cc.Invoke(ctx, "/surfstore.RaftSurfstore/SetLeader", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *raftSurfstoreClient) SendHeartbeat(ctx context.Context, in *emptypb.Empty, opts ...grpc.CallOption) (*Success, error) {
+	out := new(Success)
+	err := c.cc.Invoke(ctx, "/surfstore.RaftSurfstore/SendHeartbeat", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *raftSurfstoreClient) GetFileInfoMap(ctx context.Context, in *emptypb.Empty, opts ...grpc.CallOption) (*FileInfoMap, error) {
+	out := new(FileInfoMap)
+	err := c.cc.Invoke(ctx, "/surfstore.RaftSurfstore/GetFileInfoMap", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *raftSurfstoreClient) UpdateFile(ctx context.Context, in *FileMetaData, opts ...grpc.CallOption) (*Version, error) {
+	out := new(Version)
+	err := c.cc.Invoke(ctx, "/surfstore.RaftSurfstore/UpdateFile", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *raftSurfstoreClient) GetBlockStoreAddr(ctx context.Context, in *emptypb.Empty, opts ...grpc.CallOption) (*BlockStoreAddr, error) {
+	out := new(BlockStoreAddr)
+	err := c.cc.Invoke(ctx, "/surfstore.RaftSurfstore/GetBlockStoreAddr", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *raftSurfstoreClient) GetBlockStoreAddrs(ctx context.Context, in *emptypb.Empty, opts ...grpc.CallOption) (*BlockStoreAddrs, error) {
+	out := new(BlockStoreAddrs)
+	err := c.cc.Invoke(ctx, "/surfstore.RaftSurfstore/GetBlockStoreAddrs", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *raftSurfstoreClient) GetFileHistory(ctx context.Context, in *FileName, opts ...grpc.CallOption) (*FileHistory, error) {
+	out := new(FileHistory)
+	err := c.cc.Invoke(ctx, "/surfstore.RaftSurfstore/GetFileHistory", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *raftSurfstoreClient) RestoreFileVersion(ctx context.Context, in *FileVersion, opts ...grpc.CallOption) (*Version, error) {
+	out := new(Version)
+	err := c.cc.Invoke(ctx, "/surfstore.RaftSurfstore/RestoreFileVersion", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *raftSurfstoreClient) AckSync(ctx context.Context, in *SyncAck, opts ...grpc.CallOption) (*Success, error) {
+	out := new(Success)
+	err := c.cc.Invoke(ctx, "/surfstore.RaftSurfstore/AckSync", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *raftSurfstoreClient) WatchFileInfo(ctx context.Context, in *WatchRequest, opts ...grpc.CallOption) (RaftSurfstore_WatchFileInfoClient, error) {
+	stream, err := c.cc.NewStream(ctx, &RaftSurfstore_ServiceDesc.Streams[0], "/surfstore.RaftSurfstore/WatchFileInfo", opts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &raftSurfstoreWatchFileInfoClient{stream}
+	if err := x.ClientStream.SendMsg(in); err != nil {
+		return nil, err
+	}
+	if err := x.ClientStream.CloseSend(); err != nil {
+		return nil, err
+	}
+	return x, nil
+}
+
+type RaftSurfstore_WatchFileInfoClient interface {
+	Recv() (*FileChange, error)
+	grpc.ClientStream
+}
+
+type raftSurfstoreWatchFileInfoClient struct {
+	grpc.ClientStream
+}
+
+func (x *raftSurfstoreWatchFileInfoClient) Recv() (*FileChange, error) {
+	m := new(FileChange)
+	if err := x.ClientStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func (c *raftSurfstoreClient) GetChangesSince(ctx context.Context, in *Revision, opts ...grpc.CallOption) (*FileInfoDelta, error) {
+	out := new(FileInfoDelta)
+	err := c.cc.Invoke(ctx, "/surfstore.RaftSurfstore/GetChangesSince", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *raftSurfstoreClient) GetFileInfoMapAt(ctx context.Context, in *SnapshotRequest, opts ...grpc.CallOption) (*FileInfoMap, error) {
+	out := new(FileInfoMap)
+	err := c.cc.Invoke(ctx, "/surfstore.RaftSurfstore/GetFileInfoMapAt", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *raftSurfstoreClient) GetBlockReferences(ctx context.Context, in *BlockHash, opts ...grpc.CallOption) (*BlockReferences, error) {
+	out := new(BlockReferences)
+	err := c.cc.Invoke(ctx, "/surfstore.RaftSurfstore/GetBlockReferences", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *raftSurfstoreClient) GetRepairReport(ctx context.Context, in *emptypb.Empty, opts ...grpc.CallOption) (*RepairReport, error) {
+	out := new(RepairReport)
+	err := c.cc.Invoke(ctx, "/surfstore.RaftSurfstore/GetRepairReport", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *raftSurfstoreClient) GetStoragePolicies(ctx context.Context, in *emptypb.Empty, opts ...grpc.CallOption) (*StoragePolicies, error) {
+	out := new(StoragePolicies)
+	err := c.cc.Invoke(ctx, "/surfstore.RaftSurfstore/GetStoragePolicies", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *raftSurfstoreClient) SetBlockStoreAddrs(ctx context.Context, in *BlockStoreAddrs, opts ...grpc.CallOption) (*RebalanceStatus, error) {
+	out := new(RebalanceStatus)
+	err := c.cc.Invoke(ctx, "/surfstore.RaftSurfstore/SetBlockStoreAddrs", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *raftSurfstoreClient) GetRebalanceStatus(ctx context.Context, in *emptypb.Empty, opts ...grpc.CallOption) (*RebalanceStatus, error) {
+	out := new(RebalanceStatus)
+	err := c.cc.Invoke(ctx, "/surfstore.RaftSurfstore/GetRebalanceStatus", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *raftSurfstoreClient) RegisterBlockStore(ctx context.Context, in *BlockStoreAddr, opts ...grpc.CallOption) (*BlockStoreStatus, error) {
+	out := new(BlockStoreStatus)
+	err := c.cc.Invoke(ctx, "/surfstore.RaftSurfstore/RegisterBlockStore", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *raftSurfstoreClient) BlockStoreHeartbeat(ctx context.Context, in *BlockStoreAddr, opts ...grpc.CallOption) (*BlockStoreStatus, error) {
+	out := new(BlockStoreStatus)
+	err := c.cc.Invoke(ctx, "/surfstore.RaftSurfstore/BlockStoreHeartbeat", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *raftSurfstoreClient) DrainBlockStore(ctx context.Context, in *BlockStoreAddr, opts ...grpc.CallOption) (*BlockStoreStatus, error) {
+	out := new(BlockStoreStatus)
+	err := c.cc.Invoke(ctx, "/surfstore.RaftSurfstore/DrainBlockStore", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *raftSurfstoreClient) DecommissionBlockStore(ctx context.Context, in *BlockStoreAddr, opts ...grpc.CallOption) (*BlockStoreStatus, error) {
+	out := new(BlockStoreStatus)
+	err := c.cc.Invoke(ctx, "/surfstore.RaftSurfstore/DecommissionBlockStore", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *raftSurfstoreClient) GetBlockStoreStatuses(ctx context.Context, in *emptypb.Empty, opts ...grpc.CallOption) (*BlockStoreStatuses, error) {
+	out := new(BlockStoreStatuses)
+	err := c.cc.Invoke(ctx, "/surfstore.RaftSurfstore/GetBlockStoreStatuses", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *raftSurfstoreClient) GetInternalState(ctx context.Context, in *emptypb.Empty, opts ...grpc.CallOption) (*RaftInternalState, error) {
+	out := new(RaftInternalState)
+	err := c.cc.Invoke(ctx, "/surfstore.RaftSurfstore/GetInternalState", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *raftSurfstoreClient) IsCrashed(ctx context.Context, in *emptypb.Empty, opts ...grpc.CallOption) (*CrashedState, error) {
+	out := new(CrashedState)
+	err := c.cc.Invoke(ctx, "/surfstore.RaftSurfstore/IsCrashed", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *raftSurfstoreClient) Restore(ctx context.Context, in *emptypb.Empty, opts ...grpc.CallOption) (*Success, error) {
+	out := new(Success)
+	err := c.cc.Invoke(ctx, "/surfstore.RaftSurfstore/Restore", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *raftSurfstoreClient) Crash(ctx context.Context, in *emptypb.Empty, opts ...grpc.CallOption) (*Success, error) {
+	out := new(Success)
+	err := c.cc.Invoke(ctx, "/surfstore.RaftSurfstore/Crash", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// RaftSurfstoreServer is the server API for RaftSurfstore service.
+// All implementations must embed UnimplementedRaftSurfstoreServer
+// for forward compatibility
+type RaftSurfstoreServer interface {
+	// raft
+	AppendEntries(context.Context, *AppendEntryInput) (*AppendEntryOutput, error)
+	SetLeader(context.Context, *emptypb.Empty) (*Success, error)
+	SendHeartbeat(context.Context, *emptypb.Empty) (*Success, error)
+	// metastore
+	GetFileInfoMap(context.Context, *emptypb.Empty) (*FileInfoMap, error)
+	UpdateFile(context.Context, *FileMetaData) (*Version, error)
+	GetBlockStoreAddr(context.Context, *emptypb.Empty) (*BlockStoreAddr, error)
+	GetBlockStoreAddrs(context.Context, *emptypb.Empty) (*BlockStoreAddrs, error)
+	GetFileHistory(context.Context, *FileName) (*FileHistory, error)
+	RestoreFileVersion(context.Context, *FileVersion) (*Version, error)
+	AckSync(context.Context, *SyncAck) (*Success, error)
+	WatchFileInfo(*WatchRequest, RaftSurfstore_WatchFileInfoServer) error
+	GetChangesSince(context.Context, *Revision) (*FileInfoDelta, error)
+	GetFileInfoMapAt(context.Context, *SnapshotRequest) (*FileInfoMap, error)
+	GetBlockReferences(context.Context, *BlockHash) (*BlockReferences, error)
+	GetRepairReport(context.Context, *emptypb.Empty) (*RepairReport, error)
+	GetStoragePolicies(context.Context, *emptypb.Empty) (*StoragePolicies, error)
+	SetBlockStoreAddrs(context.Context, *BlockStoreAddrs) (*RebalanceStatus, error)
+	GetRebalanceStatus(context.Context, *emptypb.Empty) (*RebalanceStatus, error)
+	RegisterBlockStore(context.Context, *BlockStoreAddr) (*BlockStoreStatus, error)
+	BlockStoreHeartbeat(context.Context, *BlockStoreAddr) (*BlockStoreStatus, error)
+	DrainBlockStore(context.Context, *BlockStoreAddr) (*BlockStoreStatus, error)
+	DecommissionBlockStore(context.Context, *BlockStoreAddr) (*BlockStoreStatus, error)
+	GetBlockStoreStatuses(context.Context, *emptypb.Empty) (*BlockStoreStatuses, error)
+	// testing interface
+	GetInternalState(context.Context, *emptypb.Empty) (*RaftInternalState, error)
+	IsCrashed(context.Context, *emptypb.Empty) (*CrashedState, error)
+	Restore(context.Context, *emptypb.Empty) (*Success, error)
+	Crash(context.Context, *emptypb.Empty) (*Success, error)
+	mustEmbedUnimplementedRaftSurfstoreServer()
+}
+
+// UnimplementedRaftSurfstoreServer must be embedded to have forward compatible implementations.
+type UnimplementedRaftSurfstoreServer struct {
+}
+
+func (UnimplementedRaftSurfstoreServer) AppendEntries(context.Context, *AppendEntryInput) (*AppendEntryOutput, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method AppendEntries not implemented")
+}
+func (UnimplementedRaftSurfstoreServer) SetLeader(context.Context, *emptypb.Empty) (*Success, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method SetLeader not implemented")
+}
+func (UnimplementedRaftSurfstoreServer) SendHeartbeat(context.Context, *emptypb.Empty) (*Success, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method SendHeartbeat not implemented")
+}
+func (UnimplementedRaftSurfstoreServer) GetFileInfoMap(context.Context, *emptypb.Empty) (*FileInfoMap, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method GetFileInfoMap not implemented")
+}
+func (UnimplementedRaftSurfstoreServer) UpdateFile(context.Context, *FileMetaData) (*Version, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method UpdateFile not implemented")
+}
+func (UnimplementedRaftSurfstoreServer) GetBlockStoreAddr(context.Context, *emptypb.Empty) (*BlockStoreAddr, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method GetBlockStoreAddr not implemented")
+}
+func (UnimplementedRaftSurfstoreServer) GetBlockStoreAddrs(context.Context, *emptypb.Empty) (*BlockStoreAddrs, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method GetBlockStoreAddrs not implemented")
+}
+func (UnimplementedRaftSurfstoreServer) GetFileHistory(context.Context, *FileName) (*FileHistory, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method GetFileHistory not implemented")
+}
+func (UnimplementedRaftSurfstoreServer) RestoreFileVersion(context.Context, *FileVersion) (*Version, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method RestoreFileVersion not implemented")
+}
+func (UnimplementedRaftSurfstoreServer) AckSync(context.Context, *SyncAck) (*Success, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method AckSync not implemented")
+}
+func (UnimplementedRaftSurfstoreServer) WatchFileInfo(*WatchRequest, RaftSurfstore_WatchFileInfoServer) error {
+	return status.Errorf(codes.Unimplemented, "method WatchFileInfo not implemented")
+}
+func (UnimplementedRaftSurfstoreServer) GetChangesSince(context.Context, *Revision) (*FileInfoDelta, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method GetChangesSince not implemented")
+}
+func (UnimplementedRaftSurfstoreServer) GetFileInfoMapAt(context.Context, *SnapshotRequest) (*FileInfoMap, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method GetFileInfoMapAt not implemented")
+}
+func (UnimplementedRaftSurfstoreServer) GetBlockReferences(context.Context, *BlockHash) (*BlockReferences, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method GetBlockReferences not implemented")
+}
+func (UnimplementedRaftSurfstoreServer) GetRepairReport(context.Context, *emptypb.Empty) (*RepairReport, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method GetRepairReport not implemented")
+}
+func (UnimplementedRaftSurfstoreServer) GetStoragePolicies(context.Context, *emptypb.Empty) (*StoragePolicies, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method GetStoragePolicies not implemented")
+}
+func (UnimplementedRaftSurfstoreServer) SetBlockStoreAddrs(context.Context, *BlockStoreAddrs) (*RebalanceStatus, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method SetBlockStoreAddrs not implemented")
+}
+func (UnimplementedRaftSurfstoreServer) GetRebalanceStatus(context.Context, *emptypb.Empty) (*RebalanceStatus, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method GetRebalanceStatus not implemented")
+}
+func (UnimplementedRaftSurfstoreServer) RegisterBlockStore(context.Context, *BlockStoreAddr) (*BlockStoreStatus, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method RegisterBlockStore not implemented")
+}
+func (UnimplementedRaftSurfstoreServer) BlockStoreHeartbeat(context.Context, *BlockStoreAddr) (*BlockStoreStatus, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method BlockStoreHeartbeat not implemented")
+}
+func (UnimplementedRaftSurfstoreServer) DrainBlockStore(context.Context, *BlockStoreAddr) (*BlockStoreStatus, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method DrainBlockStore not implemented")
+}
+func (UnimplementedRaftSurfstoreServer) DecommissionBlockStore(context.Context, *BlockStoreAddr) (*BlockStoreStatus, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method DecommissionBlockStore not implemented")
+}
+func (UnimplementedRaftSurfstoreServer) GetBlockStoreStatuses(context.Context, *emptypb.Empty) (*BlockStoreStatuses, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method GetBlockStoreStatuses not implemented")
+}
+func (UnimplementedRaftSurfstoreServer) GetInternalState(context.Context, *emptypb.Empty) (*RaftInternalState, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method GetInternalState not implemented")
+}
+func (UnimplementedRaftSurfstoreServer) IsCrashed(context.Context, *emptypb.Empty) (*CrashedState, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method IsCrashed not implemented")
+}
+func (UnimplementedRaftSurfstoreServer) Restore(context.Context, *emptypb.Empty) (*Success, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method Restore not implemented")
+}
+func (UnimplementedRaftSurfstoreServer) Crash(context.Context, *emptypb.Empty) (*Success, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method Crash not implemented")
+}
+func (UnimplementedRaftSurfstoreServer) mustEmbedUnimplementedRaftSurfstoreServer() {}
+
+// UnsafeRaftSurfstoreServer may be embedded to opt out of forward compatibility for this service.
+// Use of this interface is not recommended, as added methods to RaftSurfstoreServer will
+// result in compilation errors.
+type UnsafeRaftSurfstoreServer interface {
+	mustEmbedUnimplementedRaftSurfstoreServer()
+}
+
+func RegisterRaftSurfstoreServer(s grpc.ServiceRegistrar, srv RaftSurfstoreServer) {
+	s.RegisterService(&RaftSurfstore_ServiceDesc, srv)
+}
+
+func _RaftSurfstore_AppendEntries_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(AppendEntryInput)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(RaftSurfstoreServer).AppendEntries(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/surfstore.RaftSurfstore/AppendEntries",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(RaftSurfstoreServer).AppendEntries(ctx, req.(*AppendEntryInput))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _RaftSurfstore_SetLeader_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(emptypb.Empty)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(RaftSurfstoreServer).SetLeader(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/surfstore.RaftSurfstore/SetLeader",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(RaftSurfstoreServer).SetLeader(ctx, req.(*emptypb.Empty))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _RaftSurfstore_SendHeartbeat_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(emptypb.Empty)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(RaftSurfstoreServer).SendHeartbeat(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/surfstore.RaftSurfstore/SendHeartbeat",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(RaftSurfstoreServer).SendHeartbeat(ctx, req.(*emptypb.Empty))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _RaftSurfstore_GetFileInfoMap_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(emptypb.Empty)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(RaftSurfstoreServer).GetFileInfoMap(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/surfstore.RaftSurfstore/GetFileInfoMap",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(RaftSurfstoreServer).GetFileInfoMap(ctx, req.(*emptypb.Empty))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _RaftSurfstore_UpdateFile_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(FileMetaData)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(RaftSurfstoreServer).UpdateFile(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/surfstore.RaftSurfstore/UpdateFile",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(RaftSurfstoreServer).UpdateFile(ctx, req.(*FileMetaData))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _RaftSurfstore_GetBlockStoreAddr_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(emptypb.Empty)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(RaftSurfstoreServer).GetBlockStoreAddr(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/surfstore.RaftSurfstore/GetBlockStoreAddr",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(RaftSurfstoreServer).GetBlockStoreAddr(ctx, req.(*emptypb.Empty))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _RaftSurfstore_GetBlockStoreAddrs_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(emptypb.Empty)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(RaftSurfstoreServer).GetBlockStoreAddrs(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/surfstore.RaftSurfstore/GetBlockStoreAddrs",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(RaftSurfstoreServer).GetBlockStoreAddrs(ctx, req.(*emptypb.Empty))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _RaftSurfstore_GetFileHistory_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(FileName)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(RaftSurfstoreServer).GetFileHistory(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/surfstore.RaftSurfstore/GetFileHistory",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(RaftSurfstoreServer).GetFileHistory(ctx, req.(*FileName))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _RaftSurfstore_RestoreFileVersion_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(FileVersion)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(RaftSurfstoreServer).RestoreFileVersion(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/surfstore.RaftSurfstore/RestoreFileVersion",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(RaftSurfstoreServer).RestoreFileVersion(ctx, req.(*FileVersion))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _RaftSurfstore_AckSync_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(SyncAck)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(RaftSurfstoreServer).AckSync(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/surfstore.RaftSurfstore/AckSync",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(RaftSurfstoreServer).AckSync(ctx, req.(*SyncAck))
+	}
+	return interceptor(ctx, in, info, handler)
+}
 
-func _MetaStore_GetFileInfoMap_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+func _RaftSurfstore_WatchFileInfo_Handler(srv interface{}, stream grpc.ServerStream) error {
+	m := new(WatchRequest)
+	if err := stream.RecvMsg(m); err != nil {
+		return err
+	}
+	return srv.(RaftSurfstoreServer).WatchFileInfo(m, &raftSurfstoreWatchFileInfoServer{stream})
+}
+
+type RaftSurfstore_WatchFileInfoServer interface {
+	Send(*FileChange) error
+	grpc.ServerStream
+}
+
+type raftSurfstoreWatchFileInfoServer struct {
+	grpc.ServerStream
+}
+
+func (x *raftSurfstoreWatchFileInfoServer) Send(m *FileChange) error {
+	return x.ServerStream.SendMsg(m)
+}
+
+func _RaftSurfstore_GetChangesSince_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(Revision)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(RaftSurfstoreServer).GetChangesSince(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/surfstore.RaftSurfstore/GetChangesSince",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(RaftSurfstoreServer).GetChangesSince(ctx, req.(*Revision))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _RaftSurfstore_GetFileInfoMapAt_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(SnapshotRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(RaftSurfstoreServer).GetFileInfoMapAt(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/surfstore.RaftSurfstore/GetFileInfoMapAt",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(RaftSurfstoreServer).GetFileInfoMapAt(ctx, req.(*SnapshotRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _RaftSurfstore_GetBlockReferences_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(BlockHash)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(RaftSurfstoreServer).GetBlockReferences(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/surfstore.RaftSurfstore/GetBlockReferences",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(RaftSurfstoreServer).GetBlockReferences(ctx, req.(*BlockHash))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _RaftSurfstore_GetRepairReport_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
 	in := new(emptypb.Empty)
 	if err := dec(in); err != nil {
 		return nil, err
 	}
 	if interceptor == nil {
-		return srv.(MetaStoreServer).GetFileInfoMap(ctx, in)
+		return srv.(RaftSurfstoreServer).GetRepairReport(ctx, in)
 	}
 	info := &grpc.UnaryServerInfo{
 		Server:     srv,
-		FullMethod: "/surfstore.MetaStore/GetFileInfoMap",
+		FullMethod: "/surfstore.RaftSurfstore/GetRepairReport",
 	}
 	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
-		return srv.(MetaStoreServer).GetFileInfoMap(ctx, req.(*emptypb.Empty))
+		return srv.(RaftSurfstoreServer).GetRepairReport(ctx, req.(*emptypb.Empty))
 	}
 	return interceptor(ctx, in, info, handler)
 }
 
-func _MetaStore_UpdateFile_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
-	in := new(FileMetaData)
+func _RaftSurfstore_GetStoragePolicies_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(emptypb.Empty)
 	if err := dec(in); err != nil {
 		return nil, err
 	}
 	if interceptor == nil {
-		return srv.(MetaStoreServer).UpdateFile(ctx, in)
+		return srv.(RaftSurfstoreServer).GetStoragePolicies(ctx, in)
 	}
 	info := &grpc.UnaryServerInfo{
 		Server:     srv,
-		FullMethod: "/surfstore.MetaStore/UpdateFile",
+		FullMethod: "/surfstore.RaftSurfstore/GetStoragePolicies",
 	}
 	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
-		return srv.(MetaStoreServer).UpdateFile(ctx, req.(*FileMetaData))
+		return srv.(RaftSurfstoreServer).GetStoragePolicies(ctx, req.(*emptypb.Empty))
 	}
 	return interceptor(ctx, in, info, handler)
 }
 
-func _MetaStore_GetBlockStoreAddr_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+func _RaftSurfstore_SetBlockStoreAddrs_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(BlockStoreAddrs)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(RaftSurfstoreServer).SetBlockStoreAddrs(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/surfstore.RaftSurfstore/SetBlockStoreAddrs",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(RaftSurfstoreServer).SetBlockStoreAddrs(ctx, req.(*BlockStoreAddrs))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _RaftSurfstore_GetRebalanceStatus_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
 	in := new(emptypb.Empty)
 	if err := dec(in); err != nil {
 		return nil, err
 	}
 	if interceptor == nil {
-		return srv.(MetaStoreServer).GetBlockStoreAddr(ctx, in)
+		return srv.(RaftSurfstoreServer).GetRebalanceStatus(ctx, in)
 	}
 	info := &grpc.UnaryServerInfo{
 		Server:     srv,
-		FullMethod: "/surfstore.MetaStore/GetBlockStoreAddr",
+		FullMethod: "/surfstore.RaftSurfstore/GetRebalanceStatus",
 	}
 	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
-		return srv.(MetaStoreServer).GetBlockStoreAddr(ctx, req.(*emptypb.Empty))
+		return srv.(RaftSurfstoreServer).GetRebalanceStatus(ctx, req.(*emptypb.Empty))
 	}
 	return interceptor(ctx, in, info, handler)
 }
 
-// MetaStore_ServiceDesc is the grpc.ServiceDesc for MetaStore service.
+func _RaftSurfstore_RegisterBlockStore_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(BlockStoreAddr)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(RaftSurfstoreServer).RegisterBlockStore(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/surfstore.RaftSurfstore/RegisterBlockStore",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(RaftSurfstoreServer).RegisterBlockStore(ctx, req.(*BlockStoreAddr))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _RaftSurfstore_BlockStoreHeartbeat_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(BlockStoreAddr)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(RaftSurfstoreServer).BlockStoreHeartbeat(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/surfstore.RaftSurfstore/BlockStoreHeartbeat",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(RaftSurfstoreServer).BlockStoreHeartbeat(ctx, req.(*BlockStoreAddr))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _RaftSurfstore_DrainBlockStore_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(BlockStoreAddr)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(RaftSurfstoreServer).DrainBlockStore(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/surfstore.RaftSurfstore/DrainBlockStore",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(RaftSurfstoreServer).DrainBlockStore(ctx, req.(*BlockStoreAddr))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _RaftSurfstore_DecommissionBlockStore_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(BlockStoreAddr)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(RaftSurfstoreServer).DecommissionBlockStore(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/surfstore.RaftSurfstore/DecommissionBlockStore",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(RaftSurfstoreServer).DecommissionBlockStore(ctx, req.(*BlockStoreAddr))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _RaftSurfstore_GetBlockStoreStatuses_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(emptypb.Empty)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(RaftSurfstoreServer).GetBlockStoreStatuses(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/surfstore.RaftSurfstore/GetBlockStoreStatuses",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(RaftSurfstoreServer).GetBlockStoreStatuses(ctx, req.(*emptypb.Empty))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _RaftSurfstore_GetInternalState_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(emptypb.Empty)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(RaftSurfstoreServer).GetInternalState(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/surfstore.RaftSurfstore/GetInternalState",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(RaftSurfstoreServer).GetInternalState(ctx, req.(*emptypb.Empty))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _RaftSurfstore_IsCrashed_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(emptypb.Empty)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(RaftSurfstoreServer).IsCrashed(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/surfstore.RaftSurfstore/IsCrashed",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(RaftSurfstoreServer).IsCrashed(ctx, req.(*emptypb.Empty))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _RaftSurfstore_Restore_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(emptypb.Empty)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(RaftSurfstoreServer).Restore(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/surfstore.RaftSurfstore/Restore",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(RaftSurfstoreServer).Restore(ctx, req.(*emptypb.Empty))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _RaftSurfstore_Crash_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(emptypb.Empty)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(RaftSurfstoreServer).Crash(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/surfstore.RaftSurfstore/Crash",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(RaftSurfstoreServer).Crash(ctx, req.(*emptypb.Empty))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+// RaftSurfstore_ServiceDesc is the grpc.ServiceDesc for RaftSurfstore service.
 // It's only intended for direct use with grpc.RegisterService,
 // and not to be introspected or modified (even as a copy)
-var MetaStore_ServiceDesc = grpc.ServiceDesc{
-	ServiceName: "surfstore.MetaStore",
-	HandlerType: (*MetaStoreServer)(nil),
+var RaftSurfstore_ServiceDesc = grpc.ServiceDesc{
+	ServiceName: "surfstore.RaftSurfstore",
+	HandlerType: (*RaftSurfstoreServer)(nil),
 	Methods: []grpc.MethodDesc{
+		{
+			MethodName: "AppendEntries",
+			Handler:    _RaftSurfstore_AppendEntries_Handler,
+		},
+		{
+			MethodName: "SetLeader",
+			Handler:    _RaftSurfstore_SetLeader_Handler,
+		},
+		{
+			MethodName: "SendHeartbeat",
+			Handler:    _RaftSurfstore_SendHeartbeat_Handler,
+		},
 		{
 			MethodName: "GetFileInfoMap",
-			Handler:    _MetaStore_GetFileInfoMap_Handler,
+			Handler:    _RaftSurfstore_GetFileInfoMap_Handler,
 		},
 		{
 			MethodName: "UpdateFile",
-			Handler:    _MetaStore_UpdateFile_Handler,
+			Handler:    _RaftSurfstore_UpdateFile_Handler,
 		},
 		{
 			MethodName: "GetBlockStoreAddr",
-			Handler:    _MetaStore_GetBlockStoreAddr_Handler,
+			Handler:    _RaftSurfstore_GetBlockStoreAddr_Handler,
+		},
+		{
+			MethodName: "GetBlockStoreAddrs",
+			Handler:    _RaftSurfstore_GetBlockStoreAddrs_Handler,
+		},
+		{
+			MethodName: "GetFileHistory",
+			Handler:    _RaftSurfstore_GetFileHistory_Handler,
+		},
+		{
+			MethodName: "RestoreFileVersion",
+			Handler:    _RaftSurfstore_RestoreFileVersion_Handler,
+		},
+		{
+			MethodName: "AckSync",
+			Handler:    _RaftSurfstore_AckSync_Handler,
+		},
+		{
+			MethodName: "GetChangesSince",
+			Handler:    _RaftSurfstore_GetChangesSince_Handler,
+		},
+		{
+			MethodName: "GetFileInfoMapAt",
+			Handler:    _RaftSurfstore_GetFileInfoMapAt_Handler,
+		},
+		{
+			MethodName: "GetBlockReferences",
+			Handler:    _RaftSurfstore_GetBlockReferences_Handler,
+		},
+		{
+			MethodName: "GetRepairReport",
+			Handler:    _RaftSurfstore_GetRepairReport_Handler,
+		},
+		{
+			MethodName: "GetStoragePolicies",
+			Handler:    _RaftSurfstore_GetStoragePolicies_Handler,
+		},
+		{
+			MethodName: "SetBlockStoreAddrs",
+			Handler:    _RaftSurfstore_SetBlockStoreAddrs_Handler,
+		},
+		{
+			MethodName: "GetRebalanceStatus",
+			Handler:    _RaftSurfstore_GetRebalanceStatus_Handler,
+		},
+		{
+			MethodName: "RegisterBlockStore",
+			Handler:    _RaftSurfstore_RegisterBlockStore_Handler,
+		},
+		{
+			MethodName: "BlockStoreHeartbeat",
+			Handler:    _RaftSurfstore_BlockStoreHeartbeat_Handler,
+		},
+		{
+			MethodName: "DrainBlockStore",
+			Handler:    _RaftSurfstore_DrainBlockStore_Handler,
+		},
+		{
+			MethodName: "DecommissionBlockStore",
+			Handler:    _RaftSurfstore_DecommissionBlockStore_Handler,
+		},
+		{
+			MethodName: "GetBlockStoreStatuses",
+			Handler:    _RaftSurfstore_GetBlockStoreStatuses_Handler,
+		},
+		{
+			MethodName: "GetInternalState",
+			Handler:    _RaftSurfstore_GetInternalState_Handler,
+		},
+		{
+			MethodName: "IsCrashed",
+			Handler:    _RaftSurfstore_IsCrashed_Handler,
+		},
+		{
+			MethodName: "Restore",
+			Handler:    _RaftSurfstore_Restore_Handler,
+		},
+		{
+			MethodName: "Crash",
+			Handler:    _RaftSurfstore_Crash_Handler,
+		},
+	},
+	Streams: []grpc.StreamDesc{
+		{
+			StreamName:    "WatchFileInfo",
+			Handler:       _RaftSurfstore_WatchFileInfo_Handler,
+			ServerStreams: true,
 		},
 	},
-	Streams:  []grpc.StreamDesc{},
 	Metadata: "pkg/surfstore/SurfStore.proto",
 }
@@ -36,18 +36,29 @@ func ConcatPath(baseDir, fileDir string) string {
 
 // NewFileMetaDataFromConfig returns a FileMetaData struct
 // associated with one line in the local metadata file.
+// Lines written before attributes were synced only have the first three
+// columns; their attributes are left zero.
 func NewFileMetaDataFromConfig(configString string) *FileMetaData {
-	configItems := strings.Split(configString, CONFIG_DELIMITER)
+	// The symlink target is the last column and may itself contain the delimiter
+	configItems := strings.SplitN(configString, CONFIG_DELIMITER, SYMLINK_TARGET_INDEX+1)
 
 	filename := configItems[FILENAME_INDEX]
 	version, _ := strconv.Atoi(configItems[VERSION_INDEX])
 	blockHashList := strings.Split(configItems[HASH_LIST_INDEX], HASH_DELIMITER)
 
-	return &FileMetaData{
+	fileMetaData := &FileMetaData{
 		Filename:      filename,
 		Version:       int32(version),
 		BlockHashList: blockHashList[:len(blockHashList)-1],
 	}
+	if len(configItems) > SYMLINK_TARGET_INDEX {
+		mode, _ := strconv.ParseUint(configItems[MODE_INDEX], 8, 32)
+		fileMetaData.Mode = uint32(mode)
+		fileMetaData.Mtime, _ = strconv.ParseInt(configItems[MTIME_INDEX], 10, 64)
+		fileMetaData.Size, _ = strconv.ParseInt(configItems[SIZE_INDEX], 10, 64)
+		fileMetaData.SymlinkTarget = configItems[SYMLINK_TARGET_INDEX]
+	}
+	return fileMetaData
 }
 
 // LoadMetaFromMetaFiles loads the local metadata file into a file meta map.
@@ -109,6 +120,11 @@ func FileMetaDataToString(fm *FileMetaData) (result string) {
 		result += blockHash + " "
 	}
 
+	result += "," + strconv.FormatUint(uint64(fm.Mode), 8)
+	result += "," + strconv.FormatInt(fm.Mtime, 10)
+	result += "," + strconv.FormatInt(fm.Size, 10)
+	result += "," + fm.SymlinkTarget
+
 	result += "\n"
 	return
 }
@@ -132,6 +148,31 @@ func WriteMetaFile(fileMetas map[string]*FileMetaData, baseDir string) error {
 	return nil
 }
 
+// LoadRevisionFile returns the server revision the client last synced
+// to, or 0 if it has never synced.
+func LoadRevisionFile(baseDir string) int64 {
+	content, err := os.ReadFile(ConcatPath(baseDir, DEFAULT_REVISION_FILENAME))
+	if err != nil {
+		return 0
+	}
+	revision, err := strconv.ParseInt(strings.TrimSpace(string(content)), 10, 64)
+	if err != nil {
+		return 0
+	}
+	return revision
+}
+
+// WriteRevisionFile records the server revision the client synced to.
+// The file is replaced atomically so a crash never leaves a torn revision.
+func WriteRevisionFile(baseDir string, revision int64) error {
+	revisionPath := ConcatPath(baseDir, DEFAULT_REVISION_FILENAME)
+	tmpPath := revisionPath + ".tmp"
+	if err := os.WriteFile(tmpPath, []byte(strconv.FormatInt(revision, 10)+"\n"), 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmpPath, revisionPath)
+}
+
 /*
 	Debugging Related
 */
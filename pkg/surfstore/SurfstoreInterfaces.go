@@ -15,6 +15,54 @@ type MetaStoreInterface interface {
 
 	// Get the the BlockStore address
 	GetBlockStoreAddr(ctx context.Context, _ *emptypb.Empty) (*BlockStoreAddr, error)
+
+	// Get every BlockStore address on the placement ring
+	GetBlockStoreAddrs(ctx context.Context, _ *emptypb.Empty) (*BlockStoreAddrs, error)
+
+	// Move blocks onto a new set of BlockStores
+	SetBlockStoreAddrs(ctx context.Context, addrs *BlockStoreAddrs) (*RebalanceStatus, error)
+
+	// Get how far moving blocks onto the current BlockStores has got
+	GetRebalanceStatus(ctx context.Context, _ *emptypb.Empty) (*RebalanceStatus, error)
+
+	// Add a BlockStore to the ring, as the BlockStore starts
+	RegisterBlockStore(ctx context.Context, addr *BlockStoreAddr) (*BlockStoreStatus, error)
+
+	// Tell the MetaStore a registered BlockStore is alive
+	BlockStoreHeartbeat(ctx context.Context, addr *BlockStoreAddr) (*BlockStoreStatus, error)
+
+	// Move the blocks off a BlockStore and take it off the ring
+	DrainBlockStore(ctx context.Context, addr *BlockStoreAddr) (*BlockStoreStatus, error)
+
+	// Forget a drained BlockStore for good
+	DecommissionBlockStore(ctx context.Context, addr *BlockStoreAddr) (*BlockStoreStatus, error)
+
+	// Get the state and health of every known BlockStore
+	GetBlockStoreStatuses(ctx context.Context, _ *emptypb.Empty) (*BlockStoreStatuses, error)
+
+	// Get which files of the caller's namespace are erasure coded
+	GetStoragePolicies(ctx context.Context, _ *emptypb.Empty) (*StoragePolicies, error)
+
+	// Get every stored version of a file
+	GetFileHistory(ctx context.Context, fileName *FileName) (*FileHistory, error)
+
+	// Store a new version of a file that points at an older version's blocks
+	RestoreFileVersion(ctx context.Context, fileVersion *FileVersion) (*Version, error)
+
+	// Get the files changed after a revision
+	GetChangesSince(ctx context.Context, revision *Revision) (*FileInfoDelta, error)
+
+	// Get the FileInfoMap as of a past revision or time
+	GetFileInfoMapAt(ctx context.Context, snapshotRequest *SnapshotRequest) (*FileInfoMap, error)
+
+	// Get the retained file versions that reference a block
+	GetBlockReferences(ctx context.Context, blockHash *BlockHash) (*BlockReferences, error)
+
+	// Get the outcome of the last check for under-replicated blocks
+	GetRepairReport(ctx context.Context, _ *emptypb.Empty) (*RepairReport, error)
+
+	// Record the revision a client has finished syncing to
+	AckSync(ctx context.Context, syncAck *SyncAck) (*Success, error)
 }
 
 type BlockStoreInterface interface {
@@ -28,13 +76,51 @@ type BlockStoreInterface interface {
 	// Given a list of hashes “in”, returns a list containing the
 	// subset of in that are stored in the key-value store
 	HasBlocks(ctx context.Context, blockHashesIn *BlockHashes) (*BlockHashes, error)
+
+	// List every stored block
+	ListBlocks(ctx context.Context, _ *emptypb.Empty) (*BlockHashes, error)
+
+	// Delete the given blocks unless they were used within the grace period
+	DeleteBlocks(ctx context.Context, blockHashesIn *BlockHashes) (*BlockHashes, error)
+}
+
+type BlockStoreReplicaInterface interface {
+	BlockStoreInterface
+
+	// Store a block forwarded by another replica
+	ReplicateBlock(ctx context.Context, block *Block) (*Success, error)
+
+	// Delete this replica's copies of blocks another replica deleted
+	DeleteReplicatedBlocks(ctx context.Context, blockHashesIn *BlockHashes) (*BlockHashes, error)
+
+	// Get the hashes of Merkle tree nodes, to find the buckets that differ
+	GetMerkleHashes(ctx context.Context, merkleNodes *MerkleNodes) (*MerkleHashes, error)
+
+	// Get the blocks of every namespace in the given Merkle tree leaves,
+	// and the ones recently deleted from them
+	GetMerkleBuckets(ctx context.Context, merkleNodes *MerkleNodes) (*MerkleBuckets, error)
+
+	// Testing interface
+	Crash(ctx context.Context, _ *emptypb.Empty) (*Success, error)
+	Restore(ctx context.Context, _ *emptypb.Empty) (*Success, error)
+	IsCrashed(ctx context.Context, _ *emptypb.Empty) (*CrashedState, error)
 }
 
 type ClientInterface interface {
 	// MetaStore
 	GetFileInfoMap(serverFileInfoMap *map[string]*FileMetaData) error
+	GetFileInfoMapAndRevision(serverFileInfoMap *map[string]*FileMetaData, revision *int64) error
 	UpdateFile(fileMetaData *FileMetaData, latestVersion *int32) error
 	GetBlockStoreAddr(blockStoreAddr *string) error
+	GetBlockStoreAddrs(blockStoreAddrs *[]string, replicationFactor *int, previousAddrs *[]string, unhealthyAddrs *[]string) error
+	GetStoragePolicies(policies *[]*StoragePolicy) error
+	GetFileHistory(filename string, versions *[]*FileMetaData) error
+	GetBlockReferences(blockHash string, references *[]*FileVersion) error
+	RestoreFileVersion(filename string, version int32, latestVersion *int32) error
+	GetChangesSince(revision int64, changes *map[string]*FileMetaData, latestRevision *int64, full *bool) error
+	GetFileInfoMapAt(revision int64, timestamp int64, serverFileInfoMap *map[string]*FileMetaData, atRevision *int64) error
+	AckSync(clientId string, revision int64) error
+	WatchFileInfo(ctx context.Context, fromRevision int64, onChange func(*FileChange) error) error
 
 	// BlockStore
 	GetBlock(blockHash string, blockStoreAddr string, block *Block) error
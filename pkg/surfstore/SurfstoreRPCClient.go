@@ -5,7 +5,8 @@ import (
 	"time"
 
 	grpc "google.golang.org/grpc"
-	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
 	"google.golang.org/protobuf/types/known/emptypb"
 )
 
@@ -13,18 +14,27 @@ type RPCClient struct {
 	MetaStoreAddrs []string
 	BaseDir        string
 	BlockSize      int
+	// Every call is made in this namespace; empty selects the default one
+	Namespace string
+	// Identifies the client to servers that require auth
+	Token string
+	// Secures every connection; nil dials in plaintext
+	TLS *TLSConfig
+	// Caching BlockStore to send every block RPC to instead of the
+	// BlockStores the metadata server lists
+	BlockCacheAddr string
 }
 
 func (surfClient *RPCClient) GetBlock(blockHash string, blockStoreAddr string, block *Block) error {
 	// connect to the server
-	conn, err := grpc.Dial(blockStoreAddr, grpc.WithTransportCredentials(insecure.NewCredentials()))
+	conn, err := grpc.Dial(blockStoreAddr, surfClient.TLS.DialOption())
 	if err != nil {
 		return err
 	}
 	c := NewBlockStoreClient(conn)
 
 	// perform the call
-	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	ctx, cancel := context.WithTimeout(surfClient.outgoingContext(context.Background()), time.Minute)
 	defer cancel()
 	b, err := c.GetBlock(ctx, &BlockHash{Hash: blockHash})
 	if err != nil {
@@ -41,14 +51,14 @@ func (surfClient *RPCClient) GetBlock(blockHash string, blockStoreAddr string, b
 // Implement SurfStore gRPC client
 func (surfClient *RPCClient) PutBlock(block *Block, blockStoreAddr string, succ *bool) error {
 	// connect to the server
-	conn, err := grpc.Dial(blockStoreAddr, grpc.WithTransportCredentials(insecure.NewCredentials()))
+	conn, err := grpc.Dial(blockStoreAddr, surfClient.TLS.DialOption())
 	if err != nil {
 		return err
 	}
 	c := NewBlockStoreClient(conn)
 
 	// perform the call
-	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	ctx, cancel := context.WithTimeout(surfClient.outgoingContext(context.Background()), time.Minute)
 	defer cancel()
 	s, err := c.PutBlock(ctx, block)
 	if err != nil {
@@ -63,14 +73,14 @@ func (surfClient *RPCClient) PutBlock(block *Block, blockStoreAddr string, succ
 
 func (surfClient *RPCClient) HasBlocks(blockHashesIn []string, blockStoreAddr string, blockHashesOut *[]string) error {
 	// connect to the server
-	conn, err := grpc.Dial(blockStoreAddr, grpc.WithTransportCredentials(insecure.NewCredentials()))
+	conn, err := grpc.Dial(blockStoreAddr, surfClient.TLS.DialOption())
 	if err != nil {
 		return err
 	}
 	c := NewBlockStoreClient(conn)
 
 	// perform the call
-	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	ctx, cancel := context.WithTimeout(surfClient.outgoingContext(context.Background()), time.Minute)
 	defer cancel()
 	out, err := c.HasBlocks(ctx, &BlockHashes{Hashes: blockHashesIn})
 	if err != nil {
@@ -85,68 +95,235 @@ func (surfClient *RPCClient) HasBlocks(blockHashesIn []string, blockStoreAddr st
 
 // metastore methods on the client side
 func (surfClient *RPCClient) GetFileInfoMap(serverFileInfoMap *map[string]*FileMetaData) error {
-	// connect to the server
-	conn, err := grpc.Dial(surfClient.MetaStoreAddrs[0], grpc.WithTransportCredentials(insecure.NewCredentials()))
-	if err != nil {
-		return err
-	}
-	c := NewRaftSurfstoreClient(conn)
+	var revision int64
+	return surfClient.GetFileInfoMapAndRevision(serverFileInfoMap, &revision)
+}
 
-	// perform the call
-	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
-	defer cancel()
-	fim, err := c.GetFileInfoMap(ctx, &emptypb.Empty{})
-	if err != nil {
-		conn.Close()
+func (surfClient *RPCClient) GetFileInfoMapAndRevision(serverFileInfoMap *map[string]*FileMetaData, revision *int64) error {
+	return surfClient.callLeader(func(ctx context.Context, c RaftSurfstoreClient) error {
+		fim, err := c.GetFileInfoMap(ctx, &emptypb.Empty{})
+		if err != nil {
+			return err
+		}
+		*serverFileInfoMap = fim.FileInfoMap
+		*revision = fim.Revision
+		return nil
+	})
+}
+
+func (surfClient *RPCClient) UpdateFile(fileMetaData *FileMetaData, latestVersion *int32) error {
+	return surfClient.callLeader(func(ctx context.Context, c RaftSurfstoreClient) error {
+		ver, err := c.UpdateFile(ctx, fileMetaData)
+		if err != nil {
+			return err
+		}
+		*latestVersion = ver.Version
+		return nil
+	})
+}
+
+func (surfClient *RPCClient) GetBlockStoreAddr(blockStoreAddr *string) error {
+	return surfClient.callLeader(func(ctx context.Context, c RaftSurfstoreClient) error {
+		addr, err := c.GetBlockStoreAddr(ctx, &emptypb.Empty{})
+		if err != nil {
+			return err
+		}
+		*blockStoreAddr = addr.Addr
+		return nil
+	})
+}
+
+func (surfClient *RPCClient) GetBlockStoreAddrs(blockStoreAddrs *[]string, replicationFactor *int, previousAddrs *[]string, unhealthyAddrs *[]string) error {
+	return surfClient.callLeader(func(ctx context.Context, c RaftSurfstoreClient) error {
+		addrs, err := c.GetBlockStoreAddrs(ctx, &emptypb.Empty{})
+		if err != nil {
+			return err
+		}
+		*blockStoreAddrs = addrs.Addrs
+		*replicationFactor = int(addrs.ReplicationFactor)
+		*previousAddrs = addrs.PreviousAddrs
+		*unhealthyAddrs = addrs.UnhealthyAddrs
+		return nil
+	})
+}
+
+func (surfClient *RPCClient) GetStoragePolicies(policies *[]*StoragePolicy) error {
+	return surfClient.callLeader(func(ctx context.Context, c RaftSurfstoreClient) error {
+		storagePolicies, err := c.GetStoragePolicies(ctx, &emptypb.Empty{})
+		if err != nil {
+			return err
+		}
+		*policies = storagePolicies.Policies
+		return nil
+	})
+}
+
+func (surfClient *RPCClient) GetFileHistory(filename string, versions *[]*FileMetaData) error {
+	return surfClient.callLeader(func(ctx context.Context, c RaftSurfstoreClient) error {
+		history, err := c.GetFileHistory(ctx, &FileName{Filename: filename})
+		if err != nil {
+			return err
+		}
+		*versions = history.Versions
+		return nil
+	})
+}
+
+func (surfClient *RPCClient) GetBlockReferences(blockHash string, references *[]*FileVersion) error {
+	return surfClient.callLeader(func(ctx context.Context, c RaftSurfstoreClient) error {
+		refs, err := c.GetBlockReferences(ctx, &BlockHash{Hash: blockHash})
+		if err != nil {
+			return err
+		}
+		*references = refs.References
+		return nil
+	})
+}
+
+func (surfClient *RPCClient) RestoreFileVersion(filename string, version int32, latestVersion *int32) error {
+	return surfClient.callLeader(func(ctx context.Context, c RaftSurfstoreClient) error {
+		ver, err := c.RestoreFileVersion(ctx, &FileVersion{Filename: filename, Version: version})
+		if err != nil {
+			return err
+		}
+		*latestVersion = ver.Version
+		return nil
+	})
+}
+
+func (surfClient *RPCClient) GetChangesSince(revision int64, changes *map[string]*FileMetaData, latestRevision *int64, full *bool) error {
+	return surfClient.callLeader(func(ctx context.Context, c RaftSurfstoreClient) error {
+		delta, err := c.GetChangesSince(ctx, &Revision{Revision: revision})
+		if err != nil {
+			return err
+		}
+		*changes = delta.Changes
+		*latestRevision = delta.Revision
+		*full = delta.Full
+		return nil
+	})
+}
+
+// Pass a revision, or a revision of 0 and a time in unix nanoseconds
+func (surfClient *RPCClient) GetFileInfoMapAt(revision int64, timestamp int64, serverFileInfoMap *map[string]*FileMetaData, atRevision *int64) error {
+	return surfClient.callLeader(func(ctx context.Context, c RaftSurfstoreClient) error {
+		fim, err := c.GetFileInfoMapAt(ctx, &SnapshotRequest{Revision: revision, Timestamp: timestamp})
+		if err != nil {
+			return err
+		}
+		*serverFileInfoMap = fim.FileInfoMap
+		*atRevision = fim.Revision
+		return nil
+	})
+}
+
+func (surfClient *RPCClient) AckSync(clientId string, revision int64) error {
+	return surfClient.callLeader(func(ctx context.Context, c RaftSurfstoreClient) error {
+		_, err := c.AckSync(ctx, &SyncAck{ClientId: clientId, Revision: revision})
 		return err
+	})
+}
+
+// WatchFileInfo calls onChange for every change committed after
+// fromRevision until ctx is done. Any metadata server can serve the watch;
+// when one fails the watch resumes on the next from the last revision seen.
+func (surfClient *RPCClient) WatchFileInfo(ctx context.Context, fromRevision int64, onChange func(*FileChange) error) error {
+	for attempt := 0; ; attempt++ {
+		addr := surfClient.MetaStoreAddrs[attempt%len(surfClient.MetaStoreAddrs)]
+		err := surfClient.watchFrom(ctx, addr, &fromRevision, onChange)
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if st, ok := status.FromError(err); ok && st.Code() == codes.OutOfRange {
+			return err
+		}
+		if _, ok := err.(watchCallbackError); ok {
+			return err
+		}
+		select {
+		case <-time.After(WATCH_RETRY_INTERVAL):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
 	}
-	*serverFileInfoMap = fim.FileInfoMap
+}
 
-	// close the connection
-	return conn.Close()
+// Wraps errors returned by a watch callback so they end the watch
+type watchCallbackError struct {
+	error
 }
 
-func (surfClient *RPCClient) UpdateFile(fileMetaData *FileMetaData, latestVersion *int32) error {
+func (surfClient *RPCClient) watchFrom(ctx context.Context, addr string, fromRevision *int64, onChange func(*FileChange) error) error {
 	// connect to the server
-	conn, err := grpc.Dial(surfClient.MetaStoreAddrs[0], grpc.WithTransportCredentials(insecure.NewCredentials()))
+	conn, err := grpc.Dial(addr, surfClient.TLS.DialOption())
 	if err != nil {
 		return err
 	}
+	defer conn.Close()
 	c := NewRaftSurfstoreClient(conn)
 
-	// perform the call
-	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
-	defer cancel()
-	ver, err := c.UpdateFile(ctx, fileMetaData)
+	stream, err := c.WatchFileInfo(surfClient.outgoingContext(ctx), &WatchRequest{FromRevision: *fromRevision})
 	if err != nil {
-		conn.Close()
 		return err
 	}
-	*latestVersion = ver.Version
+	for {
+		change, err := stream.Recv()
+		if err != nil {
+			return err
+		}
+		if err := onChange(change); err != nil {
+			return watchCallbackError{err}
+		}
+		*fromRevision = change.Revision
+	}
+}
 
-	// close the connection
-	return conn.Close()
+// Adds the namespace and token every call carries
+func (surfClient *RPCClient) outgoingContext(ctx context.Context) context.Context {
+	return WithToken(WithNamespace(ctx, surfClient.Namespace), surfClient.Token)
 }
 
-func (surfClient *RPCClient) GetBlockStoreAddr(blockStoreAddr *string) error {
-	// connect to the server
-	conn, err := grpc.Dial(surfClient.MetaStoreAddrs[0], grpc.WithTransportCredentials(insecure.NewCredentials()))
-	if err != nil {
-		return err
-	}
-	c := NewRaftSurfstoreClient(conn)
+// callLeader tries each metadata server in turn until one of them
+// handles the call, skipping servers that are crashed or not the leader
+func (surfClient *RPCClient) callLeader(call func(ctx context.Context, c RaftSurfstoreClient) error) error {
+	var err error = ERR_NOT_LEADER
+	for _, addr := range surfClient.MetaStoreAddrs {
+		// connect to the server
+		conn, dialErr := grpc.Dial(addr, surfClient.TLS.DialOption())
+		if dialErr != nil {
+			err = dialErr
+			continue
+		}
+		c := NewRaftSurfstoreClient(conn)
 
-	// perform the call
-	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
-	defer cancel()
-	addr, err := c.GetBlockStoreAddr(ctx, &emptypb.Empty{})
-	if err != nil {
+		// perform the call
+		ctx, cancel := context.WithTimeout(surfClient.outgoingContext(context.Background()), time.Minute)
+		err = call(ctx, c)
+		cancel()
+
+		// close the connection
 		conn.Close()
-		return err
+		if !isRetryableMetaStoreError(err) {
+			return err
+		}
 	}
-	*blockStoreAddr = addr.Addr
-	// close the connection
-	return conn.Close()
+	return err
+}
+
+// Errors that mean another metadata server should be tried
+func isRetryableMetaStoreError(err error) bool {
+	if err == nil {
+		return false
+	}
+	st, ok := status.FromError(err)
+	if !ok {
+		return true
+	}
+	switch st.Code() {
+	case codes.Unavailable, codes.DeadlineExceeded:
+		return true
+	}
+	return st.Message() == ERR_NOT_LEADER.Error() || st.Message() == ERR_SERVER_CRASHED.Error()
 }
 
 // This line guarantees all method for RPCClient are implemented
@@ -1,222 +1,741 @@
 package surfstore
 
 import (
+	"fmt"
+	"io"
+	"io/fs"
 	"log"
 	"os"
-	"strconv"
+	"path"
+	"path/filepath"
+	"sort"
 	"strings"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
 )
 
 // Implement the logic for a client syncing with the server here.
 func ClientSync(client RPCClient) {
-	// check local index file
-	indexFilePath := ConcatPath(client.BaseDir, DEFAULT_META_FILENAME)
-	if _, err := os.Stat(indexFilePath); os.IsNotExist(err) {
-		file, _ := os.Create(indexFilePath)
-		defer file.Close()
-	}
-	// Open index.txt
-	indFile, err := os.OpenFile(indexFilePath, os.O_APPEND|os.O_RDWR, 0777)
+	localIndexFileMetaMap, _, err := LoadMetaFromMetaFile(client.BaseDir)
 	if err != nil {
-		log.Println(err)
+		log.Println("Cannot load index.txt")
+		return
 	}
 
-	localIndexFileMetaMap, allFileMetaMap, err := LoadMetaFromMetaFile(client.BaseDir)
+	// Look at base directory, compute each file's hash list
+	clientMetaMap, clientBlockMap, err := scanBaseDir(client.BaseDir, client.BlockSize)
 	if err != nil {
-		log.Println("Cannot load index.txt")
+		log.Println("Cannot scan the base directory:", err)
+		return
 	}
 
-	clientMetaMap := make(map[string]*FileMetaData)
-	clientBlockMap := make(map[string]*Block)
+	// Only fetch what changed since the last sync; the local index holds
+	// the server's state as of then
+	remoteFileInfoMap := make(map[string]*FileMetaData)
+	var remoteRevision int64
+	lastRevision := LoadRevisionFile(client.BaseDir)
+	if lastRevision > 0 && len(localIndexFileMetaMap) > 0 {
+		var changes map[string]*FileMetaData
+		var full bool
+		err = client.GetChangesSince(lastRevision, &changes, &remoteRevision, &full)
+		if err == nil && !full {
+			for filename, fileMeta := range localIndexFileMetaMap {
+				remoteFileInfoMap[filename] = fileMeta
+			}
+		}
+		for filename, fileMeta := range changes {
+			remoteFileInfoMap[filename] = fileMeta
+		}
+	} else {
+		err = client.GetFileInfoMapAndRevision(&remoteFileInfoMap, &remoteRevision)
+	}
+	if err != nil {
+		log.Println("Failed to get remote index:", err)
+		reportDenied(err, "remote index")
+		return
+	}
 
-	// Look at base directory, compute each file's hash list
-	dir, err := os.Open(client.BaseDir)
+	ring, err := blockStoreRing(client)
+	if err != nil {
+		log.Println("Cannot get block store addresses:", err)
+		return
+	}
+	var policies []*StoragePolicy
+	if err := client.GetStoragePolicies(&policies); err != nil {
+		log.Println("Cannot get storage policies:", err)
+		return
+	}
+
+	state := &syncState{
+		client:      client,
+		ring:        ring,
+		policies:    policies,
+		localFiles:  clientMetaMap,
+		localBlocks: clientBlockMap,
+		localIndex:  localIndexFileMetaMap,
+		remoteFiles: remoteFileInfoMap,
+		newIndex:    make(map[string]*FileMetaData),
+	}
+
+	allFilenames := make(map[string]bool)
+	for _, fileMetaMap := range []map[string]*FileMetaData{clientMetaMap, localIndexFileMetaMap, remoteFileInfoMap} {
+		for filename := range fileMetaMap {
+			allFilenames[filename] = true
+		}
+	}
+	filenames := make([]string, 0, len(allFilenames))
+	for filename := range allFilenames {
+		filenames = append(filenames, filename)
+	}
+	sort.Strings(filenames)
+
+	// Entries are handled children first, so that by the time a directory
+	// comes up we know whether anything under it is left
+	synced := true
+	for i := len(filenames) - 1; i >= 0; i-- {
+		if err := state.syncEntry(filenames[i]); err != nil {
+			log.Println("Failed to sync", filenames[i]+":", err)
+			// A denied change stays out of the index, so it is retried
+			// without holding back the revision
+			if !reportDenied(err, filenames[i]) {
+				synced = false
+			}
+		}
+	}
+
+	if err := WriteMetaFile(state.newIndex, client.BaseDir); err != nil {
+		log.Println("Failed to write index.txt:", err)
+		return
+	}
+
+	// Tell the server we have seen everything up to the revision we fetched,
+	// so it knows when deleted files can be forgotten. If anything failed the
+	// revision is left alone so those entries are looked at again next time.
+	if synced {
+		if err := WriteRevisionFile(client.BaseDir, remoteRevision); err != nil {
+			log.Println("Failed to write revision file.")
+		}
+		if err := client.AckSync(ClientId(client.BaseDir), remoteRevision); err != nil {
+			log.Println("Failed to acknowledge sync.")
+		}
+	}
+}
+
+// Tells the user about requests the server refused, returning whether the
+// error was a refusal
+func reportDenied(err error, what string) bool {
+	switch status.Code(err) {
+	case codes.PermissionDenied, codes.Unauthenticated:
+		fmt.Fprintln(os.Stderr, "Permission denied:", what+":", status.Convert(err).Message())
+		return true
+	}
+	return false
+}
+
+// syncState holds one sync's view of the base directory, the local index
+// and the server, and builds up the index to write back.
+type syncState struct {
+	client RPCClient
+	// Places each block on the BlockStore server it belongs to
+	ring *ConsistentHashRing
+	// Which files are erasure coded instead of replicated
+	policies []*StoragePolicy
+
+	localFiles  map[string]*FileMetaData
+	localBlocks map[string]*Block
+	localIndex  map[string]*FileMetaData
+	remoteFiles map[string]*FileMetaData
+
+	newIndex map[string]*FileMetaData
+}
+
+// Conflict cases
+// 1. No local changes, remote version higher -> download from remote and update local index
+// 2. Local changes, local index and remote version same -> upload, then update local index
+// 3. Local changes, remote version higher -> the upload is rejected, so bring the local file up to date with the server
+func (s *syncState) syncEntry(filename string) error {
+	local, inBaseDir := s.localFiles[filename]
+	indexed, inLocalIndex := s.localIndex[filename]
+	remote, inServer := s.remoteFiles[filename]
+
+	// A directory holding synced files exists even if it was just created
+	// by downloading them
+	hasLiveChildren := isDirectory(filename) && s.hasLiveChildren(filename)
+	if hasLiveChildren && !inBaseDir {
+		local, inBaseDir = &FileMetaData{Filename: filename}, true
+	}
+
+	var update *FileMetaData
+	if inBaseDir && (!inLocalIndex || isTombstone(indexed) || fileModified(local, indexed)) {
+		// New or changed since the last sync
+		update = local
+		update.Version = indexed.GetVersion() + 1
+	} else if !inBaseDir && inLocalIndex && !isTombstone(indexed) {
+		// Deleted since the last sync
+		update = &FileMetaData{Filename: filename, Version: indexed.Version + 1, BlockHashList: []string{TOMBSTONE_HASH}}
+	}
+
+	if update != nil {
+		err := s.upload(update)
+		if err == nil {
+			s.newIndex[filename] = update
+			return nil
+		}
+		// Only give up our change for a version the server has and we have not seen
+		if !inServer || (inLocalIndex && remote.Version <= indexed.Version) {
+			s.keepIndexed(filename)
+			return err
+		}
+	}
+
+	if !inServer {
+		s.keepIndexed(filename)
+		return nil
+	}
+	if update == nil && inLocalIndex && indexed.Version == remote.Version {
+		s.newIndex[filename] = indexed
+		return nil
+	}
+
+	if hasLiveChildren && isTombstone(remote) {
+		// Another client removed the directory while files under it were
+		// kept here, so bring it back
+		revived := &FileMetaData{Filename: filename, Version: remote.Version + 1}
+		if err := s.upload(revived); err != nil {
+			s.keepIndexed(filename)
+			return err
+		}
+		s.newIndex[filename] = revived
+		return nil
+	}
+
+	if err := s.download(remote); err != nil {
+		s.keepIndexed(filename)
+		return err
+	}
+	s.newIndex[filename] = remote
+	return nil
+}
+
+func (s *syncState) keepIndexed(filename string) {
+	if indexed, ok := s.localIndex[filename]; ok {
+		s.newIndex[filename] = indexed
+	}
+}
+
+// Reports whether anything already synced under the directory still exists
+func (s *syncState) hasLiveChildren(dirname string) bool {
+	for filename, fileMeta := range s.newIndex {
+		if strings.HasPrefix(filename, dirname) && !isTombstone(fileMeta) {
+			return true
+		}
+	}
+	return false
+}
+
+// Stores the blocks the block store is missing, then the metadata
+func (s *syncState) upload(fileMeta *FileMetaData) error {
+	// An attribute-only change reuses the blocks of the last synced version
+	indexed, inLocalIndex := s.localIndex[fileMeta.Filename]
+	sameBlocks := inLocalIndex && !IsBlockHashListModified(fileMeta.BlockHashList, indexed.BlockHashList)
+	if !isTombstone(fileMeta) && len(fileMeta.BlockHashList) > 0 && !sameBlocks {
+		var err error
+		if policy := storagePolicyFor(s.policies, fileMeta.Filename); policy != nil {
+			err = s.uploadStripes(fileMeta, policy)
+		} else {
+			err = s.uploadReplicas(fileMeta)
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	var latestVersion int32
+	return s.client.UpdateFile(fileMeta, &latestVersion)
+}
+
+// Puts each block on its replicas; one copy is enough to commit the file
+func (s *syncState) uploadReplicas(fileMeta *FileMetaData) error {
+	placement := make(map[string][]string)
+	for _, hash := range fileMeta.BlockHashList {
+		placement[hash] = s.ring.GetReplicaServers(hash)
+	}
+	stored, lastErr := s.putBlocks(s.localBlocks, placement)
+	for _, hash := range fileMeta.BlockHashList {
+		if len(stored[hash]) == 0 {
+			return lastErr
+		}
+	}
+	return nil
+}
+
+// Erasure codes each block and puts every shard on its own server, adding
+// the stripes to the metadata. A block needs as many shards stored as it
+// takes to rebuild it.
+func (s *syncState) uploadStripes(fileMeta *FileMetaData, policy *StoragePolicy) error {
+	rs, err := NewReedSolomon(int(policy.DataShards), int(policy.ParityShards))
 	if err != nil {
-		log.Println("Cannot open the directory.")
+		return err
 	}
-	list, _ := dir.Readdirnames(0)
-	for _, filename := range list {
-		if filename == "index.txt" {
+	stripes := make([]*ErasureStripe, 0)
+	shards := make(map[string]*Block)
+	placement := make(map[string][]string)
+	for _, hash := range fileMeta.BlockHashList {
+		if _, ok := placement[hash]; ok {
 			continue
 		}
-		f, _ := os.Open(ConcatPath(client.BaseDir, filename))
-		i := 0
-		var newBlockHashList []string
-		// Read block size bytes for each until until EOF
-		for {
-			buf := make([]byte, client.BlockSize)
-			bytesRead, err := f.Read(buf)
-			if err != nil {
-				break
+		placement[hash] = nil
+		block := s.localBlocks[hash]
+		stripe := &ErasureStripe{BlockHash: hash, BlockSize: block.BlockSize, DataShards: policy.DataShards}
+		servers := s.ring.GetShardServers(hash, rs.DataShards+rs.ParityShards)
+		for i, data := range rs.Encode(block.BlockData) {
+			shardHash := GetBlockHashString(data)
+			stripe.ShardHashes = append(stripe.ShardHashes, shardHash)
+			shards[shardHash] = &Block{BlockData: data, BlockSize: int32(len(data))}
+			placement[shardHash] = append(placement[shardHash], servers[i])
+		}
+		stripes = append(stripes, stripe)
+	}
+
+	stored, lastErr := s.putBlocks(shards, placement)
+	for _, stripe := range stripes {
+		servers := s.ring.GetShardServers(stripe.BlockHash, len(stripe.ShardHashes))
+		storedShards := 0
+		for i, shardHash := range stripe.ShardHashes {
+			if stored[shardHash][servers[i]] {
+				storedShards++
+			}
+		}
+		if storedShards < int(stripe.DataShards) {
+			if lastErr == nil {
+				lastErr = ERR_TOO_FEW_SHARDS
+			}
+			return lastErr
+		}
+	}
+	fileMeta.ErasureStripes = stripes
+	return nil
+}
+
+// Puts blocks on the servers placement lists for them, returning the
+// servers holding each block and the last error. A server that cannot be
+// written to is repaired later. Unhealthy servers are skipped, and
+// repaired later, unless they are all a block has.
+func (s *syncState) putBlocks(blocks map[string]*Block, placement map[string][]string) (map[string]map[string]bool, error) {
+	for hash, servers := range placement {
+		healthy := make([]string, 0, len(servers))
+		for _, blockStoreAddr := range servers {
+			if !s.ring.Unhealthy[blockStoreAddr] {
+				healthy = append(healthy, blockStoreAddr)
+			}
+		}
+		if len(healthy) > 0 {
+			placement[hash] = healthy
+		}
+	}
+	stored := make(map[string]map[string]bool)
+	var lastErr error
+	for hash, servers := range placement {
+		stored[hash] = make(map[string]bool)
+		for _, blockStoreAddr := range servers {
+			var succ bool
+			err := s.client.PutBlock(blocks[hash], blockStoreAddr, &succ)
+			if err == nil && !succ {
+				err = fmt.Errorf("block store %s did not store block %s", blockStoreAddr, hash)
 			}
-			// Encode with sha256 and hex encoding
-			var newBlock Block
-			// Sum(buf...)
-			newBlock.BlockData = buf[:bytesRead]
-			newBlock.BlockSize = int32(bytesRead)
-			encodedHash := GetBlockHashString(newBlock.BlockData)
-			clientBlockMap[encodedHash] = &newBlock
-			newBlockHashList = append(newBlockHashList, encodedHash)
-			i++
-		}
-
-		var newFileMetaData FileMetaData
-		newFileMetaData.Filename = filename
-		newFileMetaData.BlockHashList = newBlockHashList
-		newFileMetaData.Version = 1
-
-		// check if a file is in local index
-		fLoc, inLocalIndex := localIndexFileMetaMap[filename]
-		if inLocalIndex {
-			if IsBlockHashListModified(newBlockHashList, fLoc.BlockHashList) {
-				newFileMetaData.Version = fLoc.Version + 1
-			} else {
-				newFileMetaData.Version = fLoc.Version
+			if err != nil {
+				log.Println("Cannot put block:", err)
+				lastErr = err
+				continue
 			}
+			stored[hash][blockStoreAddr] = true
 		}
+	}
+	return stored, lastErr
+}
 
-		clientMetaMap[filename] = &newFileMetaData
-		_, inSet := allFileMetaMap[filename]
-		if !inSet {
-			allFileMetaMap[filename] = true
+// Makes the base directory match the server's version of an entry
+func (s *syncState) download(fileMeta *FileMetaData) error {
+	localPath, err := localPathFor(s.client.BaseDir, fileMeta.Filename)
+	if err != nil {
+		return err
+	}
+	switch {
+	case isTombstone(fileMeta) && isDirectory(fileMeta.Filename):
+		return os.RemoveAll(localPath)
+	case isTombstone(fileMeta):
+		if err := os.Remove(localPath); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return nil
+	case isDirectory(fileMeta.Filename):
+		if err := os.MkdirAll(localPath, 0755); err != nil {
+			return err
 		}
-		f.Close()
+		return applyAttributes(localPath, fileMeta)
 	}
-	dir.Close()
+	return downloadFile(s.client, s.ring, fileMeta, localPath)
+}
 
-	// Compare local index with remote index
-	// 1. If files on remote index not in local or base dir, download those files, add to local index
-	// 2. If files not in local OR remote (add to remote first, then if successful add to local)
-	remoteFileInfoMap := make(map[string]*FileMetaData)
-	serverErr := client.GetFileInfoMap(&remoteFileInfoMap)
-	if serverErr != nil {
-		log.Println("Failed to get remote index.")
-	}
-	for filename := range remoteFileInfoMap {
-		_, inSet := allFileMetaMap[filename]
-		if !inSet {
-			allFileMetaMap[filename] = true
-		}
-	}
-
-	// Conflict cases
-	// 1. No local changes, remote version higher -> download blocks from remote and update local index and file in local base dir
-	// 2. Uncomitted local changes, local index and remote index version same, update mapping on remote, then local index (no file change necessary)
-	// 3. Local modifications to file (uncommited local changes), file version on remote > local index -> update local with remote version / bring local version of file up to date with server
-	for fname := range allFileMetaMap {
-		fBasedDir, inBasedDir := clientMetaMap[fname]
-		fLocalIndex, inLocalIndex := localIndexFileMetaMap[fname]
-		fServer, inServer := remoteFileInfoMap[fname]
-
-		var newFileMetaData FileMetaData
-		var latestVersion int32
-
-		// Case: in Based dir (in or not in Local) -> Update File (get from server if err)
-		// Case: not in based dir, in Local (DELETED) -> UpdateFile (get from server if err)
-		// Case: Otherwise, not in EITHER -> Get from Server
-		if inBasedDir || inLocalIndex {
-			// changed or new file
-			if inBasedDir {
-				// TestSyncTwoClientsSameFile error
-				// TODO: check hash differ
-				newFileMetaData = *fBasedDir
-				var blockStoreAddr string
-				err := client.GetBlockStoreAddr(&blockStoreAddr)
-				if err != nil {
-					log.Println("Cannot get block store address.")
-				}
-				for _, blockHash := range newFileMetaData.BlockHashList {
-					newBlock := clientBlockMap[blockHash]
-					var succ bool
-					client.PutBlock(newBlock, blockStoreAddr, &succ)
-				}
-			} else if inLocalIndex {
-				// Deleted File
-				newFileMetaData.Filename = fname
-				newFileMetaData.Version = fLocalIndex.Version + 1
-				newFileMetaData.BlockHashList = []string{"0"}
+// Reports whether an entry in the base directory differs from its last
+// synced version. Entries synced before attributes were recorded are
+// compared by content alone.
+func fileModified(local *FileMetaData, indexed *FileMetaData) bool {
+	if IsBlockHashListModified(local.BlockHashList, indexed.BlockHashList) || local.SymlinkTarget != indexed.SymlinkTarget {
+		return true
+	}
+	if indexed.Mode == 0 && indexed.Mtime == 0 {
+		return false
+	}
+	return local.Mode != indexed.Mode || local.Mtime != indexed.Mtime || local.Size != indexed.Size
+}
+
+// Sets the permission bits and modification time recorded for an entry.
+// Directory times change whenever their contents do, so they are not kept.
+func applyAttributes(localPath string, fileMeta *FileMetaData) error {
+	if fileMeta.Mode != 0 {
+		if err := os.Chmod(localPath, fs.FileMode(fileMeta.Mode)&fs.ModePerm); err != nil {
+			return err
+		}
+	}
+	if fileMeta.Mtime != 0 && !isDirectory(fileMeta.Filename) {
+		mtime := time.Unix(0, fileMeta.Mtime)
+		if err := os.Chtimes(localPath, mtime, mtime); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Builds the ring the MetaStore places blocks with, and while it is
+// rebalancing, the ring blocks are moving away from. Servers the MetaStore
+// reports unhealthy are marked on it. A client using a cache puts every
+// block on it instead.
+func blockStoreRing(client RPCClient) (*ConsistentHashRing, error) {
+	if client.BlockCacheAddr != "" {
+		return NewConsistentHashRing([]string{client.BlockCacheAddr}), nil
+	}
+	var blockStoreAddrs, previousAddrs, unhealthyAddrs []string
+	var replicationFactor int
+	if err := client.GetBlockStoreAddrs(&blockStoreAddrs, &replicationFactor, &previousAddrs, &unhealthyAddrs); err != nil {
+		return nil, err
+	}
+	ring := NewConsistentHashRing(blockStoreAddrs)
+	ring.Unhealthy = make(map[string]bool)
+	for _, addr := range unhealthyAddrs {
+		ring.Unhealthy[addr] = true
+	}
+	if len(previousAddrs) > 0 {
+		ring.Previous = NewConsistentHashRing(previousAddrs)
+	}
+	if replicationFactor > 1 {
+		ring.ReplicationFactor = replicationFactor
+		if ring.Previous != nil {
+			ring.Previous.ReplicationFactor = replicationFactor
+		}
+	}
+	return ring, nil
+}
+
+// Tries each replica of a block in turn until one returns it intact,
+// then the replicas on the previous ring, leaving unhealthy ones for last
+func getBlockFromReplicas(client RPCClient, ring *ConsistentHashRing, blockHash string, block *Block) error {
+	err := ERR_BLOCK_NOT_FOUND
+	replicas := ring.GetReplicaServers(blockHash)
+	if ring.Previous != nil {
+		for _, blockStoreAddr := range ring.Previous.GetReplicaServers(blockHash) {
+			if !containsAddr(replicas, blockStoreAddr) {
+				replicas = append(replicas, blockStoreAddr)
 			}
+		}
+	}
+	for _, blockStoreAddr := range ring.HealthyFirst(replicas) {
+		if err = client.GetBlock(blockHash, blockStoreAddr, block); err != nil {
+			log.Println("Cannot get block from", blockStoreAddr+":", err)
+			continue
+		}
+		// Never write a block the server corrupted into the user's file
+		if GetBlockHashString(block.BlockData) != blockHash {
+			err = ERR_CORRUPT_BLOCK
+			continue
+		}
+		return nil
+	}
+	return err
+}
 
-			err = client.UpdateFile(&newFileMetaData, &latestVersion)
-			// If err -> download from server
-			if err != nil {
-				// Check if updated version is to remove file
-				if len(fServer.BlockHashList) == 1 && fServer.BlockHashList[0] == "0" {
-					os.Remove(ConcatPath(client.BaseDir, fname))
-				} else {
-					// TODO: remote version == loc version?
-
-					// If updated version is new content in the file
-					updatedFile, _ := os.OpenFile(ConcatPath(client.BaseDir, fname), os.O_APPEND|os.O_RDWR|os.O_CREATE, 0755)
-					updatedFile.Truncate(0)
-					var blockStoreAddr string
-					err = client.GetBlockStoreAddr(&blockStoreAddr)
-					if err != nil {
-						log.Println(err)
-					}
-					for _, blockHash := range fServer.BlockHashList {
-						var blockToGet Block
-						err = client.GetBlock(blockHash, blockStoreAddr, &blockToGet)
-						if err != nil {
-							log.Println("Cannot get block.")
-							log.Println(err)
-						}
-						updatedFile.Write(blockToGet.BlockData)
-					}
-					updatedFile.Close()
-				}
-				// Write to index.txt server version
-				indFile.Write([]byte(fname + "," + strconv.Itoa(int(fServer.GetVersion())) + "," + strings.Join(fServer.BlockHashList, " ") + "\n"))
-			} else {
-				indFile.Write([]byte(fname + "," + strconv.Itoa(int(newFileMetaData.GetVersion())) + "," + strings.Join(newFileMetaData.BlockHashList, " ") + "\n"))
+// Rebuilds an erasure-coded block from the first shards that can be read
+// intact, looking for each on the previous ring too
+func getBlockFromShards(client RPCClient, ring *ConsistentHashRing, stripe *ErasureStripe, block *Block) error {
+	rs, err := NewReedSolomon(int(stripe.DataShards), len(stripe.ShardHashes)-int(stripe.DataShards))
+	if err != nil {
+		return err
+	}
+	shards := make([][]byte, len(stripe.ShardHashes))
+	servers := ring.GetShardServers(stripe.BlockHash, len(shards))
+	var previousServers []string
+	if ring.Previous != nil {
+		previousServers = ring.Previous.GetShardServers(stripe.BlockHash, len(shards))
+	}
+	found := 0
+	err = ERR_TOO_FEW_SHARDS
+	for i := 0; i < len(shards) && found < rs.DataShards; i++ {
+		candidates := []string{servers[i]}
+		if previousServers != nil && previousServers[i] != servers[i] {
+			candidates = append(candidates, previousServers[i])
+		}
+		for _, blockStoreAddr := range ring.HealthyFirst(candidates) {
+			var shard Block
+			if getErr := client.GetBlock(stripe.ShardHashes[i], blockStoreAddr, &shard); getErr != nil {
+				log.Println("Cannot get shard from", blockStoreAddr+":", getErr)
+				continue
 			}
-		} else if inServer {
-			// Download from Server
-			if len(fServer.BlockHashList) == 1 && fServer.BlockHashList[0] == "0" {
-				os.Remove(ConcatPath(client.BaseDir, fname))
-			} else {
-				// If updated version is new content in the file
-				var blockStoreAddr string
-				err = client.GetBlockStoreAddr(&blockStoreAddr)
-				if err != nil {
-					log.Println(err)
-				}
-				updatedFile, _ := os.OpenFile(ConcatPath(client.BaseDir, fname), os.O_APPEND|os.O_RDWR|os.O_CREATE, 0755)
-				updatedFile.Truncate(0)
-				for _, blockHash := range fServer.BlockHashList {
-					var blockToGet Block
-					err = client.GetBlock(blockHash, blockStoreAddr, &blockToGet)
-					if err != nil {
-						log.Println("Cannot get block.")
-						log.Println(err)
-					}
-					updatedFile.Write(blockToGet.BlockData)
-				}
-				updatedFile.Close()
+			if GetBlockHashString(shard.BlockData) == stripe.ShardHashes[i] {
+				shards[i] = shard.BlockData
+				found++
+				break
 			}
-			// Write to index.txt server
-			indFile.Write([]byte(fname + "," + strconv.Itoa(int(fServer.GetVersion())) + "," + strings.Join(fServer.BlockHashList, " ") + "\n"))
 		}
 	}
+	if found < rs.DataShards {
+		return err
+	}
+	data, err := rs.Decode(shards, int(stripe.BlockSize))
+	if err != nil {
+		return err
+	}
+	if GetBlockHashString(data) != stripe.BlockHash {
+		return ERR_CORRUPT_BLOCK
+	}
+	block.BlockData = data
+	block.BlockSize = stripe.BlockSize
+	return nil
+}
 
-	indFile.Close()
+// Writes a file's blocks (or its symlink) next to it and then moves it
+// into place, so a failed download leaves the old contents alone
+func downloadFile(client RPCClient, ring *ConsistentHashRing, fileMeta *FileMetaData, localPath string) error {
+	if err := os.MkdirAll(filepath.Dir(localPath), 0755); err != nil {
+		return err
+	}
+	tmpPath := localPath + DOWNLOAD_SUFFIX
+	os.Remove(tmpPath)
 
-	log.Println("\n Server Map After")
-	client.GetFileInfoMap(&remoteFileInfoMap)
-	PrintMetaMap(remoteFileInfoMap)
+	if fileMeta.SymlinkTarget != "" {
+		if err := os.Symlink(fileMeta.SymlinkTarget, tmpPath); err != nil {
+			return err
+		}
+		return os.Rename(tmpPath, localPath)
+	}
+
+	file, err := os.OpenFile(tmpPath, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	stripes := make(map[string]*ErasureStripe)
+	for _, stripe := range fileMeta.ErasureStripes {
+		stripes[stripe.BlockHash] = stripe
+	}
+	for _, blockHash := range fileMeta.BlockHashList {
+		var block Block
+		if stripe, ok := stripes[blockHash]; ok {
+			err = getBlockFromShards(client, ring, stripe, &block)
+		} else {
+			err = getBlockFromReplicas(client, ring, blockHash, &block)
+		}
+		if err != nil {
+			break
+		}
+		if _, err = file.Write(block.BlockData); err != nil {
+			break
+		}
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = applyAttributes(tmpPath, fileMeta)
+	}
+	if err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+	return os.Rename(tmpPath, localPath)
 }
 
-func IsBlockHashListModified(hashList1 []string, hashList2 []string) bool {
-	res := false
-	if ((hashList1 == nil) != (hashList2 == nil)) || (len(hashList1) != len(hashList2)) {
-		res = true
-	} else {
-		for i := range hashList1 {
-			if hashList1[i] != hashList2[i] {
-				res = true
-				break
+// Walks the base directory and splits every file into blocks. Files are
+// keyed by their path relative to the base directory, using "/" as the
+// separator; directories are keyed the same way with a trailing "/".
+func scanBaseDir(baseDir string, blockSize int) (map[string]*FileMetaData, map[string]*Block, error) {
+	fileMetaMap := make(map[string]*FileMetaData)
+	blockMap := make(map[string]*Block)
+
+	err := filepath.WalkDir(baseDir, func(filePath string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		relPath, err := filepath.Rel(baseDir, filePath)
+		if err != nil {
+			return err
+		}
+		if relPath == "." {
+			return nil
+		}
+		filename := filepath.ToSlash(relPath)
+		info, err := entry.Info()
+		if err != nil {
+			return err
+		}
+
+		if entry.IsDir() {
+			filename += DIRECTORY_SUFFIX
+			fileMetaMap[filename] = &FileMetaData{Filename: filename, Mode: uint32(info.Mode().Perm())}
+			return nil
+		}
+		if filename == DEFAULT_META_FILENAME || filename == DEFAULT_REVISION_FILENAME || strings.HasSuffix(filename, DOWNLOAD_SUFFIX) {
+			return nil
+		}
+
+		// Symlinks are synced as their target, never followed
+		if entry.Type()&fs.ModeSymlink != 0 {
+			target, err := os.Readlink(filePath)
+			if err != nil {
+				return err
+			}
+			fileMetaMap[filename] = &FileMetaData{Filename: filename, SymlinkTarget: target}
+			return nil
+		}
+		if !entry.Type().IsRegular() {
+			return nil
+		}
+
+		hashList, err := splitFile(filePath, blockSize, blockMap)
+		if err != nil {
+			return err
+		}
+		fileMetaMap[filename] = &FileMetaData{
+			Filename:      filename,
+			BlockHashList: hashList,
+			Mode:          uint32(info.Mode().Perm()),
+			Mtime:         info.ModTime().UnixNano(),
+			Size:          info.Size(),
+		}
+		return nil
+	})
+	return fileMetaMap, blockMap, err
+}
+
+// Reads a file block by block, adding each block to blockMap
+func splitFile(filePath string, blockSize int, blockMap map[string]*Block) ([]string, error) {
+	f, err := os.Open(filePath)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var hashList []string
+	for {
+		buf := make([]byte, blockSize)
+		bytesRead, err := io.ReadFull(f, buf)
+		if bytesRead > 0 {
+			block := &Block{BlockData: buf[:bytesRead], BlockSize: int32(bytesRead)}
+			hash := GetBlockHashString(block.BlockData)
+			blockMap[hash] = block
+			hashList = append(hashList, hash)
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return hashList, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+}
+
+// Maps a synced filename to a path under the base directory, refusing
+// names that would land outside it, including through a synced symlink
+func localPathFor(baseDir string, filename string) (string, error) {
+	name := strings.TrimSuffix(filename, DIRECTORY_SUFFIX)
+	if name == "" || path.IsAbs(name) || path.Clean(name) != name || name == ".." || strings.HasPrefix(name, "../") {
+		return "", fmt.Errorf("invalid filename %q", filename)
+	}
+
+	parts := strings.Split(name, "/")
+	parent := baseDir
+	for _, part := range parts[:len(parts)-1] {
+		parent = ConcatPath(parent, part)
+		if info, err := os.Lstat(parent); err == nil && info.Mode()&fs.ModeSymlink != 0 {
+			return "", fmt.Errorf("filename %q is under a symlink", filename)
+		}
+	}
+	return ConcatPath(baseDir, filepath.FromSlash(name)), nil
+}
+
+func isDirectory(filename string) bool {
+	return strings.HasSuffix(filename, DIRECTORY_SUFFIX)
+}
+
+// ClientCheckout writes the files as they were at a past revision (or
+// time, when revision is 0) into an empty base directory. No index is
+// written, so the checkout is not synced afterwards.
+func ClientCheckout(client RPCClient, revision int64, timestamp int64) error {
+	if err := os.MkdirAll(client.BaseDir, 0755); err != nil {
+		return err
+	}
+	entries, err := os.ReadDir(client.BaseDir)
+	if err != nil {
+		return err
+	}
+	if len(entries) > 0 {
+		return fmt.Errorf("%s is not empty", client.BaseDir)
+	}
+
+	var fileInfoMap map[string]*FileMetaData
+	var atRevision int64
+	if err := client.GetFileInfoMapAt(revision, timestamp, &fileInfoMap, &atRevision); err != nil {
+		return err
+	}
+	ring, err := blockStoreRing(client)
+	if err != nil {
+		return err
+	}
+
+	for filename, fileMeta := range fileInfoMap {
+		if isTombstone(fileMeta) {
+			continue
+		}
+		localPath, err := localPathFor(client.BaseDir, filename)
+		if err != nil {
+			return err
+		}
+		if isDirectory(filename) {
+			if err = os.MkdirAll(localPath, 0755); err == nil {
+				err = applyAttributes(localPath, fileMeta)
 			}
+		} else {
+			err = downloadFile(client, ring, fileMeta, localPath)
+		}
+		if err != nil {
+			return err
 		}
 	}
-	return res
+	log.Println("Checked out revision", atRevision)
+	return nil
+}
+
+// ClientId identifies a synced directory to the server
+func ClientId(baseDir string) string {
+	hostname, _ := os.Hostname()
+	absBaseDir, err := filepath.Abs(baseDir)
+	if err != nil {
+		absBaseDir = baseDir
+	}
+	return hostname + ":" + absBaseDir
+}
+
+// Empty and nil hash lists are the same: both are an empty file
+func IsBlockHashListModified(hashList1 []string, hashList2 []string) bool {
+	return !stringSlicesEqual(hashList1, hashList2)
 }
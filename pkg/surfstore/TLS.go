@@ -0,0 +1,104 @@
+package surfstore
+
+import (
+	context "context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"os"
+	"path"
+
+	grpc "google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+)
+
+// TLSConfig holds the certificates a process uses on its gRPC links.
+// A nil *TLSConfig keeps every link in plaintext.
+type TLSConfig struct {
+	serverTLS *tls.Config
+	clientTLS *tls.Config
+	// Replication RPCs are only accepted from callers presenting a
+	// certificate signed by the CA (mutual TLS between peers)
+	requirePeerCert bool
+}
+
+// Loads a certificate and key to present and a CA to trust. Clients that
+// do not present a certificate leave certFile and keyFile empty, and an
+// empty caFile trusts the system roots instead. Requiring peer
+// certificates needs a CA to check them against.
+func LoadTLSConfig(certFile string, keyFile string, caFile string, requirePeerCert bool) (*TLSConfig, error) {
+	t := &TLSConfig{
+		serverTLS:       &tls.Config{MinVersion: tls.VersionTLS12},
+		clientTLS:       &tls.Config{MinVersion: tls.VersionTLS12},
+		requirePeerCert: requirePeerCert,
+	}
+
+	if certFile != "" || keyFile != "" {
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return nil, err
+		}
+		// Servers present the same certificate when they call their peers
+		t.serverTLS.Certificates = []tls.Certificate{cert}
+		t.clientTLS.Certificates = []tls.Certificate{cert}
+	}
+
+	if caFile != "" {
+		caPEM, err := os.ReadFile(caFile)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(caPEM) {
+			return nil, fmt.Errorf("no certificates found in %s", caFile)
+		}
+		t.clientTLS.RootCAs = pool
+		// Clients may connect without a certificate; the ones that present
+		// one must be signed by the CA
+		t.serverTLS.ClientCAs = pool
+		t.serverTLS.ClientAuth = tls.VerifyClientCertIfGiven
+	} else if requirePeerCert {
+		return nil, fmt.Errorf("mutual TLS needs a CA file")
+	}
+	return t, nil
+}
+
+// Returns the gRPC server options that serve over TLS
+func (t *TLSConfig) ServerOptions() []grpc.ServerOption {
+	if t == nil {
+		return nil
+	}
+	opts := []grpc.ServerOption{grpc.Creds(credentials.NewTLS(t.serverTLS))}
+	if t.requirePeerCert {
+		opts = append(opts, grpc.ChainUnaryInterceptor(t.peerCertInterceptor))
+	}
+	return opts
+}
+
+// Returns the dial option every outgoing connection uses
+func (t *TLSConfig) DialOption() grpc.DialOption {
+	if t == nil {
+		return grpc.WithTransportCredentials(insecure.NewCredentials())
+	}
+	return grpc.WithTransportCredentials(credentials.NewTLS(t.clientTLS))
+}
+
+func (t *TLSConfig) peerCertInterceptor(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	if serverMethods[path.Base(info.FullMethod)] && !hasVerifiedPeerCert(ctx) {
+		return nil, status.Error(codes.Unauthenticated, "peer certificate required")
+	}
+	return handler(ctx, req)
+}
+
+func hasVerifiedPeerCert(ctx context.Context) bool {
+	p, ok := peer.FromContext(ctx)
+	if !ok {
+		return false
+	}
+	tlsInfo, ok := p.AuthInfo.(credentials.TLSInfo)
+	return ok && len(tlsInfo.State.VerifiedChains) > 0
+}
@@ -0,0 +1,161 @@
+package surfstore
+
+import (
+	"container/list"
+	"log"
+	"sync"
+	"time"
+)
+
+// TieredBlockStorage keeps every block in a durable cold tier and the most
+// recently read ones in a memory tier capped at a number of bytes. Reads
+// that miss memory promote the block, evicting the least recently used
+// blocks to make room.
+type TieredBlockStorage struct {
+	cold     BlockStorage
+	maxBytes int64
+
+	mutex sync.Mutex
+	// Most recently used at the front; values are *hotBlock
+	lru      *list.List
+	hot      map[string]*list.Element
+	hotBytes int64
+	// Blocks being read from the cold tier, so that a read finishing after
+	// a delete does not bring the block back into memory
+	reads map[string]*coldRead
+	stats TieredStorageStats
+}
+
+// TieredStorageStats counts how the memory tier has been doing
+type TieredStorageStats struct {
+	Hits      int64
+	Misses    int64
+	Evictions int64
+	// Blocks and bytes currently held in memory
+	HotBlocks int64
+	HotBytes  int64
+}
+
+type hotBlock struct {
+	key   string
+	block *Block
+}
+
+type coldRead struct {
+	readers int
+	deleted bool
+}
+
+func NewTieredBlockStorage(cold BlockStorage, maxBytes int64) *TieredBlockStorage {
+	return &TieredBlockStorage{
+		cold:     cold,
+		maxBytes: maxBytes,
+		lru:      list.New(),
+		hot:      map[string]*list.Element{},
+		reads:    map[string]*coldRead{},
+	}
+}
+
+func (s *TieredBlockStorage) Get(namespace string, hash string) (*Block, error) {
+	key := blockKey(namespace, hash)
+	s.mutex.Lock()
+	if elem, ok := s.hot[key]; ok {
+		s.lru.MoveToFront(elem)
+		s.stats.Hits++
+		s.mutex.Unlock()
+		return elem.Value.(*hotBlock).block, nil
+	}
+	s.stats.Misses++
+	read, ok := s.reads[key]
+	if !ok {
+		read = &coldRead{}
+		s.reads[key] = read
+	}
+	read.readers++
+	s.mutex.Unlock()
+
+	block, err := s.cold.Get(namespace, hash)
+	s.promote(key, read, block)
+	return block, err
+}
+
+// Blocks only go to memory once they are read
+func (s *TieredBlockStorage) Put(namespace string, hash string, block *Block) error {
+	return s.cold.Put(namespace, hash, block)
+}
+
+// Checks memory, then the cold tier, without loading the block
+func (s *TieredBlockStorage) Has(namespace string, hash string) (bool, error) {
+	s.mutex.Lock()
+	_, ok := s.hot[blockKey(namespace, hash)]
+	s.mutex.Unlock()
+	if ok {
+		return true, nil
+	}
+	return s.cold.Has(namespace, hash)
+}
+
+func (s *TieredBlockStorage) Delete(namespace string, hash string) error {
+	key := blockKey(namespace, hash)
+	s.mutex.Lock()
+	if elem, ok := s.hot[key]; ok {
+		s.lru.Remove(elem)
+		delete(s.hot, key)
+		s.hotBytes -= int64(len(elem.Value.(*hotBlock).block.GetBlockData()))
+	}
+	if read, ok := s.reads[key]; ok {
+		read.deleted = true
+	}
+	s.mutex.Unlock()
+	return s.cold.Delete(namespace, hash)
+}
+
+// Every block is in the cold tier
+func (s *TieredBlockStorage) Walk(visit func(namespace string, hash string) error) error {
+	return s.cold.Walk(visit)
+}
+
+func (s *TieredBlockStorage) Stats() TieredStorageStats {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	stats := s.stats
+	stats.HotBlocks = int64(len(s.hot))
+	stats.HotBytes = s.hotBytes
+	return stats
+}
+
+// Logs the memory tier's counters every interval
+func (s *TieredBlockStorage) StatsLoop(interval time.Duration) {
+	for range time.Tick(interval) {
+		stats := s.Stats()
+		log.Println(SURF_SERVER, "memory tier:", stats.Hits, "hits,", stats.Misses, "misses,", stats.Evictions, "evictions,", stats.HotBlocks, "blocks,", stats.HotBytes, "bytes")
+	}
+}
+
+// Ends a read from the cold tier, keeping the block in memory unless it
+// was deleted while it was being read
+func (s *TieredBlockStorage) promote(key string, read *coldRead, block *Block) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	read.readers--
+	if read.readers == 0 {
+		delete(s.reads, key)
+	}
+	size := int64(len(block.GetBlockData()))
+	if block == nil || read.deleted || size > s.maxBytes {
+		return
+	}
+	// Another reader may have promoted it in the meantime
+	if _, ok := s.hot[key]; ok {
+		return
+	}
+	for s.hotBytes+size > s.maxBytes {
+		oldest := s.lru.Back()
+		evicted := s.lru.Remove(oldest).(*hotBlock)
+		delete(s.hot, evicted.key)
+		s.hotBytes -= int64(len(evicted.block.GetBlockData()))
+		s.stats.Evictions++
+	}
+	s.hot[key] = s.lru.PushFront(&hotBlock{key: key, block: block})
+	s.hotBytes += size
+}
@@ -0,0 +1,117 @@
+package SurfTest
+
+import (
+	context "context"
+	"cse224/proj5/pkg/surfstore"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/status"
+	emptypb "google.golang.org/protobuf/types/known/emptypb"
+)
+
+const AUTH_CONFIG = `# test users
+user alice alice-token
+user bob bob-token
+user ops ops-token admin
+user carol carol-token
+user meta1 meta1-token server
+user meta2 meta2-token server
+grant alice rw * docs/
+grant bob r * docs/
+grant carol rw team *
+`
+
+// Tokens are required, writes outside a user's grants are refused, and
+// only admins reach the testing RPCs.
+func TestAuthAccessControl(t *testing.T) {
+	cfgPath := filepath.Join(t.TempDir(), "auth.txt")
+	noError(os.WriteFile(cfgPath, []byte(AUTH_CONFIG), 0600))
+	auth, err := surfstore.LoadAuthConfigFile(cfgPath)
+	if err != nil {
+		t.Fatalf("Could not load auth config: %v", err)
+	}
+
+	grpcServer := grpc.NewServer(auth.ServerOptions()...)
+	metaStore := surfstore.NewMetaStore("")
+	metaStore.Auth = auth
+	surfstore.RegisterMetaStoreServer(grpcServer, metaStore)
+	blockStore := surfstore.NewReplicatedBlockStore(0, []string{""})
+	blockStore.Auth = auth
+	surfstore.RegisterBlockStoreServer(grpcServer, blockStore)
+	ln, err := net.Listen("tcp", "localhost:0")
+	noError(err)
+	go grpcServer.Serve(ln)
+	defer grpcServer.Stop()
+
+	conn, err := grpc.Dial(ln.Addr().String(), grpc.WithTransportCredentials(insecure.NewCredentials()))
+	noError(err)
+	defer conn.Close()
+	metaClient := surfstore.NewMetaStoreClient(conn)
+	blockClient := surfstore.NewBlockStoreClient(conn)
+
+	ctx := context.Background()
+	alice := surfstore.WithToken(ctx, "alice-token")
+	bob := surfstore.WithToken(ctx, "bob-token")
+	ops := surfstore.WithToken(ctx, "ops-token")
+	carol := surfstore.WithToken(ctx, "carol-token")
+
+	_, err = metaClient.GetFileInfoMap(ctx, &emptypb.Empty{})
+	if status.Code(err) != codes.Unauthenticated {
+		t.Fatalf("A call without a token should be unauthenticated, got %v", err)
+	}
+
+	_, err = metaClient.UpdateFile(alice, NewFileMetaDataFromParams("docs/a.txt", 1, []string{"hash1"}))
+	if err != nil {
+		t.Fatalf("alice should be able to write under docs/: %v", err)
+	}
+	_, err = metaClient.UpdateFile(alice, NewFileMetaDataFromParams("secret.txt", 1, []string{"hash2"}))
+	if status.Code(err) != codes.PermissionDenied {
+		t.Fatalf("alice should not be able to write secret.txt, got %v", err)
+	}
+	_, err = metaClient.UpdateFile(bob, NewFileMetaDataFromParams("docs/b.txt", 1, []string{"hash3"}))
+	if status.Code(err) != codes.PermissionDenied {
+		t.Fatalf("bob should not be able to write, got %v", err)
+	}
+
+	fim, err := metaClient.GetFileInfoMap(bob, &emptypb.Empty{})
+	noError(err)
+	fileMeta, ok := fim.FileInfoMap["docs/a.txt"]
+	if !ok || len(fim.FileInfoMap) != 1 {
+		t.Fatalf("bob should see exactly docs/a.txt")
+	}
+	if fileMeta.Owner != "alice" {
+		t.Fatalf("docs/a.txt should be owned by alice, got %q", fileMeta.Owner)
+	}
+
+	// Acknowledgements need a grant in the namespace, and count for the
+	// caller's own clients
+	_, err = metaClient.AckSync(carol, &surfstore.SyncAck{ClientId: "laptop", Revision: 1})
+	if status.Code(err) != codes.PermissionDenied {
+		t.Fatalf("carol should not be able to acknowledge outside her namespace, got %v", err)
+	}
+	_, err = metaClient.AckSync(surfstore.WithNamespace(carol, "team"), &surfstore.SyncAck{ClientId: "laptop", Revision: 1})
+	noError(err)
+	_, err = metaClient.AckSync(alice, &surfstore.SyncAck{ClientId: "bob/laptop", Revision: 1})
+	noError(err)
+	if len(metaStore.ClientRevisions) != 1 || metaStore.ClientRevisions["alice/bob/laptop"] != 1 {
+		t.Fatalf("alice's acknowledgement should only count for her own client, got %v", metaStore.ClientRevisions)
+	}
+	if auth.ServerToken() != "meta1-token" {
+		t.Fatalf("Servers should use the first server token in the file, got %q", auth.ServerToken())
+	}
+
+	_, err = blockClient.Crash(alice, &emptypb.Empty{})
+	if status.Code(err) != codes.PermissionDenied {
+		t.Fatalf("alice should not be able to crash a server, got %v", err)
+	}
+	_, err = blockClient.Crash(ops, &emptypb.Empty{})
+	if err != nil {
+		t.Fatalf("ops should be able to crash a server: %v", err)
+	}
+}
@@ -0,0 +1,99 @@
+package SurfTest
+
+import (
+	context "context"
+	"cse224/proj5/pkg/surfstore"
+	"net"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc"
+)
+
+// An upstream BlockStore far enough away for concurrent misses to overlap
+type slowBlockStore struct {
+	*surfstore.BlockStore
+	gets int32
+}
+
+func (s *slowBlockStore) GetBlock(ctx context.Context, blockHash *surfstore.BlockHash) (*surfstore.Block, error) {
+	atomic.AddInt32(&s.gets, 1)
+	time.Sleep(200 * time.Millisecond)
+	return s.BlockStore.GetBlock(ctx, blockHash)
+}
+
+// A cache writes blocks through to its upstream, fetches each missing
+// block from it once however many readers ask, and then serves it itself.
+func TestCachingBlockStore(t *testing.T) {
+	ctx := context.Background()
+	ln, err := net.Listen("tcp", "localhost:0")
+	noError(err)
+	upstream := &slowBlockStore{BlockStore: surfstore.NewBlockStore()}
+	grpcServer := grpc.NewServer()
+	surfstore.RegisterBlockStoreServer(grpcServer, upstream)
+	go grpcServer.Serve(ln)
+	defer grpcServer.Stop()
+	cache := surfstore.NewCachingBlockStore(ln.Addr().String())
+
+	written := &surfstore.Block{BlockData: []byte("written at the branch"), BlockSize: 21}
+	succ, err := cache.PutBlock(ctx, written)
+	if err != nil || !succ.Flag {
+		t.Fatalf("PutBlock through the cache failed: %v", err)
+	}
+	if ok, _ := upstream.Storage.Has(surfstore.DEFAULT_NAMESPACE, surfstore.GetBlockHashString(written.BlockData)); !ok {
+		t.Fatalf("Expected the block to be written through to the upstream")
+	}
+
+	data := []byte("written at the office")
+	hash := surfstore.GetBlockHashString(data)
+	noError(upstream.Storage.Put(surfstore.DEFAULT_NAMESPACE, hash, &surfstore.Block{BlockData: data, BlockSize: int32(len(data))}))
+	has, err := cache.HasBlocks(ctx, &surfstore.BlockHashes{Hashes: []string{hash}})
+	noError(err)
+	if len(has.Hashes) != 1 {
+		t.Fatalf("Expected the cache to report the upstream's blocks, got %v", has.Hashes)
+	}
+
+	// five readers miss at once
+	var wg sync.WaitGroup
+	errs := make(chan error, 5)
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			block, err := cache.GetBlock(ctx, &surfstore.BlockHash{Hash: hash})
+			if err == nil && string(block.BlockData) != string(data) {
+				err = surfstore.ERR_CORRUPT_BLOCK
+			}
+			errs <- err
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		noError(err)
+	}
+	if gets := atomic.LoadInt32(&upstream.gets); gets != 1 {
+		t.Fatalf("Expected concurrent misses to share one upstream fetch, got %d", gets)
+	}
+
+	// later reads stay at the branch
+	_, err = cache.GetBlock(ctx, &surfstore.BlockHash{Hash: hash})
+	noError(err)
+	stats := cache.Stats()
+	if atomic.LoadInt32(&upstream.gets) != 1 || stats.Hits != 1 || stats.Misses != 1 || stats.SharedMisses != 4 {
+		t.Fatalf("Expected one miss shared by four readers and then a hit, got %+v", stats)
+	}
+
+	// only the most recently used block fits
+	cache.MaxBytes = int64(len(data))
+	_, err = cache.PutBlock(ctx, &surfstore.Block{BlockData: []byte("newer block"), BlockSize: 11})
+	noError(err)
+	if stats := cache.Stats(); stats.Blocks != 1 || stats.Evictions != 2 {
+		t.Fatalf("Expected the older blocks to be evicted, got %+v", stats)
+	}
+	if ok, _ := cache.Storage.Has(surfstore.DEFAULT_NAMESPACE, hash); ok {
+		t.Fatalf("Expected the evicted block to be removed from the cache's storage")
+	}
+}
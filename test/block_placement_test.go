@@ -0,0 +1,217 @@
+package SurfTest
+
+import (
+	context "context"
+	"cse224/proj5/pkg/surfstore"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"google.golang.org/grpc"
+	emptypb "google.golang.org/protobuf/types/known/emptypb"
+)
+
+// Every server owns part of the ring, and removing a server only moves
+// the blocks it owned.
+func TestConsistentHashRing(t *testing.T) {
+	addrs := []string{"localhost:8081", "localhost:8082", "localhost:8083"}
+	ring := surfstore.NewConsistentHashRing(addrs)
+	smaller := surfstore.NewConsistentHashRing(addrs[:2])
+
+	owned := make(map[string]int)
+	for i := 0; i < 300; i++ {
+		hash := surfstore.GetBlockHashString([]byte(fmt.Sprintf("block %d", i)))
+		server := ring.GetResponsibleServer(hash)
+		owned[server]++
+		if server != addrs[2] && smaller.GetResponsibleServer(hash) != server {
+			t.Fatalf("Block %d moved although its server is still on the ring", i)
+		}
+	}
+	for _, addr := range addrs {
+		if owned[addr] == 0 {
+			t.Fatalf("Server %s owns no blocks: %v", addr, owned)
+		}
+	}
+}
+
+// A file's blocks are spread across the BlockStores by hash, each
+// BlockStore only holds the blocks it owns, and another client puts the
+// file back together.
+func TestSyncAcrossBlockStores(t *testing.T) {
+	cfgPath := "./config_files/3nodes.txt"
+	test := InitBlockStoresTest(cfgPath, "8080", "8081")
+	defer EndTest(test)
+	test.Clients[0].SetLeader(test.Context, &emptypb.Empty{})
+	test.Clients[0].SendHeartbeat(test.Context, &emptypb.Empty{})
+
+	worker1 := InitDirectoryWorker("test0", SRC_PATH)
+	worker2 := InitDirectoryWorker("test1", SRC_PATH)
+	defer worker1.CleanUp()
+	defer worker2.CleanUp()
+
+	file1 := "spread_file.txt"
+	data := make([]byte, 0, 20*BLOCK_SIZE)
+	hashes := make([]string, 0)
+	for i := 0; i < 20; i++ {
+		block := make([]byte, BLOCK_SIZE)
+		copy(block, fmt.Sprintf("block number %d", i))
+		data = append(data, block...)
+		hashes = append(hashes, surfstore.GetBlockHashString(block))
+	}
+	noError(os.WriteFile(filepath.Join(worker1.DirectoryName, file1), data, 0644))
+
+	if err := SyncClient("localhost:8080", "test0", BLOCK_SIZE, cfgPath); err != nil {
+		t.Fatalf("Sync failed: %v", err)
+	}
+
+	addrs := []string{"localhost:8080", "localhost:8081"}
+	ring := surfstore.NewConsistentHashRing(addrs)
+	for _, addr := range addrs {
+		conn, err := grpc.Dial(addr, grpc.WithInsecure())
+		noError(err)
+		defer conn.Close()
+		has, err := surfstore.NewBlockStoreClient(conn).HasBlocks(test.Context, &surfstore.BlockHashes{Hashes: hashes})
+		noError(err)
+		expected := make([]string, 0)
+		for _, hash := range hashes {
+			if ring.GetResponsibleServer(hash) == addr {
+				expected = append(expected, hash)
+			}
+		}
+		if len(expected) == 0 || !SameHashList(has.Hashes, expected) {
+			t.Fatalf("BlockStore %s should hold exactly the %d blocks it owns, got %d", addr, len(expected), len(has.Hashes))
+		}
+	}
+
+	if err := SyncClient("localhost:8080", "test1", BLOCK_SIZE, cfgPath); err != nil {
+		t.Fatalf("Sync failed: %v", err)
+	}
+	c, e := SameFile(filepath.Join(worker2.DirectoryName, file1), filepath.Join(worker1.DirectoryName, file1))
+	if e != nil || !c {
+		t.Fatalf("The file did not sync across BlockStores")
+	}
+}
+
+// A block's replicas are distinct servers, starting with the one
+// responsible for it, and there are never more than the servers.
+func TestReplicaServers(t *testing.T) {
+	addrs := []string{"localhost:8081", "localhost:8082", "localhost:8083"}
+	ring := surfstore.NewConsistentHashRing(addrs)
+	ring.ReplicationFactor = 2
+	for i := 0; i < 100; i++ {
+		hash := surfstore.GetBlockHashString([]byte(fmt.Sprintf("block %d", i)))
+		replicas := ring.GetReplicaServers(hash)
+		if len(replicas) != 2 || replicas[0] != ring.GetResponsibleServer(hash) || replicas[0] == replicas[1] {
+			t.Fatalf("Block %d has the wrong replicas: %v", i, replicas)
+		}
+	}
+	ring.ReplicationFactor = 5
+	if replicas := ring.GetReplicaServers(surfstore.GetBlockHashString([]byte("block"))); len(replicas) != 3 {
+		t.Fatalf("Expected every server as a replica, got %v", replicas)
+	}
+}
+
+// Repair copies a block missing from one replica back from the other, and
+// reports blocks missing from every replica as lost.
+func TestRepairBlocks(t *testing.T) {
+	ctx := context.Background()
+	blockStores := make([]*surfstore.BlockStore, 0)
+	addrs := make([]string, 0)
+	for i := 0; i < 3; i++ {
+		blockStore := surfstore.NewBlockStore()
+		ln, err := net.Listen("tcp", "localhost:0")
+		noError(err)
+		grpcServer := grpc.NewServer()
+		surfstore.RegisterBlockStoreServer(grpcServer, blockStore)
+		go grpcServer.Serve(ln)
+		defer grpcServer.Stop()
+		blockStores = append(blockStores, blockStore)
+		addrs = append(addrs, ln.Addr().String())
+	}
+	byAddr := make(map[string]*surfstore.BlockStore)
+	for i, addr := range addrs {
+		byAddr[addr] = blockStores[i]
+	}
+
+	metaStore := surfstore.NewMetaStore(addrs...)
+	metaStore.ReplicationFactor = 2
+	ring := surfstore.NewConsistentHashRing(addrs)
+	ring.ReplicationFactor = 2
+
+	hashes := make([]string, 0)
+	for _, data := range []string{"first block", "second block"} {
+		block := &surfstore.Block{BlockData: []byte(data), BlockSize: int32(len(data))}
+		hash := surfstore.GetBlockHashString(block.BlockData)
+		for _, addr := range ring.GetReplicaServers(hash) {
+			_, err := byAddr[addr].PutBlock(ctx, block)
+			noError(err)
+		}
+		hashes = append(hashes, hash)
+	}
+	_, err := metaStore.UpdateFile(ctx, &surfstore.FileMetaData{Filename: "file1", Version: 1, BlockHashList: hashes})
+	noError(err)
+
+	report := metaStore.RepairBlocks()
+	if report.CheckedBlocks != 2 || report.UnderReplicatedBlocks != 0 {
+		t.Fatalf("Expected 2 fully replicated blocks, got %+v", report)
+	}
+
+	damaged := ring.GetReplicaServers(hashes[0])[1]
+	noError(byAddr[damaged].Storage.Delete("", hashes[0]))
+	for _, addr := range ring.GetReplicaServers(hashes[1]) {
+		noError(byAddr[addr].Storage.Delete("", hashes[1]))
+	}
+	report = metaStore.RepairBlocks()
+	if report.UnderReplicatedBlocks != 2 || report.RepairedCopies != 1 || report.FailedCopies != 0 {
+		t.Fatalf("Expected 1 copy repaired out of 2 under-replicated blocks, got %+v", report)
+	}
+	if len(report.LostBlocks) != 1 || report.LostBlocks[0] != hashes[1] {
+		t.Fatalf("The block missing from both replicas should be lost, got %v", report.LostBlocks)
+	}
+	if ok, _ := byAddr[damaged].Storage.Has("", hashes[0]); !ok {
+		t.Fatalf("The missing copy should have been repaired")
+	}
+	last, err := metaStore.GetRepairReport(ctx, &emptypb.Empty{})
+	noError(err)
+	if last.Timestamp != report.Timestamp {
+		t.Fatalf("GetRepairReport should return the last repair")
+	}
+}
+
+// With every block on two of three BlockStores, a file still syncs down
+// after one of them dies.
+func TestSyncWithDeadBlockStore(t *testing.T) {
+	cfgPath := "./config_files/3nodes.txt"
+	test := InitReplicatedBlockStoresTest(cfgPath, 2, "8080", "8081", "8082")
+	defer EndTest(test)
+	test.Clients[0].SetLeader(test.Context, &emptypb.Empty{})
+	test.Clients[0].SendHeartbeat(test.Context, &emptypb.Empty{})
+
+	worker1 := InitDirectoryWorker("test0", SRC_PATH)
+	worker2 := InitDirectoryWorker("test1", SRC_PATH)
+	defer worker1.CleanUp()
+	defer worker2.CleanUp()
+
+	file1 := "replicated_file.txt"
+	data := make([]byte, 0, 20*BLOCK_SIZE)
+	for i := 0; i < 20; i++ {
+		block := make([]byte, BLOCK_SIZE)
+		copy(block, fmt.Sprintf("block number %d", i))
+		data = append(data, block...)
+	}
+	noError(os.WriteFile(filepath.Join(worker1.DirectoryName, file1), data, 0644))
+	if err := SyncClient("localhost:8080", "test0", BLOCK_SIZE, cfgPath); err != nil {
+		t.Fatalf("Sync failed: %v", err)
+	}
+
+	noError(test.Procs[1].Process.Kill())
+	if err := SyncClient("localhost:8080", "test1", BLOCK_SIZE, cfgPath); err != nil {
+		t.Fatalf("Sync failed: %v", err)
+	}
+	c, e := SameFile(filepath.Join(worker2.DirectoryName, file1), filepath.Join(worker1.DirectoryName, file1))
+	if e != nil || !c {
+		t.Fatalf("The file should be read from the surviving replicas")
+	}
+}
@@ -0,0 +1,188 @@
+package SurfTest
+
+import (
+	context "context"
+	"cse224/proj5/pkg/surfstore"
+	"fmt"
+	"net"
+	"testing"
+
+	"google.golang.org/grpc"
+	emptypb "google.golang.org/protobuf/types/known/emptypb"
+)
+
+// A block put through one replica survives that replica crashing, and a replica that missed the write can still serve it.
+func TestBlockReplicaCrash(t *testing.T) {
+	//Setup
+	cfgPath := "./config_files/3blocks.txt"
+	test := InitBlockReplicaTest(cfgPath)
+	defer EndTest(test)
+
+	block := &surfstore.Block{BlockData: []byte("replicated block"), BlockSize: 16}
+	hash := surfstore.GetBlockHashString(block.BlockData)
+
+	// one replica down still leaves a quorum
+	test.BlockClients[2].Crash(test.Context, &emptypb.Empty{})
+	succ, err := test.BlockClients[0].PutBlock(test.Context, block)
+	if err != nil || !succ.Flag {
+		t.Fatalf("PutBlock should succeed with a quorum of replicas")
+	}
+
+	// the crashed replica does not serve requests
+	_, err = test.BlockClients[2].GetBlock(test.Context, &surfstore.BlockHash{Hash: hash})
+	if err == nil {
+		t.Fatalf("Crashed replica should not serve GetBlock")
+	}
+
+	// the writer goes down, the block is still readable
+	test.BlockClients[0].Crash(test.Context, &emptypb.Empty{})
+	got, err := test.BlockClients[1].GetBlock(test.Context, &surfstore.BlockHash{Hash: hash})
+	if err != nil || string(got.BlockData) != string(block.BlockData) {
+		t.Fatalf("Block should be readable from a surviving replica")
+	}
+
+	// two replicas down is not a quorum
+	other := &surfstore.Block{BlockData: []byte("no quorum"), BlockSize: 9}
+	succ, err = test.BlockClients[1].PutBlock(test.Context, other)
+	if err == nil && succ.Flag {
+		t.Fatalf("PutBlock should fail without a quorum of replicas")
+	}
+
+	// a restored replica that missed the write fetches it from its peers
+	test.BlockClients[2].Restore(test.Context, &emptypb.Empty{})
+	got, err = test.BlockClients[2].GetBlock(test.Context, &surfstore.BlockHash{Hash: hash})
+	if err != nil || string(got.BlockData) != string(block.BlockData) {
+		t.Fatalf("Restored replica should serve the block from its peers")
+	}
+}
+
+// Starts a group of replicas in this process, so tests can reach into their storage
+func startBlockReplicas(t *testing.T, n int) ([]*surfstore.ReplicatedBlockStore, []string) {
+	listeners := make([]net.Listener, n)
+	addrs := make([]string, n)
+	for i := range listeners {
+		ln, err := net.Listen("tcp", "localhost:0")
+		noError(err)
+		listeners[i] = ln
+		addrs[i] = ln.Addr().String()
+	}
+	replicas := make([]*surfstore.ReplicatedBlockStore, n)
+	for i, ln := range listeners {
+		replicas[i] = surfstore.NewReplicatedBlockStore(int64(i), addrs)
+		grpcServer := grpc.NewServer()
+		surfstore.RegisterBlockStoreServer(grpcServer, replicas[i])
+		go grpcServer.Serve(ln)
+		t.Cleanup(grpcServer.Stop)
+	}
+	return replicas, addrs
+}
+
+// Replicas that missed some writes find the differing blocks through their Merkle trees and copy them both ways.
+func TestAntiEntropy(t *testing.T) {
+	replicas, addrs := startBlockReplicas(t, 2)
+
+	put := func(replica *surfstore.ReplicatedBlockStore, namespace string, data string) string {
+		hash := surfstore.GetBlockHashString([]byte(data))
+		noError(replica.Storage.Put(namespace, hash, &surfstore.Block{BlockData: []byte(data), BlockSize: int32(len(data))}))
+		return hash
+	}
+	for i := 0; i < 500; i++ {
+		for _, replica := range replicas {
+			put(replica, surfstore.DEFAULT_NAMESPACE, fmt.Sprintf("shared block %d", i))
+		}
+	}
+	onlyA := []string{put(replicas[0], surfstore.DEFAULT_NAMESPACE, "a1"), put(replicas[0], surfstore.DEFAULT_NAMESPACE, "a2"), put(replicas[0], "team", "a3")}
+	onlyB := []string{put(replicas[1], surfstore.DEFAULT_NAMESPACE, "b1"), put(replicas[1], surfstore.DEFAULT_NAMESPACE, "b2")}
+
+	stats, err := replicas[0].AntiEntropy(addrs[1])
+	noError(err)
+	if stats.Pulled != 2 || stats.Pushed != 3 || stats.Failed != 0 {
+		t.Fatalf("Expected 2 blocks pulled and 3 pushed, got %+v", stats)
+	}
+	if stats.DifferingBuckets > 5 || stats.ComparedNodes > 2*8*5+1 {
+		t.Fatalf("Only the paths to the differing buckets should be compared, got %+v", stats)
+	}
+	for i, hash := range onlyA {
+		namespace := surfstore.DEFAULT_NAMESPACE
+		if i == 2 {
+			namespace = "team"
+		}
+		if ok, _ := replicas[1].Storage.Has(namespace, hash); !ok {
+			t.Fatalf("Block only on the first replica should have been pushed")
+		}
+	}
+	for _, hash := range onlyB {
+		if ok, _ := replicas[0].Storage.Has(surfstore.DEFAULT_NAMESPACE, hash); !ok {
+			t.Fatalf("Block only on the second replica should have been pulled")
+		}
+	}
+
+	// In sync, the roots match
+	stats, err = replicas[1].AntiEntropy(addrs[0])
+	noError(err)
+	if stats.ComparedNodes != 1 || stats.DifferingBuckets != 0 || stats.Pulled != 0 || stats.Pushed != 0 {
+		t.Fatalf("Replicas in sync should only compare their roots, got %+v", stats)
+	}
+
+	// A replica that missed a delete has its copy deleted rather than
+	// copied back to the replica that deleted it
+	for _, replica := range replicas {
+		replica.GCGracePeriod = 0
+	}
+	replicas[1].Crash(context.Background(), &emptypb.Empty{})
+	deleted, err := replicas[0].DeleteBlocks(context.Background(), &surfstore.BlockHashes{Hashes: onlyB})
+	noError(err)
+	if len(deleted.Hashes) != 2 {
+		t.Fatalf("Expected the blocks to be deleted, got %v", deleted.Hashes)
+	}
+	replicas[1].Restore(context.Background(), &emptypb.Empty{})
+	stats, err = replicas[1].AntiEntropy(addrs[0])
+	noError(err)
+	if stats.Pushed != 0 || stats.Deleted != 2 {
+		t.Fatalf("Expected the missed deletes to be applied instead of the blocks pushed back, got %+v", stats)
+	}
+
+	// or when the replica that deleted it starts the exchange
+	replicas[1].Crash(context.Background(), &emptypb.Empty{})
+	_, err = replicas[0].DeleteBlocks(context.Background(), &surfstore.BlockHashes{Hashes: onlyA[:2]})
+	noError(err)
+	replicas[1].Restore(context.Background(), &emptypb.Empty{})
+	stats, err = replicas[0].AntiEntropy(addrs[1])
+	noError(err)
+	if stats.Pulled != 0 || stats.Deleted != 2 {
+		t.Fatalf("Expected the missed deletes to be applied instead of the blocks pulled back, got %+v", stats)
+	}
+	for _, replica := range replicas {
+		for _, hash := range []string{onlyA[0], onlyA[1], onlyB[0], onlyB[1]} {
+			if ok, _ := replica.Storage.Has(surfstore.DEFAULT_NAMESPACE, hash); ok {
+				t.Fatalf("Expected deleted blocks to stay deleted")
+			}
+		}
+	}
+}
+
+// Blocks collected through one replica are deleted from its peers too, so
+// none of them serves the block to a replica falling back on it.
+func TestReplicatedDeleteBlocks(t *testing.T) {
+	replicas, _ := startBlockReplicas(t, 3)
+	data := []byte("collected block")
+	hash := surfstore.GetBlockHashString(data)
+	for _, replica := range replicas {
+		replica.GCGracePeriod = 0
+		noError(replica.Storage.Put(surfstore.DEFAULT_NAMESPACE, hash, &surfstore.Block{BlockData: data, BlockSize: int32(len(data))}))
+	}
+
+	deleted, err := replicas[0].DeleteBlocks(context.Background(), &surfstore.BlockHashes{Hashes: []string{hash}})
+	noError(err)
+	if len(deleted.Hashes) != 1 {
+		t.Fatalf("Expected the block to be deleted, got %v", deleted.Hashes)
+	}
+	for i, replica := range replicas {
+		if ok, _ := replica.Storage.Has(surfstore.DEFAULT_NAMESPACE, hash); ok {
+			t.Fatalf("Expected replica %d to have deleted its copy", i)
+		}
+	}
+	if _, err := replicas[1].GetBlock(context.Background(), &surfstore.BlockHash{Hash: hash}); err == nil {
+		t.Fatalf("Expected no replica to serve the deleted block")
+	}
+}
@@ -0,0 +1,313 @@
+package SurfTest
+
+import (
+	"bytes"
+	context "context"
+	"cse224/proj5/pkg/surfstore"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// The filesystem backend stores blocks under their sharded hash, keeps
+// namespaces apart, survives being reopened, and refuses hashes that are
+// not hex.
+func TestFileBlockStorage(t *testing.T) {
+	ctx := context.Background()
+	root := t.TempDir()
+	storage, err := surfstore.NewFileBlockStorage(root)
+	noError(err)
+	blockStore := surfstore.NewBlockStore()
+	blockStore.Storage = storage
+
+	data := []byte("block contents")
+	hash := surfstore.GetBlockHashString(data)
+	succ, err := blockStore.PutBlock(ctx, &surfstore.Block{BlockData: data, BlockSize: int32(len(data))})
+	if err != nil || !succ.Flag {
+		t.Fatalf("Could not put block: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(root, hash[0:2], hash[2:4], hash)); err != nil {
+		t.Fatalf("Block should be stored under its sharded hash: %v", err)
+	}
+
+	storage, err = surfstore.NewFileBlockStorage(root)
+	noError(err)
+	blockStore = surfstore.NewBlockStore()
+	blockStore.Storage = storage
+	block, err := blockStore.GetBlock(ctx, &surfstore.BlockHash{Hash: hash})
+	if err != nil || block == nil || string(block.BlockData) != string(data) || block.BlockSize != int32(len(data)) {
+		t.Fatalf("Block did not survive reopening the storage: %v", err)
+	}
+
+	has, err := blockStore.HasBlocks(ctx, &surfstore.BlockHashes{Hashes: []string{hash, "../../etc/passwd"}})
+	noError(err)
+	if !SameHashList(has.Hashes, []string{hash}) {
+		t.Fatalf("Expected only the stored block, got %v", has.Hashes)
+	}
+	has, err = blockStore.HasBlocks(namespaceContext("team"), &surfstore.BlockHashes{Hashes: []string{hash}})
+	noError(err)
+	if len(has.Hashes) != 0 {
+		t.Fatalf("Blocks should not leak across namespaces")
+	}
+}
+
+// The memory tier stays under its byte limit, evicting the least recently
+// read block, and HasBlocks does not pull blocks into memory.
+func TestTieredBlockStorage(t *testing.T) {
+	ctx := context.Background()
+	cold, err := surfstore.NewFileBlockStorage(t.TempDir())
+	noError(err)
+	storage := surfstore.NewTieredBlockStorage(cold, 25)
+	blockStore := surfstore.NewBlockStore()
+	blockStore.Storage = storage
+
+	hashes := make([]string, 0)
+	for _, data := range []string{"0123456789", "abcdefghij", "ABCDEFGHIJ"} {
+		_, err := blockStore.PutBlock(ctx, &surfstore.Block{BlockData: []byte(data), BlockSize: int32(len(data))})
+		noError(err)
+		hashes = append(hashes, surfstore.GetBlockHashString([]byte(data)))
+	}
+
+	has, err := blockStore.HasBlocks(ctx, &surfstore.BlockHashes{Hashes: hashes})
+	noError(err)
+	if len(has.Hashes) != 3 || storage.Stats().HotBlocks != 0 {
+		t.Fatalf("HasBlocks should find every block without loading any")
+	}
+
+	for _, hash := range []string{hashes[0], hashes[1], hashes[0], hashes[2]} {
+		block, err := blockStore.GetBlock(ctx, &surfstore.BlockHash{Hash: hash})
+		if err != nil || block == nil {
+			t.Fatalf("Could not get block: %v", err)
+		}
+	}
+	stats := storage.Stats()
+	if stats.Hits != 1 || stats.Misses != 3 || stats.Evictions != 1 {
+		t.Fatalf("Expected 1 hit, 3 misses and 1 eviction, got %+v", stats)
+	}
+	if stats.HotBytes > 25 || stats.HotBlocks != 2 {
+		t.Fatalf("Memory tier went over its limit: %+v", stats)
+	}
+
+	// hashes[1] was the least recently read, so it is the one evicted
+	_, err = blockStore.GetBlock(ctx, &surfstore.BlockHash{Hash: hashes[0]})
+	noError(err)
+	if storage.Stats().Hits != 2 {
+		t.Fatalf("The most recently read blocks should have stayed in memory")
+	}
+}
+
+// pausedStorage holds every Get until it is released, after telling the
+// test it has read the block
+type pausedStorage struct {
+	surfstore.BlockStorage
+	read    chan struct{}
+	release chan struct{}
+}
+
+func (s *pausedStorage) Get(namespace string, hash string) (*surfstore.Block, error) {
+	block, err := s.BlockStorage.Get(namespace, hash)
+	s.read <- struct{}{}
+	<-s.release
+	return block, err
+}
+
+// A block deleted while it is being read from the cold tier is not put
+// back in memory, so it is not served after the delete.
+func TestTieredBlockStorageDeleteDuringRead(t *testing.T) {
+	cold := &pausedStorage{BlockStorage: surfstore.NewMemoryBlockStorage(), read: make(chan struct{}, 1), release: make(chan struct{})}
+	storage := surfstore.NewTieredBlockStorage(cold, 1024)
+	data := []byte("block contents")
+	hash := surfstore.GetBlockHashString(data)
+	noError(storage.Put("", hash, &surfstore.Block{BlockData: data, BlockSize: int32(len(data))}))
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		storage.Get("", hash)
+	}()
+	<-cold.read
+	noError(storage.Delete("", hash))
+	close(cold.release)
+	<-done
+
+	if storage.Stats().HotBlocks != 0 {
+		t.Fatalf("A deleted block should not be promoted")
+	}
+	has, err := storage.Has("", hash)
+	noError(err)
+	block, err := storage.Get("", hash)
+	noError(err)
+	if has || block != nil {
+		t.Fatalf("A deleted block should not be served")
+	}
+}
+
+// Blocks appended to packs survive reopening, deletions stick, a torn
+// record is dropped, and repacking removes mostly-dead packs without
+// bringing deleted blocks back.
+func TestPackBlockStorage(t *testing.T) {
+	root := t.TempDir()
+	storage, err := surfstore.NewPackBlockStorage(root)
+	noError(err)
+	// Start a new pack after every two blocks
+	storage.SegmentBytes = 150
+
+	hashes := make([]string, 0)
+	for i := 0; i < 6; i++ {
+		data := []byte(fmt.Sprintf("block number %d", i))
+		hash := surfstore.GetBlockHashString(data)
+		noError(storage.Put("", hash, &surfstore.Block{BlockData: data, BlockSize: int32(len(data))}))
+		hashes = append(hashes, hash)
+	}
+	noError(storage.Delete("", hashes[0]))
+	noError(storage.Delete("", hashes[1]))
+	noError(storage.Delete("", hashes[2]))
+	noError(storage.Close())
+
+	packs, err := filepath.Glob(filepath.Join(root, "pack-*.pack"))
+	noError(err)
+	if len(packs) < 3 {
+		t.Fatalf("Expected the blocks to span several packs, got %d", len(packs))
+	}
+	last, err := os.OpenFile(packs[len(packs)-1], os.O_WRONLY|os.O_APPEND, 0600)
+	noError(err)
+	_, err = last.Write([]byte{0, 0, 0, 9, 1, 2})
+	noError(err)
+	noError(last.Close())
+
+	storage, err = surfstore.NewPackBlockStorage(root)
+	noError(err)
+	checkBlocks := func() {
+		for i, hash := range hashes {
+			block, err := storage.Get("", hash)
+			noError(err)
+			if deleted := i < 3; deleted != (block == nil) {
+				t.Fatalf("Block %d: expected deleted=%v", i, deleted)
+			}
+			if block != nil && string(block.BlockData) != fmt.Sprintf("block number %d", i) {
+				t.Fatalf("Block %d has the wrong contents", i)
+			}
+		}
+	}
+	checkBlocks()
+
+	noError(storage.Repack())
+	repacked, err := filepath.Glob(filepath.Join(root, "pack-*.pack"))
+	noError(err)
+	if _, err := os.Stat(packs[0]); !os.IsNotExist(err) {
+		t.Fatalf("The fully deleted first pack should have been removed")
+	}
+	checkBlocks()
+	noError(storage.Close())
+
+	storage, err = surfstore.NewPackBlockStorage(root)
+	noError(err)
+	defer storage.Close()
+	checkBlocks()
+	if after, _ := filepath.Glob(filepath.Join(root, "pack-*.pack")); len(after) != len(repacked) {
+		t.Fatalf("Reopening should not change the packs")
+	}
+}
+
+// A corrupt record in the middle of a pack is quarantined and skipped,
+// and the blocks after it stay readable, in the last pack as elsewhere.
+func TestPackBlockStorageSkipsCorruptRecords(t *testing.T) {
+	root := t.TempDir()
+	storage, err := surfstore.NewPackBlockStorage(root)
+	noError(err)
+	// Start a new pack after every three blocks
+	storage.SegmentBytes = 250
+
+	hashes := make([]string, 0)
+	for i := 0; i < 6; i++ {
+		data := []byte(fmt.Sprintf("block number %d", i))
+		hash := surfstore.GetBlockHashString(data)
+		noError(storage.Put("", hash, &surfstore.Block{BlockData: data, BlockSize: int32(len(data))}))
+		hashes = append(hashes, hash)
+	}
+	noError(storage.Close())
+
+	packs, err := filepath.Glob(filepath.Join(root, "pack-*.pack"))
+	noError(err)
+	if len(packs) != 2 {
+		t.Fatalf("Expected the blocks to span two packs, got %d", len(packs))
+	}
+	sizes := make([]int64, len(packs))
+	for i, pack := range packs {
+		// Flip a byte of the second block of each pack
+		data, err := os.ReadFile(pack)
+		noError(err)
+		offset := bytes.Index(data, []byte(fmt.Sprintf("block number %d", 3*i+1)))
+		data[offset] ^= 0xff
+		noError(os.WriteFile(pack, data, 0600))
+		sizes[i] = int64(len(data))
+	}
+
+	storage, err = surfstore.NewPackBlockStorage(root)
+	noError(err)
+	defer storage.Close()
+	for i, hash := range hashes {
+		block, err := storage.Get("", hash)
+		noError(err)
+		if corrupt := i%3 == 1; corrupt != (block == nil) {
+			t.Fatalf("Block %d: expected missing=%v", i, corrupt)
+		}
+	}
+	for i, pack := range packs {
+		if info, err := os.Stat(pack); err != nil || info.Size() != sizes[i] {
+			t.Fatalf("Expected %s not to be truncated", pack)
+		}
+	}
+	if quarantined, _ := filepath.Glob(filepath.Join(root, surfstore.QUARANTINE_DIRNAME, "*")); len(quarantined) != 2 {
+		t.Fatalf("Expected both corrupt records to be quarantined, got %v", quarantined)
+	}
+}
+
+// Blocks corrupted on disk are refused when verifying reads and found by
+// the scrubber, and either way are quarantined so clients upload them again.
+func TestBlockStoreScrub(t *testing.T) {
+	ctx := context.Background()
+	root := t.TempDir()
+	storage, err := surfstore.NewFileBlockStorage(filepath.Join(root, "blocks"))
+	noError(err)
+	blockStore := surfstore.NewBlockStore()
+	blockStore.Storage = storage
+	blockStore.VerifyOnRead = true
+	blockStore.QuarantineDir = filepath.Join(root, "quarantine")
+
+	hashes := make([]string, 0)
+	for _, data := range []string{"first block", "second block", "third block"} {
+		_, err := blockStore.PutBlock(ctx, &surfstore.Block{BlockData: []byte(data), BlockSize: int32(len(data))})
+		noError(err)
+		hashes = append(hashes, surfstore.GetBlockHashString([]byte(data)))
+	}
+	for _, hash := range hashes[:2] {
+		noError(os.WriteFile(filepath.Join(root, "blocks", hash[0:2], hash[2:4], hash), []byte("bit rot"), 0600))
+	}
+
+	_, err = blockStore.GetBlock(ctx, &surfstore.BlockHash{Hash: hashes[0]})
+	if status.Code(err) != codes.DataLoss {
+		t.Fatalf("A corrupt block should not be served, got %v", err)
+	}
+
+	checked, quarantined, err := blockStore.Scrub()
+	noError(err)
+	if checked != 2 || quarantined != 1 {
+		t.Fatalf("Expected the scrub to check 2 blocks and quarantine 1, got %d and %d", checked, quarantined)
+	}
+
+	has, err := blockStore.HasBlocks(ctx, &surfstore.BlockHashes{Hashes: hashes})
+	noError(err)
+	if !SameHashList(has.Hashes, hashes[2:]) {
+		t.Fatalf("Only the intact block should be left, got %v", has.Hashes)
+	}
+	quarantinedFiles, err := os.ReadDir(blockStore.QuarantineDir)
+	noError(err)
+	if len(quarantinedFiles) != 2 {
+		t.Fatalf("Both corrupt blocks should have been saved to the quarantine, got %d", len(quarantinedFiles))
+	}
+}
@@ -0,0 +1,201 @@
+package SurfTest
+
+import (
+	context "context"
+	"cse224/proj5/pkg/surfstore"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"google.golang.org/grpc"
+	emptypb "google.golang.org/protobuf/types/known/emptypb"
+)
+
+// Any 4 of 4 data and 2 parity shards rebuild the data, and 3 do not.
+func TestReedSolomon(t *testing.T) {
+	rs, err := surfstore.NewReedSolomon(4, 2)
+	noError(err)
+	data := make([]byte, 1001)
+	for i := range data {
+		data[i] = byte(i * 7)
+	}
+	encoded := rs.Encode(data)
+	if len(encoded) != 6 {
+		t.Fatalf("Expected 6 shards, got %d", len(encoded))
+	}
+
+	for first := 0; first < 6; first++ {
+		for second := first + 1; second < 6; second++ {
+			shards := make([][]byte, 6)
+			copy(shards, encoded)
+			shards[first], shards[second] = nil, nil
+			decoded, err := rs.Decode(shards, len(data))
+			if err != nil || !reflect.DeepEqual(decoded, data) {
+				t.Fatalf("Losing shards %d and %d should not lose data: %v", first, second, err)
+			}
+		}
+	}
+
+	shards := make([][]byte, 6)
+	copy(shards, encoded)
+	shards[0], shards[3], shards[5] = nil, nil, nil
+	if _, err := rs.Decode(shards, len(data)); err != surfstore.ERR_TOO_FEW_SHARDS {
+		t.Fatalf("Expected ERR_TOO_FEW_SHARDS with 3 shards left, got %v", err)
+	}
+}
+
+// A namespace's own rule for a prefix overrides the rule for every
+// namespace, and namespaces without rules only get the shared ones.
+func TestStoragePolicies(t *testing.T) {
+	policies, err := surfstore.LoadStoragePolicyFile("./config_files/erasure_policy.txt")
+	noError(err)
+	metaStore := surfstore.NewMetaStore()
+	metaStore.StoragePolicies = policies
+
+	shared, err := metaStore.GetStoragePolicies(context.Background(), &emptypb.Empty{})
+	noError(err)
+	if len(shared.Policies) != 1 || shared.Policies[0].Prefix != "big/" || shared.Policies[0].DataShards != 4 || shared.Policies[0].ParityShards != 2 {
+		t.Fatalf("Expected only the big/ policy, got %v", shared.Policies)
+	}
+	archive, err := metaStore.GetStoragePolicies(namespaceContext("archive"), &emptypb.Empty{})
+	noError(err)
+	if len(archive.Policies) != 3 {
+		t.Fatalf("Expected 3 policies in the archive namespace, got %v", archive.Policies)
+	}
+
+	for _, line := range []string{"* big/ erasure 4", "* big/ erasure 0 2", "* big/ mirror", "bad/ns * replicate"} {
+		path := filepath.Join(t.TempDir(), "policy.txt")
+		noError(os.WriteFile(path, []byte(line+"\n"), 0644))
+		if _, err := surfstore.LoadStoragePolicyFile(path); err == nil {
+			t.Fatalf("Expected %q to be rejected", line)
+		}
+	}
+
+	// Stripes must describe blocks of the file
+	_, err = metaStore.UpdateFile(context.Background(), &surfstore.FileMetaData{
+		Filename:       "big/file",
+		Version:        1,
+		BlockHashList:  []string{"abc"},
+		ErasureStripes: []*surfstore.ErasureStripe{{BlockHash: "def", DataShards: 1, ShardHashes: []string{"a", "b"}}},
+	})
+	if err == nil {
+		t.Fatalf("A stripe for a block the file does not have should be rejected")
+	}
+}
+
+// An erasure-coded file keeps one shard of each block per BlockStore and
+// still syncs down with two of the six BlockStores dead.
+func TestSyncErasureCoded(t *testing.T) {
+	cfgPath := "./config_files/3nodes.txt"
+	ports := []string{"8080", "8081", "8082", "8083", "8084", "8085"}
+	test := InitErasureCodedTest(cfgPath, "./config_files/erasure_policy.txt", ports...)
+	defer EndTest(test)
+	test.Clients[0].SetLeader(test.Context, &emptypb.Empty{})
+	test.Clients[0].SendHeartbeat(test.Context, &emptypb.Empty{})
+
+	worker1 := InitDirectoryWorker("test0", SRC_PATH)
+	worker2 := InitDirectoryWorker("test1", SRC_PATH)
+	defer worker1.CleanUp()
+	defer worker2.CleanUp()
+
+	file1 := "big/striped_file.txt"
+	data := make([]byte, 0, 10*BLOCK_SIZE)
+	hashes := make([]string, 0)
+	for i := 0; i < 10; i++ {
+		block := make([]byte, BLOCK_SIZE)
+		copy(block, fmt.Sprintf("block number %d", i))
+		data = append(data, block...)
+		hashes = append(hashes, surfstore.GetBlockHashString(block))
+	}
+	noError(os.MkdirAll(filepath.Join(worker1.DirectoryName, "big"), 0755))
+	noError(os.WriteFile(filepath.Join(worker1.DirectoryName, file1), data, 0644))
+	if err := SyncClient("localhost:8080", "test0", BLOCK_SIZE, cfgPath); err != nil {
+		t.Fatalf("Sync failed: %v", err)
+	}
+
+	state, err := test.Clients[0].GetFileInfoMap(test.Context, &emptypb.Empty{})
+	noError(err)
+	stripes := state.FileInfoMap[file1].GetErasureStripes()
+	if len(stripes) != len(hashes) {
+		t.Fatalf("Expected a stripe per block, got %d", len(stripes))
+	}
+	for i := range ports {
+		conn, err := grpc.Dial("localhost:"+ports[i], grpc.WithInsecure())
+		noError(err)
+		defer conn.Close()
+		has, err := surfstore.NewBlockStoreClient(conn).HasBlocks(test.Context, &surfstore.BlockHashes{Hashes: hashes})
+		noError(err)
+		if len(has.Hashes) != 0 {
+			t.Fatalf("BlockStore %s should only hold shards, not whole blocks", ports[i])
+		}
+	}
+
+	noError(test.Procs[1].Process.Kill())
+	noError(test.Procs[4].Process.Kill())
+	if err := SyncClient("localhost:8080", "test1", BLOCK_SIZE, cfgPath); err != nil {
+		t.Fatalf("Sync failed: %v", err)
+	}
+	c, e := SameFile(filepath.Join(worker2.DirectoryName, file1), filepath.Join(worker1.DirectoryName, file1))
+	if e != nil || !c {
+		t.Fatalf("The file should be rebuilt from the remaining shards")
+	}
+}
+
+// Repair rebuilds a lost shard from the others, and reports a block with
+// too few shards left as lost.
+func TestRepairStripes(t *testing.T) {
+	ctx := context.Background()
+	byAddr := make(map[string]*surfstore.BlockStore)
+	addrs := make([]string, 0)
+	for i := 0; i < 3; i++ {
+		blockStore := surfstore.NewBlockStore()
+		ln, err := net.Listen("tcp", "localhost:0")
+		noError(err)
+		grpcServer := grpc.NewServer()
+		surfstore.RegisterBlockStoreServer(grpcServer, blockStore)
+		go grpcServer.Serve(ln)
+		defer grpcServer.Stop()
+		byAddr[ln.Addr().String()] = blockStore
+		addrs = append(addrs, ln.Addr().String())
+	}
+	metaStore := surfstore.NewMetaStore(addrs...)
+	ring := surfstore.NewConsistentHashRing(addrs)
+	rs, err := surfstore.NewReedSolomon(2, 1)
+	noError(err)
+
+	data := []byte("a block that is erasure coded into three shards")
+	hash := surfstore.GetBlockHashString(data)
+	stripe := &surfstore.ErasureStripe{BlockHash: hash, BlockSize: int32(len(data)), DataShards: 2}
+	servers := ring.GetShardServers(hash, 3)
+	for i, shard := range rs.Encode(data) {
+		stripe.ShardHashes = append(stripe.ShardHashes, surfstore.GetBlockHashString(shard))
+		_, err := byAddr[servers[i]].PutBlock(ctx, &surfstore.Block{BlockData: shard, BlockSize: int32(len(shard))})
+		noError(err)
+	}
+	_, err = metaStore.UpdateFile(ctx, &surfstore.FileMetaData{
+		Filename:       "file1",
+		Version:        1,
+		BlockHashList:  []string{hash},
+		ErasureStripes: []*surfstore.ErasureStripe{stripe},
+	})
+	noError(err)
+
+	noError(byAddr[servers[0]].Storage.Delete("", stripe.ShardHashes[0]))
+	report := metaStore.RepairBlocks()
+	if report.CheckedBlocks != 1 || report.UnderReplicatedBlocks != 1 || report.RepairedCopies != 1 {
+		t.Fatalf("Expected the lost shard to be rebuilt, got %+v", report)
+	}
+	if ok, _ := byAddr[servers[0]].Storage.Has("", stripe.ShardHashes[0]); !ok {
+		t.Fatalf("The rebuilt shard should be back on its server")
+	}
+
+	noError(byAddr[servers[0]].Storage.Delete("", stripe.ShardHashes[0]))
+	noError(byAddr[servers[1]].Storage.Delete("", stripe.ShardHashes[1]))
+	report = metaStore.RepairBlocks()
+	if len(report.LostBlocks) != 1 || report.LostBlocks[0] != hash {
+		t.Fatalf("A block with one of three shards left should be lost, got %+v", report)
+	}
+}
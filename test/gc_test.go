@@ -0,0 +1,71 @@
+package SurfTest
+
+import (
+	context "context"
+	"cse224/proj5/pkg/surfstore"
+	"net"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc"
+)
+
+// Blocks of pruned versions and blocks never committed are collected once
+// they are past the grace period, blocks of retained versions are kept,
+// and the reverse lookup lists the versions using a block.
+func TestGarbageCollection(t *testing.T) {
+	ctx := context.Background()
+	blockStore := surfstore.NewBlockStore()
+	blockStore.GCGracePeriod = time.Hour
+	ln, err := net.Listen("tcp", "localhost:0")
+	noError(err)
+	grpcServer := grpc.NewServer()
+	surfstore.RegisterBlockStoreServer(grpcServer, blockStore)
+	go grpcServer.Serve(ln)
+	defer grpcServer.Stop()
+
+	hashes := make([]string, 0)
+	for _, data := range []string{"old block", "shared block", "new block", "uncommitted block"} {
+		_, err := blockStore.PutBlock(ctx, &surfstore.Block{BlockData: []byte(data), BlockSize: int32(len(data))})
+		noError(err)
+		hashes = append(hashes, surfstore.GetBlockHashString([]byte(data)))
+	}
+
+	metaStore := surfstore.NewMetaStore(ln.Addr().String())
+	_, err = metaStore.UpdateFile(ctx, &surfstore.FileMetaData{Filename: "file1", Version: 1, BlockHashList: hashes[0:2]})
+	noError(err)
+	_, err = metaStore.UpdateFile(ctx, &surfstore.FileMetaData{Filename: "file1", Version: 2, BlockHashList: hashes[1:3]})
+	noError(err)
+
+	refs, err := metaStore.GetBlockReferences(ctx, &surfstore.BlockHash{Hash: hashes[1]})
+	noError(err)
+	if len(refs.References) != 2 || refs.References[0].Version != 1 || refs.References[1].Version != 2 {
+		t.Fatalf("Both versions of file1 should reference the shared block, got %v", refs.References)
+	}
+
+	metaStore.Retention = surfstore.RetentionPolicy{KeepVersions: 1}
+	metaStore.ApplyRetention(time.Now())
+	refs, err = metaStore.GetBlockReferences(ctx, &surfstore.BlockHash{Hash: hashes[0]})
+	noError(err)
+	if len(refs.References) != 0 {
+		t.Fatalf("The pruned version should no longer reference its blocks, got %v", refs.References)
+	}
+
+	deleted, err := metaStore.CollectGarbage()
+	noError(err)
+	if deleted != 0 {
+		t.Fatalf("Blocks stored within the grace period should be kept, but %d were deleted", deleted)
+	}
+
+	blockStore.GCGracePeriod = 0
+	deleted, err = metaStore.CollectGarbage()
+	noError(err)
+	if deleted != 2 {
+		t.Fatalf("Expected the 2 unreferenced blocks to be deleted, got %d", deleted)
+	}
+	has, err := blockStore.HasBlocks(ctx, &surfstore.BlockHashes{Hashes: hashes})
+	noError(err)
+	if !SameHashList(has.Hashes, hashes[1:3]) {
+		t.Fatalf("Only the blocks of the retained version should be left, got %v", has.Hashes)
+	}
+}
@@ -0,0 +1,65 @@
+package SurfTest
+
+import (
+	context "context"
+	"cse224/proj5/pkg/surfstore"
+	"testing"
+
+	"google.golang.org/grpc/metadata"
+	emptypb "google.golang.org/protobuf/types/known/emptypb"
+)
+
+func namespaceContext(namespace string) context.Context {
+	return metadata.NewIncomingContext(context.Background(), metadata.Pairs(surfstore.NAMESPACE_METADATA_KEY, namespace))
+}
+
+// Files and blocks stored in one namespace are invisible from the others.
+func TestNamespaceIsolation(t *testing.T) {
+	teamA := namespaceContext("team-a")
+	teamB := namespaceContext("team-b")
+
+	metaStore := surfstore.NewMetaStore("")
+	_, err := metaStore.UpdateFile(teamA, NewFileMetaDataFromParams("file1", 1, []string{"hash1"}))
+	noError(err)
+
+	fim, err := metaStore.GetFileInfoMap(teamB, &emptypb.Empty{})
+	noError(err)
+	if len(fim.FileInfoMap) != 0 || fim.Revision != 0 {
+		t.Fatalf("team-b should not see team-a's files")
+	}
+	if len(metaStore.FileMetaMap) != 0 {
+		t.Fatalf("The default namespace should not see team-a's files")
+	}
+
+	// team-b gets its own version sequence for the same filename
+	_, err = metaStore.UpdateFile(teamB, NewFileMetaDataFromParams("file1", 1, []string{"hash2"}))
+	noError(err)
+	fim, err = metaStore.GetFileInfoMap(teamA, &emptypb.Empty{})
+	noError(err)
+	if fim.FileInfoMap["file1"].BlockHashList[0] != "hash1" {
+		t.Fatalf("team-b's update should not change team-a's file")
+	}
+
+	blockStore := surfstore.NewBlockStore()
+	block := &surfstore.Block{BlockData: []byte("secret"), BlockSize: 6}
+	hash := surfstore.GetBlockHashString(block.BlockData)
+	_, err = blockStore.PutBlock(teamA, block)
+	noError(err)
+
+	has, err := blockStore.HasBlocks(teamB, &surfstore.BlockHashes{Hashes: []string{hash}})
+	noError(err)
+	if len(has.Hashes) != 0 {
+		t.Fatalf("team-b should not find team-a's block")
+	}
+	if got, _ := blockStore.GetBlock(teamB, &surfstore.BlockHash{Hash: hash}); got != nil {
+		t.Fatalf("team-b should not be able to read team-a's block")
+	}
+	if got, _ := blockStore.GetBlock(teamA, &surfstore.BlockHash{Hash: hash}); got == nil {
+		t.Fatalf("team-a should read back its own block")
+	}
+
+	_, err = metaStore.GetFileInfoMap(namespaceContext("../etc"), &emptypb.Empty{})
+	if err == nil {
+		t.Fatalf("An invalid namespace should be rejected")
+	}
+}
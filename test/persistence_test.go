@@ -0,0 +1,85 @@
+package SurfTest
+
+import (
+	context "context"
+	"cse224/proj5/pkg/surfstore"
+	"os"
+	"path/filepath"
+	"testing"
+
+	emptypb "google.golang.org/protobuf/types/known/emptypb"
+)
+
+// A durable MetaStore comes back with its files, history, namespaces and
+// client revisions after a restart, from a checkpoint plus the journal,
+// and drops a record torn by a crash.
+func TestMetaStorePersistence(t *testing.T) {
+	ctx := context.Background()
+	dataDir := t.TempDir()
+	metaStore, err := surfstore.OpenMetaStore(dataDir)
+	noError(err)
+
+	_, err = metaStore.UpdateFile(ctx, NewFileMetaDataFromParams("file1", 1, []string{"hash1"}))
+	noError(err)
+	_, err = metaStore.UpdateFile(ctx, NewFileMetaDataFromParams("file1", 2, []string{"hash2"}))
+	noError(err)
+	_, err = metaStore.UpdateFile(namespaceContext("team"), NewFileMetaDataFromParams("file2", 1, []string{"hash3"}))
+	noError(err)
+	noError(metaStore.Checkpoint())
+
+	// These only live in the journal
+	_, err = metaStore.UpdateFile(ctx, NewFileMetaDataFromParams("file3", 1, []string{"hash4"}))
+	noError(err)
+	_, err = metaStore.AckSync(ctx, &surfstore.SyncAck{ClientId: "client1", Revision: 3})
+	noError(err)
+	if _, err = metaStore.UpdateFile(ctx, NewFileMetaDataFromParams("file1", 5, []string{"hash5"})); err == nil {
+		t.Fatalf("An update with the wrong version should fail")
+	}
+	noError(metaStore.Close())
+
+	// Simulate a crash in the middle of writing a record
+	journal, err := os.OpenFile(filepath.Join(dataDir, surfstore.JOURNAL_FILENAME), os.O_WRONLY|os.O_APPEND, 0600)
+	noError(err)
+	_, err = journal.Write([]byte{0, 0, 0, 42, 1, 2, 3})
+	noError(err)
+	noError(journal.Close())
+
+	metaStore, err = surfstore.OpenMetaStore(dataDir)
+	if err != nil {
+		t.Fatalf("Could not reopen the MetaStore: %v", err)
+	}
+	defer metaStore.Close()
+
+	fim, err := metaStore.GetFileInfoMap(ctx, &emptypb.Empty{})
+	noError(err)
+	if len(fim.FileInfoMap) != 2 || fim.Revision != 3 {
+		t.Fatalf("Expected 2 files at revision 3, got %d at revision %d", len(fim.FileInfoMap), fim.Revision)
+	}
+	if fim.FileInfoMap["file1"].Version != 2 || !SameHashList(fim.FileInfoMap["file3"].BlockHashList, []string{"hash4"}) {
+		t.Fatalf("Files did not survive the restart")
+	}
+	history, err := metaStore.GetFileHistory(ctx, &surfstore.FileName{Filename: "file1"})
+	noError(err)
+	if len(history.Versions) != 2 {
+		t.Fatalf("History should have 2 versions, got %d", len(history.Versions))
+	}
+	if metaStore.ClientRevisions["client1"] != 3 {
+		t.Fatalf("Client revisions did not survive the restart")
+	}
+	fim, err = metaStore.GetFileInfoMap(namespaceContext("team"), &emptypb.Empty{})
+	noError(err)
+	if len(fim.FileInfoMap) != 1 || fim.FileInfoMap["file2"] == nil {
+		t.Fatalf("Namespace did not survive the restart")
+	}
+
+	// The torn record was dropped, so new updates are kept after it
+	_, err = metaStore.UpdateFile(ctx, NewFileMetaDataFromParams("file1", 3, []string{"hash6"}))
+	noError(err)
+	noError(metaStore.Close())
+	metaStore, err = surfstore.OpenMetaStore(dataDir)
+	noError(err)
+	defer metaStore.Close()
+	if metaStore.FileMetaMap["file1"].Version != 3 || metaStore.Revision != 4 {
+		t.Fatalf("Update after the torn record was lost")
+	}
+}
@@ -4,7 +4,7 @@ import (
 	emptypb "google.golang.org/protobuf/types/known/emptypb"
 	"os"
 	"testing"
-	//	"time"
+	"time"
 )
 
 // A creates and syncs with a file. B creates and syncs with same file. A syncs again.
@@ -110,3 +110,127 @@ func TestSyncTwoClientsSameFileLeaderFailure(t *testing.T) {
 		t.Fatalf("wrong file2 contents at client2")
 	}
 }
+
+// A creates nested and empty directories and syncs. B syncs. A removes a directory and syncs. B syncs again.
+func TestSyncNestedDirectories(t *testing.T) {
+	t.Logf("client1 syncs a directory tree. client2 syncs. client1 removes a directory. client2 syncs again.")
+	cfgPath := "./config_files/3nodes.txt"
+	test := InitTest(cfgPath, "8080")
+	defer EndTest(test)
+	test.Clients[0].SetLeader(test.Context, &emptypb.Empty{})
+	test.Clients[0].SendHeartbeat(test.Context, &emptypb.Empty{})
+
+	worker1 := InitDirectoryWorker("test0", SRC_PATH)
+	worker2 := InitDirectoryWorker("test1", SRC_PATH)
+	defer worker1.CleanUp()
+	defer worker2.CleanUp()
+
+	noError(os.MkdirAll(worker1.DirectoryName+"/docs/drafts", 0755))
+	noError(os.MkdirAll(worker1.DirectoryName+"/empty", 0755))
+	noError(CopyFile(SRC_PATH+"/multi_file1.txt", worker1.DirectoryName+"/docs/drafts/multi_file1.txt"))
+	noError(CopyFile(SRC_PATH+"/multi_file2.txt", worker1.DirectoryName+"/docs/multi_file2.txt"))
+
+	err := SyncClient("localhost:8080", "test0", BLOCK_SIZE, cfgPath)
+	if err != nil {
+		t.Fatalf("Sync failed")
+	}
+	err = SyncClient("localhost:8080", "test1", BLOCK_SIZE, cfgPath)
+	if err != nil {
+		t.Fatalf("Sync failed")
+	}
+
+	c, e := SameFile(worker2.DirectoryName+"/docs/drafts/multi_file1.txt", SRC_PATH+"/multi_file1.txt")
+	if e != nil || !c {
+		t.Fatalf("Nested file was not downloaded to client2")
+	}
+	if info, err := os.Stat(worker2.DirectoryName + "/empty"); err != nil || !info.IsDir() {
+		t.Fatalf("Empty directory was not created at client2")
+	}
+
+	noError(os.RemoveAll(worker1.DirectoryName + "/docs"))
+	err = SyncClient("localhost:8080", "test0", BLOCK_SIZE, cfgPath)
+	if err != nil {
+		t.Fatalf("Sync failed")
+	}
+	err = SyncClient("localhost:8080", "test1", BLOCK_SIZE, cfgPath)
+	if err != nil {
+		t.Fatalf("Sync failed")
+	}
+
+	if _, err := os.Stat(worker2.DirectoryName + "/docs"); !os.IsNotExist(err) {
+		t.Fatalf("Removed directory should be gone at client2")
+	}
+	if _, err := os.Stat(worker2.DirectoryName + "/empty"); err != nil {
+		t.Fatalf("Empty directory should still exist at client2")
+	}
+
+	fileMeta2, err := LoadMetaFromMetaFile(worker2.DirectoryName)
+	if err != nil {
+		t.Fatalf("Could not load meta file for client2")
+	}
+	if !IsTombHashList(fileMeta2["docs/"].BlockHashList) || !IsTombHashList(fileMeta2["docs/drafts/multi_file1.txt"].BlockHashList) {
+		t.Fatalf("Removed directory should be recorded as deleted in client2 metadata")
+	}
+}
+
+// A syncs an executable file and a symlink. B syncs. A changes only the file's mode and syncs. B syncs again.
+func TestSyncFileAttributes(t *testing.T) {
+	t.Logf("client1 syncs an executable and a symlink. client2 syncs. client1 changes the mode. client2 syncs again.")
+	cfgPath := "./config_files/3nodes.txt"
+	test := InitTest(cfgPath, "8080")
+	defer EndTest(test)
+	test.Clients[0].SetLeader(test.Context, &emptypb.Empty{})
+	test.Clients[0].SendHeartbeat(test.Context, &emptypb.Empty{})
+
+	worker1 := InitDirectoryWorker("test0", SRC_PATH)
+	worker2 := InitDirectoryWorker("test1", SRC_PATH)
+	defer worker1.CleanUp()
+	defer worker2.CleanUp()
+
+	file1 := "multi_file1.txt"
+	noError(worker1.AddFile(file1))
+	noError(os.Chmod(worker1.DirectoryName+"/"+file1, 0755))
+	mtime := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	noError(os.Chtimes(worker1.DirectoryName+"/"+file1, mtime, mtime))
+	noError(os.Symlink(file1, worker1.DirectoryName+"/link"))
+
+	err := SyncClient("localhost:8080", "test0", BLOCK_SIZE, cfgPath)
+	if err != nil {
+		t.Fatalf("Sync failed")
+	}
+	err = SyncClient("localhost:8080", "test1", BLOCK_SIZE, cfgPath)
+	if err != nil {
+		t.Fatalf("Sync failed")
+	}
+
+	info, err := os.Stat(worker2.DirectoryName + "/" + file1)
+	if err != nil || info.Mode().Perm() != 0755 || !info.ModTime().Equal(mtime) {
+		t.Fatalf("Mode and mtime were not restored at client2")
+	}
+	target, err := os.Readlink(worker2.DirectoryName + "/link")
+	if err != nil || target != file1 {
+		t.Fatalf("Symlink was not restored at client2")
+	}
+
+	noError(os.Chmod(worker1.DirectoryName+"/"+file1, 0600))
+	err = SyncClient("localhost:8080", "test0", BLOCK_SIZE, cfgPath)
+	if err != nil {
+		t.Fatalf("Sync failed")
+	}
+	err = SyncClient("localhost:8080", "test1", BLOCK_SIZE, cfgPath)
+	if err != nil {
+		t.Fatalf("Sync failed")
+	}
+
+	info, err = os.Stat(worker2.DirectoryName + "/" + file1)
+	if err != nil || info.Mode().Perm() != 0600 {
+		t.Fatalf("Mode change was not synced to client2")
+	}
+	fileMeta2, err := LoadMetaFromMetaFile(worker2.DirectoryName)
+	if err != nil {
+		t.Fatalf("Could not load meta file for client2")
+	}
+	if fileMeta2[file1].Version != 2 {
+		t.Fatalf("A mode change should create version 2, got %d", fileMeta2[file1].Version)
+	}
+}
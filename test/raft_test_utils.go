@@ -5,33 +5,78 @@ import (
 	"cse224/proj5/pkg/surfstore"
 	"google.golang.org/grpc"
 	"log"
+	"net"
 	"os"
 	"os/exec"
 	"strconv"
+	"strings"
 	"time"
 )
 
 type TestInfo struct {
-	CfgPath    string
-	Ips        []string
-	Context    context.Context
-	CancelFunc context.CancelFunc
-	Procs      []*exec.Cmd
-	Conns      []*grpc.ClientConn
-	Clients    []surfstore.RaftSurfstoreClient
+	CfgPath      string
+	Ips          []string
+	Context      context.Context
+	CancelFunc   context.CancelFunc
+	Procs        []*exec.Cmd
+	Conns        []*grpc.ClientConn
+	Clients      []surfstore.RaftSurfstoreClient
+	BlockClients []surfstore.BlockStoreClient
 }
 
 func InitTest(cfgPath, blockStorePort string) TestInfo {
+	return initTest(cfgPath, []string{blockStorePort}, grpc.WithInsecure())
+}
+
+// Starts a BlockStore on each port and Raft servers that place blocks
+// across all of them
+func InitBlockStoresTest(cfgPath string, blockStorePorts ...string) TestInfo {
+	return initTest(cfgPath, blockStorePorts, grpc.WithInsecure())
+}
+
+// Like InitBlockStoresTest, storing each block on replication of the
+// BlockStores. The BlockStores are the first processes in Procs.
+func InitReplicatedBlockStoresTest(cfgPath string, replication int, blockStorePorts ...string) TestInfo {
+	return initTest(cfgPath, blockStorePorts, grpc.WithInsecure(), "-replication", strconv.Itoa(replication))
+}
+
+// Like InitBlockStoresTest, erasure coding files as the storage policy
+// file says. The BlockStores are the first processes in Procs.
+func InitErasureCodedTest(cfgPath string, policyPath string, blockStorePorts ...string) TestInfo {
+	return initTest(cfgPath, blockStorePorts, grpc.WithInsecure(), "-storage-policy", policyPath)
+}
+
+// Starts Raft servers without any BlockStores, for tests where the
+// BlockStores register themselves
+func InitRegistryTest(cfgPath string, serverFlags ...string) TestInfo {
+	return initTest(cfgPath, nil, grpc.WithInsecure(), serverFlags...)
+}
+
+// Starts the servers with TLS, requiring peer certificates for Raft and
+// block traffic, and connects to them presenting the client certificate
+func InitTLSTest(cfgPath, blockStorePort string, certs TestCerts) TestInfo {
+	tlsConfig, err := surfstore.LoadTLSConfig(certs.ClientCert, certs.ClientKey, certs.CA, false)
+	if err != nil {
+		log.Fatal("Error loading test certificates ", err)
+	}
+	return initTest(cfgPath, []string{blockStorePort}, tlsConfig.DialOption(), certs.ServerFlags()...)
+}
+
+func initTest(cfgPath string, blockStorePorts []string, dialOption grpc.DialOption, serverFlags ...string) TestInfo {
 	cfg := surfstore.LoadRaftConfigFile(cfgPath)
 
 	procs := make([]*exec.Cmd, 0)
-	procs = append(procs, InitBlockStore(blockStorePort))
-	procs = append(procs, InitRaftServers(cfgPath)...)
+	blockStoreAddrs := make([]string, 0, len(blockStorePorts))
+	for _, port := range blockStorePorts {
+		procs = append(procs, InitBlockStore(port, serverFlags...))
+		blockStoreAddrs = append(blockStoreAddrs, "localhost:"+port)
+	}
+	procs = append(procs, InitRaftServers(cfgPath, blockStoreAddrs, serverFlags...)...)
 
 	conns := make([]*grpc.ClientConn, 0)
 	clients := make([]surfstore.RaftSurfstoreClient, 0)
 	for _, addr := range cfg {
-		conn, err := grpc.Dial(addr, grpc.WithInsecure())
+		conn, err := grpc.Dial(addr, dialOption)
 		if err != nil {
 			log.Fatal("Error connecting to clients ", err)
 		}
@@ -70,8 +115,62 @@ func EndTest(test TestInfo) {
 	time.Sleep(100 * time.Millisecond)
 }
 
-func InitBlockStore(blockStorePort string) *exec.Cmd {
-	blockCmd := exec.Command("_bin/SurfstoreServerExec", "-s", "block", "-p", blockStorePort, "-l")
+func InitBlockReplicaTest(cfgPath string) TestInfo {
+	cfg := surfstore.LoadRaftConfigFile(cfgPath)
+
+	procs := InitBlockStoreReplicas(cfgPath)
+
+	conns := make([]*grpc.ClientConn, 0)
+	clients := make([]surfstore.BlockStoreClient, 0)
+	for _, addr := range cfg {
+		conn, err := grpc.Dial(addr, grpc.WithInsecure())
+		if err != nil {
+			log.Fatal("Error connecting to block replicas ", err)
+		}
+		client := surfstore.NewBlockStoreClient(conn)
+
+		conns = append(conns, conn)
+		clients = append(clients, client)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+
+	return TestInfo{
+		CfgPath:      cfgPath,
+		Ips:          cfg,
+		Context:      ctx,
+		CancelFunc:   cancel,
+		Procs:        procs,
+		Conns:        conns,
+		BlockClients: clients,
+	}
+}
+
+func InitBlockStoreReplicas(cfgPath string) []*exec.Cmd {
+	cfg := surfstore.LoadRaftConfigFile(cfgPath)
+	cmdList := make([]*exec.Cmd, 0)
+	for idx, addr := range cfg {
+		_, port, _ := net.SplitHostPort(addr)
+		cmd := exec.Command("_bin/SurfstoreServerExec", "-s", "block", "-p", port, "-l", "-f", cfgPath, "-i", strconv.Itoa(idx))
+		cmd.Stderr = os.Stderr
+		cmd.Stdout = os.Stdout
+		cmdList = append(cmdList, cmd)
+	}
+
+	for _, cmd := range cmdList {
+		err := cmd.Start()
+		if err != nil {
+			log.Fatal("Error starting block replicas", err)
+		}
+	}
+
+	time.Sleep(2 * time.Second)
+
+	return cmdList
+}
+
+func InitBlockStore(blockStorePort string, flags ...string) *exec.Cmd {
+	blockCmd := exec.Command("_bin/SurfstoreServerExec", append([]string{"-s", "block", "-p", blockStorePort, "-l"}, flags...)...)
 	blockCmd.Stderr = os.Stderr
 	blockCmd.Stdout = os.Stdout
 	err := blockCmd.Start()
@@ -82,11 +181,12 @@ func InitBlockStore(blockStorePort string) *exec.Cmd {
 	return blockCmd
 }
 
-func InitRaftServers(cfgPath string) []*exec.Cmd {
+func InitRaftServers(cfgPath string, blockStoreAddrs []string, flags ...string) []*exec.Cmd {
 	cfg := surfstore.LoadRaftConfigFile(cfgPath)
 	cmdList := make([]*exec.Cmd, 0)
 	for idx, _ := range cfg {
-		cmd := exec.Command("_bin/SurfstoreRaftServerExec", "-f", cfgPath, "-i", strconv.Itoa(idx), "-b", "localhost:8080")
+		args := append([]string{"-f", cfgPath, "-i", strconv.Itoa(idx), "-b", strings.Join(blockStoreAddrs, ",")}, flags...)
+		cmd := exec.Command("_bin/SurfstoreRaftServerExec", args...)
 		cmd.Stderr = os.Stderr
 		cmd.Stdout = os.Stdout
 		cmdList = append(cmdList, cmd)
@@ -118,6 +218,9 @@ func SameOperation(op1, op2 *surfstore.UpdateOperation) bool {
 		op1.FileMetaData != nil && op2.FileMetaData == nil {
 		return false
 	}
+	if op1.FileMetaData == nil {
+		return true
+	}
 	if op1.FileMetaData.Version != op2.FileMetaData.Version {
 		return false
 	}
@@ -0,0 +1,220 @@
+package SurfTest
+
+import (
+	context "context"
+	"cse224/proj5/pkg/surfstore"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"google.golang.org/grpc"
+	emptypb "google.golang.org/protobuf/types/known/emptypb"
+)
+
+// Adding a BlockStore moves the blocks it now owns onto it, under the
+// rate limit, and the rebalance finishes once they are all there.
+func TestRebalanceBlocks(t *testing.T) {
+	ctx := context.Background()
+	byAddr := make(map[string]*surfstore.BlockStore)
+	addrs := make([]string, 0)
+	for i := 0; i < 3; i++ {
+		blockStore := surfstore.NewBlockStore()
+		ln, err := net.Listen("tcp", "localhost:0")
+		noError(err)
+		grpcServer := grpc.NewServer()
+		surfstore.RegisterBlockStoreServer(grpcServer, blockStore)
+		go grpcServer.Serve(ln)
+		defer grpcServer.Stop()
+		byAddr[ln.Addr().String()] = blockStore
+		addrs = append(addrs, ln.Addr().String())
+	}
+
+	metaStore := surfstore.NewMetaStore(addrs[:2]...)
+	metaStore.RebalanceRate = 50000
+	oldRing := surfstore.NewConsistentHashRing(addrs[:2])
+	hashes := make([]string, 0)
+	for i := 0; i < 30; i++ {
+		data := make([]byte, 1000)
+		copy(data, fmt.Sprintf("block number %d", i))
+		hash := surfstore.GetBlockHashString(data)
+		_, err := byAddr[oldRing.GetResponsibleServer(hash)].PutBlock(ctx, &surfstore.Block{BlockData: data, BlockSize: 1000})
+		noError(err)
+		hashes = append(hashes, hash)
+	}
+	_, err := metaStore.UpdateFile(ctx, &surfstore.FileMetaData{Filename: "file1", Version: 1, BlockHashList: hashes})
+	noError(err)
+
+	status, err := metaStore.SetBlockStoreAddrs(ctx, &surfstore.BlockStoreAddrs{Addrs: addrs})
+	noError(err)
+	if !status.InProgress || len(status.PreviousAddrs) != 2 {
+		t.Fatalf("Expected a rebalance from the 2 old BlockStores, got %+v", status)
+	}
+	served, err := metaStore.GetBlockStoreAddrs(ctx, &emptypb.Empty{})
+	noError(err)
+	if len(served.Addrs) != 3 || len(served.PreviousAddrs) != 2 {
+		t.Fatalf("Clients should be told about both rings while rebalancing, got %+v", served)
+	}
+	if _, err := metaStore.SetBlockStoreAddrs(ctx, &surfstore.BlockStoreAddrs{Addrs: addrs[1:]}); err != surfstore.ERR_REBALANCE_IN_PROGRESS {
+		t.Fatalf("Expected ERR_REBALANCE_IN_PROGRESS, got %v", err)
+	}
+
+	newRing := surfstore.NewConsistentHashRing(addrs)
+	expected := 0
+	for _, hash := range hashes {
+		if newRing.GetResponsibleServer(hash) == addrs[2] {
+			expected++
+		}
+	}
+	status = metaStore.Rebalance()
+	if status.InProgress || status.FinishedAt == 0 {
+		t.Fatalf("The rebalance should have finished, got %+v", status)
+	}
+	if expected == 0 || status.MovedBlocks != int64(expected) || status.MovedBytes != int64(expected*1000) || status.FailedBlocks != 0 {
+		t.Fatalf("Expected %d blocks moved, got %+v", expected, status)
+	}
+	if status.RateLimit != 50000 || status.ThrottledNanos == 0 {
+		t.Fatalf("Moving %d bytes at 50000 bytes/s should have been throttled, got %+v", status.MovedBytes, status)
+	}
+	for _, hash := range hashes {
+		if ok, _ := byAddr[newRing.GetResponsibleServer(hash)].Storage.Has("", hash); !ok {
+			t.Fatalf("Block %s is not on its new server", hash)
+		}
+	}
+	served, err = metaStore.GetBlockStoreAddrs(ctx, &emptypb.Empty{})
+	noError(err)
+	if len(served.PreviousAddrs) != 0 {
+		t.Fatalf("The previous ring should be gone once the rebalance finished")
+	}
+}
+
+// A block none of its previous BlockStores has is reported lost and does
+// not hold up the rebalance, unlike one on a BlockStore that cannot be
+// reached and may still have it.
+func TestRebalanceReportsLostBlocks(t *testing.T) {
+	ctx := context.Background()
+	addrs := make([]string, 0)
+	for i := 0; i < 2; i++ {
+		ln, err := net.Listen("tcp", "localhost:0")
+		noError(err)
+		grpcServer := grpc.NewServer()
+		surfstore.RegisterBlockStoreServer(grpcServer, surfstore.NewBlockStore())
+		go grpcServer.Serve(ln)
+		defer grpcServer.Stop()
+		addrs = append(addrs, ln.Addr().String())
+	}
+	ln, err := net.Listen("tcp", "localhost:0")
+	noError(err)
+	deadAddr := ln.Addr().String()
+	ln.Close()
+
+	hashes := make([]string, 0)
+	for i := 0; i < 30; i++ {
+		hashes = append(hashes, surfstore.GetBlockHashString([]byte(fmt.Sprintf("never stored %d", i))))
+	}
+	movingFrom := func(oldAddrs []string, newAddrs []string, from string) int {
+		oldRing := surfstore.NewConsistentHashRing(oldAddrs)
+		newRing := surfstore.NewConsistentHashRing(newAddrs)
+		moving := 0
+		for _, hash := range hashes {
+			if oldRing.GetResponsibleServer(hash) == from && newRing.GetResponsibleServer(hash) != from {
+				moving++
+			}
+		}
+		return moving
+	}
+
+	metaStore := surfstore.NewMetaStore(addrs[:1]...)
+	_, err = metaStore.UpdateFile(ctx, &surfstore.FileMetaData{Filename: "file1", Version: 1, BlockHashList: hashes})
+	noError(err)
+	_, err = metaStore.SetBlockStoreAddrs(ctx, &surfstore.BlockStoreAddrs{Addrs: addrs})
+	noError(err)
+	status := metaStore.Rebalance()
+	expected := movingFrom(addrs[:1], addrs, addrs[0])
+	if status.InProgress || expected == 0 || len(status.LostBlocks) != expected || status.FailedBlocks != 0 {
+		t.Fatalf("Expected the rebalance to finish with %d lost blocks, got %+v", expected, status)
+	}
+
+	metaStore = surfstore.NewMetaStore(deadAddr)
+	_, err = metaStore.UpdateFile(ctx, &surfstore.FileMetaData{Filename: "file1", Version: 1, BlockHashList: hashes})
+	noError(err)
+	_, err = metaStore.SetBlockStoreAddrs(ctx, &surfstore.BlockStoreAddrs{Addrs: []string{deadAddr, addrs[0]}})
+	noError(err)
+	status = metaStore.Rebalance()
+	if !status.InProgress || status.FailedBlocks == 0 || len(status.LostBlocks) != 0 {
+		t.Fatalf("Expected blocks on an unreachable BlockStore to fail rather than be lost, got %+v", status)
+	}
+}
+
+// While the blocks have not moved yet, another client still reads a file
+// by falling back to the BlockStores that had them.
+func TestSyncDuringRebalance(t *testing.T) {
+	cfgPath := "./config_files/3nodes.txt"
+	test := InitBlockStoresTest(cfgPath, "8080", "8081")
+	test.Procs = append(test.Procs, InitBlockStore("8082"))
+	defer EndTest(test)
+	test.Clients[0].SetLeader(test.Context, &emptypb.Empty{})
+	test.Clients[0].SendHeartbeat(test.Context, &emptypb.Empty{})
+
+	worker1 := InitDirectoryWorker("test0", SRC_PATH)
+	worker2 := InitDirectoryWorker("test1", SRC_PATH)
+	defer worker1.CleanUp()
+	defer worker2.CleanUp()
+
+	file1 := "moving_file.txt"
+	data := make([]byte, 0, 20*BLOCK_SIZE)
+	for i := 0; i < 20; i++ {
+		block := make([]byte, BLOCK_SIZE)
+		copy(block, fmt.Sprintf("block number %d", i))
+		data = append(data, block...)
+	}
+	noError(os.WriteFile(filepath.Join(worker1.DirectoryName, file1), data, 0644))
+	if err := SyncClient("localhost:8080", "test0", BLOCK_SIZE, cfgPath); err != nil {
+		t.Fatalf("Sync failed: %v", err)
+	}
+
+	addrs := []string{"localhost:8080", "localhost:8081", "localhost:8082"}
+	status, err := test.Clients[0].SetBlockStoreAddrs(test.Context, &surfstore.BlockStoreAddrs{Addrs: addrs})
+	noError(err)
+	if !status.InProgress {
+		t.Fatalf("Expected a rebalance onto the new BlockStore")
+	}
+
+	if err := SyncClient("localhost:8080", "test1", BLOCK_SIZE, cfgPath); err != nil {
+		t.Fatalf("Sync failed: %v", err)
+	}
+	c, e := SameFile(filepath.Join(worker2.DirectoryName, file1), filepath.Join(worker1.DirectoryName, file1))
+	if e != nil || !c {
+		t.Fatalf("The file should be read from the old BlockStores until its blocks move")
+	}
+}
+
+// A durable MetaStore restarted with different BlockStores rebalances
+// from the ones it had, even across a checkpoint.
+func TestRebalanceAfterRestart(t *testing.T) {
+	ctx := context.Background()
+	dataDir := t.TempDir()
+	metaStore, err := surfstore.OpenMetaStore(dataDir, "localhost:8081")
+	noError(err)
+	noError(metaStore.Checkpoint())
+	noError(metaStore.Close())
+
+	metaStore, err = surfstore.OpenMetaStore(dataDir, "localhost:8081", "localhost:8082")
+	noError(err)
+	status, err := metaStore.GetRebalanceStatus(ctx, &emptypb.Empty{})
+	noError(err)
+	if !status.InProgress || len(status.PreviousAddrs) != 1 || status.PreviousAddrs[0] != "localhost:8081" || len(status.Addrs) != 2 {
+		t.Fatalf("Expected a rebalance from the BlockStore used before the restart, got %+v", status)
+	}
+	noError(metaStore.Close())
+
+	metaStore, err = surfstore.OpenMetaStore(dataDir, "localhost:8083")
+	noError(err)
+	defer metaStore.Close()
+	status, err = metaStore.GetRebalanceStatus(ctx, &emptypb.Empty{})
+	noError(err)
+	if !status.InProgress || len(status.Addrs) != 2 {
+		t.Fatalf("The unfinished rebalance should be kept, got %+v", status)
+	}
+}
@@ -0,0 +1,180 @@
+package SurfTest
+
+import (
+	context "context"
+	"cse224/proj5/pkg/surfstore"
+	"sort"
+	"strconv"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	emptypb "google.golang.org/protobuf/types/known/emptypb"
+)
+
+// BlockStores join the ring by registering, are only handed out while they
+// send heartbeats, and leave it by being drained and then decommissioned.
+func TestBlockStoreRegistry(t *testing.T) {
+	ctx := context.Background()
+	metaStore := surfstore.NewMetaStore("static:8080")
+	metaStore.BlockStoreTimeout = 300 * time.Millisecond
+	bs1 := &surfstore.BlockStoreAddr{Addr: "bs1:8080"}
+	bs2 := &surfstore.BlockStoreAddr{Addr: "bs2:8080"}
+	static := &surfstore.BlockStoreAddr{Addr: "static:8080"}
+
+	// unknown BlockStores are told to register
+	if _, err := metaStore.BlockStoreHeartbeat(ctx, bs1); status.Code(err) != codes.NotFound {
+		t.Fatalf("Expected NotFound for an unregistered BlockStore, got %v", err)
+	}
+
+	bsStatus, err := metaStore.RegisterBlockStore(ctx, bs1)
+	noError(err)
+	if !bsStatus.Registered || !bsStatus.OnRing || !bsStatus.Healthy {
+		t.Fatalf("A registered BlockStore should be on the ring, got %+v", bsStatus)
+	}
+	// the second one waits for the blocks to reach the first
+	bsStatus, err = metaStore.RegisterBlockStore(ctx, bs2)
+	noError(err)
+	if bsStatus.OnRing {
+		t.Fatalf("A BlockStore registering during a rebalance should wait for it, got %+v", bsStatus)
+	}
+	if rebalance := metaStore.Rebalance(); !rebalance.InProgress || len(rebalance.Addrs) != 3 {
+		t.Fatalf("Finishing a rebalance should start the next one, got %+v", rebalance)
+	}
+	if rebalance := metaStore.Rebalance(); rebalance.InProgress {
+		t.Fatalf("Expected the rebalance to finish, got %+v", rebalance)
+	}
+
+	// servers given on the command line can be drained too
+	_, err = metaStore.DrainBlockStore(ctx, static)
+	noError(err)
+	if _, err := metaStore.DecommissionBlockStore(ctx, static); err != surfstore.ERR_BLOCKSTORE_NOT_DRAINED {
+		t.Fatalf("Expected ERR_BLOCKSTORE_NOT_DRAINED while blocks move off it, got %v", err)
+	}
+	metaStore.Rebalance()
+	bsStatus, err = metaStore.DecommissionBlockStore(ctx, static)
+	noError(err)
+	if bsStatus.State != surfstore.BlockStoreState_DECOMMISSIONED {
+		t.Fatalf("Expected the drained BlockStore to be decommissioned, got %+v", bsStatus)
+	}
+	if _, err := metaStore.RegisterBlockStore(ctx, static); err != surfstore.ERR_BLOCKSTORE_DECOMMISSIONED {
+		t.Fatalf("Expected ERR_BLOCKSTORE_DECOMMISSIONED, got %v", err)
+	}
+
+	// only bs2 keeps sending heartbeats
+	for i := 0; i < 5; i++ {
+		time.Sleep(100 * time.Millisecond)
+		_, err := metaStore.BlockStoreHeartbeat(ctx, bs2)
+		noError(err)
+	}
+	addr, err := metaStore.GetBlockStoreAddr(ctx, &emptypb.Empty{})
+	noError(err)
+	if addr.Addr != bs2.Addr {
+		t.Fatalf("Expected only the healthy BlockStore to be handed out, got %v", addr.Addr)
+	}
+	addrs, err := metaStore.GetBlockStoreAddrs(ctx, &emptypb.Empty{})
+	noError(err)
+	if len(addrs.Addrs) != 2 || len(addrs.UnhealthyAddrs) != 1 || addrs.UnhealthyAddrs[0] != bs1.Addr {
+		t.Fatalf("Expected bs1 to be reported unhealthy, got %+v", addrs)
+	}
+	statuses, err := metaStore.GetBlockStoreStatuses(ctx, &emptypb.Empty{})
+	noError(err)
+	if len(statuses.Statuses) != 3 || statuses.Statuses[0].Healthy || !statuses.Statuses[1].Healthy {
+		t.Fatalf("Expected the statuses of all three BlockStores, got %+v", statuses)
+	}
+
+	// the ring cannot be drained empty
+	metaStore.DrainBlockStore(ctx, bs2)
+	metaStore.Rebalance()
+	if _, err := metaStore.DrainBlockStore(ctx, bs1); err != surfstore.ERR_NO_BLOCKSTORES {
+		t.Fatalf("Expected ERR_NO_BLOCKSTORES, got %v", err)
+	}
+}
+
+// The registry survives a restart, and keeps registered BlockStores on
+// the ring whatever the command line says.
+func TestBlockStoreRegistryAfterRestart(t *testing.T) {
+	ctx := context.Background()
+	dataDir := t.TempDir()
+	metaStore, err := surfstore.OpenMetaStore(dataDir, "static:8080")
+	noError(err)
+	_, err = metaStore.RegisterBlockStore(ctx, &surfstore.BlockStoreAddr{Addr: "bs1:8080"})
+	noError(err)
+	metaStore.Rebalance()
+	noError(metaStore.Close())
+
+	metaStore, err = surfstore.OpenMetaStore(dataDir, "static:8080")
+	noError(err)
+	defer metaStore.Close()
+	addrs, err := metaStore.GetBlockStoreAddrs(ctx, &emptypb.Empty{})
+	noError(err)
+	if len(addrs.Addrs) != 2 || len(addrs.PreviousAddrs) != 0 {
+		t.Fatalf("Expected the registered BlockStore to stay on the ring, got %+v", addrs)
+	}
+	bsStatus, err := metaStore.BlockStoreHeartbeat(ctx, &surfstore.BlockStoreAddr{Addr: "bs1:8080"})
+	noError(err)
+	if !bsStatus.Registered {
+		t.Fatalf("Expected the registration to be restored, got %+v", bsStatus)
+	}
+}
+
+// BlockStores register with the Raft cluster through the log, so a new
+// leader knows them, and stop being handed out when they go down.
+func TestBlockStoresRegisterWithRaft(t *testing.T) {
+	cfgPath := "./config_files/3nodes.txt"
+	raftFlags := []string{"-blockstore-timeout", "1s", "-rebalance-interval", "200ms"}
+	test := InitRegistryTest(cfgPath, raftFlags...)
+	ports := []int{8095, 8096}
+	blockStores := make([]string, 0)
+	for _, port := range ports {
+		proc := InitBlockStore(strconv.Itoa(port), "-meta-config", cfgPath, "-heartbeat-interval", "200ms")
+		test.Procs = append(test.Procs, proc)
+		blockStores = append(blockStores, "localhost:"+strconv.Itoa(port))
+	}
+	defer EndTest(test)
+
+	test.Clients[0].SetLeader(test.Context, &emptypb.Empty{})
+	test.Clients[0].SendHeartbeat(test.Context, &emptypb.Empty{})
+	time.Sleep(2 * time.Second)
+	addrs, err := test.Clients[0].GetBlockStoreAddrs(test.Context, &emptypb.Empty{})
+	noError(err)
+	sort.Strings(addrs.Addrs)
+	if !SameHashList(addrs.Addrs, blockStores) {
+		t.Fatalf("Expected both BlockStores to register, got %+v", addrs)
+	}
+
+	// another leader has the registrations and heartbeats too
+	test.Clients[0].Crash(test.Context, &emptypb.Empty{})
+	test.Clients[1].SetLeader(test.Context, &emptypb.Empty{})
+	test.Clients[1].SendHeartbeat(test.Context, &emptypb.Empty{})
+	addrs, err = test.Clients[1].GetBlockStoreAddrs(test.Context, &emptypb.Empty{})
+	noError(err)
+	if len(addrs.Addrs) != 2 || len(addrs.UnhealthyAddrs) != 0 {
+		t.Fatalf("Expected the new leader to know both healthy BlockStores, got %+v", addrs)
+	}
+
+	// a BlockStore that goes down stops being handed out
+	_ = test.Procs[len(test.Procs)-1].Process.Kill()
+	time.Sleep(1500 * time.Millisecond)
+	addrs, err = test.Clients[1].GetBlockStoreAddrs(test.Context, &emptypb.Empty{})
+	noError(err)
+	if len(addrs.UnhealthyAddrs) != 1 || addrs.UnhealthyAddrs[0] != blockStores[1] {
+		t.Fatalf("Expected the stopped BlockStore to be unhealthy, got %+v", addrs)
+	}
+	addr, err := test.Clients[1].GetBlockStoreAddr(test.Context, &emptypb.Empty{})
+	noError(err)
+	if addr.Addr != blockStores[0] {
+		t.Fatalf("Expected only the live BlockStore to be handed out, got %v", addr.Addr)
+	}
+
+	// drain it, and once the leader has moved its blocks, decommission it
+	_, err = test.Clients[1].DrainBlockStore(test.Context, &surfstore.BlockStoreAddr{Addr: blockStores[1]})
+	noError(err)
+	time.Sleep(time.Second)
+	bsStatus, err := test.Clients[1].DecommissionBlockStore(test.Context, &surfstore.BlockStoreAddr{Addr: blockStores[1]})
+	noError(err)
+	if bsStatus.State != surfstore.BlockStoreState_DECOMMISSIONED || bsStatus.OnRing {
+		t.Fatalf("Expected the BlockStore to be decommissioned, got %+v", bsStatus)
+	}
+}
@@ -0,0 +1,103 @@
+package SurfTest
+
+import (
+	context "context"
+	"cse224/proj5/pkg/surfstore"
+	emptypb "google.golang.org/protobuf/types/known/emptypb"
+	"testing"
+	"time"
+)
+
+// A deleted file is only forgotten once every client that synced has seen the deletion.
+func TestMetaStorePrunesTombstoneAfterClientsSync(t *testing.T) {
+	ctx := context.Background()
+	metaStore := surfstore.NewMetaStore("")
+	metaStore.Retention = surfstore.RetentionPolicy{KeepVersions: 1}
+
+	_, err := metaStore.UpdateFile(ctx, NewFileMetaDataFromParams("file1", 1, []string{"hash1"}))
+	noError(err)
+	fileInfoMap, err := metaStore.GetFileInfoMap(ctx, &emptypb.Empty{})
+	noError(err)
+	_, err = metaStore.AckSync(ctx, &surfstore.SyncAck{ClientId: "client1", Revision: fileInfoMap.Revision})
+	noError(err)
+	_, err = metaStore.AckSync(ctx, &surfstore.SyncAck{ClientId: "client2", Revision: fileInfoMap.Revision})
+	noError(err)
+
+	_, err = metaStore.UpdateFile(ctx, NewFileMetaDataFromParams("file1", 2, []string{TOMBSTONE_HASH}))
+	noError(err)
+	fileInfoMap, err = metaStore.GetFileInfoMap(ctx, &emptypb.Empty{})
+	noError(err)
+
+	// only client1 has seen the tombstone
+	_, err = metaStore.AckSync(ctx, &surfstore.SyncAck{ClientId: "client1", Revision: fileInfoMap.Revision})
+	noError(err)
+	metaStore.ApplyRetention(time.Now())
+	if _, ok := metaStore.FileMetaMap["file1"]; !ok {
+		t.Fatalf("Tombstone should be kept until every client has synced past it")
+	}
+	history, err := metaStore.GetFileHistory(ctx, &surfstore.FileName{Filename: "file1"})
+	noError(err)
+	if len(history.Versions) != 1 || history.Versions[0].Version != 2 {
+		t.Fatalf("Only the newest version should be retained")
+	}
+
+	_, err = metaStore.AckSync(ctx, &surfstore.SyncAck{ClientId: "client2", Revision: fileInfoMap.Revision})
+	noError(err)
+	metaStore.ApplyRetention(time.Now())
+	if _, ok := metaStore.FileMetaMap["file1"]; ok {
+		t.Fatalf("Tombstone should be pruned once every client has synced past it")
+	}
+}
+
+// Without a retention policy every version is kept, but deleted files
+// still drop out of the FileInfoMap once every client has seen them go.
+func TestMetaStoreForgetsTombstoneKeepingHistory(t *testing.T) {
+	ctx := context.Background()
+	metaStore := surfstore.NewMetaStore("")
+
+	_, err := metaStore.UpdateFile(ctx, NewFileMetaDataFromParams("file1", 1, []string{"hash1"}))
+	noError(err)
+	_, err = metaStore.UpdateFile(ctx, NewFileMetaDataFromParams("file1", 2, []string{TOMBSTONE_HASH}))
+	noError(err)
+	fileInfoMap, err := metaStore.GetFileInfoMap(ctx, &emptypb.Empty{})
+	noError(err)
+	_, err = metaStore.AckSync(ctx, &surfstore.SyncAck{ClientId: "client1", Revision: fileInfoMap.Revision})
+	noError(err)
+
+	metaStore.ApplyRetention(time.Now())
+	fileInfoMap, err = metaStore.GetFileInfoMap(ctx, &emptypb.Empty{})
+	noError(err)
+	if _, ok := fileInfoMap.FileInfoMap["file1"]; ok {
+		t.Fatalf("Tombstone should be pruned once every client has synced past it")
+	}
+	history, err := metaStore.GetFileHistory(ctx, &surfstore.FileName{Filename: "file1"})
+	noError(err)
+	if len(history.Versions) != 2 {
+		t.Fatalf("Every version should still be retained, got %d", len(history.Versions))
+	}
+
+	// the deleted file can still be restored on top of its tombstone
+	version, err := metaStore.RestoreFileVersion(ctx, &surfstore.FileVersion{Filename: "file1", Version: 1})
+	noError(err)
+	if version.Version != 3 {
+		t.Fatalf("Expected the restored file to carry on as version 3, got %d", version.Version)
+	}
+
+	// a new file under a forgotten name starts a new history
+	_, err = metaStore.UpdateFile(ctx, NewFileMetaDataFromParams("file2", 1, []string{"hash2"}))
+	noError(err)
+	_, err = metaStore.UpdateFile(ctx, NewFileMetaDataFromParams("file2", 2, []string{TOMBSTONE_HASH}))
+	noError(err)
+	fileInfoMap, err = metaStore.GetFileInfoMap(ctx, &emptypb.Empty{})
+	noError(err)
+	_, err = metaStore.AckSync(ctx, &surfstore.SyncAck{ClientId: "client1", Revision: fileInfoMap.Revision})
+	noError(err)
+	metaStore.ApplyRetention(time.Now())
+	_, err = metaStore.UpdateFile(ctx, NewFileMetaDataFromParams("file2", 1, []string{"hash3"}))
+	noError(err)
+	history, err = metaStore.GetFileHistory(ctx, &surfstore.FileName{Filename: "file2"})
+	noError(err)
+	if len(history.Versions) != 1 || history.Versions[0].BlockHashList[0] != "hash3" {
+		t.Fatalf("Expected only the new file's version, got %v", history.Versions)
+	}
+}
@@ -5,6 +5,7 @@ const BLOCK_SIZE = 1024
 const META_FILENAME = "index.txt"
 
 const DEFAULT_META_FILENAME string = "index.txt"
+const DEFAULT_REVISION_FILENAME string = "revision.txt"
 const DEFAULT_BLOCK_SIZE int = 4096
 
 const META_INIT_BY_FILENAME int = 0
@@ -146,7 +146,7 @@ func DirFullySynced(worker1, worker2 DirectoryWorker) bool {
 	}
 
 	for filename := range fileMap1 {
-		if filepath.Base(filename) == DEFAULT_META_FILENAME {
+		if filepath.Base(filename) == DEFAULT_META_FILENAME || filepath.Base(filename) == DEFAULT_REVISION_FILENAME {
 			continue
 		}
 
@@ -245,8 +245,11 @@ func KillSurfServers(servers []*exec.Cmd) {
 	exec.Command("pkill SurfstoreServerExec*")
 }
 
-func SyncClient(metaAddr, baseDir string, blockSize int, cfg string) error {
-	clientCmd := exec.Command("_bin/SurfstoreClientExec", "-d", "-f", cfg, baseDir, strconv.Itoa(blockSize))
+// Extra flags (e.g. the TLS ones) go before the positional arguments
+func SyncClient(metaAddr, baseDir string, blockSize int, cfg string, flags ...string) error {
+	args := append([]string{"-d", "-f", cfg}, flags...)
+	args = append(args, baseDir, strconv.Itoa(blockSize))
+	clientCmd := exec.Command("_bin/SurfstoreClientExec", args...)
 	clientCmd.Stderr = os.Stderr
 	clientCmd.Stdout = os.Stdout
 
@@ -0,0 +1,81 @@
+package SurfTest
+
+import (
+	context "context"
+	"cse224/proj5/pkg/surfstore"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/status"
+	emptypb "google.golang.org/protobuf/types/known/emptypb"
+)
+
+// Clients sync over TLS, Raft peers replicate over mutual TLS, and neither
+// plaintext callers nor callers without a certificate get to append entries.
+func TestSyncOverTLS(t *testing.T) {
+	certs, err := GenerateTestCerts(t.TempDir())
+	if err != nil {
+		t.Fatalf("Could not generate test certificates: %v", err)
+	}
+	cfgPath := "./config_files/3nodes.txt"
+	test := InitTLSTest(cfgPath, "8080", certs)
+	defer EndTest(test)
+	test.Clients[0].SetLeader(test.Context, &emptypb.Empty{})
+	test.Clients[0].SendHeartbeat(test.Context, &emptypb.Empty{})
+
+	worker1 := InitDirectoryWorker("test0", SRC_PATH)
+	worker2 := InitDirectoryWorker("test1", SRC_PATH)
+	defer worker1.CleanUp()
+	defer worker2.CleanUp()
+
+	file1 := "multi_file1.txt"
+	noError(worker1.AddFile(file1))
+	if err := SyncClient("localhost:8080", "test0", BLOCK_SIZE, cfgPath, certs.ClientFlags()...); err != nil {
+		t.Fatalf("Sync failed: %v", err)
+	}
+	if err := SyncClient("localhost:8080", "test1", BLOCK_SIZE, cfgPath, certs.ClientFlags()...); err != nil {
+		t.Fatalf("Sync failed: %v", err)
+	}
+	c, e := SameFile(worker2.DirectoryName+"/"+file1, SRC_PATH+"/"+file1)
+	if e != nil || !c {
+		t.Fatalf("The file did not sync over TLS")
+	}
+
+	test.Clients[0].SendHeartbeat(test.Context, &emptypb.Empty{})
+	leaderState, err := test.Clients[0].GetInternalState(test.Context, &emptypb.Empty{})
+	noError(err)
+	for idx := 1; idx < len(test.Clients); idx++ {
+		state, err := test.Clients[idx].GetInternalState(test.Context, &emptypb.Empty{})
+		noError(err)
+		if !SameLog(leaderState.Log, state.Log) {
+			t.Fatalf("Server %d did not replicate the log over mutual TLS", idx)
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	plainConn, err := grpc.Dial(test.Ips[1], grpc.WithTransportCredentials(insecure.NewCredentials()))
+	noError(err)
+	defer plainConn.Close()
+	_, err = surfstore.NewRaftSurfstoreClient(plainConn).GetInternalState(ctx, &emptypb.Empty{})
+	if err == nil {
+		t.Fatalf("A plaintext connection should be refused")
+	}
+
+	noCert, err := surfstore.LoadTLSConfig("", "", certs.CA, false)
+	noError(err)
+	noCertConn, err := grpc.Dial(test.Ips[1], noCert.DialOption())
+	noError(err)
+	defer noCertConn.Close()
+	noCertClient := surfstore.NewRaftSurfstoreClient(noCertConn)
+	if _, err := noCertClient.GetInternalState(ctx, &emptypb.Empty{}); err != nil {
+		t.Fatalf("A TLS client without a certificate should still be served: %v", err)
+	}
+	_, err = noCertClient.AppendEntries(ctx, &surfstore.AppendEntryInput{Term: leaderState.Term + 1, PrevLogIndex: -1})
+	if status.Code(err) != codes.Unauthenticated {
+		t.Fatalf("AppendEntries without a peer certificate should be unauthenticated, got %v", err)
+	}
+}
@@ -0,0 +1,111 @@
+package SurfTest
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// Files of a throwaway CA and the certificates it signed for a test
+type TestCerts struct {
+	CA         string
+	ServerCert string
+	ServerKey  string
+	ClientCert string
+	ClientKey  string
+}
+
+// Flags that make a server exec serve TLS and require peer certificates
+func (c TestCerts) ServerFlags() []string {
+	return []string{"-tls-cert", c.ServerCert, "-tls-key", c.ServerKey, "-tls-ca", c.CA, "-mtls"}
+}
+
+// Flags that make the client exec connect over TLS without a certificate
+func (c TestCerts) ClientFlags() []string {
+	return []string{"-tls-ca", c.CA}
+}
+
+// Generates a CA, a certificate for the servers on localhost and a client
+// certificate, all written into dir
+func GenerateTestCerts(dir string) (TestCerts, error) {
+	certs := TestCerts{
+		CA:         filepath.Join(dir, "ca.pem"),
+		ServerCert: filepath.Join(dir, "server.pem"),
+		ServerKey:  filepath.Join(dir, "server-key.pem"),
+		ClientCert: filepath.Join(dir, "client.pem"),
+		ClientKey:  filepath.Join(dir, "client-key.pem"),
+	}
+
+	caKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return certs, err
+	}
+	caTemplate := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "surfstore test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(24 * time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	caDER, err := x509.CreateCertificate(rand.Reader, caTemplate, caTemplate, &caKey.PublicKey, caKey)
+	if err != nil {
+		return certs, err
+	}
+	if err := writePEM(certs.CA, "CERTIFICATE", caDER); err != nil {
+		return certs, err
+	}
+
+	// Servers present their certificate to peers too, so it serves both ways
+	serverTemplate := &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		Subject:      pkix.Name{CommonName: "localhost"},
+		DNSNames:     []string{"localhost"},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1"), net.ParseIP("::1")},
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	if err := issueCert(serverTemplate, caTemplate, caKey, certs.ServerCert, certs.ServerKey); err != nil {
+		return certs, err
+	}
+	clientTemplate := &x509.Certificate{
+		SerialNumber: big.NewInt(3),
+		Subject:      pkix.Name{CommonName: "surfstore test client"},
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	return certs, issueCert(clientTemplate, caTemplate, caKey, certs.ClientCert, certs.ClientKey)
+}
+
+func issueCert(template, ca *x509.Certificate, caKey *ecdsa.PrivateKey, certFile, keyFile string) error {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return err
+	}
+	template.NotBefore = ca.NotBefore
+	template.NotAfter = ca.NotAfter
+	template.KeyUsage = x509.KeyUsageDigitalSignature
+	der, err := x509.CreateCertificate(rand.Reader, template, ca, &key.PublicKey, caKey)
+	if err != nil {
+		return err
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return err
+	}
+	if err := writePEM(certFile, "CERTIFICATE", der); err != nil {
+		return err
+	}
+	return writePEM(keyFile, "EC PRIVATE KEY", keyDER)
+}
+
+func writePEM(filename, blockType string, der []byte) error {
+	return os.WriteFile(filename, pem.EncodeToMemory(&pem.Block{Type: blockType, Bytes: der}), 0600)
+}
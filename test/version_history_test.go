@@ -0,0 +1,141 @@
+package SurfTest
+
+import (
+	context "context"
+	"cse224/proj5/pkg/surfstore"
+	"testing"
+	"time"
+)
+
+// A file is written twice and then restored to its first version.
+func TestMetaStoreRestoreFileVersion(t *testing.T) {
+	ctx := context.Background()
+	metaStore := surfstore.NewMetaStore("")
+
+	v1 := NewFileMetaDataFromParams("file1", 1, []string{"hash1", "hash2"})
+	v2 := NewFileMetaDataFromParams("file1", 2, []string{"hash3"})
+	_, err := metaStore.UpdateFile(ctx, v1)
+	noError(err)
+	_, err = metaStore.UpdateFile(ctx, v2)
+	noError(err)
+
+	version, err := metaStore.RestoreFileVersion(ctx, &surfstore.FileVersion{Filename: "file1", Version: 1})
+	if err != nil {
+		t.Fatalf("Could not restore version 1: %v", err)
+	}
+	if version.Version != 3 {
+		t.Fatalf("Restore should create version 3, got %d", version.Version)
+	}
+
+	history, err := metaStore.GetFileHistory(ctx, &surfstore.FileName{Filename: "file1"})
+	if err != nil {
+		t.Fatalf("Could not get history: %v", err)
+	}
+	if len(history.Versions) != 3 {
+		t.Fatalf("History should have 3 versions, got %d", len(history.Versions))
+	}
+	for i, fileMeta := range history.Versions {
+		if fileMeta.Version != int32(i+1) {
+			t.Fatalf("History out of order at %d", i)
+		}
+	}
+	if !SameHashList(history.Versions[2].BlockHashList, v1.BlockHashList) {
+		t.Fatalf("Restored version should point at the blocks of version 1")
+	}
+	if !SameHashList(metaStore.FileMetaMap["file1"].BlockHashList, v1.BlockHashList) {
+		t.Fatalf("Restored version should be the current version")
+	}
+
+	_, err = metaStore.RestoreFileVersion(ctx, &surfstore.FileVersion{Filename: "file1", Version: 7})
+	if err == nil {
+		t.Fatalf("Restoring a missing version should fail")
+	}
+}
+
+// Only files changed after the requested revision are returned.
+func TestMetaStoreGetChangesSince(t *testing.T) {
+	ctx := context.Background()
+	metaStore := surfstore.NewMetaStore("")
+
+	_, err := metaStore.UpdateFile(ctx, NewFileMetaDataFromParams("file1", 1, []string{"hash1"}))
+	noError(err)
+	_, err = metaStore.UpdateFile(ctx, NewFileMetaDataFromParams("file2", 1, []string{"hash2"}))
+	noError(err)
+	_, err = metaStore.UpdateFile(ctx, NewFileMetaDataFromParams("file2", 2, []string{"hash3"}))
+	noError(err)
+
+	delta, err := metaStore.GetChangesSince(ctx, &surfstore.Revision{Revision: 1})
+	if err != nil {
+		t.Fatalf("Could not get changes: %v", err)
+	}
+	if delta.Full || delta.Revision != 3 {
+		t.Fatalf("Expected an incremental delta up to revision 3")
+	}
+	if len(delta.Changes) != 1 || delta.Changes["file2"].Version != 2 {
+		t.Fatalf("Only the latest version of file2 should have changed")
+	}
+	if delta.Changes["file2"].Revision != 3 {
+		t.Fatalf("file2 should have been modified at revision 3")
+	}
+
+	delta, err = metaStore.GetChangesSince(ctx, &surfstore.Revision{Revision: 3})
+	noError(err)
+	if len(delta.Changes) != 0 {
+		t.Fatalf("Nothing changed after revision 3")
+	}
+}
+
+// Reads at a past revision or time see the files as they were then.
+func TestMetaStoreGetFileInfoMapAt(t *testing.T) {
+	ctx := context.Background()
+	metaStore := surfstore.NewMetaStore("")
+
+	_, err := metaStore.UpdateFile(ctx, NewFileMetaDataFromParams("file1", 1, []string{"hash1"}))
+	noError(err)
+	_, err = metaStore.UpdateFile(ctx, NewFileMetaDataFromParams("file2", 1, []string{"hash2"}))
+	noError(err)
+	_, err = metaStore.UpdateFile(ctx, NewFileMetaDataFromParams("file1", 2, []string{"hash3"}))
+	noError(err)
+
+	fim, err := metaStore.GetFileInfoMapAt(ctx, &surfstore.SnapshotRequest{Revision: 2})
+	if err != nil {
+		t.Fatalf("Could not read revision 2: %v", err)
+	}
+	if len(fim.FileInfoMap) != 2 || fim.FileInfoMap["file1"].Version != 1 || fim.FileInfoMap["file2"].Version != 1 {
+		t.Fatalf("Revision 2 should hold version 1 of both files")
+	}
+
+	fim, err = metaStore.GetFileInfoMapAt(ctx, &surfstore.SnapshotRequest{Revision: 1})
+	if err != nil {
+		t.Fatalf("Could not read revision 1: %v", err)
+	}
+	if len(fim.FileInfoMap) != 1 || fim.FileInfoMap["file1"].Version != 1 {
+		t.Fatalf("Revision 1 should only hold file1")
+	}
+
+	latest := metaStore.FileMetaMap["file1"]
+	fim, err = metaStore.GetFileInfoMapAt(ctx, &surfstore.SnapshotRequest{Timestamp: latest.Timestamp})
+	if err != nil {
+		t.Fatalf("Could not read by time: %v", err)
+	}
+	if fim.Revision != 3 || fim.FileInfoMap["file1"].Version != 2 {
+		t.Fatalf("Reading at the latest commit time should see revision 3")
+	}
+
+	_, err = metaStore.GetFileInfoMapAt(ctx, &surfstore.SnapshotRequest{Revision: 4})
+	if err == nil {
+		t.Fatalf("Reading an uncommitted revision should fail")
+	}
+
+	// Once version 1 of file1 is pruned, revisions before it was replaced are gone
+	metaStore.Retention = surfstore.RetentionPolicy{KeepVersions: 1}
+	metaStore.ApplyRetention(time.Now())
+	_, err = metaStore.GetFileInfoMapAt(ctx, &surfstore.SnapshotRequest{Revision: 2})
+	if err == nil {
+		t.Fatalf("Reading a pruned revision should fail")
+	}
+	_, err = metaStore.GetFileInfoMapAt(ctx, &surfstore.SnapshotRequest{Revision: 3})
+	if err != nil {
+		t.Fatalf("Revision 3 should still be readable: %v", err)
+	}
+}
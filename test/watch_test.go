@@ -0,0 +1,53 @@
+package SurfTest
+
+import (
+	context "context"
+	"cse224/proj5/pkg/surfstore"
+	emptypb "google.golang.org/protobuf/types/known/emptypb"
+	"testing"
+	"time"
+)
+
+// A watch keeps delivering committed changes after the leader it was connected to crashes.
+func TestRaftWatchAcrossLeaderChange(t *testing.T) {
+	//Setup
+	cfgPath := "./config_files/3nodes.txt"
+	test := InitTest(cfgPath, "8080")
+	defer EndTest(test)
+
+	test.Clients[0].SetLeader(test.Context, &emptypb.Empty{})
+	test.Clients[0].SendHeartbeat(test.Context, &emptypb.Empty{})
+
+	changes := make(chan *surfstore.FileChange, 10)
+	watchCtx, cancelWatch := context.WithCancel(test.Context)
+	defer cancelWatch()
+	client := surfstore.NewSurfstoreRPCClient(test.Ips, "", BLOCK_SIZE)
+	go client.WatchFileInfo(watchCtx, 0, func(change *surfstore.FileChange) error {
+		changes <- change
+		return nil
+	})
+
+	_, err := test.Clients[0].UpdateFile(test.Context, NewFileMetaDataFromParams("file1", 1, []string{"hash1"}))
+	noError(err)
+	expectChange(t, changes, "file1", 1)
+
+	test.Clients[0].Crash(test.Context, &emptypb.Empty{})
+	test.Clients[1].SetLeader(test.Context, &emptypb.Empty{})
+	test.Clients[1].SendHeartbeat(test.Context, &emptypb.Empty{})
+
+	_, err = test.Clients[1].UpdateFile(test.Context, NewFileMetaDataFromParams("file2", 1, []string{"hash2"}))
+	noError(err)
+	expectChange(t, changes, "file2", 2)
+}
+
+func expectChange(t *testing.T, changes chan *surfstore.FileChange, filename string, revision int64) {
+	select {
+	case change := <-changes:
+		if change.FileMetaData.Filename != filename || change.Revision != revision {
+			t.Fatalf("Expected %s at revision %d, got %s at revision %d",
+				filename, revision, change.FileMetaData.Filename, change.Revision)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("No change received for %s", filename)
+	}
+}